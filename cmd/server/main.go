@@ -1,13 +1,27 @@
+// Command server runs the payment token API server.
+//
+// Usage:
+//
+//	server [-config file]
+//	server [-config file] migrate up|down|status
+//	server [-config file] migrate to <version>
+//
+// The migrate command applies all the pending database migrations (up), reverts the last one applied (down),
+// lists the migrations applied and pending (status), or applies or reverts the migrations until the database
+// schema is at the given version (to, 0 reverts them all). The migrations are embedded in the binary.
 package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
+	_ "time/tzdata" // token policy time zones must resolve in minimal containers without zoneinfo
 
 	dbx "github.com/go-ozzo/ozzo-dbx"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
@@ -15,13 +29,21 @@ import (
 	"github.com/go-ozzo/ozzo-routing/v2/cors"
 	_ "github.com/lib/pq"
 	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/bruteforce"
 	"github.com/pauluswi/tulip/internal/config"
 	"github.com/pauluswi/tulip/internal/errors"
 	"github.com/pauluswi/tulip/internal/healthcheck"
+	"github.com/pauluswi/tulip/internal/idempotency"
 	"github.com/pauluswi/tulip/internal/paytoken"
+	"github.com/pauluswi/tulip/internal/sweeper"
+	"github.com/pauluswi/tulip/migrations"
 	"github.com/pauluswi/tulip/pkg/accesslog"
 	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/generator"
+	"github.com/pauluswi/tulip/pkg/kvstore"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/migration"
+	"github.com/pauluswi/tulip/pkg/pagination"
 )
 
 // Version indicates the current version of the application.
@@ -31,6 +53,11 @@ var flagConfig = flag.String("config", "./config/local.yml", "path to the config
 
 func main() {
 	flag.Parse()
+	args := flag.Args()
+	if len(args) > 0 && args[0] != "migrate" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		os.Exit(2)
+	}
 	// create root logger tagged with server version
 	logger := log.New().With(nil, "version", Version)
 
@@ -55,11 +82,60 @@ func main() {
 		}
 	}()
 
+	// the background workers run until the server shuts down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// run the migrate command instead of the server, or apply the pending migrations before starting it
+	migrator, err := newMigrator(db, logger)
+	if err != nil {
+		logger.Errorf("failed to load the database migrations: %s", err)
+		os.Exit(-1)
+	}
+	if len(args) > 0 {
+		if err := migrate(ctx, migrator, args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.AutoMigrate {
+		if err := migrator.Up(ctx); err != nil {
+			logger.Errorf("failed to migrate the database schema: %s", err)
+			os.Exit(-1)
+		}
+	}
+
+	// load the keys which sign and verify JWTs
+	keys, err := auth.NewKeySetFromConfig(cfg)
+	if err != nil {
+		logger.Errorf("failed to load JWT keys: %s", err)
+		os.Exit(-1)
+	}
+
 	// build HTTP server
+	dbc := dbcontext.New(db)
+	handler, err := buildHandler(ctx, logger, dbc, cfg, keys)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
 	address := fmt.Sprintf(":%v", cfg.ServerPort)
 	hs := &http.Server{
 		Addr:    address,
-		Handler: buildHandler(logger, dbcontext.New(db), cfg),
+		Handler: handler,
+	}
+	// the background workers stop as soon as routing.GracefulShutdown starts shutting the server down
+	hs.RegisterOnShutdown(cancel)
+
+	// sweep the payment tokens in-process if configured, the sweep in progress stops before the server exits
+	if cfg.Sweeper.Enabled {
+		swept := make(chan struct{})
+		go func() {
+			sweeper.NewSweeper(sweeper.NewRepository(dbc, logger), cfg.Sweeper, cfg.TokenPolicy.Location(), logger).Run(ctx)
+			close(swept)
+		}()
+		defer func() { <-swept }()
 	}
 
 	// start the HTTP server with graceful shutdown
@@ -72,7 +148,8 @@ func main() {
 }
 
 // buildHandler sets up the HTTP routing and builds an HTTP handler.
-func buildHandler(logger log.Logger, db *dbcontext.DB, cfg *config.Config) http.Handler {
+// The background workers of the features are started as well, and stop when ctx is done.
+func buildHandler(ctx context.Context, logger log.Logger, db *dbcontext.DB, cfg *config.Config, keys *auth.KeySet) (http.Handler, error) {
 	router := routing.New()
 
 	router.Use(
@@ -83,22 +160,158 @@ func buildHandler(logger log.Logger, db *dbcontext.DB, cfg *config.Config) http.
 	)
 
 	healthcheck.RegisterHandlers(router, Version)
+	auth.RegisterKeyHandlers(router, keys)
 
 	rg := router.Group("/v1")
 
-	authHandler := auth.Handler(cfg.JWTSigningKey)
+	idempotencyStore, bruteForceStore, nonceCache := newRequestStores(cfg.PayTokenStore, db, logger)
+	denylist := auth.NewDenylist(db, logger)
+	authHandler := auth.Handler(keys, denylist)
+	signatureHandler := auth.SignatureHandler(auth.NewSigningKeyRepository(db, logger), nonceCache,
+		time.Duration(cfg.SignatureMaxSkew)*time.Second, logger)
+	merchantAuthHandler, err := auth.MerchantHandler(cfg.MerchantAuth, authHandler, signatureHandler)
+	if err != nil {
+		return nil, err
+	}
 
-	paytoken.RegisterHandlers(rg.Group(""),
-		paytoken.NewService(paytoken.NewRepository(db, logger), logger),
-		authHandler, logger,
+	_, fallbackAlphabet := cfg.TokenPolicy.Fallback()
+	tokenRepo := newPayTokenRepository(cfg.PayTokenStore, db, logger)
+	if store := newCacheStore(cfg.Cache); store != nil {
+		tokenRepo = paytoken.NewCachedRepository(tokenRepo, store, cfg.Cache.TTLDuration(), logger)
+	}
+	tokenService := paytoken.NewService(tokenRepo, paytoken.NewPool(db, logger),
+		newTokenGenerator(cfg.TokenPolicy.Alphabet, cfg.TokenPolicy.CheckDigit),
+		newTokenGenerator(fallbackAlphabet, cfg.TokenPolicy.CheckDigit), cfg.TokenPolicy, logger)
+	if cfg.TokenPolicy.Pool.Enabled {
+		go paytoken.RunPoolWorker(ctx, tokenService, cfg.TokenPolicy.Pool.IntervalDuration(), logger)
+	}
+	cursors, err := newCursorSigner(cfg.CursorSigningKey, logger)
+	if err != nil {
+		return nil, err
+	}
+	paytoken.RegisterHandlers(rg.Group(""), tokenService,
+		authHandler, merchantAuthHandler,
+		idempotency.Handler(idempotencyStore, time.Duration(cfg.IdempotencyTTL)*time.Hour, logger),
+		bruteforce.Handler(bruteforce.NewGuard("token_guessing", bruteForceStore, cfg.BruteForce, logger), logger),
+		cursors, logger,
 	)
 
 	auth.RegisterHandlers(rg.Group(""),
-		auth.NewService(cfg.JWTSigningKey, cfg.JWTExpiration, logger),
+		auth.NewService(keys, cfg.AccessTokenExpiration, cfg.JWTExpiration,
+			auth.NewUserRepository(db, logger), auth.NewSessionRepository(db, logger), denylist,
+			cfg.LoginMaxAttempts, cfg.LoginLockout, logger),
+		authHandler, logger,
+	)
+
+	auth.RegisterClientHandlers(rg.Group(""),
+		auth.NewClientService(keys, cfg.AccessTokenExpiration, auth.NewClientRepository(db, logger), logger),
 		logger,
 	)
 
-	return router
+	return router, nil
+}
+
+// newTokenGenerator builds a payment token generator picking characters from the alphabet,
+// and appending the named check digit if any.
+func newTokenGenerator(alphabet, checkDigitName string) generator.Generator {
+	gen := generator.NewRandom(alphabet)
+	if checkDigit := generator.CheckDigitByName(checkDigitName); checkDigit != nil {
+		gen = generator.NewWithCheckDigit(gen, checkDigit)
+	}
+	return gen
+}
+
+// newPayTokenRepository builds the payment token repository of the configured store.
+// The users, clients, sessions, signing keys and revoked tokens are kept in the database whatever the store.
+func newPayTokenRepository(store string, db *dbcontext.DB, logger log.Logger) paytoken.Repository {
+	if store == "memory" {
+		logger.Warn("payment tokens are stored in memory, they are lost on restart and not shared across server instances")
+		return paytoken.NewMemoryRepository()
+	}
+	return paytoken.NewRepository(db, logger)
+}
+
+// newRequestStores builds the stores of the idempotency keys, the brute force counters and the request nonces.
+// They are kept in memory along with the payment tokens of the memory store, as they only need to be shared by
+// the server instances sharing the payment tokens.
+func newRequestStores(store string, db *dbcontext.DB, logger log.Logger) (idempotency.Store, bruteforce.Store, auth.NonceCache) {
+	if store == "memory" {
+		return idempotency.NewMemoryStore(), bruteforce.NewMemoryStore(), auth.NewMemoryNonceCache()
+	}
+	return idempotency.NewStore(db, logger), bruteforce.NewStore(db, logger), auth.NewNonceCache(db, logger)
+}
+
+// newCacheStore builds the store caching the payment tokens as configured by the cache policy,
+// or returns nil if the cache is disabled.
+func newCacheStore(policy config.CachePolicy) kvstore.Store {
+	switch policy.Store {
+	case "memory":
+		return kvstore.NewLRU(policy.Size)
+	case "redis":
+		return kvstore.NewRESPClient(policy.Address, policy.Password, policy.DB, policy.TimeoutDuration())
+	}
+	return nil
+}
+
+// newMigrator builds the migrator applying the database migrations embedded in the binary.
+func newMigrator(db *dbx.DB, logger log.Logger) (*migration.Migrator, error) {
+	ms, err := migration.Load(migrations.FS)
+	if err != nil {
+		return nil, err
+	}
+	return migration.New(db.DB(), ms, logger), nil
+}
+
+// migrate runs the migrate command given by args.
+func migrate(ctx context.Context, migrator *migration.Migrator, args []string) error {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch {
+	case command == "up" && len(args) == 1:
+		return migrator.Up(ctx)
+	case command == "down" && len(args) == 1:
+		return migrator.Down(ctx)
+	case command == "to" && len(args) == 2:
+		version, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+		return migrator.To(ctx, version)
+	case command == "status" && len(args) == 1:
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		dirty := ""
+		if status.Dirty {
+			dirty = " (dirty)"
+		}
+		fmt.Printf("version %v%v\n", status.Version, dirty)
+		for _, m := range status.Applied {
+			fmt.Printf("applied %v\n", m)
+		}
+		for _, m := range status.Pending {
+			fmt.Printf("pending %v\n", m)
+		}
+		return nil
+	}
+	return fmt.Errorf("usage: server [-config file] migrate up|down|status|to <version>")
+}
+
+// newCursorSigner builds the signer of the pagination cursors from the configured key,
+// or from a random key if none is configured.
+func newCursorSigner(key string, logger log.Logger) (pagination.CursorSigner, error) {
+	if key != "" {
+		return pagination.NewCursorSigner([]byte(key)), nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return pagination.CursorSigner{}, err
+	}
+	logger.Warn("cursor_signing_key is not set, the pagination cursors are only valid until the server restarts")
+	return pagination.NewCursorSigner(random), nil
 }
 
 // logDBQuery returns a logging function that can be used to log SQL queries.
@@ -3,10 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/generator"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/pagination"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,3 +45,100 @@ func Test_logDBExec(t *testing.T) {
 		assert.Equal(t, "DB execution error: test", entries.All()[0].Message)
 	}
 }
+
+func Test_newTokenGenerator(t *testing.T) {
+	policy := config.DefaultTokenPolicy()
+	token, err := newTokenGenerator(policy.Alphabet, policy.CheckDigit).Generate(policy.Length)
+	assert.Nil(t, err)
+	assert.Len(t, token, policy.Length)
+
+	policy.CheckDigit = "damm"
+	token, err = newTokenGenerator(policy.Alphabet, policy.CheckDigit).Generate(policy.Length)
+	assert.Nil(t, err)
+	assert.Len(t, token, policy.Length)
+	assert.True(t, generator.Damm.Verify(token))
+
+	token, err = newTokenGenerator("AB", "").Generate(8)
+	assert.Nil(t, err)
+	assert.Empty(t, strings.Trim(token, "AB"))
+}
+
+func Test_newCursorSigner(t *testing.T) {
+	logger, entries := log.NewForTest()
+	cursor := pagination.Cursor{ID: "a1"}
+
+	signer, err := newCursorSigner("secret", logger)
+	assert.Nil(t, err)
+	_, err = pagination.NewCursorSigner([]byte("secret")).Decode(signer.Encode(cursor))
+	assert.Nil(t, err)
+	assert.Zero(t, entries.Len())
+
+	// a random key is used and a warning is logged without configured key
+	signer, err = newCursorSigner("", logger)
+	assert.Nil(t, err)
+	_, err = signer.Decode(signer.Encode(cursor))
+	assert.Nil(t, err)
+	_, err = pagination.NewCursorSigner(nil).Decode(signer.Encode(cursor))
+	assert.Equal(t, pagination.ErrInvalidCursor, err)
+	assert.Equal(t, 1, entries.Len())
+}
+
+func Test_newCacheStore(t *testing.T) {
+	policy := config.DefaultCachePolicy()
+	assert.Nil(t, newCacheStore(policy))
+	policy.Store = "memory"
+	assert.NotNil(t, newCacheStore(policy))
+	policy.Store = "redis"
+	policy.Address = "127.0.0.1:6379"
+	assert.NotNil(t, newCacheStore(policy))
+}
+
+func Test_newPayTokenRepository(t *testing.T) {
+	logger, entries := log.NewForTest()
+	assert.NotNil(t, newPayTokenRepository("postgres", nil, logger))
+	assert.Zero(t, entries.Len())
+
+	// the memory store works without database, and a warning is logged
+	repo := newPayTokenRepository("memory", nil, logger)
+	assert.Nil(t, repo.Save(context.Background(), entity.PayToken{ID: "1", Token: "123456", TokenDate: time.Now()}))
+	_, err := repo.GetTodayPayToken(context.Background(), "123456", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, entries.Len())
+}
+
+func Test_newRequestStores(t *testing.T) {
+	logger, _ := log.NewForTest()
+	idempotencyStore, bruteForceStore, nonceCache := newRequestStores("postgres", nil, logger)
+	assert.NotNil(t, idempotencyStore)
+	assert.NotNil(t, bruteForceStore)
+	assert.NotNil(t, nonceCache)
+
+	// the memory stores work without database
+	ctx := context.Background()
+	idempotencyStore, bruteForceStore, nonceCache = newRequestStores("memory", nil, logger)
+	_, created, err := idempotencyStore.Begin(ctx, "key-1", "fp-1", time.Now().Add(time.Minute), time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, created)
+	_, err = bruteForceStore.Fail(ctx, "key-1", time.Now(), time.Minute)
+	assert.Nil(t, err)
+	added, err := nonceCache.Add(ctx, "nonce-1", time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, added)
+}
+
+func Test_newMigrator(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db, err := dbx.Open("postgres", "postgres://127.0.0.1/test")
+	assert.Nil(t, err)
+	migrator, err := newMigrator(db, logger)
+	assert.Nil(t, err)
+	assert.NotNil(t, migrator)
+}
+
+func Test_migrate(t *testing.T) {
+	// the invalid commands fail before reaching the database
+	for _, args := range [][]string{nil, {"sideways"}, {"up", "1"}, {"down", "1"}, {"status", "all"}, {"to"}, {"to", "latest"}, {"to", "-1"}} {
+		err := migrate(context.Background(), nil, args)
+		assert.NotNil(t, err, fmt.Sprint(args))
+	}
+}
@@ -0,0 +1,73 @@
+// Command sweeper marks the payment tokens past their validity as expired, and archives or deletes the payment
+// tokens older than the retention period, as configured in the sweeper section of the configuration file.
+//
+// Usage:
+//
+//	sweeper [-config file] [-once]
+//
+// The sweeper runs at every configured interval until it receives SIGINT or SIGTERM, or only once with -once,
+// e.g. when it is scheduled by cron or a Kubernetes CronJob. Run it when the server does not run the sweeper
+// in-process.
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	_ "github.com/lib/pq"
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/internal/sweeper"
+	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+var flagConfig = flag.String("config", "./config/local.yml", "path to the config file")
+var flagOnce = flag.Bool("once", false, "sweep once and exit")
+
+func main() {
+	flag.Parse()
+	logger := log.New()
+
+	cfg, err := config.Load(*flagConfig, logger)
+	if err != nil {
+		logger.Errorf("failed to load application configuration: %s", err)
+		os.Exit(-1)
+	}
+
+	db, err := dbx.MustOpen("postgres", cfg.DSN)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			logger.Error(err)
+		}
+	}()
+
+	// stop sweeping on SIGINT or SIGTERM, the batch being run is rolled back
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("received %v, stopping the sweeper", sig)
+		cancel()
+	}()
+
+	s := sweeper.NewSweeper(sweeper.NewRepository(dbcontext.New(db), logger), cfg.Sweeper, cfg.TokenPolicy.Location(), logger)
+	if !*flagOnce {
+		logger.Infof("sweeping payment tokens every %v", cfg.Sweeper.IntervalDuration())
+		s.Run(ctx)
+		return
+	}
+	if _, err := s.Sweep(ctx); err != nil {
+		logger.Errorf("failed to sweep payment tokens: %v", err)
+		os.Exit(1)
+	}
+}
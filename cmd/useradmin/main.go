@@ -0,0 +1,168 @@
+// Command useradmin manages the users who can log in to the server, the OAuth2 clients
+// which request access tokens with the client credentials grant, and the keys merchants sign
+// their requests with.
+//
+// Usage:
+//
+//	useradmin [-config file] [-role role] [-owner id] create <username> [password]
+//	useradmin [-config file] disable <username>
+//	useradmin [-config file] enable <username>
+//	useradmin [-config file] revoke <username>
+//	useradmin [-config file] [-role role] [-owner id] [-scope scopes] client-create <name>
+//	useradmin [-config file] client-disable <client_id>
+//	useradmin [-config file] client-enable <client_id>
+//	useradmin [-config file] signing-key-create <merchant_id>
+//	useradmin [-config file] signing-key-disable <key_id>
+//	useradmin [-config file] signing-key-enable <key_id>
+//
+// If the password is omitted, it is read from the first line of the standard input.
+// The role is one of admin, customer (the default) or merchant. Customers and merchants
+// require the ID of the customer or merchant they act for. The secret of a client is only
+// printed when the client is created, the secret of a signing key likewise.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	_ "github.com/lib/pq"
+	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+var flagConfig = flag.String("config", "./config/local.yml", "path to the config file")
+var flagRole = flag.String("role", string(entity.RoleCustomer), "role of the created user or client: admin, customer or merchant")
+var flagOwner = flag.String("owner", "", "ID of the customer or merchant the created user or client acts for")
+var flagScope = flag.String("scope", "", "space separated scopes the created client may request, all the scopes of its role by default")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	logger := log.New()
+
+	cfg, err := config.Load(*flagConfig, logger)
+	if err != nil {
+		logger.Errorf("failed to load application configuration: %s", err)
+		os.Exit(-1)
+	}
+
+	db, err := dbx.MustOpen("postgres", cfg.DSN)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+	defer db.Close()
+
+	keys, err := auth.NewKeySetFromConfig(cfg)
+	if err != nil {
+		logger.Errorf("failed to load JWT keys: %s", err)
+		os.Exit(-1)
+	}
+
+	dbc := dbcontext.New(db)
+	service := auth.NewService(keys, cfg.AccessTokenExpiration, cfg.JWTExpiration,
+		auth.NewUserRepository(dbc, logger), auth.NewSessionRepository(dbc, logger), auth.NewDenylist(dbc, logger),
+		cfg.LoginMaxAttempts, cfg.LoginLockout, logger)
+	clients := auth.NewClientService(keys, cfg.AccessTokenExpiration, auth.NewClientRepository(dbc, logger), logger)
+	signingKeys := auth.NewSigningKeyService(auth.NewSigningKeyRepository(dbc, logger), logger)
+
+	if err := run(context.Background(), service, clients, signingKeys, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command given by args.
+func run(ctx context.Context, service auth.Service, clients auth.ClientService, signingKeys auth.SigningKeyService, args []string) error {
+	command, username := args[0], args[1]
+	switch command {
+	case "create":
+		password := ""
+		if len(args) > 2 {
+			password = args[2]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("failed to read the password: %w", err)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+		user, err := service.CreateUser(ctx, username, password, entity.Role(*flagRole), *flagOwner)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s created with id %s\n", user.Role, user.Name, user.ID)
+	case "disable", "enable":
+		if err := service.SetUserDisabled(ctx, username, command == "disable"); err != nil {
+			return err
+		}
+		fmt.Printf("user %s %sd\n", username, command)
+	case "revoke":
+		if err := service.RevokeSessions(ctx, username); err != nil {
+			return err
+		}
+		fmt.Printf("sessions of user %s revoked\n", username)
+	case "client-create":
+		client, secret, err := clients.CreateClient(ctx, args[1], entity.Role(*flagRole), *flagOwner, strings.Fields(*flagScope))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s client %s created with scope %q\nclient_id:     %s\nclient_secret: %s\n",
+			client.Role, client.Name, client.Scope, client.ID, secret)
+	case "client-disable", "client-enable":
+		if err := clients.SetClientDisabled(ctx, args[1], command == "client-disable"); err != nil {
+			return err
+		}
+		fmt.Printf("client %s %sd\n", args[1], strings.TrimPrefix(command, "client-"))
+	case "signing-key-create":
+		key, err := signingKeys.CreateSigningKey(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("signing key created for merchant %s\nkey_id: %s\nsecret: %s\n", key.MerchantID, key.ID, key.Secret)
+	case "signing-key-disable", "signing-key-enable":
+		if err := signingKeys.SetSigningKeyDisabled(ctx, args[1], command == "signing-key-disable"); err != nil {
+			return err
+		}
+		fmt.Printf("signing key %s %sd\n", args[1], strings.TrimPrefix(command, "signing-key-"))
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: useradmin [-config file] [-role role] [-owner id] [-scope scopes] <command> <username|name|client_id|merchant_id|key_id> [password]
+
+Commands:
+  create   create a user, the password is read from the standard input if omitted
+  disable  prevent a user from logging in and revoke its sessions
+  enable   allow a disabled user to log in again
+  revoke   log a user out of all its sessions
+
+  client-create   register an OAuth2 client and print its client_id and client_secret
+  client-disable  prevent a client from requesting access tokens
+  client-enable   allow a disabled client to request access tokens again
+
+  signing-key-create   create a key for a merchant to sign its requests and print its key_id and secret
+  signing-key-disable  reject the requests signed by a key
+  signing-key-enable   accept the requests signed by a disabled key again
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
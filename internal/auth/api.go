@@ -1,14 +1,36 @@
 package auth
 
 import (
+	stderrors "errors"
+	"net/http"
+	"net/url"
+	"strings"
+
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	"github.com/pauluswi/tulip/internal/errors"
 	"github.com/pauluswi/tulip/pkg/log"
 )
 
 // RegisterHandlers registers handlers for different HTTP requests.
-func RegisterHandlers(rg *routing.RouteGroup, service Service, logger log.Logger) {
+// Logging out requires a valid JWT, which is checked by authHandler.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
 	rg.Post("/login", login(service, logger))
+	rg.Post("/refresh", refresh(service, logger))
+	rg.Post("/logout", authHandler, logout(service, logger))
+}
+
+// RegisterKeyHandlers registers the JWKS endpoint, which publishes the public keys verifying the JWTs.
+func RegisterKeyHandlers(r *routing.Router, keys *KeySet) {
+	r.Get("/.well-known/jwks.json", jwks(keys))
+}
+
+// jwks returns a handler that responds with the public keys of the key set.
+func jwks(keys *KeySet) routing.Handler {
+	return func(c *routing.Context) error {
+		// verifiers may cache the keys, a new key should be published before it becomes active
+		c.Response.Header().Set("Cache-Control", "public, max-age=300")
+		return c.Write(keys.JWKS())
+	}
 }
 
 // login returns a handler that handles user login request.
@@ -24,12 +46,104 @@ func login(service Service, logger log.Logger) routing.Handler {
 			return errors.BadRequest("")
 		}
 
-		token, err := service.Login(c.Request.Context(), req.Username, req.Password)
+		tokens, err := service.Login(c.Request.Context(), req.Username, req.Password)
 		if err != nil {
 			return err
 		}
-		return c.Write(struct {
-			Token string `json:"token"`
-		}{token})
+		return c.Write(tokens)
+	}
+}
+
+// refresh returns a handler that exchanges a refresh token for new tokens.
+func refresh(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		if err := c.Read(&req); err != nil || req.RefreshToken == "" {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return errors.BadRequest("")
+		}
+
+		tokens, err := service.Refresh(c.Request.Context(), req.RefreshToken)
+		if err != nil {
+			return err
+		}
+		return c.Write(tokens)
+	}
+}
+
+// logout returns a handler that revokes the access token of the request and the optional refresh token.
+func logout(service Service, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		if c.Request.ContentLength != 0 {
+			if err := c.Read(&req); err != nil {
+				logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+				return errors.BadRequest("")
+			}
+		}
+
+		if err := service.Logout(c.Request.Context(), req.RefreshToken); err != nil {
+			return err
+		}
+		c.Response.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// RegisterClientHandlers registers the OAuth2 token endpoint of the client credentials grant.
+func RegisterClientHandlers(rg *routing.RouteGroup, service ClientService, logger log.Logger) {
+	rg.Post("/oauth/token", clientToken(service, logger))
+}
+
+// oauthError represents an error response of the OAuth2 token endpoint (RFC 6749 section 5.2).
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// clientToken returns a handler that issues access tokens with the client credentials grant.
+// The client authenticates with HTTP Basic authentication or with the client_id and client_secret form parameters.
+func clientToken(service ClientService, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		// token responses must not be cached
+		c.Response.Header().Set("Cache-Control", "no-store")
+		c.Response.Header().Set("Pragma", "no-cache")
+
+		if err := c.Request.ParseForm(); err != nil {
+			logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+			return c.WriteWithStatus(oauthError{"invalid_request", "The request body is malformed."}, http.StatusBadRequest)
+		}
+		if grantType := c.Request.PostForm.Get("grant_type"); grantType != "client_credentials" {
+			return c.WriteWithStatus(oauthError{"unsupported_grant_type", "Only the client_credentials grant is supported."}, http.StatusBadRequest)
+		}
+
+		clientID, clientSecret, ok := c.Request.BasicAuth()
+		if ok {
+			// the credentials of the Basic scheme are form encoded (RFC 6749 section 2.3.1)
+			clientID, _ = url.QueryUnescape(clientID)
+			clientSecret, _ = url.QueryUnescape(clientSecret)
+		} else {
+			clientID, clientSecret = c.Request.PostForm.Get("client_id"), c.Request.PostForm.Get("client_secret")
+		}
+
+		token, err := service.Token(c.Request.Context(), clientID, clientSecret, strings.Fields(c.Request.PostForm.Get("scope")))
+		switch {
+		case stderrors.Is(err, ErrInvalidClient):
+			if ok {
+				c.Response.Header().Set("WWW-Authenticate", `Basic realm="API"`)
+			}
+			return c.WriteWithStatus(oauthError{"invalid_client", "Client authentication failed."}, http.StatusUnauthorized)
+		case stderrors.Is(err, ErrInvalidScope):
+			return c.WriteWithStatus(oauthError{"invalid_scope", err.Error()}, http.StatusBadRequest)
+		case err != nil:
+			return err
+		}
+		return c.Write(token)
 	}
 }
@@ -2,9 +2,11 @@ package auth
 
 import (
 	"context"
+	"encoding/base64"
 	"net/http"
 	"testing"
 
+	"github.com/pauluswi/tulip/internal/entity"
 	"github.com/pauluswi/tulip/internal/errors"
 	"github.com/pauluswi/tulip/internal/test"
 	"github.com/pauluswi/tulip/pkg/log"
@@ -12,22 +14,115 @@ import (
 
 type mockService struct{}
 
-func (m mockService) Login(ctx context.Context, username, password string) (string, error) {
+func (m mockService) Login(ctx context.Context, username, password string) (Tokens, error) {
 	if username == "test" && password == "pass" {
-		return "token-100", nil
+		return Tokens{"token-100", "refresh-100", 900}, nil
 	}
-	return "", errors.Unauthorized("")
+	return Tokens{}, errors.Unauthorized("")
+}
+
+func (m mockService) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	if refreshToken == "refresh-100" {
+		return Tokens{"token-101", "refresh-101", 900}, nil
+	}
+	return Tokens{}, errors.Unauthorized("")
+}
+
+func (m mockService) Logout(ctx context.Context, refreshToken string) error {
+	if CurrentUser(ctx) == nil {
+		return errors.Unauthorized("")
+	}
+	return nil
+}
+
+func (m mockService) CreateUser(ctx context.Context, username, password string, role entity.Role, ownerID string) (entity.User, error) {
+	return entity.User{ID: "100", Name: username, Role: role, OwnerID: ownerID}, nil
+}
+
+func (m mockService) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	return nil
+}
+
+func (m mockService) RevokeSessions(ctx context.Context, username string) error {
+	return nil
 }
 
 func TestAPI(t *testing.T) {
 	logger, _ := log.NewForTest()
 	router := test.MockRouter(logger)
-	RegisterHandlers(router.Group(""), mockService{}, logger)
+	RegisterHandlers(router.Group(""), mockService{}, MockAuthHandler, logger)
+	header := MockAuthHeader()
 
 	tests := []test.APITestCase{
-		{"success", "POST", "/login", `{"username":"test","password":"pass"}`, nil, http.StatusOK, `{"token":"token-100"}`},
+		{"success", "POST", "/login", `{"username":"test","password":"pass"}`, nil, http.StatusOK, `{"token":"token-100","refresh_token":"refresh-100","expires_in":900}`},
 		{"bad credential", "POST", "/login", `{"username":"test","password":"wrong pass"}`, nil, http.StatusUnauthorized, ""},
 		{"bad json", "POST", "/login", `"username":"test","password":"wrong pass"}`, nil, http.StatusBadRequest, ""},
+		{"refresh", "POST", "/refresh", `{"refresh_token":"refresh-100"}`, nil, http.StatusOK, `{"token":"token-101","refresh_token":"refresh-101","expires_in":900}`},
+		{"refresh unknown", "POST", "/refresh", `{"refresh_token":"refresh-999"}`, nil, http.StatusUnauthorized, ""},
+		{"refresh missing token", "POST", "/refresh", `{}`, nil, http.StatusBadRequest, ""},
+		{"logout", "POST", "/logout", `{"refresh_token":"refresh-100"}`, header, http.StatusNoContent, ""},
+		{"logout without refresh token", "POST", "/logout", "", header, http.StatusNoContent, ""},
+		{"logout auth error", "POST", "/logout", `{"refresh_token":"refresh-100"}`, nil, http.StatusUnauthorized, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestKeyAPI(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	RegisterKeyHandlers(router, NewHMACKeySet("test"))
+
+	tests := []test.APITestCase{
+		{"jwks", "GET", "/.well-known/jwks.json", "", nil, http.StatusOK, `{"keys":[]}`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+type mockClientService struct{}
+
+func (m mockClientService) Token(ctx context.Context, clientID, clientSecret string, scopes []string) (ClientToken, error) {
+	if clientID != "client-100" || clientSecret != "secret" {
+		return ClientToken{}, ErrInvalidClient
+	}
+	if len(scopes) > 0 && scopes[0] != entity.ScopeTokenValidate {
+		return ClientToken{}, ErrInvalidScope
+	}
+	return ClientToken{"token-100", "Bearer", 900, entity.ScopeTokenValidate}, nil
+}
+
+func (m mockClientService) CreateClient(ctx context.Context, name string, role entity.Role, ownerID string, scopes []string) (entity.Client, string, error) {
+	return entity.Client{ID: "client-100", Name: name, Role: role, OwnerID: ownerID}, "secret", nil
+}
+
+func (m mockClientService) SetClientDisabled(ctx context.Context, clientID string, disabled bool) error {
+	return nil
+}
+
+func TestClientAPI(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	RegisterClientHandlers(router.Group(""), mockClientService{}, logger)
+
+	form := http.Header{}
+	form.Set("Content-Type", "application/x-www-form-urlencoded")
+	basic := http.Header{}
+	basic.Set("Content-Type", "application/x-www-form-urlencoded")
+	basic.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("client-100:secret")))
+	wrongBasic := http.Header{}
+	wrongBasic.Set("Content-Type", "application/x-www-form-urlencoded")
+	wrongBasic.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("client-100:wrong")))
+
+	tests := []test.APITestCase{
+		{"basic auth", "POST", "/oauth/token", "grant_type=client_credentials", basic, http.StatusOK, `{"access_token":"token-100","token_type":"Bearer","expires_in":900,"scope":"token:validate"}`},
+		{"form credentials", "POST", "/oauth/token", "grant_type=client_credentials&client_id=client-100&client_secret=secret&scope=token%3Avalidate", form, http.StatusOK, `*"access_token":"token-100"*`},
+		{"wrong secret", "POST", "/oauth/token", "grant_type=client_credentials", wrongBasic, http.StatusUnauthorized, `{"error":"invalid_client","error_description":"Client authentication failed."}`},
+		{"unknown client", "POST", "/oauth/token", "grant_type=client_credentials&client_id=unknown&client_secret=secret", form, http.StatusUnauthorized, `*invalid_client*`},
+		{"invalid scope", "POST", "/oauth/token", "grant_type=client_credentials&scope=token%3Agenerate", basic, http.StatusBadRequest, `*invalid_scope*`},
+		{"unsupported grant", "POST", "/oauth/token", "grant_type=password&username=demo&password=pass", form, http.StatusBadRequest, `*unsupported_grant_type*`},
 	}
 	for _, tc := range tests {
 		test.Endpoint(t, router, tc)
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// ClientService encapsulates the OAuth2 client credentials grant, which authenticates systems rather than users.
+type ClientService interface {
+	// Token issues an access token to the client authenticated by its ID and secret.
+	// The token grants the requested scopes, or all the scopes of the client if none is requested.
+	Token(ctx context.Context, clientID, clientSecret string, scopes []string) (ClientToken, error)
+	// CreateClient registers a client which may request the given scopes, all the scopes of its role by default.
+	// It returns the client together with its secret, which is not stored and can not be retrieved later on.
+	CreateClient(ctx context.Context, name string, role entity.Role, ownerID string, scopes []string) (entity.Client, string, error)
+	// SetClientDisabled disables or enables the client with the given ID.
+	// A disabled client can not request access tokens anymore.
+	SetClientDisabled(ctx context.Context, clientID string, disabled bool) error
+}
+
+// ClientToken represents the access token issued to a client (RFC 6749 section 5.1).
+// No refresh token is issued, the client requests a new access token with its credentials instead.
+type ClientToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// --- list of client errors
+var (
+	ErrInvalidClient     = stderrors.New("invalid client")
+	ErrInvalidScope      = stderrors.New("invalid scope")
+	ErrInvalidClientName = stderrors.New("client name must have 3 to 64 characters")
+)
+
+type clientService struct {
+	keys             *KeySet
+	accessExpiration time.Duration
+	clients          ClientRepository
+	logger           log.Logger
+}
+
+// NewClientService creates a new OAuth2 client service, whose access tokens expire after accessMinutes.
+func NewClientService(keys *KeySet, accessMinutes int, clients ClientRepository, logger log.Logger) ClientService {
+	return clientService{keys, time.Duration(accessMinutes) * time.Minute, clients, logger}
+}
+
+// Token issues an access token to the client authenticated by its ID and secret.
+func (s clientService) Token(ctx context.Context, clientID, clientSecret string, scopes []string) (ClientToken, error) {
+	logger := s.logger.With(ctx, "client", clientID)
+
+	client, err := s.clients.Get(ctx, clientID)
+	if err != nil {
+		if !stderrors.Is(err, sql.ErrNoRows) {
+			return ClientToken{}, err
+		}
+		logger.Infof("client authentication failed: unknown client")
+		return ClientToken{}, ErrInvalidClient
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(clientSecret)), []byte(client.SecretHash)) != 1 {
+		logger.Infof("client authentication failed: wrong secret")
+		return ClientToken{}, ErrInvalidClient
+	}
+	if client.Disabled {
+		logger.Infof("client authentication failed: client is disabled")
+		return ClientToken{}, ErrInvalidClient
+	}
+
+	allowed := client.GetScopes()
+	if len(scopes) == 0 {
+		scopes = allowed
+	}
+	for _, scope := range scopes {
+		if !entity.HasScope(allowed, scope) {
+			return ClientToken{}, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+	}
+	// the access token only grants the requested scopes
+	client.Scope = strings.Join(scopes, " ")
+
+	expiresAt := time.Now().UTC().Add(s.accessExpiration)
+	token, err := signAccessToken(s.keys, client, entity.GenerateID(), expiresAt)
+	if err != nil {
+		return ClientToken{}, err
+	}
+	logger.Infof("access token issued for scope %q", client.Scope)
+	return ClientToken{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(s.accessExpiration.Seconds()),
+		Scope:       client.Scope,
+	}, nil
+}
+
+// CreateClient registers a client which may request the given scopes.
+func (s clientService) CreateClient(ctx context.Context, name string, role entity.Role, ownerID string, scopes []string) (entity.Client, string, error) {
+	if len(name) < 3 || len(name) > 64 {
+		return entity.Client{}, "", ErrInvalidClientName
+	}
+	if !role.IsValid() {
+		return entity.Client{}, "", ErrInvalidRole
+	}
+	if role != entity.RoleAdmin && ownerID == "" {
+		return entity.Client{}, "", ErrMissingOwnerID
+	}
+	if len(scopes) == 0 {
+		scopes = entity.RoleScopes(role)
+	}
+	for _, scope := range scopes {
+		if !entity.HasScope(entity.RoleScopes(role), scope) {
+			return entity.Client{}, "", fmt.Errorf("%w: %s can not be granted to a %s", ErrInvalidScope, scope, role)
+		}
+	}
+
+	secret, err := randomSecret()
+	if err != nil {
+		return entity.Client{}, "", err
+	}
+	now := time.Now().UTC()
+	client := entity.Client{
+		ID:         entity.GenerateID(),
+		Name:       name,
+		SecretHash: hashSecret(secret),
+		Role:       role,
+		OwnerID:    ownerID,
+		Scope:      strings.Join(scopes, " "),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := s.clients.Create(ctx, client); err != nil {
+		return entity.Client{}, "", err
+	}
+	s.logger.With(ctx, "client", client.ID).Infof("client %s created", name)
+	return client, secret, nil
+}
+
+// SetClientDisabled disables or enables the client with the given ID.
+func (s clientService) SetClientDisabled(ctx context.Context, clientID string, disabled bool) error {
+	client, err := s.clients.Get(ctx, clientID)
+	if err != nil {
+		return fmt.Errorf("client %s: %w", clientID, err)
+	}
+	client.Disabled = disabled
+	client.UpdatedAt = time.Now().UTC()
+	if err := s.clients.Update(ctx, client); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "client", clientID).Infof("client disabled: %v", disabled)
+	return nil
+}
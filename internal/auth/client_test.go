@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_clientService_Token(t *testing.T) {
+	logger, _ := log.NewForTest()
+	keys := NewHMACKeySet("test")
+	s := NewClientService(keys, 15, newMockClientRepository(), logger)
+	ctx := context.Background()
+
+	client, secret, err := s.CreateClient(ctx, "pos backend", entity.RoleMerchant, "M001", nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "token:validate token:redeem", client.Scope)
+	assert.NotEqual(t, secret, client.SecretHash)
+
+	// all the scopes of the client are granted by default
+	token, err := s.Token(ctx, client.ID, secret, nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Bearer", token.TokenType)
+		assert.Equal(t, 15*60, token.ExpiresIn)
+		assert.Equal(t, "token:validate token:redeem", token.Scope)
+	}
+
+	// the access token only grants the requested scopes
+	token, err = s.Token(ctx, client.ID, secret, []string{entity.ScopeTokenValidate})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "token:validate", token.Scope)
+		parsed, err := keys.Parse(token.AccessToken)
+		if assert.Nil(t, err) {
+			identity := newTokenIdentity(parsed.Claims.(jwt.MapClaims))
+			assert.Equal(t, client.ID, identity.GetID())
+			assert.Equal(t, entity.RoleMerchant, identity.GetRole())
+			assert.Equal(t, "M001", identity.GetOwnerID())
+			assert.Equal(t, []string{entity.ScopeTokenValidate}, identity.GetScopes())
+		}
+	}
+
+	_, err = s.Token(ctx, client.ID, secret, []string{entity.ScopeTokenGenerate})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+	_, err = s.Token(ctx, client.ID, "wrong secret", nil)
+	assert.Equal(t, ErrInvalidClient, err)
+	_, err = s.Token(ctx, "unknown", secret, nil)
+	assert.Equal(t, ErrInvalidClient, err)
+
+	assert.Nil(t, s.SetClientDisabled(ctx, client.ID, true))
+	_, err = s.Token(ctx, client.ID, secret, nil)
+	assert.Equal(t, ErrInvalidClient, err)
+	assert.Nil(t, s.SetClientDisabled(ctx, client.ID, false))
+	_, err = s.Token(ctx, client.ID, secret, nil)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, s.SetClientDisabled(ctx, "unknown", true), sql.ErrNoRows)
+}
+
+func Test_clientService_CreateClient(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewClientService(NewHMACKeySet("test"), 15, newMockClientRepository(), logger)
+	ctx := context.Background()
+
+	_, _, err := s.CreateClient(ctx, "ab", entity.RoleMerchant, "M001", nil)
+	assert.Equal(t, ErrInvalidClientName, err)
+	_, _, err = s.CreateClient(ctx, "pos backend", "root", "M001", nil)
+	assert.Equal(t, ErrInvalidRole, err)
+	_, _, err = s.CreateClient(ctx, "pos backend", entity.RoleMerchant, "", nil)
+	assert.Equal(t, ErrMissingOwnerID, err)
+	// a merchant can not be granted the scopes of a customer
+	_, _, err = s.CreateClient(ctx, "pos backend", entity.RoleMerchant, "M001", []string{entity.ScopeTokenGenerate})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+
+	client, _, err := s.CreateClient(ctx, "pos backend", entity.RoleMerchant, "M001", []string{entity.ScopeTokenValidate})
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{entity.ScopeTokenValidate}, client.GetScopes())
+	}
+}
+
+type mockClientRepository struct {
+	clients map[string]entity.Client
+}
+
+func newMockClientRepository() *mockClientRepository {
+	return &mockClientRepository{clients: map[string]entity.Client{}}
+}
+
+func (m *mockClientRepository) Get(ctx context.Context, id string) (entity.Client, error) {
+	if client, ok := m.clients[id]; ok {
+		return client, nil
+	}
+	return entity.Client{}, sql.ErrNoRows
+}
+
+func (m *mockClientRepository) Create(ctx context.Context, client entity.Client) error {
+	m.clients[client.ID] = client
+	return nil
+}
+
+func (m *mockClientRepository) Update(ctx context.Context, client entity.Client) error {
+	m.clients[client.ID] = client
+	return nil
+}
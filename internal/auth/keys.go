@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	stderrors "errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pauluswi/tulip/internal/config"
+)
+
+// --- list of key errors
+var (
+	ErrUnknownKey    = stderrors.New("unknown signing key")
+	ErrNoSigningKey  = stderrors.New("no active signing key")
+	ErrKeyAlgorithm  = stderrors.New("key does not match the signing algorithm")
+	ErrWeakRSAKey    = stderrors.New("RSA keys must have at least 2048 bits")
+	ErrUnsupportedEC = stderrors.New("ES256 keys must use the P-256 curve")
+)
+
+// key represents a key used to sign or verify JWTs.
+type key struct {
+	id     string
+	method jwt.SigningMethod
+	// signingKey is nil if the key only verifies JWTs.
+	signingKey      interface{}
+	verificationKey interface{}
+}
+
+// KeySet holds the keys used to sign and verify JWTs. New JWTs are signed by the active key and carry its ID
+// in their "kid" header, so that the JWTs signed by a previous key are still verified after a rotation.
+type KeySet struct {
+	active *key
+	keys   map[string]*key
+	parser *jwt.Parser
+}
+
+// NewHMACKeySet creates a key set which signs and verifies JWTs with HS256 using a shared secret.
+// JWTs signed with a shared secret carry no "kid" header and are not published in the JWKS.
+func NewHMACKeySet(secret string) *KeySet {
+	k := &key{"", jwt.SigningMethodHS256, []byte(secret), []byte(secret)}
+	return &KeySet{
+		active: k,
+		keys:   map[string]*key{"": k},
+		parser: &jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Alg()}},
+	}
+}
+
+// NewKeySet creates a key set from the configured RS256 and ES256 keys, the key identified by activeID signs new JWTs.
+// PEM encoded keys are read from the configuration or from the files it refers to.
+func NewKeySet(keys []config.JWTKey, activeID string) (*KeySet, error) {
+	ks := &KeySet{keys: map[string]*key{}, parser: &jwt.Parser{}}
+	for _, cfg := range keys {
+		k, err := loadKey(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: %w", cfg.ID, err)
+		}
+		if _, ok := ks.keys[k.id]; ok {
+			return nil, fmt.Errorf("jwt key %s: duplicate key ID", cfg.ID)
+		}
+		ks.keys[k.id] = k
+		ks.parser.ValidMethods = appendUnique(ks.parser.ValidMethods, k.method.Alg())
+	}
+	ks.active = ks.keys[activeID]
+	if ks.active == nil || ks.active.signingKey == nil {
+		return nil, fmt.Errorf("jwt key %s: %w", activeID, ErrNoSigningKey)
+	}
+	return ks, nil
+}
+
+// NewKeySetFromConfig creates the key set described by the application configuration: the configured RS256 and
+// ES256 keys if any, or the HS256 signing key otherwise.
+func NewKeySetFromConfig(cfg *config.Config) (*KeySet, error) {
+	if len(cfg.JWTKeys) == 0 {
+		return NewHMACKeySet(cfg.JWTSigningKey), nil
+	}
+	return NewKeySet(cfg.JWTKeys, cfg.JWTActiveKeyID)
+}
+
+// appendUnique appends s to list unless it is already part of it.
+func appendUnique(list []string, s string) []string {
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// loadKey parses a configured key.
+func loadKey(cfg config.JWTKey) (*key, error) {
+	var method jwt.SigningMethod
+	switch cfg.Algorithm {
+	case "RS256":
+		method = jwt.SigningMethodRS256
+	case "ES256":
+		method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", cfg.Algorithm)
+	}
+
+	private, err := readPEM(cfg.PrivateKey, cfg.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	public, err := readPEM(cfg.PublicKey, cfg.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &key{id: cfg.ID, method: method}
+	switch {
+	case private != nil && method == jwt.SigningMethodRS256:
+		rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(private)
+		if err != nil {
+			return nil, err
+		}
+		k.signingKey, k.verificationKey = rsaKey, &rsaKey.PublicKey
+	case private != nil:
+		ecKey, err := jwt.ParseECPrivateKeyFromPEM(private)
+		if err != nil {
+			return nil, err
+		}
+		k.signingKey, k.verificationKey = ecKey, &ecKey.PublicKey
+	case public != nil && method == jwt.SigningMethodRS256:
+		if k.verificationKey, err = jwt.ParseRSAPublicKeyFromPEM(public); err != nil {
+			return nil, err
+		}
+	case public != nil:
+		if k.verificationKey, err = jwt.ParseECPublicKeyFromPEM(public); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, stderrors.New("no private or public key")
+	}
+	return k, checkKey(k.verificationKey)
+}
+
+// checkKey rejects keys which are too weak for the algorithms they are used with.
+func checkKey(public crypto.PublicKey) error {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return ErrWeakRSAKey
+		}
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return ErrUnsupportedEC
+		}
+	}
+	return nil
+}
+
+// readPEM returns the inline PEM data, or the content of the file if no inline data is given.
+// Nil is returned if neither is given.
+func readPEM(inline, file string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+	return nil, nil
+}
+
+// Sign signs the claims with the active key.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	if ks.active.id != "" {
+		token.Header["kid"] = ks.active.id
+	}
+	return token.SignedString(ks.active.signingKey)
+}
+
+// Parse parses a JWT and verifies its signature with the key identified by its "kid" header.
+func (ks *KeySet) Parse(token string) (*jwt.Token, error) {
+	return ks.parser.Parse(token, ks.verificationKey)
+}
+
+// verificationKey returns the key which verifies the given token.
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	// a token must not pick another algorithm than the one of its key, e.g. HS256 with an RSA public key as secret
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, ErrKeyAlgorithm
+	}
+	return k.verificationKey, nil
+}
+
+// JWK represents a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA public key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC public key
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKS represents a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the key set, which is empty for a shared secret.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, k := range ks.keys {
+		jwk := JWK{KeyID: k.id, Use: "sig", Algorithm: k.method.Alg()}
+		switch public := k.verificationKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encodeBase64URL(public.N.Bytes())
+			jwk.E = encodeBase64URL(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.KeyType = "EC"
+			jwk.Curve = public.Curve.Params().Name
+			jwk.X = encodeBase64URL(padLeft(public.X.Bytes(), 32))
+			jwk.Y = encodeBase64URL(padLeft(public.Y.Bytes(), 32))
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID })
+	return jwks
+}
+
+func encodeBase64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// padLeft pads b with leading zeros up to the given size, as required for EC coordinates.
+func padLeft(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySet(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}))
+	rsaPublicDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	rsaPublicPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPublicDER}))
+
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"id": "100", "exp": time.Now().Add(time.Minute).Unix()}
+	}
+
+	// sign with the RSA key
+	before, err := NewKeySet([]config.JWTKey{{ID: "rsa", Algorithm: "RS256", PrivateKey: rsaPEM}}, "rsa")
+	if !assert.Nil(t, err) {
+		return
+	}
+	oldToken, err := before.Sign(claims())
+	assert.Nil(t, err)
+	parsed, err := before.Parse(oldToken)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "rsa", parsed.Header["kid"])
+		assert.Equal(t, "RS256", parsed.Method.Alg())
+	}
+
+	// rotate to the EC key, the RSA key only verifies the JWTs it signed before
+	after, err := NewKeySet([]config.JWTKey{
+		{ID: "ec", Algorithm: "ES256", PrivateKey: ecPEM},
+		{ID: "rsa", Algorithm: "RS256", PublicKey: rsaPublicPEM},
+	}, "ec")
+	if !assert.Nil(t, err) {
+		return
+	}
+	newToken, err := after.Sign(claims())
+	assert.Nil(t, err)
+	parsed, err = after.Parse(newToken)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "ec", parsed.Header["kid"])
+	}
+	_, err = after.Parse(oldToken)
+	assert.Nil(t, err)
+	_, err = before.Parse(newToken)
+	assert.NotNil(t, err)
+
+	// a public key can not sign
+	_, err = NewKeySet([]config.JWTKey{{ID: "rsa", Algorithm: "RS256", PublicKey: rsaPublicPEM}}, "rsa")
+	assert.ErrorIs(t, err, ErrNoSigningKey)
+
+	// a JWT signed with HS256 using the public key as secret is rejected
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	forged.Header["kid"] = "rsa"
+	forgedToken, _ := forged.SignedString([]byte(rsaPublicPEM))
+	_, err = after.Parse(forgedToken)
+	assert.NotNil(t, err)
+
+	// a JWT signed with an unknown kid is rejected
+	unknown := jwt.NewWithClaims(jwt.SigningMethodES256, claims())
+	unknown.Header["kid"] = "unknown"
+	unknownToken, _ := unknown.SignedString(ecKey)
+	_, err = after.Parse(unknownToken)
+	assert.NotNil(t, err)
+
+	// the JWKS publishes the public keys
+	jwks := after.JWKS()
+	if assert.Len(t, jwks.Keys, 2) {
+		assert.Equal(t, JWK{KeyType: "EC", KeyID: "ec", Use: "sig", Algorithm: "ES256", Curve: "P-256",
+			X: encodeBase64URL(padLeft(ecKey.X.Bytes(), 32)), Y: encodeBase64URL(padLeft(ecKey.Y.Bytes(), 32))}, jwks.Keys[0])
+		assert.Equal(t, "RSA", jwks.Keys[1].KeyType)
+		n, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[1].N)
+		assert.Equal(t, 0, new(big.Int).SetBytes(n).Cmp(rsaKey.N))
+		assert.Equal(t, "AQAB", jwks.Keys[1].E)
+	}
+}
+
+func TestKeySet_Files(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(ecKey)
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ec.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewKeySet([]config.JWTKey{{ID: "ec", Algorithm: "ES256", PrivateKeyFile: file}}, "ec")
+	assert.Nil(t, err)
+	_, err = NewKeySet([]config.JWTKey{{ID: "ec", Algorithm: "ES256", PrivateKeyFile: filepath.Join(dir, "unknown.pem")}}, "ec")
+	assert.NotNil(t, err)
+	_, err = NewKeySet([]config.JWTKey{
+		{ID: "ec", Algorithm: "ES256", PrivateKeyFile: file},
+		{ID: "ec", Algorithm: "ES256", PrivateKeyFile: file},
+	}, "ec")
+	assert.NotNil(t, err)
+}
+
+func TestKeySet_WeakKeys(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	_, err := NewKeySet([]config.JWTKey{{ID: "rsa", Algorithm: "RS256", PrivateKey: rsaPEM}}, "rsa")
+	assert.ErrorIs(t, err, ErrWeakRSAKey)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(ecKey)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	_, err = NewKeySet([]config.JWTKey{{ID: "ec", Algorithm: "ES256", PrivateKey: ecPEM}}, "ec")
+	assert.ErrorIs(t, err, ErrUnsupportedEC)
+}
+
+func TestKeySet_HMAC(t *testing.T) {
+	keys := NewHMACKeySet("test")
+	token, err := keys.Sign(jwt.MapClaims{"id": "100"})
+	assert.Nil(t, err)
+	parsed, err := keys.Parse(token)
+	if assert.Nil(t, err) {
+		assert.Nil(t, parsed.Header["kid"])
+	}
+	assert.Empty(t, keys.JWKS().Keys)
+
+	keys, err = NewKeySetFromConfig(&config.Config{JWTSigningKey: "test"})
+	assert.Nil(t, err)
+	_, err = keys.Parse(token)
+	assert.Nil(t, err)
+}
@@ -3,59 +3,176 @@ package auth
 import (
 	"context"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
-	"github.com/go-ozzo/ozzo-routing/v2/auth"
 	"github.com/pauluswi/tulip/internal/entity"
 	"github.com/pauluswi/tulip/internal/errors"
 )
 
-// Handler returns a JWT-based authentication middleware.
-func Handler(verificationKey string) routing.Handler {
-	return auth.JWT(verificationKey, auth.JWTOptions{TokenHandler: handleToken})
+// Handler returns a JWT-based authentication middleware. The JWT sent as a Bearer token must be signed by
+// one of the keys of the key set. Access tokens listed in the denylist are rejected.
+func Handler(keys *KeySet, denylist Denylist) routing.Handler {
+	handleToken := tokenHandler(denylist)
+	return func(c *routing.Context) error {
+		header := c.Request.Header.Get("Authorization")
+		if strings.HasPrefix(header, "Bearer ") {
+			token, err := keys.Parse(header[7:])
+			if err == nil && token.Valid {
+				err = handleToken(c, token)
+			}
+			if err == nil {
+				return nil
+			}
+		}
+		c.Response.Header().Set("WWW-Authenticate", `Bearer realm="API"`)
+		return errors.Unauthorized("")
+	}
 }
 
-// handleToken stores the user identity in the request context so that it can be accessed elsewhere.
-func handleToken(c *routing.Context, token *jwt.Token) error {
-	ctx := WithUser(
-		c.Request.Context(),
-		token.Claims.(jwt.MapClaims)["id"].(string),
-		token.Claims.(jwt.MapClaims)["name"].(string),
-	)
-	c.Request = c.Request.WithContext(ctx)
-	return nil
+// tokenHandler returns a handler which rejects revoked tokens and stores the user identity in the request context
+// so that it can be accessed elsewhere. Tokens without a role or scope claim carry no permission.
+func tokenHandler(denylist Denylist) func(c *routing.Context, token *jwt.Token) error {
+	return func(c *routing.Context, token *jwt.Token) error {
+		claims := token.Claims.(jwt.MapClaims)
+		// tokens without a jti can not be revoked, so they are not accepted
+		jti, _ := claims["jti"].(string)
+		if jti == "" {
+			return errors.Unauthorized("")
+		}
+		revoked, err := denylist.IsRevoked(c.Request.Context(), jti)
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return errors.Unauthorized("")
+		}
+
+		ctx := WithIdentity(c.Request.Context(), newTokenIdentity(claims))
+		var expiresAt time.Time
+		if exp, ok := claims["exp"].(float64); ok {
+			expiresAt = time.Unix(int64(exp), 0).UTC()
+		}
+		ctx = context.WithValue(ctx, accessTokenKey, accessToken{jti, expiresAt})
+		c.Request = c.Request.WithContext(ctx)
+		return nil
+	}
 }
 
 type contextKey int
 
 const (
 	userKey contextKey = iota
+	accessTokenKey
 )
 
+// accessToken identifies the access token of the current request.
+type accessToken struct {
+	ID        string
+	ExpiresAt time.Time
+}
+
 // WithUser returns a context that contains the user identity from the given JWT.
-func WithUser(ctx context.Context, id, name string) context.Context {
-	return context.WithValue(ctx, userKey, entity.User{ID: id, Name: name})
+// The user is granted all the scopes of its role.
+func WithUser(ctx context.Context, id, name string, role entity.Role, ownerID string) context.Context {
+	return WithIdentity(ctx, entity.User{ID: id, Name: name, Role: role, OwnerID: ownerID})
+}
+
+// WithIdentity returns a context that contains the given identity.
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, userKey, identity)
 }
 
 // CurrentUser returns the user identity from the given context.
 // Nil is returned if no user identity is found in the context.
 func CurrentUser(ctx context.Context) Identity {
-	if user, ok := ctx.Value(userKey).(entity.User); ok {
-		return user
+	if identity, ok := ctx.Value(userKey).(Identity); ok {
+		return identity
 	}
 	return nil
 }
 
+// RequireScope returns a middleware which only lets through the requests whose access token grants the scope.
+func RequireScope(scope string) routing.Handler {
+	return func(c *routing.Context) error {
+		identity := CurrentUser(c.Request.Context())
+		if identity == nil || !entity.HasScope(identity.GetScopes(), scope) {
+			return errors.Forbidden("The access token does not grant the " + scope + " scope.")
+		}
+		return nil
+	}
+}
+
+// tokenIdentity represents the user or client identity carried by the claims of an access token.
+type tokenIdentity struct {
+	id, name string
+	role     entity.Role
+	ownerID  string
+	scopes   []string
+}
+
+// newTokenIdentity returns the identity carried by the claims of an access token.
+func newTokenIdentity(claims jwt.MapClaims) tokenIdentity {
+	id, _ := claims["id"].(string)
+	name, _ := claims["name"].(string)
+	role, _ := claims["role"].(string)
+	ownerID, _ := claims["owner_id"].(string)
+	scope, _ := claims["scope"].(string)
+	return tokenIdentity{id, name, entity.Role(role), ownerID, strings.Fields(scope)}
+}
+
+// GetID returns the user or client ID.
+func (i tokenIdentity) GetID() string {
+	return i.id
+}
+
+// GetName returns the user or client name.
+func (i tokenIdentity) GetName() string {
+	return i.name
+}
+
+// GetRole returns the user or client role.
+func (i tokenIdentity) GetRole() entity.Role {
+	return i.role
+}
+
+// GetOwnerID returns the ID of the customer or merchant the user or client acts for.
+func (i tokenIdentity) GetOwnerID() string {
+	return i.ownerID
+}
+
+// GetScopes returns the scopes granted by the access token.
+func (i tokenIdentity) GetScopes() []string {
+	return i.scopes
+}
+
+// currentAccessToken returns the access token of the current request.
+// An empty access token is returned if the request was not authenticated with a JWT.
+func currentAccessToken(ctx context.Context) accessToken {
+	token, _ := ctx.Value(accessTokenKey).(accessToken)
+	return token
+}
+
 // MockAuthHandler creates a mock authentication middleware for testing purpose.
 // If the request contains an Authorization header whose value is "TEST", then
-// it considers the user is authenticated as "Tester" whose ID is "100".
+// it considers the user is authenticated as the admin "Tester" whose ID is "100".
+// A header built by MockAuthHeaderAs authenticates "Tester" with the given role and owner ID instead.
 // It fails the authentication otherwise.
 func MockAuthHandler(c *routing.Context) error {
-	if c.Request.Header.Get("Authorization") != "TEST" {
+	fields := strings.Fields(c.Request.Header.Get("Authorization"))
+	if len(fields) == 0 || fields[0] != "TEST" {
 		return errors.Unauthorized("")
 	}
-	ctx := WithUser(c.Request.Context(), "100", "Tester")
+	role, ownerID := entity.RoleAdmin, ""
+	if len(fields) > 1 {
+		role = entity.Role(fields[1])
+	}
+	if len(fields) > 2 {
+		ownerID = fields[2]
+	}
+	ctx := WithUser(c.Request.Context(), "100", "Tester", role, ownerID)
 	c.Request = c.Request.WithContext(ctx)
 	return nil
 }
@@ -66,3 +183,11 @@ func MockAuthHeader() http.Header {
 	header.Add("Authorization", "TEST")
 	return header
 }
+
+// MockAuthHeaderAs returns an HTTP header that can pass the authentication check by MockAuthHandler
+// as a user with the given role, acting for the given customer or merchant.
+func MockAuthHeaderAs(role entity.Role, ownerID string) http.Header {
+	header := http.Header{}
+	header.Add("Authorization", "TEST "+string(role)+" "+ownerID)
+	return header
+}
@@ -4,8 +4,12 @@ import (
 	"context"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/internal/errors"
 	"github.com/pauluswi/tulip/internal/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -13,27 +17,65 @@ import (
 func TestCurrentUser(t *testing.T) {
 	ctx := context.Background()
 	assert.Nil(t, CurrentUser(ctx))
-	ctx = WithUser(ctx, "100", "test")
+	ctx = WithUser(ctx, "100", "test", entity.RoleCustomer, "0811")
 	identity := CurrentUser(ctx)
 	if assert.NotNil(t, identity) {
 		assert.Equal(t, "100", identity.GetID())
 		assert.Equal(t, "test", identity.GetName())
+		assert.Equal(t, entity.RoleCustomer, identity.GetRole())
+		assert.Equal(t, "0811", identity.GetOwnerID())
 	}
 }
 
 func TestHandler(t *testing.T) {
-	assert.NotNil(t, Handler("test"))
+	keys := NewHMACKeySet("test")
+	denylist := newMockDenylist()
+	handler := Handler(keys, denylist)
+
+	sign := func(keys *KeySet, jti string) string {
+		token, _ := keys.Sign(jwt.MapClaims{"jti": jti, "id": "100", "name": "test", "exp": time.Now().Add(time.Minute).Unix()})
+		return token
+	}
+	call := func(header string) (*routing.Context, error) {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		ctx, _ := test.MockRoutingContext(req)
+		return ctx, handler(ctx)
+	}
+
+	ctx, err := call("Bearer " + sign(keys, "jti-100"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "100", CurrentUser(ctx.Request.Context()).GetID())
+	}
+
+	ctx, err = call("")
+	assert.Equal(t, errors.Unauthorized(""), err)
+	assert.NotEmpty(t, ctx.Response.Header().Get("WWW-Authenticate"))
+
+	_, err = call("Bearer " + sign(NewHMACKeySet("other"), "jti-100"))
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	_ = denylist.Revoke(context.Background(), "jti-100", time.Now().Add(time.Minute))
+	_, err = call("Bearer " + sign(keys, "jti-100"))
+	assert.Equal(t, errors.Unauthorized(""), err)
 }
 
 func Test_handleToken(t *testing.T) {
 	req, _ := http.NewRequest("GET", "http://example.com", nil)
 	ctx, _ := test.MockRoutingContext(req)
 	assert.Nil(t, CurrentUser(ctx.Request.Context()))
+	denylist := newMockDenylist()
+	handleToken := tokenHandler(denylist)
 
 	err := handleToken(ctx, &jwt.Token{
 		Claims: jwt.MapClaims{
-			"id":   "100",
-			"name": "test",
+			"jti":      "jti-100",
+			"id":       "100",
+			"name":     "test",
+			"role":     "merchant",
+			"owner_id": "M01",
 		},
 	})
 	assert.Nil(t, err)
@@ -41,7 +83,41 @@ func Test_handleToken(t *testing.T) {
 	if assert.NotNil(t, identity) {
 		assert.Equal(t, "100", identity.GetID())
 		assert.Equal(t, "test", identity.GetName())
+		assert.Equal(t, entity.RoleMerchant, identity.GetRole())
+		assert.Equal(t, "M01", identity.GetOwnerID())
 	}
+	assert.Equal(t, "jti-100", currentAccessToken(ctx.Request.Context()).ID)
+
+	// tokens without a role claim carry no permission
+	err = handleToken(ctx, &jwt.Token{
+		Claims: jwt.MapClaims{
+			"jti":  "jti-101",
+			"id":   "100",
+			"name": "test",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.Role(""), CurrentUser(ctx.Request.Context()).GetRole())
+
+	// tokens without a jti can not be revoked and are rejected
+	err = handleToken(ctx, &jwt.Token{
+		Claims: jwt.MapClaims{
+			"id":   "100",
+			"name": "test",
+		},
+	})
+	assert.NotNil(t, err)
+
+	// revoked tokens are rejected
+	_ = denylist.Revoke(context.Background(), "jti-100", time.Now().Add(time.Minute))
+	err = handleToken(ctx, &jwt.Token{
+		Claims: jwt.MapClaims{
+			"jti":  "jti-100",
+			"id":   "100",
+			"name": "test",
+		},
+	})
+	assert.NotNil(t, err)
 }
 
 func TestMocks(t *testing.T) {
@@ -51,5 +127,31 @@ func TestMocks(t *testing.T) {
 	req.Header = MockAuthHeader()
 	ctx, _ = test.MockRoutingContext(req)
 	assert.Nil(t, MockAuthHandler(ctx))
-	assert.NotNil(t, CurrentUser(ctx.Request.Context()))
+	if identity := CurrentUser(ctx.Request.Context()); assert.NotNil(t, identity) {
+		assert.Equal(t, entity.RoleAdmin, identity.GetRole())
+	}
+	req.Header = MockAuthHeaderAs(entity.RoleCustomer, "0811")
+	ctx, _ = test.MockRoutingContext(req)
+	assert.Nil(t, MockAuthHandler(ctx))
+	if identity := CurrentUser(ctx.Request.Context()); assert.NotNil(t, identity) {
+		assert.Equal(t, entity.RoleCustomer, identity.GetRole())
+		assert.Equal(t, "0811", identity.GetOwnerID())
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	handler := RequireScope(entity.ScopeTokenValidate)
+	call := func(ctx context.Context) error {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		c, _ := test.MockRoutingContext(req.WithContext(ctx))
+		return handler(c)
+	}
+
+	assert.NotNil(t, call(context.Background()))
+	// users are granted the scopes of their role
+	assert.Nil(t, call(WithUser(context.Background(), "100", "test", entity.RoleMerchant, "M001")))
+	assert.NotNil(t, call(WithUser(context.Background(), "100", "test", entity.RoleCustomer, "0811")))
+	// access tokens only grant the scopes of their scope claim
+	assert.Nil(t, call(WithIdentity(context.Background(), newTokenIdentity(jwt.MapClaims{"scope": "token:read token:validate"}))))
+	assert.NotNil(t, call(WithIdentity(context.Background(), newTokenIdentity(jwt.MapClaims{"role": "admin"}))))
 }
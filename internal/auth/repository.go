@@ -0,0 +1,396 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/lib/pq"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// UserRepository encapsulates the logic to access users from the data source.
+type UserRepository interface {
+	// GetByUsername returns the user with the specified username.
+	GetByUsername(ctx context.Context, username string) (entity.User, error)
+	// GetByID returns the user with the specified ID.
+	GetByID(ctx context.Context, id string) (entity.User, error)
+	// Create saves a new user in the data source.
+	// It returns ErrUsernameTaken if another user has the same username.
+	Create(ctx context.Context, user entity.User) error
+	// Update saves the changes to a user in the data source.
+	Update(ctx context.Context, user entity.User) error
+	// IncrementFailedAttempts atomically increments the failed login attempts of a user and returns the new count.
+	IncrementFailedAttempts(ctx context.Context, id string) (int, error)
+}
+
+// ErrUsernameTaken is returned when a user is created with a username which already exists.
+var ErrUsernameTaken = errors.New("username already taken")
+
+// userRepository persists users in database
+type userRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewUserRepository creates a new user repository
+func NewUserRepository(db *dbcontext.DB, logger log.Logger) UserRepository {
+	return userRepository{db, logger}
+}
+
+// GetByUsername returns the user with the specified username.
+func (r userRepository) GetByUsername(ctx context.Context, username string) (entity.User, error) {
+	var user entity.User
+	err := r.db.With(ctx).Select().
+		From("users").
+		Where(dbx.HashExp{"username": username}).
+		One(&user)
+	return user, err
+}
+
+// GetByID returns the user with the specified ID.
+func (r userRepository) GetByID(ctx context.Context, id string) (entity.User, error) {
+	var user entity.User
+	err := r.db.With(ctx).Select().
+		From("users").
+		Where(dbx.HashExp{"id": id}).
+		One(&user)
+	return user, err
+}
+
+// Create saves a new user in the data source.
+func (r userRepository) Create(ctx context.Context, user entity.User) error {
+	_, err := r.db.With(ctx).Insert("users", dbx.Params{
+		"id":            user.ID,
+		"username":      user.Name,
+		"password_hash": user.PasswordHash,
+		"role":          user.Role,
+		"owner_id":      user.OwnerID,
+		"disabled":      user.Disabled,
+		"created_at":    user.CreatedAt,
+		"updated_at":    user.UpdatedAt,
+	}).Execute()
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == entity.PGErrCodeUniqueViolation && pqErr.Constraint == entity.PGConstraintUniqueUsername {
+		return fmt.Errorf("%w: %s", ErrUsernameTaken, user.Name)
+	}
+	return err
+}
+
+// Update saves the changes to a user in the data source.
+func (r userRepository) Update(ctx context.Context, user entity.User) error {
+	_, err := r.db.With(ctx).Update("users", dbx.Params{
+		"password_hash":   user.PasswordHash,
+		"role":            user.Role,
+		"owner_id":        user.OwnerID,
+		"failed_attempts": user.FailedAttempts,
+		"locked_until":    user.LockedUntil,
+		"disabled":        user.Disabled,
+		"updated_at":      user.UpdatedAt,
+	}, dbx.HashExp{"id": user.ID}).Execute()
+	return err
+}
+
+// IncrementFailedAttempts atomically increments the failed login attempts of a user and returns the new count.
+func (r userRepository) IncrementFailedAttempts(ctx context.Context, id string) (int, error) {
+	var attempts int
+	err := r.db.With(ctx).
+		NewQuery("UPDATE users SET failed_attempts = failed_attempts + 1 WHERE id = {:id} RETURNING failed_attempts").
+		Bind(dbx.Params{"id": id}).
+		Row(&attempts)
+	return attempts, err
+}
+
+// SessionRepository encapsulates the logic to access refresh tokens from the data source.
+type SessionRepository interface {
+	// GetRefreshToken returns the refresh token with the specified hash.
+	GetRefreshToken(ctx context.Context, tokenHash string) (entity.RefreshToken, error)
+	// CreateRefreshToken saves a new refresh token in the data source.
+	CreateRefreshToken(ctx context.Context, token entity.RefreshToken) error
+	// UseRefreshToken marks a refresh token as used, so that it can not be exchanged again.
+	// It returns ErrRefreshTokenUsed if the token was already used or revoked in the meantime.
+	UseRefreshToken(ctx context.Context, id string, usedAt time.Time) error
+	// RevokeFamily revokes all refresh tokens of a family and returns the tokens revoked by this call.
+	RevokeFamily(ctx context.Context, familyID string, revokedAt time.Time) ([]entity.RefreshToken, error)
+	// RevokeUser revokes all refresh tokens of a user and returns the tokens revoked by this call.
+	RevokeUser(ctx context.Context, userID string, revokedAt time.Time) ([]entity.RefreshToken, error)
+}
+
+// ErrRefreshTokenUsed is returned when a refresh token is used after it was exchanged or revoked.
+var ErrRefreshTokenUsed = errors.New("refresh token already used")
+
+// sessionRepository persists refresh tokens in database
+type sessionRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewSessionRepository creates a new refresh token repository
+func NewSessionRepository(db *dbcontext.DB, logger log.Logger) SessionRepository {
+	return sessionRepository{db, logger}
+}
+
+// GetRefreshToken returns the refresh token with the specified hash.
+func (r sessionRepository) GetRefreshToken(ctx context.Context, tokenHash string) (entity.RefreshToken, error) {
+	var token entity.RefreshToken
+	err := r.db.With(ctx).Select().
+		From("refresh_tokens").
+		Where(dbx.HashExp{"token_hash": tokenHash}).
+		One(&token)
+	return token, err
+}
+
+// CreateRefreshToken saves a new refresh token in the data source.
+func (r sessionRepository) CreateRefreshToken(ctx context.Context, token entity.RefreshToken) error {
+	_, err := r.db.With(ctx).Insert("refresh_tokens", dbx.Params{
+		"id":                token.ID,
+		"token_hash":        token.TokenHash,
+		"family_id":         token.FamilyID,
+		"user_id":           token.UserID,
+		"access_token_id":   token.AccessTokenID,
+		"access_expires_at": token.AccessExpiresAt,
+		"expires_at":        token.ExpiresAt,
+		"created_at":        token.CreatedAt,
+	}).Execute()
+	return err
+}
+
+// UseRefreshToken marks a refresh token as used, so that it can not be exchanged again.
+func (r sessionRepository) UseRefreshToken(ctx context.Context, id string, usedAt time.Time) error {
+	result, err := r.db.With(ctx).Update("refresh_tokens", dbx.Params{"used_at": usedAt},
+		dbx.HashExp{"id": id, "used_at": nil, "revoked_at": nil}).Execute()
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRefreshTokenUsed
+	}
+	return nil
+}
+
+// RevokeFamily revokes all refresh tokens of a family and returns the tokens revoked by this call.
+func (r sessionRepository) RevokeFamily(ctx context.Context, familyID string, revokedAt time.Time) ([]entity.RefreshToken, error) {
+	return r.revoke(ctx, "family_id", familyID, revokedAt)
+}
+
+// RevokeUser revokes all refresh tokens of a user and returns the tokens revoked by this call.
+func (r sessionRepository) RevokeUser(ctx context.Context, userID string, revokedAt time.Time) ([]entity.RefreshToken, error) {
+	return r.revoke(ctx, "user_id", userID, revokedAt)
+}
+
+// revoke revokes the refresh tokens whose column matches the value and which are not revoked yet.
+func (r sessionRepository) revoke(ctx context.Context, column, value string, revokedAt time.Time) ([]entity.RefreshToken, error) {
+	var tokens []entity.RefreshToken
+	err := r.db.With(ctx).
+		NewQuery("UPDATE refresh_tokens SET revoked_at = {:revoked_at} WHERE " + column + " = {:value} AND revoked_at IS NULL RETURNING *").
+		Bind(dbx.Params{"revoked_at": revokedAt, "value": value}).
+		All(&tokens)
+	return tokens, err
+}
+
+// Denylist keeps track of the access tokens which are revoked before their expiry.
+type Denylist interface {
+	// Revoke adds the access token with the given jti to the denylist until it expires.
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	// IsRevoked reports whether the access token with the given jti is revoked.
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// denylist persists revoked access tokens in database
+type denylist struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewDenylist creates a new access token denylist
+func NewDenylist(db *dbcontext.DB, logger log.Logger) Denylist {
+	return denylist{db, logger}
+}
+
+// Revoke adds the access token with the given jti to the denylist until it expires.
+// Expired entries are removed on the way, as the tokens they refer to are rejected anyway.
+func (d denylist) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := d.db.With(ctx).
+		NewQuery("INSERT INTO revoked_tokens (jti, expires_at) VALUES ({:jti}, {:expires_at}) ON CONFLICT (jti) DO NOTHING").
+		Bind(dbx.Params{"jti": jti, "expires_at": expiresAt}).
+		Execute()
+	if err != nil {
+		return err
+	}
+	if _, err := d.db.With(ctx).Delete("revoked_tokens", dbx.NewExp("expires_at < now()")).Execute(); err != nil {
+		d.logger.With(ctx).Errorf("failed to remove expired revoked tokens: %v", err)
+	}
+	return nil
+}
+
+// IsRevoked reports whether the access token with the given jti is revoked.
+func (d denylist) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var count int
+	err := d.db.With(ctx).Select("COUNT(*)").
+		From("revoked_tokens").
+		Where(dbx.HashExp{"jti": jti}).
+		Row(&count)
+	return count > 0, err
+}
+
+// ClientRepository encapsulates the logic to access OAuth2 clients from the data source.
+type ClientRepository interface {
+	// Get returns the client with the specified client ID.
+	Get(ctx context.Context, id string) (entity.Client, error)
+	// Create saves a new client in the data source.
+	Create(ctx context.Context, client entity.Client) error
+	// Update saves the changes to a client in the data source.
+	Update(ctx context.Context, client entity.Client) error
+}
+
+// clientRepository persists OAuth2 clients in database
+type clientRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewClientRepository creates a new OAuth2 client repository
+func NewClientRepository(db *dbcontext.DB, logger log.Logger) ClientRepository {
+	return clientRepository{db, logger}
+}
+
+// Get returns the client with the specified client ID.
+func (r clientRepository) Get(ctx context.Context, id string) (entity.Client, error) {
+	var client entity.Client
+	err := r.db.With(ctx).Select().
+		From("clients").
+		Where(dbx.HashExp{"id": id}).
+		One(&client)
+	return client, err
+}
+
+// Create saves a new client in the data source.
+func (r clientRepository) Create(ctx context.Context, client entity.Client) error {
+	_, err := r.db.With(ctx).Insert("clients", dbx.Params{
+		"id":          client.ID,
+		"name":        client.Name,
+		"secret_hash": client.SecretHash,
+		"role":        client.Role,
+		"owner_id":    client.OwnerID,
+		"scope":       client.Scope,
+		"disabled":    client.Disabled,
+		"created_at":  client.CreatedAt,
+		"updated_at":  client.UpdatedAt,
+	}).Execute()
+	return err
+}
+
+// Update saves the changes to a client in the data source.
+func (r clientRepository) Update(ctx context.Context, client entity.Client) error {
+	_, err := r.db.With(ctx).Update("clients", dbx.Params{
+		"name":        client.Name,
+		"secret_hash": client.SecretHash,
+		"role":        client.Role,
+		"owner_id":    client.OwnerID,
+		"scope":       client.Scope,
+		"disabled":    client.Disabled,
+		"updated_at":  client.UpdatedAt,
+	}, dbx.HashExp{"id": client.ID}).Execute()
+	return err
+}
+
+// SigningKeyRepository encapsulates the logic to access the signing keys of merchants from the data source.
+type SigningKeyRepository interface {
+	// Get returns the signing key with the specified key ID.
+	Get(ctx context.Context, id string) (entity.SigningKey, error)
+	// Create saves a new signing key in the data source.
+	Create(ctx context.Context, key entity.SigningKey) error
+	// Update saves the changes to a signing key in the data source.
+	Update(ctx context.Context, key entity.SigningKey) error
+}
+
+// signingKeyRepository persists signing keys in database
+type signingKeyRepository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewSigningKeyRepository creates a new signing key repository
+func NewSigningKeyRepository(db *dbcontext.DB, logger log.Logger) SigningKeyRepository {
+	return signingKeyRepository{db, logger}
+}
+
+// Get returns the signing key with the specified key ID.
+func (r signingKeyRepository) Get(ctx context.Context, id string) (entity.SigningKey, error) {
+	var key entity.SigningKey
+	err := r.db.With(ctx).Select().
+		From("signing_keys").
+		Where(dbx.HashExp{"id": id}).
+		One(&key)
+	return key, err
+}
+
+// Create saves a new signing key in the data source.
+func (r signingKeyRepository) Create(ctx context.Context, key entity.SigningKey) error {
+	_, err := r.db.With(ctx).Insert("signing_keys", dbx.Params{
+		"id":          key.ID,
+		"merchant_id": key.MerchantID,
+		"secret":      key.Secret,
+		"disabled":    key.Disabled,
+		"created_at":  key.CreatedAt,
+		"updated_at":  key.UpdatedAt,
+	}).Execute()
+	return err
+}
+
+// Update saves the changes to a signing key in the data source.
+func (r signingKeyRepository) Update(ctx context.Context, key entity.SigningKey) error {
+	_, err := r.db.With(ctx).Update("signing_keys", dbx.Params{
+		"merchant_id": key.MerchantID,
+		"secret":      key.Secret,
+		"disabled":    key.Disabled,
+		"updated_at":  key.UpdatedAt,
+	}, dbx.HashExp{"id": key.ID}).Execute()
+	return err
+}
+
+// NonceCache keeps track of the nonces of signed requests, so that a request can not be replayed.
+type NonceCache interface {
+	// Add records a nonce until it expires. It returns false if the nonce is already recorded.
+	Add(ctx context.Context, nonce string, expiresAt time.Time) (bool, error)
+}
+
+// nonceCache persists nonces in database, so that they are shared by all the server instances
+type nonceCache struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewNonceCache creates a new nonce cache backed by the database
+func NewNonceCache(db *dbcontext.DB, logger log.Logger) NonceCache {
+	return nonceCache{db, logger}
+}
+
+// Add records a nonce until it expires. It returns false if the nonce is already recorded.
+// Expired nonces are removed on the way, as the requests they belong to are rejected anyway.
+func (n nonceCache) Add(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	result, err := n.db.With(ctx).
+		NewQuery("INSERT INTO request_nonces (nonce, expires_at) VALUES ({:nonce}, {:expires_at}) ON CONFLICT (nonce) DO NOTHING").
+		Bind(dbx.Params{"nonce": nonce, "expires_at": expiresAt}).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if _, err := n.db.With(ctx).Delete("request_nonces", dbx.NewExp("expires_at < now()")).Execute(); err != nil {
+		n.logger.With(ctx).Errorf("failed to remove expired request nonces: %v", err)
+	}
+	return rows > 0, nil
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "users")
+	repo := NewUserRepository(db, logger)
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// create
+	user := entity.User{
+		ID:           entity.GenerateID(),
+		Name:         "alice",
+		PasswordHash: "hash",
+		Role:         entity.RoleCustomer,
+		OwnerID:      "0811",
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	assert.Nil(t, repo.Create(ctx, user))
+	assert.ErrorIs(t, repo.Create(ctx, entity.User{ID: entity.GenerateID(), Name: "alice", PasswordHash: "hash", Role: entity.RoleAdmin, CreatedAt: now, UpdatedAt: now}), ErrUsernameTaken)
+
+	// get
+	found, err := repo.GetByUsername(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	assert.Equal(t, entity.RoleCustomer, found.Role)
+	assert.Equal(t, "0811", found.OwnerID)
+	_, err = repo.GetByUsername(ctx, "bob")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// increment failed attempts
+	attempts, err := repo.IncrementFailedAttempts(ctx, user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts)
+	attempts, err = repo.IncrementFailedAttempts(ctx, user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// update
+	lockedUntil := now.Add(time.Hour)
+	user.LockedUntil = &lockedUntil
+	user.Disabled = true
+	assert.Nil(t, repo.Update(ctx, user))
+	found, _ = repo.GetByUsername(ctx, "alice")
+	assert.True(t, found.Disabled)
+	assert.Equal(t, 0, found.FailedAttempts)
+	assert.True(t, found.IsLocked(now))
+}
+
+func TestSessionRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "users")
+	users := NewUserRepository(db, logger)
+	repo := NewSessionRepository(db, logger)
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	user := entity.User{ID: entity.GenerateID(), Name: "alice", PasswordHash: "hash", Role: entity.RoleAdmin, CreatedAt: now, UpdatedAt: now}
+	assert.Nil(t, users.Create(ctx, user))
+
+	familyID := entity.GenerateID()
+	token := entity.RefreshToken{
+		ID:              entity.GenerateID(),
+		TokenHash:       "hash-1",
+		FamilyID:        familyID,
+		UserID:          user.ID,
+		AccessTokenID:   "jti-1",
+		AccessExpiresAt: now.Add(time.Minute),
+		ExpiresAt:       now.Add(time.Hour),
+		CreatedAt:       now,
+	}
+	assert.Nil(t, repo.CreateRefreshToken(ctx, token))
+	next := token
+	next.ID, next.TokenHash, next.AccessTokenID = entity.GenerateID(), "hash-2", "jti-2"
+	assert.Nil(t, repo.CreateRefreshToken(ctx, next))
+
+	// get
+	found, err := repo.GetRefreshToken(ctx, "hash-1")
+	assert.Nil(t, err)
+	assert.Equal(t, token.ID, found.ID)
+	assert.True(t, found.IsUsable(now))
+	_, err = repo.GetRefreshToken(ctx, "unknown")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// use
+	assert.Nil(t, repo.UseRefreshToken(ctx, token.ID, now))
+	assert.Equal(t, ErrRefreshTokenUsed, repo.UseRefreshToken(ctx, token.ID, now))
+
+	// revoke
+	revoked, err := repo.RevokeFamily(ctx, familyID, now)
+	assert.Nil(t, err)
+	assert.Len(t, revoked, 2)
+	revoked, err = repo.RevokeUser(ctx, user.ID, now)
+	assert.Nil(t, err)
+	assert.Len(t, revoked, 0)
+	assert.Equal(t, ErrRefreshTokenUsed, repo.UseRefreshToken(ctx, next.ID, now))
+}
+
+func TestDenylist(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "revoked_tokens")
+	denylist := NewDenylist(db, logger)
+
+	ctx := context.Background()
+	revoked, err := denylist.IsRevoked(ctx, "jti-1")
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	assert.Nil(t, denylist.Revoke(ctx, "jti-1", time.Now().Add(time.Minute)))
+	assert.Nil(t, denylist.Revoke(ctx, "jti-1", time.Now().Add(time.Minute)))
+	revoked, err = denylist.IsRevoked(ctx, "jti-1")
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+}
+
+func TestClientRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "clients")
+	repo := NewClientRepository(db, logger)
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	client := entity.Client{
+		ID:         entity.GenerateID(),
+		Name:       "pos backend",
+		SecretHash: "hash",
+		Role:       entity.RoleMerchant,
+		OwnerID:    "M001",
+		Scope:      "token:validate token:redeem",
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	assert.Nil(t, repo.Create(ctx, client))
+
+	found, err := repo.Get(ctx, client.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, client.Scope, found.Scope)
+	_, err = repo.Get(ctx, "unknown")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	client.Disabled = true
+	assert.Nil(t, repo.Update(ctx, client))
+	found, _ = repo.Get(ctx, client.ID)
+	assert.True(t, found.Disabled)
+}
+
+func TestSigningKeyRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "signing_keys")
+	repo := NewSigningKeyRepository(db, logger)
+
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	key := entity.SigningKey{ID: entity.GenerateID(), MerchantID: "M001", Secret: "secret", CreatedAt: now, UpdatedAt: now}
+	assert.Nil(t, repo.Create(ctx, key))
+
+	found, err := repo.Get(ctx, key.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", found.Secret)
+	_, err = repo.Get(ctx, "unknown")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	key.Disabled = true
+	assert.Nil(t, repo.Update(ctx, key))
+	found, _ = repo.Get(ctx, key.ID)
+	assert.True(t, found.Disabled)
+}
+
+func TestNonceCache(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "request_nonces")
+	cache := NewNonceCache(db, logger)
+
+	ctx := context.Background()
+	added, err := cache.Add(ctx, "key-100:nonce-1", time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, added)
+	added, err = cache.Add(ctx, "key-100:nonce-1", time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, added)
+}
@@ -2,19 +2,41 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/pauluswi/tulip/internal/entity"
 	"github.com/pauluswi/tulip/internal/errors"
 	"github.com/pauluswi/tulip/pkg/log"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Service encapsulates the authentication logic.
 type Service interface {
 	// authenticate authenticates a user using username and password.
-	// It returns a JWT token if authentication succeeds. Otherwise, an error is returned.
-	Login(ctx context.Context, username, password string) (string, error)
+	// It returns a short-lived access token and a refresh token if authentication succeeds. Otherwise, an error is returned.
+	Login(ctx context.Context, username, password string) (Tokens, error)
+	// Refresh exchanges a refresh token for a new access token and a new refresh token.
+	// A refresh token can only be used once, using it again revokes all tokens issued since the login.
+	Refresh(ctx context.Context, refreshToken string) (Tokens, error)
+	// Logout revokes the access token of the current user and, if given, the refresh token issued with it.
+	Logout(ctx context.Context, refreshToken string) error
+	// CreateUser creates a user who can log in with the given username and password.
+	// Customers and merchants act for the customer or merchant given by ownerID.
+	CreateUser(ctx context.Context, username, password string, role entity.Role, ownerID string) (entity.User, error)
+	// SetUserDisabled disables or enables the user with the given username.
+	// A disabled user can not log in anymore and its sessions are revoked.
+	SetUserDisabled(ctx context.Context, username string, disabled bool) error
+	// RevokeSessions revokes all access and refresh tokens of the user with the given username.
+	RevokeSessions(ctx context.Context, username string) error
 }
 
 // Identity represents an authenticated user identity.
@@ -23,26 +45,195 @@ type Identity interface {
 	GetID() string
 	// GetName returns the user name.
 	GetName() string
+	// GetRole returns the user role.
+	GetRole() entity.Role
+	// GetOwnerID returns the ID of the customer or merchant the user acts for.
+	GetOwnerID() string
+	// GetScopes returns the scopes granted to the user.
+	GetScopes() []string
 }
 
+// Tokens represents the tokens given to a user at login or refresh.
+type Tokens struct {
+	// AccessToken is the JWT to send in the Authorization header.
+	AccessToken string `json:"token"`
+	// RefreshToken is exchanged for new tokens once the access token expires.
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresIn is the number of seconds the access token is valid for.
+	ExpiresIn int `json:"expires_in"`
+}
+
+// --- list of error and constants
+var (
+	ErrInvalidUsername = stderrors.New("username must have 3 to 64 characters")
+	ErrInvalidPassword = stderrors.New("password must have 8 to 72 characters")
+	ErrInvalidRole     = stderrors.New("role must be one of admin, customer or merchant")
+	ErrMissingOwnerID  = stderrors.New("customers and merchants require an owner ID")
+)
+
+// dummyHash is compared against when the user is unknown, so that the response time does not reveal
+// whether a username exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
 type service struct {
-	signingKey      string
-	tokenExpiration int
-	logger          log.Logger
+	keys              *KeySet
+	accessExpiration  time.Duration
+	sessionExpiration time.Duration
+	users             UserRepository
+	sessions          SessionRepository
+	denylist          Denylist
+	maxAttempts       int
+	lockout           time.Duration
+	logger            log.Logger
 }
 
-// NewService creates a new authentication service.
-func NewService(signingKey string, tokenExpiration int, logger log.Logger) Service {
-	return service{signingKey, tokenExpiration, logger}
+// NewService creates a new authentication service, which signs access tokens with the active key of the key set.
+// Access tokens expire after accessMinutes while the refresh tokens issued at login can be used for sessionHours.
+// A user is locked out for lockoutMinutes after maxAttempts consecutive failed logins.
+func NewService(keys *KeySet, accessMinutes, sessionHours int, users UserRepository, sessions SessionRepository,
+	denylist Denylist, maxAttempts, lockoutMinutes int, logger log.Logger) Service {
+	return service{
+		keys,
+		time.Duration(accessMinutes) * time.Minute,
+		time.Duration(sessionHours) * time.Hour,
+		users,
+		sessions,
+		denylist,
+		maxAttempts,
+		time.Duration(lockoutMinutes) * time.Minute,
+		logger,
+	}
 }
 
-// Login authenticates a user and generates a JWT token if authentication succeeds.
+// Login authenticates a user and generates an access token and a refresh token if authentication succeeds.
 // Otherwise, an error is returned.
-func (s service) Login(ctx context.Context, username, password string) (string, error) {
+func (s service) Login(ctx context.Context, username, password string) (Tokens, error) {
 	if identity := s.authenticate(ctx, username, password); identity != nil {
-		return s.generateJWT(identity)
+		now := time.Now().UTC()
+		return s.issueTokens(ctx, identity, entity.GenerateID(), now.Add(s.sessionExpiration), now)
+	}
+	return Tokens{}, errors.Unauthorized("")
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh token.
+func (s service) Refresh(ctx context.Context, refreshToken string) (Tokens, error) {
+	now := time.Now().UTC()
+	token, err := s.sessions.GetRefreshToken(ctx, hashSecret(refreshToken))
+	if err != nil {
+		if !stderrors.Is(err, sql.ErrNoRows) {
+			return Tokens{}, err
+		}
+		return Tokens{}, errors.Unauthorized("")
+	}
+	logger := s.logger.With(ctx, "user_id", token.UserID)
+
+	if token.UsedAt != nil && token.RevokedAt == nil {
+		// a refresh token used twice was most likely stolen, cut off whoever holds the other tokens of the session
+		logger.Infof("refresh token reused, revoking the session")
+		return Tokens{}, s.revokeReused(ctx, token.FamilyID, now)
+	}
+	if !token.IsUsable(now) {
+		return Tokens{}, errors.Unauthorized("")
+	}
+
+	user, err := s.users.GetByID(ctx, token.UserID)
+	if err != nil {
+		if !stderrors.Is(err, sql.ErrNoRows) {
+			return Tokens{}, err
+		}
+		return Tokens{}, errors.Unauthorized("")
+	}
+	if user.Disabled {
+		logger.Infof("refresh failed: user is disabled")
+		return Tokens{}, errors.Unauthorized("")
+	}
+
+	if err := s.sessions.UseRefreshToken(ctx, token.ID, now); err != nil {
+		if stderrors.Is(err, ErrRefreshTokenUsed) {
+			logger.Infof("refresh token reused concurrently, revoking the session")
+			return Tokens{}, s.revokeReused(ctx, token.FamilyID, now)
+		}
+		return Tokens{}, err
+	}
+	return s.issueTokens(ctx, user, token.FamilyID, token.ExpiresAt, now)
+}
+
+// revokeReused revokes the session of a reused refresh token and returns the error to report to the client.
+func (s service) revokeReused(ctx context.Context, familyID string, now time.Time) error {
+	tokens, err := s.sessions.RevokeFamily(ctx, familyID, now)
+	if err != nil {
+		return err
+	}
+	if err := s.denyAccessTokens(ctx, tokens, now); err != nil {
+		return err
 	}
-	return "", errors.Unauthorized("")
+	return errors.Unauthorized("")
+}
+
+// Logout revokes the access token of the current user and, if given, the refresh token issued with it.
+func (s service) Logout(ctx context.Context, refreshToken string) error {
+	identity, access := CurrentUser(ctx), currentAccessToken(ctx)
+	if identity == nil || access.ID == "" {
+		return errors.Unauthorized("")
+	}
+	now := time.Now().UTC()
+	if err := s.denylist.Revoke(ctx, access.ID, access.ExpiresAt); err != nil {
+		return err
+	}
+
+	if refreshToken != "" {
+		token, err := s.sessions.GetRefreshToken(ctx, hashSecret(refreshToken))
+		if err != nil && !stderrors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// the refresh token of another user is left alone
+		if err == nil && token.UserID == identity.GetID() {
+			tokens, err := s.sessions.RevokeFamily(ctx, token.FamilyID, now)
+			if err != nil {
+				return err
+			}
+			if err := s.denyAccessTokens(ctx, tokens, now); err != nil {
+				return err
+			}
+		}
+	}
+	s.logger.With(ctx, "user", identity.GetName()).Infof("user logged out")
+	return nil
+}
+
+// RevokeSessions revokes all access and refresh tokens of the user with the given username.
+func (s service) RevokeSessions(ctx context.Context, username string) error {
+	user, err := s.users.GetByUsername(ctx, username)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", username, err)
+	}
+	return s.revokeSessions(ctx, user)
+}
+
+// revokeSessions revokes all access and refresh tokens of the user.
+func (s service) revokeSessions(ctx context.Context, user entity.User) error {
+	now := time.Now().UTC()
+	tokens, err := s.sessions.RevokeUser(ctx, user.ID, now)
+	if err != nil {
+		return err
+	}
+	if err := s.denyAccessTokens(ctx, tokens, now); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.Name).Infof("%d sessions revoked", len(tokens))
+	return nil
+}
+
+// denyAccessTokens adds the access tokens issued with the given refresh tokens to the denylist, unless they expired.
+func (s service) denyAccessTokens(ctx context.Context, tokens []entity.RefreshToken, now time.Time) error {
+	for _, token := range tokens {
+		if token.AccessExpiresAt.After(now) {
+			if err := s.denylist.Revoke(ctx, token.AccessTokenID, token.AccessExpiresAt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // authenticate authenticates a user using username and password.
@@ -50,21 +241,191 @@ func (s service) Login(ctx context.Context, username, password string) (string,
 func (s service) authenticate(ctx context.Context, username, password string) Identity {
 	logger := s.logger.With(ctx, "user", username)
 
-	// TODO: the following authentication logic is only for demo purpose
-	if username == "demo" && password == "pass" {
-		logger.Infof("authentication successful")
-		return entity.User{ID: "100", Name: "demo"}
+	user, err := s.users.GetByUsername(ctx, username)
+	if err != nil {
+		if !stderrors.Is(err, sql.ErrNoRows) {
+			logger.Errorf("failed to look up user: %v", err)
+		}
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		logger.Infof("authentication failed")
+		return nil
+	}
+
+	// the password is compared before the checks below, so that disabled and locked users can not be told apart
+	// by the response time
+	mismatch := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+
+	now := time.Now().UTC()
+	if user.Disabled {
+		logger.Infof("authentication failed: user is disabled")
+		return nil
+	}
+	if user.IsLocked(now) {
+		logger.Infof("authentication failed: user is locked until %s", user.LockedUntil.Format(time.RFC3339))
+		return nil
+	}
+
+	if mismatch != nil {
+		s.recordFailure(ctx, logger, user, now)
+		logger.Infof("authentication failed")
+		return nil
+	}
+
+	// a successful login clears the failed attempts
+	if user.FailedAttempts > 0 || user.LockedUntil != nil {
+		user.FailedAttempts = 0
+		user.LockedUntil = nil
+		user.UpdatedAt = now
+		if err := s.users.Update(ctx, user); err != nil {
+			logger.Errorf("failed to reset failed login attempts: %v", err)
+		}
+	}
+
+	logger.Infof("authentication successful")
+	return entity.User{ID: user.ID, Name: user.Name, Role: user.Role, OwnerID: user.OwnerID}
+}
+
+// recordFailure counts a failed login attempt and locks the user out once the maximum number of attempts is reached.
+func (s service) recordFailure(ctx context.Context, logger log.Logger, user entity.User, now time.Time) {
+	attempts, err := s.users.IncrementFailedAttempts(ctx, user.ID)
+	if err != nil {
+		logger.Errorf("failed to record failed login attempt: %v", err)
+		return
+	}
+	if s.maxAttempts <= 0 || attempts < s.maxAttempts {
+		return
+	}
+
+	lockedUntil := now.Add(s.lockout)
+	user.FailedAttempts = 0
+	user.LockedUntil = &lockedUntil
+	user.UpdatedAt = now
+	if err := s.users.Update(ctx, user); err != nil {
+		logger.Errorf("failed to lock user: %v", err)
+		return
+	}
+	logger.Infof("user locked until %s after %d failed login attempts", lockedUntil.Format(time.RFC3339), attempts)
+}
+
+// CreateUser creates a user who can log in with the given username and password.
+func (s service) CreateUser(ctx context.Context, username, password string, role entity.Role, ownerID string) (entity.User, error) {
+	if len(username) < 3 || len(username) > 64 {
+		return entity.User{}, ErrInvalidUsername
+	}
+	// bcrypt only uses the first 72 bytes of a password
+	if len(password) < 8 || len(password) > 72 {
+		return entity.User{}, ErrInvalidPassword
+	}
+	if !role.IsValid() {
+		return entity.User{}, ErrInvalidRole
+	}
+	if role != entity.RoleAdmin && ownerID == "" {
+		return entity.User{}, ErrMissingOwnerID
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return entity.User{}, err
 	}
 
-	logger.Infof("authentication failed")
+	now := time.Now().UTC()
+	user := entity.User{
+		ID:           entity.GenerateID(),
+		Name:         username,
+		PasswordHash: string(hash),
+		Role:         role,
+		OwnerID:      ownerID,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := s.users.Create(ctx, user); err != nil {
+		return entity.User{}, err
+	}
+	s.logger.With(ctx, "user", username).Infof("user created")
+	return user, nil
+}
+
+// SetUserDisabled disables or enables the user with the given username.
+func (s service) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+	user, err := s.users.GetByUsername(ctx, username)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", username, err)
+	}
+	user.Disabled = disabled
+	user.UpdatedAt = time.Now().UTC()
+	if err := s.users.Update(ctx, user); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", username).Infof("user disabled: %v", disabled)
+	if disabled {
+		return s.revokeSessions(ctx, user)
+	}
 	return nil
 }
 
+// issueTokens generates an access token for the identity together with a refresh token of the given session family.
+func (s service) issueTokens(ctx context.Context, identity Identity, familyID string, sessionExpiresAt, now time.Time) (Tokens, error) {
+	jti := entity.GenerateID()
+	accessExpiresAt := now.Add(s.accessExpiration)
+	accessToken, err := s.generateJWT(identity, jti, accessExpiresAt)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	refreshToken, err := randomSecret()
+	if err != nil {
+		return Tokens{}, err
+	}
+	if err := s.sessions.CreateRefreshToken(ctx, entity.RefreshToken{
+		ID:              entity.GenerateID(),
+		TokenHash:       hashSecret(refreshToken),
+		FamilyID:        familyID,
+		UserID:          identity.GetID(),
+		AccessTokenID:   jti,
+		AccessExpiresAt: accessExpiresAt,
+		ExpiresAt:       sessionExpiresAt,
+		CreatedAt:       now,
+	}); err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.accessExpiration.Seconds()),
+	}, nil
+}
+
 // generateJWT generates a JWT that encodes an identity.
-func (s service) generateJWT(identity Identity) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":   identity.GetID(),
-		"name": identity.GetName(),
-		"exp":  time.Now().Add(time.Duration(s.tokenExpiration) * time.Hour).Unix(),
-	}).SignedString([]byte(s.signingKey))
+func (s service) generateJWT(identity Identity, jti string, expiresAt time.Time) (string, error) {
+	return signAccessToken(s.keys, identity, jti, expiresAt)
+}
+
+// signAccessToken generates a JWT that encodes an identity together with the scopes it is granted.
+func signAccessToken(keys *KeySet, identity Identity, jti string, expiresAt time.Time) (string, error) {
+	return keys.Sign(jwt.MapClaims{
+		"id":       identity.GetID(),
+		"name":     identity.GetName(),
+		"role":     identity.GetRole(),
+		"owner_id": identity.GetOwnerID(),
+		"scope":    strings.Join(identity.GetScopes(), " "),
+		"jti":      jti,
+		"exp":      expiresAt.Unix(),
+	})
+}
+
+// randomSecret generates an opaque secret of 256 random bits, e.g. a refresh token or a client secret.
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret returns the hash under which a secret generated by randomSecret is stored, so that a leak of the
+// data source does not leak usable secrets. A fast hash is enough as such secrets can not be guessed.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
 }
@@ -2,39 +2,349 @@ package auth
 
 import (
 	"context"
+	"database/sql"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/pauluswi/tulip/internal/entity"
 	"github.com/pauluswi/tulip/internal/errors"
 	"github.com/pauluswi/tulip/pkg/log"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func Test_service_Authenticate(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := NewService("test", 100, logger)
+	s := newTestService(logger)
 	_, err := s.Login(context.Background(), "unknown", "bad")
 	assert.Equal(t, errors.Unauthorized(""), err)
-	token, err := s.Login(context.Background(), "demo", "pass")
+	tokens, err := s.Login(context.Background(), "demo", "pass")
 	assert.Nil(t, err)
-	assert.NotEmpty(t, token)
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, 15*60, tokens.ExpiresIn)
 }
 
 func Test_service_authenticate(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := service{"test", 100, logger}
+	s := newTestService(logger)
 	assert.Nil(t, s.authenticate(context.Background(), "unknown", "bad"))
+	assert.Nil(t, s.authenticate(context.Background(), "demo", "bad"))
 	assert.NotNil(t, s.authenticate(context.Background(), "demo", "pass"))
 }
 
+func Test_service_Lockout(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(logger)
+	repo := s.users.(*mockUserRepository)
+	ctx := context.Background()
+
+	// a successful login resets the failed attempts
+	assert.Nil(t, s.authenticate(ctx, "demo", "bad"))
+	assert.Nil(t, s.authenticate(ctx, "demo", "bad"))
+	assert.NotNil(t, s.authenticate(ctx, "demo", "pass"))
+	assert.Equal(t, 0, repo.users["demo"].FailedAttempts)
+
+	// the user is locked after 3 consecutive failures, even for the right password
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, s.authenticate(ctx, "demo", "bad"))
+	}
+	assert.True(t, repo.users["demo"].IsLocked(time.Now()))
+	assert.Nil(t, s.authenticate(ctx, "demo", "pass"))
+
+	// the lockout expires
+	past := time.Now().Add(-time.Minute)
+	user := repo.users["demo"]
+	user.LockedUntil = &past
+	repo.users["demo"] = user
+	assert.NotNil(t, s.authenticate(ctx, "demo", "pass"))
+	assert.Nil(t, repo.users["demo"].LockedUntil)
+}
+
+func Test_service_CreateUser(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(logger)
+	ctx := context.Background()
+
+	_, err := s.CreateUser(ctx, "ab", "password1", entity.RoleCustomer, "0811")
+	assert.Equal(t, ErrInvalidUsername, err)
+	_, err = s.CreateUser(ctx, "alice", "short", entity.RoleCustomer, "0811")
+	assert.Equal(t, ErrInvalidPassword, err)
+	_, err = s.CreateUser(ctx, "alice", "password1", "root", "")
+	assert.Equal(t, ErrInvalidRole, err)
+	_, err = s.CreateUser(ctx, "alice", "password1", entity.RoleMerchant, "")
+	assert.Equal(t, ErrMissingOwnerID, err)
+
+	user, err := s.CreateUser(ctx, "alice", "password1", entity.RoleCustomer, "0811")
+	if assert.Nil(t, err) {
+		assert.NotEmpty(t, user.ID)
+		assert.NotEqual(t, "password1", user.PasswordHash)
+		assert.Equal(t, entity.RoleCustomer, user.Role)
+		assert.Equal(t, "0811", user.OwnerID)
+	}
+	_, err = s.CreateUser(ctx, "alice", "password2", entity.RoleAdmin, "")
+	assert.ErrorIs(t, err, ErrUsernameTaken)
+
+	tokens, err := s.Login(ctx, "alice", "password1")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+}
+
+func Test_service_SetUserDisabled(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(logger)
+	ctx := context.Background()
+
+	assert.Nil(t, s.SetUserDisabled(ctx, "demo", true))
+	_, err := s.Login(ctx, "demo", "pass")
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	assert.Nil(t, s.SetUserDisabled(ctx, "demo", false))
+	_, err = s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+
+	assert.ErrorIs(t, s.SetUserDisabled(ctx, "unknown", true), sql.ErrNoRows)
+}
+
+func Test_service_Refresh(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(logger)
+	denylist := s.denylist.(*mockDenylist)
+	ctx := context.Background()
+
+	tokens, err := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, err)
+
+	_, err = s.Refresh(ctx, "unknown")
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// a refresh token is rotated on every use
+	refreshed, err := s.Refresh(ctx, tokens.RefreshToken)
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, tokens.AccessToken, refreshed.AccessToken)
+		assert.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+	}
+	again, err := s.Refresh(ctx, refreshed.RefreshToken)
+	assert.Nil(t, err)
+
+	// reusing a refresh token revokes the whole session, including the latest access token
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = s.Refresh(ctx, again.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+	assert.True(t, denylist.revoked[jtiOf(t, again.AccessToken)])
+
+	// the session of a disabled user can not be refreshed
+	tokens, _ = s.Login(ctx, "demo", "pass")
+	user := s.users.(*mockUserRepository).users["demo"]
+	user.Disabled = true
+	s.users.(*mockUserRepository).users["demo"] = user
+	_, err = s.Refresh(ctx, tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+}
+
+func Test_service_RefreshExpiredSession(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(logger)
+	s.sessionExpiration = -time.Minute
+	tokens, err := s.Login(context.Background(), "demo", "pass")
+	assert.Nil(t, err)
+	_, err = s.Refresh(context.Background(), tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+}
+
+func Test_service_Logout(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(logger)
+	denylist := s.denylist.(*mockDenylist)
+	ctx := context.Background()
+
+	assert.Equal(t, errors.Unauthorized(""), s.Logout(ctx, ""))
+
+	tokens, _ := s.Login(ctx, "demo", "pass")
+	jti := jtiOf(t, tokens.AccessToken)
+	ctx = WithUser(ctx, "100", "demo", entity.RoleAdmin, "")
+	ctx = context.WithValue(ctx, accessTokenKey, accessToken{jti, time.Now().Add(time.Minute)})
+	assert.Nil(t, s.Logout(ctx, tokens.RefreshToken))
+	assert.True(t, denylist.revoked[jti])
+	_, err := s.Refresh(context.Background(), tokens.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+}
+
+func Test_service_RevokeSessions(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := newTestService(logger)
+	denylist := s.denylist.(*mockDenylist)
+	ctx := context.Background()
+
+	first, _ := s.Login(ctx, "demo", "pass")
+	second, _ := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, s.RevokeSessions(ctx, "demo"))
+	assert.True(t, denylist.revoked[jtiOf(t, first.AccessToken)])
+	assert.True(t, denylist.revoked[jtiOf(t, second.AccessToken)])
+	_, err := s.Refresh(ctx, second.RefreshToken)
+	assert.Equal(t, errors.Unauthorized(""), err)
+
+	// disabling a user revokes its sessions too
+	third, _ := s.Login(ctx, "demo", "pass")
+	assert.Nil(t, s.SetUserDisabled(ctx, "demo", true))
+	assert.True(t, denylist.revoked[jtiOf(t, third.AccessToken)])
+}
+
 func Test_service_GenerateJWT(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := service{"test", 100, logger}
+	s := newTestService(logger)
 	token, err := s.generateJWT(entity.User{
-		ID:   "100",
-		Name: "demo",
-	})
+		ID:      "100",
+		Name:    "demo",
+		Role:    entity.RoleCustomer,
+		OwnerID: "0811",
+	}, "jti-100", time.Now().Add(time.Minute))
 	if assert.Nil(t, err) {
 		assert.NotEmpty(t, token)
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) { return []byte("test"), nil })
+		assert.Nil(t, err)
+		assert.Equal(t, "customer", claims["role"])
+		assert.Equal(t, "0811", claims["owner_id"])
+		assert.Equal(t, "jti-100", claims["jti"])
 	}
 }
+
+// newTestService returns a service whose users are held by a mockUserRepository.
+func newTestService(logger log.Logger) service {
+	return NewService(NewHMACKeySet("test"), 15, 72, newMockUserRepository(), newMockSessionRepository(), newMockDenylist(), 3, 15, logger).(service)
+}
+
+// jtiOf returns the jti claim of an access token.
+func jtiOf(t *testing.T, token string) string {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) { return []byte("test"), nil })
+	assert.Nil(t, err)
+	jti, _ := claims["jti"].(string)
+	return jti
+}
+
+type mockUserRepository struct {
+	users map[string]entity.User
+}
+
+// newMockUserRepository returns a repository holding the user "demo" with the password "pass".
+func newMockUserRepository() *mockUserRepository {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	return &mockUserRepository{users: map[string]entity.User{
+		"demo": {ID: "100", Name: "demo", PasswordHash: string(hash), Role: entity.RoleAdmin},
+	}}
+}
+
+func (m *mockUserRepository) GetByUsername(ctx context.Context, username string) (entity.User, error) {
+	if user, ok := m.users[username]; ok {
+		return user, nil
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m *mockUserRepository) GetByID(ctx context.Context, id string) (entity.User, error) {
+	for _, user := range m.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m *mockUserRepository) Create(ctx context.Context, user entity.User) error {
+	if _, ok := m.users[user.Name]; ok {
+		return ErrUsernameTaken
+	}
+	m.users[user.Name] = user
+	return nil
+}
+
+func (m *mockUserRepository) Update(ctx context.Context, user entity.User) error {
+	m.users[user.Name] = user
+	return nil
+}
+
+func (m *mockUserRepository) IncrementFailedAttempts(ctx context.Context, id string) (int, error) {
+	for name, user := range m.users {
+		if user.ID == id {
+			user.FailedAttempts++
+			m.users[name] = user
+			return user.FailedAttempts, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+type mockSessionRepository struct {
+	tokens map[string]entity.RefreshToken
+}
+
+func newMockSessionRepository() *mockSessionRepository {
+	return &mockSessionRepository{tokens: map[string]entity.RefreshToken{}}
+}
+
+func (m *mockSessionRepository) GetRefreshToken(ctx context.Context, tokenHash string) (entity.RefreshToken, error) {
+	if token, ok := m.tokens[tokenHash]; ok {
+		return token, nil
+	}
+	return entity.RefreshToken{}, sql.ErrNoRows
+}
+
+func (m *mockSessionRepository) CreateRefreshToken(ctx context.Context, token entity.RefreshToken) error {
+	m.tokens[token.TokenHash] = token
+	return nil
+}
+
+func (m *mockSessionRepository) UseRefreshToken(ctx context.Context, id string, usedAt time.Time) error {
+	for hash, token := range m.tokens {
+		if token.ID == id {
+			if token.UsedAt != nil || token.RevokedAt != nil {
+				return ErrRefreshTokenUsed
+			}
+			token.UsedAt = &usedAt
+			m.tokens[hash] = token
+			return nil
+		}
+	}
+	return ErrRefreshTokenUsed
+}
+
+func (m *mockSessionRepository) RevokeFamily(ctx context.Context, familyID string, revokedAt time.Time) ([]entity.RefreshToken, error) {
+	return m.revoke(func(token entity.RefreshToken) bool { return token.FamilyID == familyID }, revokedAt), nil
+}
+
+func (m *mockSessionRepository) RevokeUser(ctx context.Context, userID string, revokedAt time.Time) ([]entity.RefreshToken, error) {
+	return m.revoke(func(token entity.RefreshToken) bool { return token.UserID == userID }, revokedAt), nil
+}
+
+func (m *mockSessionRepository) revoke(match func(entity.RefreshToken) bool, revokedAt time.Time) []entity.RefreshToken {
+	var revoked []entity.RefreshToken
+	for hash, token := range m.tokens {
+		if match(token) && token.RevokedAt == nil {
+			token.RevokedAt = &revokedAt
+			m.tokens[hash] = token
+			revoked = append(revoked, token)
+		}
+	}
+	return revoked
+}
+
+type mockDenylist struct {
+	revoked map[string]bool
+}
+
+func newMockDenylist() *mockDenylist {
+	return &mockDenylist{revoked: map[string]bool{}}
+}
+
+func (m *mockDenylist) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	m.revoked[jti] = true
+	return nil
+}
+
+func (m *mockDenylist) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	return m.revoked[jti], nil
+}
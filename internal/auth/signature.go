@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/internal/errors"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// The headers of a signed request. The signature is the hex encoded HMAC-SHA256 of the string to sign, computed
+// with the secret of the signing key. The string to sign joins with "\n" the request method, the request URI
+// (path and query), the timestamp, the nonce and the hex encoded SHA-256 digest of the request body.
+const (
+	SignatureKeyHeader       = "X-Signature-Key"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+	SignatureHeader          = "X-Signature"
+)
+
+// The ways merchants may authenticate their calls, see MerchantHandler.
+const (
+	MerchantAuthJWT             = "jwt"
+	MerchantAuthSignature       = "signature"
+	MerchantAuthJWTOrSignature  = "jwt_or_signature"
+	MerchantAuthJWTAndSignature = "jwt_and_signature"
+)
+
+// maxSignedBody is the maximum size of the body of a signed request.
+const maxSignedBody = 1 << 20
+
+// SigningKeyService manages the keys which merchants use to sign their requests.
+type SigningKeyService interface {
+	// CreateSigningKey creates a signing key for the merchant. The returned key holds the secret to share with the merchant.
+	CreateSigningKey(ctx context.Context, merchantID string) (entity.SigningKey, error)
+	// SetSigningKeyDisabled disables or enables the signing key with the given ID.
+	// The requests signed by a disabled key are rejected.
+	SetSigningKeyDisabled(ctx context.Context, keyID string, disabled bool) error
+}
+
+type signingKeyService struct {
+	keys   SigningKeyRepository
+	logger log.Logger
+}
+
+// NewSigningKeyService creates a new signing key service.
+func NewSigningKeyService(keys SigningKeyRepository, logger log.Logger) SigningKeyService {
+	return signingKeyService{keys, logger}
+}
+
+// CreateSigningKey creates a signing key for the merchant.
+func (s signingKeyService) CreateSigningKey(ctx context.Context, merchantID string) (entity.SigningKey, error) {
+	if merchantID == "" {
+		return entity.SigningKey{}, ErrMissingOwnerID
+	}
+	secret, err := randomSecret()
+	if err != nil {
+		return entity.SigningKey{}, err
+	}
+	now := time.Now().UTC()
+	key := entity.SigningKey{
+		ID:         entity.GenerateID(),
+		MerchantID: merchantID,
+		Secret:     secret,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := s.keys.Create(ctx, key); err != nil {
+		return entity.SigningKey{}, err
+	}
+	s.logger.With(ctx, "signing_key", key.ID).Infof("signing key created for merchant %s", merchantID)
+	return key, nil
+}
+
+// SetSigningKeyDisabled disables or enables the signing key with the given ID.
+func (s signingKeyService) SetSigningKeyDisabled(ctx context.Context, keyID string, disabled bool) error {
+	key, err := s.keys.Get(ctx, keyID)
+	if err != nil {
+		return fmt.Errorf("signing key %s: %w", keyID, err)
+	}
+	key.Disabled = disabled
+	key.UpdatedAt = time.Now().UTC()
+	if err := s.keys.Update(ctx, key); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "signing_key", keyID).Infof("signing key disabled: %v", disabled)
+	return nil
+}
+
+// SignatureHandler returns a middleware which authenticates the requests signed with the signing key of a merchant.
+// The timestamp of a request may differ from the server clock by maxSkew at most, and its nonce may only be used
+// once within that window, which prevents signed requests from being replayed.
+//
+// If the request was already authenticated with a JWT, the signature must come from the merchant of the JWT and
+// the identity of the JWT is kept. Otherwise the request is authenticated as the merchant owning the signing key.
+func SignatureHandler(keys SigningKeyRepository, nonces NonceCache, maxSkew time.Duration, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		keyID := c.Request.Header.Get(SignatureKeyHeader)
+		nonce := c.Request.Header.Get(SignatureNonceHeader)
+		signature, err := hex.DecodeString(c.Request.Header.Get(SignatureHeader))
+		if keyID == "" || err != nil || len(signature) == 0 {
+			return errors.Unauthorized("The request is not signed.")
+		}
+		if len(nonce) < 16 || len(nonce) > 128 {
+			return errors.Unauthorized("The nonce must have 16 to 128 characters.")
+		}
+		timestamp, err := strconv.ParseInt(c.Request.Header.Get(SignatureTimestampHeader), 10, 64)
+		if err != nil {
+			return errors.Unauthorized("The timestamp must be a Unix time in seconds.")
+		}
+		signedAt := time.Unix(timestamp, 0)
+		if math.Abs(float64(time.Since(signedAt))) > float64(maxSkew) {
+			return errors.Unauthorized("The timestamp is outside of the accepted window.")
+		}
+
+		key, err := keys.Get(ctx, keyID)
+		if err != nil {
+			if !stderrors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			logger.With(ctx, "signing_key", keyID).Infof("signature rejected: unknown signing key")
+			return errors.Unauthorized("")
+		}
+		if key.Disabled {
+			logger.With(ctx, "signing_key", keyID).Infof("signature rejected: signing key is disabled")
+			return errors.Unauthorized("")
+		}
+
+		body, err := readBody(c.Request)
+		if err != nil {
+			return errors.BadRequest("The request body is too large to be signed.")
+		}
+		if !hmac.Equal(signature, sign(key.Secret, c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body)) {
+			logger.With(ctx, "signing_key", keyID).Infof("signature rejected: signature mismatch")
+			return errors.Unauthorized("")
+		}
+		// the nonce is only recorded once the signature is verified, so that nonces can not be burnt by third parties
+		added, err := nonces.Add(ctx, keyID+":"+nonce, signedAt.Add(maxSkew))
+		if err != nil {
+			return err
+		}
+		if !added {
+			logger.With(ctx, "signing_key", keyID).Infof("signature rejected: replayed nonce")
+			return errors.Unauthorized("The request has already been received.")
+		}
+
+		if identity := CurrentUser(ctx); identity != nil {
+			if identity.GetRole() != entity.RoleAdmin && identity.GetOwnerID() != key.MerchantID {
+				return errors.Forbidden("The request is not signed by the merchant of the access token.")
+			}
+			return nil
+		}
+		c.Request = c.Request.WithContext(WithUser(ctx, key.ID, key.MerchantID, entity.RoleMerchant, key.MerchantID))
+		return nil
+	}
+}
+
+// readBody reads the request body and puts it back, so that the handlers can read it again.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSignedBody {
+		return nil, stderrors.New("request body too large")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// sign computes the signature of a request with the given secret.
+func sign(secret, method, uri string, timestamp int64, nonce string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(digest[:]))
+	return mac.Sum(nil)
+}
+
+// MerchantHandler returns the middleware authenticating the merchant calls in the given mode:
+// a JWT, a signature, either of them (the signature is checked if the request carries one), or both of them.
+func MerchantHandler(mode string, jwtHandler, signatureHandler routing.Handler) (routing.Handler, error) {
+	switch mode {
+	case MerchantAuthJWT:
+		return jwtHandler, nil
+	case MerchantAuthSignature:
+		return signatureHandler, nil
+	case MerchantAuthJWTOrSignature:
+		return func(c *routing.Context) error {
+			if c.Request.Header.Get(SignatureHeader) != "" {
+				return signatureHandler(c)
+			}
+			return jwtHandler(c)
+		}, nil
+	case MerchantAuthJWTAndSignature:
+		return func(c *routing.Context) error {
+			if err := jwtHandler(c); err != nil {
+				return err
+			}
+			return signatureHandler(c)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown merchant authentication %q", mode)
+}
+
+// memoryNonceCache keeps nonces in memory, which only prevents replays on a single server instance.
+type memoryNonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+// NewMemoryNonceCache creates a nonce cache which keeps nonces in memory.
+func NewMemoryNonceCache() NonceCache {
+	return &memoryNonceCache{nonces: map[string]time.Time{}}
+}
+
+// Add records a nonce until it expires. It returns false if the nonce is already recorded.
+func (m *memoryNonceCache) Add(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	// expired nonces are removed once a minute at most
+	if now.Sub(m.pruned) > time.Minute {
+		for n, exp := range m.nonces {
+			if now.After(exp) {
+				delete(m.nonces, n)
+			}
+		}
+		m.pruned = now
+	}
+	if exp, ok := m.nonces[nonce]; ok && !now.After(exp) {
+		return false, nil
+	}
+	m.nonces[nonce] = expiresAt
+	return true, nil
+}
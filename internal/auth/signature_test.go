@@ -0,0 +1,198 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/internal/errors"
+	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// signedRequest builds a request signed with the given key, its headers can be tampered with afterwards.
+func signedRequest(key entity.SigningKey, body, nonce string, signedAt time.Time) *http.Request {
+	req, _ := http.NewRequest("POST", "http://example.com/v1/validate?x=1", strings.NewReader(body))
+	timestamp := signedAt.Unix()
+	req.Header.Set(SignatureKeyHeader, key.ID)
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureNonceHeader, nonce)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(sign(key.Secret, "POST", "/v1/validate?x=1", timestamp, nonce, []byte(body))))
+	return req
+}
+
+func TestSignatureHandler(t *testing.T) {
+	logger, _ := log.NewForTest()
+	keys := newMockSigningKeyRepository()
+	key := entity.SigningKey{ID: "key-100", MerchantID: "M001", Secret: "secret"}
+	disabled := entity.SigningKey{ID: "key-101", MerchantID: "M001", Secret: "secret", Disabled: true}
+	_ = keys.Create(context.Background(), key)
+	_ = keys.Create(context.Background(), disabled)
+	handler := SignatureHandler(keys, NewMemoryNonceCache(), 5*time.Minute, logger)
+
+	call := func(req *http.Request) (*routing.Context, error) {
+		c, _ := test.MockRoutingContext(req)
+		return c, handler(c)
+	}
+	body := `{"token":"123456"}`
+
+	c, err := call(signedRequest(key, body, "nonce-0000000001", time.Now()))
+	if assert.Nil(t, err) {
+		identity := CurrentUser(c.Request.Context())
+		assert.Equal(t, entity.RoleMerchant, identity.GetRole())
+		assert.Equal(t, "M001", identity.GetOwnerID())
+		// the body can still be read by the handlers
+		read, _ := ioutil.ReadAll(c.Request.Body)
+		assert.Equal(t, body, string(read))
+	}
+
+	// a replayed request is rejected
+	_, err = call(signedRequest(key, body, "nonce-0000000001", time.Now()))
+	assert.Equal(t, errors.Unauthorized("The request has already been received."), err)
+
+	// the timestamp must be within the skew window
+	_, err = call(signedRequest(key, body, "nonce-0000000002", time.Now().Add(-6*time.Minute)))
+	assert.NotNil(t, err)
+	_, err = call(signedRequest(key, body, "nonce-0000000003", time.Now().Add(6*time.Minute)))
+	assert.NotNil(t, err)
+	_, err = call(signedRequest(key, body, "nonce-0000000004", time.Now().Add(-4*time.Minute)))
+	assert.Nil(t, err)
+
+	// the body, the method and the URI are covered by the signature
+	req := signedRequest(key, body, "nonce-0000000005", time.Now())
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"token":"654321"}`))
+	_, err = call(req)
+	assert.Equal(t, errors.Unauthorized(""), err)
+	req = signedRequest(key, body, "nonce-0000000006", time.Now())
+	req.URL.RawQuery = "x=2"
+	_, err = call(req)
+	assert.Equal(t, errors.Unauthorized(""), err)
+	// the nonce of a rejected request is not burnt
+	_, err = call(signedRequest(key, body, "nonce-0000000006", time.Now()))
+	assert.Nil(t, err)
+
+	_, err = call(signedRequest(entity.SigningKey{ID: "key-100", Secret: "wrong"}, body, "nonce-0000000007", time.Now()))
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = call(signedRequest(entity.SigningKey{ID: "unknown", Secret: "secret"}, body, "nonce-0000000008", time.Now()))
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = call(signedRequest(disabled, body, "nonce-0000000009", time.Now()))
+	assert.Equal(t, errors.Unauthorized(""), err)
+	_, err = call(signedRequest(key, body, "short", time.Now()))
+	assert.NotNil(t, err)
+	req, _ = http.NewRequest("POST", "http://example.com/v1/validate", strings.NewReader(body))
+	_, err = call(req)
+	assert.Equal(t, errors.Unauthorized("The request is not signed."), err)
+
+	// a request authenticated with a JWT must be signed by the merchant of the JWT
+	req = signedRequest(key, body, "nonce-0000000010", time.Now())
+	req = req.WithContext(WithUser(req.Context(), "200", "shop", entity.RoleMerchant, "M002"))
+	_, err = call(req)
+	assert.Equal(t, errors.Forbidden("The request is not signed by the merchant of the access token."), err)
+	req = signedRequest(key, body, "nonce-0000000011", time.Now())
+	req = req.WithContext(WithUser(req.Context(), "200", "shop", entity.RoleMerchant, "M001"))
+	c, err = call(req)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "200", CurrentUser(c.Request.Context()).GetID())
+	}
+}
+
+func TestMerchantHandler(t *testing.T) {
+	jwtHandler := func(c *routing.Context) error {
+		c.Response.Header().Add("X-Auth", "jwt")
+		return nil
+	}
+	signatureHandler := func(c *routing.Context) error {
+		c.Response.Header().Add("X-Auth", "signature")
+		return nil
+	}
+	call := func(mode string, signed bool) []string {
+		handler, err := MerchantHandler(mode, jwtHandler, signatureHandler)
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		req, _ := http.NewRequest("POST", "http://example.com/v1/validate", nil)
+		if signed {
+			req.Header.Set(SignatureHeader, "00")
+		}
+		c, res := test.MockRoutingContext(req)
+		assert.Nil(t, handler(c))
+		return res.Header()["X-Auth"]
+	}
+
+	assert.Equal(t, []string{"jwt"}, call(MerchantAuthJWT, true))
+	assert.Equal(t, []string{"signature"}, call(MerchantAuthSignature, false))
+	assert.Equal(t, []string{"jwt"}, call(MerchantAuthJWTOrSignature, false))
+	assert.Equal(t, []string{"signature"}, call(MerchantAuthJWTOrSignature, true))
+	assert.Equal(t, []string{"jwt", "signature"}, call(MerchantAuthJWTAndSignature, true))
+
+	_, err := MerchantHandler("basic", jwtHandler, signatureHandler)
+	assert.NotNil(t, err)
+}
+
+func Test_signingKeyService(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewSigningKeyService(newMockSigningKeyRepository(), logger)
+	ctx := context.Background()
+
+	_, err := s.CreateSigningKey(ctx, "")
+	assert.Equal(t, ErrMissingOwnerID, err)
+
+	key, err := s.CreateSigningKey(ctx, "M001")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "M001", key.MerchantID)
+		assert.NotEmpty(t, key.Secret)
+	}
+	assert.Nil(t, s.SetSigningKeyDisabled(ctx, key.ID, true))
+	assert.ErrorIs(t, s.SetSigningKeyDisabled(ctx, "unknown", true), sql.ErrNoRows)
+}
+
+func TestMemoryNonceCache(t *testing.T) {
+	cache := NewMemoryNonceCache()
+	ctx := context.Background()
+
+	added, err := cache.Add(ctx, "nonce-1", time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, added)
+	added, _ = cache.Add(ctx, "nonce-1", time.Now().Add(time.Minute))
+	assert.False(t, added)
+
+	// an expired nonce may be used again
+	added, _ = cache.Add(ctx, "nonce-2", time.Now().Add(-time.Second))
+	assert.True(t, added)
+	added, _ = cache.Add(ctx, "nonce-2", time.Now().Add(time.Minute))
+	assert.True(t, added)
+}
+
+type mockSigningKeyRepository struct {
+	keys map[string]entity.SigningKey
+}
+
+func newMockSigningKeyRepository() *mockSigningKeyRepository {
+	return &mockSigningKeyRepository{keys: map[string]entity.SigningKey{}}
+}
+
+func (m *mockSigningKeyRepository) Get(ctx context.Context, id string) (entity.SigningKey, error) {
+	if key, ok := m.keys[id]; ok {
+		return key, nil
+	}
+	return entity.SigningKey{}, sql.ErrNoRows
+}
+
+func (m *mockSigningKeyRepository) Create(ctx context.Context, key entity.SigningKey) error {
+	m.keys[key.ID] = key
+	return nil
+}
+
+func (m *mockSigningKeyRepository) Update(ctx context.Context, key entity.SigningKey) error {
+	m.keys[key.ID] = key
+	return nil
+}
@@ -0,0 +1,86 @@
+// Package bruteforce locks out the callers and IP addresses which keep failing an attempt, e.g. guessing tokens.
+package bruteforce
+
+import (
+	"context"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// maxLockoutShift bounds the doubling of the lockout, which is capped by the policy anyway.
+const maxLockoutShift = 16
+
+// Guard tracks the failed attempts of keys, such as caller identities and IP addresses, and locks a key out
+// every time its failures within the window of the policy reach a multiple of the maximum number of failures.
+// The lockout doubles every time, up to the longest lockout of the policy.
+type Guard struct {
+	event  string
+	store  Store
+	policy config.BruteForcePolicy
+	logger log.Logger
+}
+
+// NewGuard creates a new guard. The event names the security event logged when a key is locked out.
+func NewGuard(event string, store Store, policy config.BruteForcePolicy, logger log.Logger) *Guard {
+	return &Guard{event, store, policy, logger}
+}
+
+// Check returns the time left until all the given keys are unlocked, or 0 if none of them is locked.
+func (g *Guard) Check(ctx context.Context, keys ...string) (time.Duration, error) {
+	if g.policy.MaxFailures == 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, key := range keys {
+		attempts, err := g.store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		if attempts.IsLocked(now) && attempts.LockedUntil.Sub(now) > retryAfter {
+			retryAfter = attempts.LockedUntil.Sub(now)
+		}
+	}
+	return retryAfter, nil
+}
+
+// Fail records a failed attempt of the given keys, and locks out the keys reaching the maximum number of failures.
+func (g *Guard) Fail(ctx context.Context, keys ...string) error {
+	if g.policy.MaxFailures == 0 {
+		return nil
+	}
+	now := time.Now()
+	window := time.Duration(g.policy.Window) * time.Minute
+	for _, key := range keys {
+		attempts, err := g.store.Fail(ctx, key, now, window)
+		if err != nil {
+			return err
+		}
+		if attempts.Failures%g.policy.MaxFailures != 0 {
+			continue
+		}
+
+		lockout := g.lockout(attempts.Failures / g.policy.MaxFailures)
+		if err := g.store.Lock(ctx, key, now.Add(lockout)); err != nil {
+			return err
+		}
+		g.logger.With(ctx, log.SecurityEventKey, g.event, "key", key, "failures", attempts.Failures).
+			Warnf("%s locked out for %s after %d failed attempts since %s",
+				key, lockout, attempts.Failures, attempts.WindowStart.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// lockout returns the duration of the nth lockout of a key.
+func (g *Guard) lockout(n int) time.Duration {
+	if n > maxLockoutShift {
+		n = maxLockoutShift
+	}
+	lockout := time.Duration(g.policy.Lockout) * time.Minute << uint(n-1)
+	if max := time.Duration(g.policy.MaxLockout) * time.Minute; lockout > max {
+		return max
+	}
+	return lockout
+}
@@ -0,0 +1,74 @@
+package bruteforce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuard(t *testing.T) {
+	logger, entries := log.NewForTest()
+	store := NewMemoryStore()
+	policy := config.BruteForcePolicy{MaxFailures: 3, Window: 60, Lockout: 1, MaxLockout: 3}
+	guard := NewGuard("token_guessing", store, policy, logger)
+	ctx := context.Background()
+
+	lockedFor := func(key string) time.Duration {
+		attempts, _ := store.Get(ctx, key)
+		if attempts.LockedUntil == nil {
+			return 0
+		}
+		return time.Until(*attempts.LockedUntil).Round(time.Minute)
+	}
+
+	assert.Nil(t, guard.Fail(ctx, "ip:10.0.0.1", "identity:100"))
+	assert.Nil(t, guard.Fail(ctx, "ip:10.0.0.1"))
+	retryAfter, err := guard.Check(ctx, "ip:10.0.0.1", "identity:100")
+	assert.Nil(t, err)
+	assert.Zero(t, retryAfter)
+	assert.Zero(t, entries.Len())
+
+	// the third failure locks the IP address out, but not the identity
+	assert.Nil(t, guard.Fail(ctx, "ip:10.0.0.1", "identity:100"))
+	assert.Equal(t, time.Minute, lockedFor("ip:10.0.0.1"))
+	assert.Zero(t, lockedFor("identity:100"))
+	retryAfter, _ = guard.Check(ctx, "identity:100", "ip:10.0.0.1")
+	assert.InDelta(t, time.Minute, retryAfter, float64(time.Second))
+	retryAfter, _ = guard.Check(ctx, "identity:100")
+	assert.Zero(t, retryAfter)
+
+	// a security event is logged
+	if assert.Equal(t, 1, entries.Len()) {
+		entry := entries.All()[0]
+		assert.Equal(t, "WARN", entry.Level.CapitalString())
+		assert.Equal(t, "token_guessing", entry.ContextMap()[log.SecurityEventKey])
+		assert.Equal(t, "ip:10.0.0.1", entry.ContextMap()["key"])
+	}
+
+	// the lockout doubles every time, up to the longest lockout
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, guard.Fail(ctx, "ip:10.0.0.1"))
+	}
+	assert.Equal(t, 2*time.Minute, lockedFor("ip:10.0.0.1"))
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, guard.Fail(ctx, "ip:10.0.0.1"))
+	}
+	assert.Equal(t, 3*time.Minute, lockedFor("ip:10.0.0.1"))
+}
+
+func TestGuard_Disabled(t *testing.T) {
+	logger, _ := log.NewForTest()
+	guard := NewGuard("token_guessing", NewMemoryStore(), config.BruteForcePolicy{}, logger)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, guard.Fail(ctx, "ip:10.0.0.1"))
+	}
+	retryAfter, err := guard.Check(ctx, "ip:10.0.0.1")
+	assert.Nil(t, err)
+	assert.Zero(t, retryAfter)
+}
@@ -0,0 +1,71 @@
+package bruteforce
+
+import (
+	"context"
+	"net"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/errors"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+type contextKey int
+
+const attemptKey contextKey = iota
+
+// attempt records whether the handlers reported the current request as a failed attempt.
+type attempt struct {
+	failed bool
+}
+
+// Handler returns a middleware which rejects the requests of locked out callers and IP addresses with 429,
+// and records a failed attempt of both when a handler reports the request as failed via Failed.
+//
+// The middleware must run after the authentication middleware, since the caller is identified by its identity.
+// The IP address is the remote address of the connection, a reverse proxy in front of the server should rewrite
+// it from the header it sets, as headers sent by clients can not be trusted.
+func Handler(guard *Guard, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		keys := attemptKeys(c)
+		retryAfter, err := guard.Check(ctx, keys...)
+		if err != nil {
+			return err
+		}
+		if retryAfter > 0 {
+			return errors.TooManyRequests("Too many failed attempts, please retry later.", retryAfter)
+		}
+
+		current := &attempt{}
+		c.Request = c.Request.WithContext(context.WithValue(ctx, attemptKey, current))
+		err = c.Next()
+		if current.failed {
+			if err := guard.Fail(ctx, keys...); err != nil {
+				logger.With(ctx).Errorf("failed to record a failed attempt: %v", err)
+			}
+		}
+		return err
+	}
+}
+
+// Failed reports the current request as a failed attempt. It does nothing if the request is not guarded by Handler.
+func Failed(ctx context.Context) {
+	if current, ok := ctx.Value(attemptKey).(*attempt); ok {
+		current.failed = true
+	}
+}
+
+// attemptKeys returns the keys under which the attempts of the request are tracked:
+// the identity of the caller if it is authenticated, and its IP address.
+func attemptKeys(c *routing.Context) []string {
+	var keys []string
+	if identity := auth.CurrentUser(c.Request.Context()); identity != nil {
+		keys = append(keys, "identity:"+identity.GetID())
+	}
+	ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		ip = c.Request.RemoteAddr
+	}
+	return append(keys, "ip:"+ip)
+}
@@ -0,0 +1,57 @@
+package bruteforce
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/internal/errors"
+	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	logger, _ := log.NewForTest()
+	policy := config.BruteForcePolicy{MaxFailures: 2, Window: 60, Lockout: 1, MaxLockout: 60}
+	router := test.MockRouter(logger)
+	router.Post("/validate", auth.MockAuthHandler, Handler(NewGuard("token_guessing", NewMemoryStore(), policy, logger), logger),
+		func(c *routing.Context) error {
+			if c.Request.Header.Get("X-Token") != "999999" {
+				Failed(c.Request.Context())
+				return errors.NotFound("")
+			}
+			return c.Write("ok")
+		})
+
+	call := func(token, remoteAddr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/validate", nil)
+		req.Header = auth.MockAuthHeader()
+		req.Header.Set("X-Token", token)
+		req.RemoteAddr = remoteAddr
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	assert.Equal(t, http.StatusNotFound, call("111111", "10.0.0.1:1234").Code)
+	// successful attempts are not counted, and do not reset the failures
+	assert.Equal(t, http.StatusOK, call("999999", "10.0.0.1:1234").Code)
+	assert.Equal(t, http.StatusNotFound, call("222222", "10.0.0.1:1234").Code)
+
+	// the caller is locked out, even with a valid token
+	res := call("999999", "10.0.0.1:1234")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "60", res.Header().Get("Retry-After"))
+	// the identity of the caller is locked out from any IP address
+	assert.Equal(t, http.StatusTooManyRequests, call("999999", "10.0.0.2:1234").Code)
+}
+
+func TestFailed(t *testing.T) {
+	// Failed does nothing for the requests which are not guarded
+	req, _ := http.NewRequest("POST", "/validate", nil)
+	Failed(req.Context())
+}
@@ -0,0 +1,154 @@
+package bruteforce
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"sync"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// Attempts represents the failed attempts of a caller or an IP address.
+type Attempts struct {
+	Key string `db:"key"`
+	// Failures is the number of failures since WindowStart.
+	Failures    int        `db:"failures"`
+	WindowStart time.Time  `db:"window_start"`
+	LockedUntil *time.Time `db:"locked_until"`
+}
+
+// IsLocked reports whether the attempts are locked out at the given time.
+func (a Attempts) IsLocked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+// Store keeps the failed attempts of callers and IP addresses.
+type Store interface {
+	// Get returns the failed attempts of the key. Empty attempts are returned for an unknown key.
+	Get(ctx context.Context, key string) (Attempts, error)
+	// Fail records a failure of the key and returns the updated attempts. The failures are counted again
+	// from 1 if the window started more than window ago.
+	Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Attempts, error)
+	// Lock locks the key out until the given time.
+	Lock(ctx context.Context, key string, until time.Time) error
+}
+
+// store persists failed attempts in database, so that they are shared by all the server instances
+type store struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewStore creates a new failed attempt store backed by the database
+func NewStore(db *dbcontext.DB, logger log.Logger) Store {
+	return store{db, logger}
+}
+
+// Get returns the failed attempts of the key.
+func (s store) Get(ctx context.Context, key string) (Attempts, error) {
+	var attempts Attempts
+	err := s.db.With(ctx).Select().
+		From("failed_attempts").
+		Where(dbx.HashExp{"key": key}).
+		One(&attempts)
+	if stderrors.Is(err, sql.ErrNoRows) {
+		return Attempts{Key: key}, nil
+	}
+	return attempts, err
+}
+
+// Fail records a failure of the key and returns the updated attempts.
+// The attempts which are neither counted nor locked anymore are removed on the way.
+func (s store) Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Attempts, error) {
+	var attempts Attempts
+	err := s.db.With(ctx).
+		NewQuery(`INSERT INTO failed_attempts (key, failures, window_start) VALUES ({:key}, 1, {:now})
+			ON CONFLICT (key) DO UPDATE SET
+				failures = CASE WHEN failed_attempts.window_start < {:expired} THEN 1 ELSE failed_attempts.failures + 1 END,
+				window_start = CASE WHEN failed_attempts.window_start < {:expired} THEN {:now} ELSE failed_attempts.window_start END
+			RETURNING *`).
+		Bind(dbx.Params{"key": key, "now": now, "expired": now.Add(-window)}).
+		One(&attempts)
+	if err != nil {
+		return Attempts{}, err
+	}
+
+	_, err = s.db.With(ctx).Delete("failed_attempts", dbx.And(
+		dbx.NewExp("window_start < {:expired}", dbx.Params{"expired": now.Add(-window)}),
+		dbx.Or(dbx.HashExp{"locked_until": nil}, dbx.NewExp("locked_until < {:now}", dbx.Params{"now": now})),
+	)).Execute()
+	if err != nil {
+		s.logger.With(ctx).Errorf("failed to remove expired failed attempts: %v", err)
+	}
+	return attempts, nil
+}
+
+// Lock locks the key out until the given time.
+func (s store) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.db.With(ctx).Update("failed_attempts", dbx.Params{"locked_until": until}, dbx.HashExp{"key": key}).Execute()
+	return err
+}
+
+// memoryStore keeps failed attempts in memory, which only covers the attempts reaching the same server instance.
+type memoryStore struct {
+	mu       sync.Mutex
+	attempts map[string]Attempts
+	pruned   time.Time
+}
+
+// NewMemoryStore creates a failed attempt store which keeps the attempts in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{attempts: map[string]Attempts{}}
+}
+
+// Get returns the failed attempts of the key.
+func (m *memoryStore) Get(ctx context.Context, key string) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if attempts, ok := m.attempts[key]; ok {
+		return attempts, nil
+	}
+	return Attempts{Key: key}, nil
+}
+
+// Fail records a failure of the key and returns the updated attempts.
+func (m *memoryStore) Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := now.Add(-window)
+	// the attempts which are neither counted nor locked anymore are removed once a minute at most
+	if now.Sub(m.pruned) > time.Minute {
+		for k, attempts := range m.attempts {
+			if attempts.WindowStart.Before(expired) && !attempts.IsLocked(now) {
+				delete(m.attempts, k)
+			}
+		}
+		m.pruned = now
+	}
+
+	attempts, ok := m.attempts[key]
+	if !ok || attempts.WindowStart.Before(expired) {
+		attempts.Key, attempts.Failures, attempts.WindowStart = key, 0, now
+	}
+	attempts.Failures++
+	m.attempts[key] = attempts
+	return attempts, nil
+}
+
+// Lock locks the key out until the given time.
+func (m *memoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if attempts, ok := m.attempts[key]; ok {
+		attempts.LockedUntil = &until
+		m.attempts[key] = attempts
+	}
+	return nil
+}
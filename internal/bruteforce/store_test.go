@@ -0,0 +1,50 @@
+package bruteforce
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestStore(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "failed_attempts")
+	testStore(t, NewStore(db, logger))
+}
+
+// testStore checks the behavior shared by all the store backends.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	attempts, err := store.Get(ctx, "ip:10.0.0.1")
+	assert.Nil(t, err)
+	assert.Zero(t, attempts.Failures)
+	assert.False(t, attempts.IsLocked(now))
+
+	attempts, err = store.Fail(ctx, "ip:10.0.0.1", now, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+	attempts, _ = store.Fail(ctx, "ip:10.0.0.1", now.Add(time.Minute), time.Hour)
+	assert.Equal(t, 2, attempts.Failures)
+	assert.True(t, now.Equal(attempts.WindowStart))
+
+	assert.Nil(t, store.Lock(ctx, "ip:10.0.0.1", now.Add(time.Minute)))
+	attempts, _ = store.Get(ctx, "ip:10.0.0.1")
+	assert.True(t, attempts.IsLocked(now))
+	assert.False(t, attempts.IsLocked(now.Add(time.Minute)))
+
+	// the failures are counted again once the window has passed
+	attempts, _ = store.Fail(ctx, "ip:10.0.0.1", now.Add(2*time.Hour), time.Hour)
+	assert.Equal(t, 1, attempts.Failures)
+	assert.True(t, now.Add(2*time.Hour).Equal(attempts.WindowStart))
+}
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"errors"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/pauluswi/tulip/pkg/log"
@@ -12,6 +15,35 @@ import (
 const (
 	defaultServerPort         = 8080
 	defaultJWTExpirationHours = 72
+	defaultAccessTokenMinutes = 15
+	defaultTokenLength        = 6
+	defaultTokenAlphabet      = "123456789"
+	defaultTokenTTLMinutes    = 24 * 60
+	defaultTokenTimeZone      = "UTC"
+	defaultTokenMaxRetries    = 5
+	defaultTokenFallbackExtra = 2
+	defaultTokenPoolSize      = 5000
+	defaultTokenPoolLowWater  = 1000
+	defaultTokenPoolDays      = 2
+	defaultTokenPoolInterval  = 10
+	defaultTokenPoolBatchSize = 500
+	defaultSweeperInterval    = 5
+	defaultSweeperBatchSize   = 1000
+	defaultSweeperRetention   = 90
+	defaultSweeperAction      = "archive"
+	defaultCacheSize          = 10000
+	defaultCacheTTL           = 60
+	defaultCacheTimeout       = 100
+	defaultLoginMaxAttempts   = 5
+	defaultLoginLockout       = 15
+	defaultMerchantAuth       = "jwt"
+	defaultPayTokenStore      = "postgres"
+	defaultSignatureMaxSkew   = 300
+	defaultIdempotencyTTL     = 24
+	defaultBruteForceFailures = 10
+	defaultBruteForceWindow   = 60
+	defaultBruteForceLockout  = 1
+	defaultBruteForceMaxLock  = 60
 )
 
 // Config represents an application configuration.
@@ -20,26 +52,447 @@ type Config struct {
 	ServerPort int `yaml:"server_port" env:"SERVER_PORT"`
 	// the data source name (DSN) for connecting to the database. required.
 	DSN string `yaml:"dsn" env:"DSN,secret"`
-	// JWT signing key. required.
+	// whether the server applies the pending database migrations at startup. The server instances starting together
+	// apply each migration once. Defaults to false
+	AutoMigrate bool `yaml:"auto_migrate" env:"AUTO_MIGRATE"`
+	// where the payment tokens are stored: "postgres" in the database, or "memory" in the server process, which
+	// only suits tests and local development as the tokens are lost on restart. The idempotency keys, brute force
+	// counters and request nonces are then kept in memory too, the server still needs the database for the users,
+	// clients, sessions, signing keys and revoked tokens. Defaults to "postgres"
+	PayTokenStore string `yaml:"paytoken_store" env:"PAYTOKEN_STORE"`
+	// JWT signing key used with HS256. required unless JWTKeys is set.
 	JWTSigningKey string `yaml:"jwt_signing_key" env:"JWT_SIGNING_KEY,secret"`
-	// JWT expiration in hours. Defaults to 72 hours (3 days)
+	// the keys used to sign and verify JWTs with RS256 or ES256, which replace the HS256 signing key when set.
+	// The environment variable holds the keys in JSON format.
+	JWTKeys []JWTKey `yaml:"jwt_keys" env:"JWT_KEYS,secret"`
+	// the ID of the key in JWTKeys which signs new JWTs. The other keys only verify JWTs signed before a rotation.
+	JWTActiveKeyID string `yaml:"jwt_active_kid" env:"JWT_ACTIVE_KID"`
+	// the secret key signing the cursors of the paginated lists. When empty, a random key is generated at startup,
+	// so that the cursors neither survive a restart nor work across server instances.
+	CursorSigningKey string `yaml:"cursor_signing_key" env:"CURSOR_SIGNING_KEY,secret"`
+	// login session expiration in hours, after which the refresh token can not be used anymore.
+	// Defaults to 72 hours (3 days)
 	JWTExpiration int `yaml:"jwt_expiration" env:"JWT_EXPIRATION"`
+	// access token (JWT) expiration in minutes. Defaults to 15 minutes
+	AccessTokenExpiration int `yaml:"access_token_expiration" env:"ACCESS_TOKEN_EXPIRATION"`
+	// the number of consecutive failed logins after which a user is locked out. Defaults to 5
+	LoginMaxAttempts int `yaml:"login_max_attempts" env:"LOGIN_MAX_ATTEMPTS"`
+	// the duration of a login lockout in minutes. Defaults to 15 minutes
+	LoginLockout int `yaml:"login_lockout" env:"LOGIN_LOCKOUT"`
+	// how merchants authenticate the validate and redeem calls: "jwt", "signature", "jwt_or_signature" or
+	// "jwt_and_signature". Defaults to "jwt"
+	MerchantAuth string `yaml:"merchant_auth" env:"MERCHANT_AUTH"`
+	// the maximum difference in seconds between the timestamp of a signed request and the server clock.
+	// Defaults to 300 seconds (5 minutes)
+	SignatureMaxSkew int `yaml:"signature_max_skew" env:"SIGNATURE_MAX_SKEW"`
+	// the number of hours during which a request retried with the same Idempotency-Key header replays the response
+	// of the original request. Defaults to 24 hours
+	IdempotencyTTL int `yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL"`
+	// the rules used to generate payment tokens. The environment variable holds the policy in JSON format.
+	TokenPolicy TokenPolicy `yaml:"token_policy" env:"TOKEN_POLICY"`
+	// the lockout of the callers and IP addresses failing to validate tokens. The environment variable holds the
+	// policy in JSON format.
+	BruteForce BruteForcePolicy `yaml:"brute_force" env:"BRUTE_FORCE"`
+	// the job expiring and archiving payment tokens. The environment variable holds the policy in JSON format.
+	Sweeper SweeperPolicy `yaml:"sweeper" env:"SWEEPER"`
+	// the cache of the payment tokens looked up by validations. The environment variable holds the policy
+	// in JSON format.
+	Cache CachePolicy `yaml:"cache" env:"CACHE,secret"`
+}
+
+// CachePolicy represents the cache of the payment tokens of the day, which spares a database lookup to most
+// validations.
+type CachePolicy struct {
+	// where the tokens are cached: "" disables the cache, "memory" keeps them in an LRU of every server instance,
+	// "redis" in a Redis compatible server shared by the instances. Defaults to ""
+	Store string `yaml:"store" json:"store"`
+	// the number of tokens kept by the memory store. Defaults to 10000
+	Size int `yaml:"size" json:"size"`
+	// the number of seconds a token is cached, which bounds how long a token changed by another server instance
+	// may be seen with its previous status. Defaults to 60
+	TTL int `yaml:"ttl" json:"ttl"`
+	// the address (host:port) of the Redis server
+	Address string `yaml:"address" json:"address"`
+	// the password of the Redis server, if any
+	Password string `yaml:"password" json:"password"`
+	// the Redis database number. Defaults to 0
+	DB int `yaml:"db" json:"db"`
+	// the timeout of the Redis commands in milliseconds. Defaults to 100
+	Timeout int `yaml:"timeout" json:"timeout"`
+}
+
+// DefaultCachePolicy returns the cache policy used when the configuration does not override it.
+func DefaultCachePolicy() CachePolicy {
+	return CachePolicy{
+		Size:    defaultCacheSize,
+		TTL:     defaultCacheTTL,
+		Timeout: defaultCacheTimeout,
+	}
+}
+
+// Validate validates the cache policy.
+func (p CachePolicy) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.Store, validation.In("memory", "redis")),
+		validation.Field(&p.Size, validation.When(p.Store == "memory", validation.Required), validation.Min(1)),
+		validation.Field(&p.TTL, validation.When(p.Store != "", validation.Required), validation.Min(1)),
+		validation.Field(&p.Address, validation.When(p.Store == "redis", validation.Required)),
+		validation.Field(&p.DB, validation.Min(0)),
+		validation.Field(&p.Timeout, validation.When(p.Store == "redis", validation.Required), validation.Min(1)),
+	)
+}
+
+// TTLDuration returns how long a token is cached as a time.Duration.
+func (p CachePolicy) TTLDuration() time.Duration {
+	return time.Duration(p.TTL) * time.Second
+}
+
+// TimeoutDuration returns the timeout of the Redis commands as a time.Duration.
+func (p CachePolicy) TimeoutDuration() time.Duration {
+	return time.Duration(p.Timeout) * time.Millisecond
+}
+
+// SweeperPolicy represents the job which marks the payment tokens past their validity as expired, and archives
+// or deletes the payment tokens older than the retention period.
+type SweeperPolicy struct {
+	// whether the server runs the job in-process, rather than leaving it to the sweeper command. Defaults to false
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// the interval in minutes between two runs of the job. Defaults to 5
+	Interval int `yaml:"interval" json:"interval"`
+	// the number of tokens changed per database statement. Defaults to 1000
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+	// the number of days the tokens are kept after their token day, 0 keeps them forever. Defaults to 90
+	Retention int `yaml:"retention" json:"retention"`
+	// what happens to the tokens older than the retention period: "archive" moves them to the archive table,
+	// "delete" deletes them. Defaults to "archive"
+	RetentionAction string `yaml:"retention_action" json:"retention_action"`
+}
+
+// DefaultSweeperPolicy returns the sweeper policy used when the configuration does not override it.
+func DefaultSweeperPolicy() SweeperPolicy {
+	return SweeperPolicy{
+		Interval:        defaultSweeperInterval,
+		BatchSize:       defaultSweeperBatchSize,
+		Retention:       defaultSweeperRetention,
+		RetentionAction: defaultSweeperAction,
+	}
+}
+
+// Validate validates the sweeper policy.
+func (p SweeperPolicy) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.Interval, validation.Required, validation.Min(1)),
+		validation.Field(&p.BatchSize, validation.Required, validation.Min(1), validation.Max(100000)),
+		validation.Field(&p.Retention, validation.Min(0)),
+		validation.Field(&p.RetentionAction, validation.Required, validation.In("archive", "delete")),
+	)
+}
+
+// IntervalDuration returns the interval between two runs of the job as a time.Duration.
+func (p SweeperPolicy) IntervalDuration() time.Duration {
+	return time.Duration(p.Interval) * time.Minute
+}
+
+// BruteForcePolicy represents the lockout of the callers which keep failing an attempt, e.g. guessing tokens.
+// A caller is locked out every time its failures within the window reach a multiple of MaxFailures,
+// and the lockout doubles every time.
+type BruteForcePolicy struct {
+	// the number of failures after which a caller is locked out, 0 disables the lockout. Defaults to 10
+	MaxFailures int `yaml:"max_failures" json:"max_failures"`
+	// the window in minutes within which failures are counted, starting with the first failure. Defaults to 60
+	Window int `yaml:"window" json:"window"`
+	// the first lockout in minutes. Defaults to 1
+	Lockout int `yaml:"lockout" json:"lockout"`
+	// the longest lockout in minutes. Defaults to 60
+	MaxLockout int `yaml:"max_lockout" json:"max_lockout"`
+}
+
+// DefaultBruteForcePolicy returns the brute force policy used when the configuration does not override it.
+func DefaultBruteForcePolicy() BruteForcePolicy {
+	return BruteForcePolicy{
+		MaxFailures: defaultBruteForceFailures,
+		Window:      defaultBruteForceWindow,
+		Lockout:     defaultBruteForceLockout,
+		MaxLockout:  defaultBruteForceMaxLock,
+	}
+}
+
+// Validate validates the brute force policy.
+func (p BruteForcePolicy) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.MaxFailures, validation.Min(0)),
+		validation.Field(&p.Window, validation.When(p.MaxFailures > 0, validation.Required), validation.Min(1)),
+		validation.Field(&p.Lockout, validation.When(p.MaxFailures > 0, validation.Required), validation.Min(1)),
+		validation.Field(&p.MaxLockout, validation.When(p.MaxFailures > 0, validation.Required), validation.Min(p.Lockout)),
+	)
+}
+
+// JWTKey represents an asymmetric key used to sign or verify JWTs.
+// A key is given either by its private key, or by its public key if it is only used to verify JWTs.
+type JWTKey struct {
+	// the key ID, sent in the "kid" header of the JWTs signed by the key. required.
+	ID string `yaml:"kid" json:"kid"`
+	// the signing algorithm, either "RS256" or "ES256". required.
+	Algorithm string `yaml:"algorithm" json:"algorithm"`
+	// the PEM encoded private key
+	PrivateKey string `yaml:"private_key" json:"private_key"`
+	// the path of a file holding the PEM encoded private key
+	PrivateKeyFile string `yaml:"private_key_file" json:"private_key_file"`
+	// the PEM encoded public key
+	PublicKey string `yaml:"public_key" json:"public_key"`
+	// the path of a file holding the PEM encoded public key
+	PublicKeyFile string `yaml:"public_key_file" json:"public_key_file"`
+}
+
+// Validate validates the JWT key.
+func (k JWTKey) Validate() error {
+	sources := 0
+	for _, source := range []string{k.PrivateKey, k.PrivateKeyFile, k.PublicKey, k.PublicKeyFile} {
+		if source != "" {
+			sources++
+		}
+	}
+	return validation.ValidateStruct(&k,
+		validation.Field(&k.ID, validation.Required),
+		validation.Field(&k.Algorithm, validation.Required, validation.In("RS256", "ES256")),
+		validation.Field(&k.PrivateKey, validation.By(func(interface{}) error {
+			if sources != 1 {
+				return errors.New("exactly one of private_key, private_key_file, public_key and public_key_file is required")
+			}
+			return nil
+		})),
+	)
+}
+
+// TokenPolicy represents the rules used to generate payment tokens.
+type TokenPolicy struct {
+	// the number of characters of a token. Defaults to 6
+	Length int `yaml:"length" json:"length"`
+	// the characters a token is made of. Defaults to "123456789"
+	Alphabet string `yaml:"alphabet" json:"alphabet"`
+	// the token time-to-live in minutes. Defaults to 1440 (24 hours)
+	TTL int `yaml:"ttl" json:"ttl"`
+	// the time zone whose midnight ends the token day, a token is never valid beyond it. Defaults to UTC
+	TimeZone string `yaml:"time_zone" json:"time_zone"`
+	// the number of attempts to generate a token which is unique for the day. Defaults to 5
+	MaxRetries int `yaml:"max_retries" json:"max_retries"`
+	// the check digit algorithm appended to tokens, either "luhn" or "damm". Defaults to none.
+	// The check digit is part of the token length and requires a numeric alphabet.
+	CheckDigit string `yaml:"check_digit" json:"check_digit"`
+	// the maximum number of usable (active or validated) tokens of a customer, 0 for no limit. Defaults to 0
+	MaxActive int `yaml:"max_active" json:"max_active"`
+	// the maximum number of tokens generated for a customer within a minute, 0 for no limit. Defaults to 0
+	MaxPerMinute int `yaml:"max_per_minute" json:"max_per_minute"`
+	// the maximum number of tokens generated for a customer within a token day, 0 for no limit. Defaults to 0
+	MaxPerDay int `yaml:"max_per_day" json:"max_per_day"`
+	// the share of the tokens of a token day already issued, between 0 and 1, from which tokens are generated with
+	// the fallback length and alphabet, 0 disables the fallback. Defaults to 0
+	MaxFillRatio float64 `yaml:"max_fill_ratio" json:"max_fill_ratio"`
+	// the number of characters of the tokens generated once the fill ratio is reached.
+	// Defaults to 2 characters more than the length, up to 10
+	FallbackLength int `yaml:"fallback_length" json:"fallback_length"`
+	// the characters of the tokens generated once the fill ratio is reached. Defaults to the alphabet
+	FallbackAlphabet string `yaml:"fallback_alphabet" json:"fallback_alphabet"`
+	// the pool of tokens reserved in advance. Disabled by default
+	Pool TokenPoolPolicy `yaml:"pool" json:"pool"`
+}
+
+// TokenPoolPolicy represents the pool of tokens reserved in advance for the upcoming token days, from which tokens
+// are claimed instead of being generated and inserted until they do not collide with the tokens already issued.
+type TokenPoolPolicy struct {
+	// whether tokens are claimed from the pool. Defaults to false
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// the number of tokens the pool is refilled to for each token day. Defaults to 5000
+	Size int `yaml:"size" json:"size"`
+	// the number of tokens left for a token day below which the pool is refilled. Defaults to 1000
+	LowWater int `yaml:"low_water" json:"low_water"`
+	// the number of token days the pool is filled for, starting with today. Defaults to 2
+	Days int `yaml:"days" json:"days"`
+	// the interval in seconds between two checks of the pool. Defaults to 10
+	Interval int `yaml:"interval" json:"interval"`
+	// the number of tokens reserved per database statement. Defaults to 500
+	BatchSize int `yaml:"batch_size" json:"batch_size"`
+}
+
+// Validate validates the token pool policy.
+func (p TokenPoolPolicy) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.Size, validation.When(p.Enabled, validation.Required), validation.Min(0)),
+		validation.Field(&p.LowWater, validation.Min(0), validation.Max(p.Size)),
+		validation.Field(&p.Days, validation.When(p.Enabled, validation.Required), validation.Min(0), validation.Max(7)),
+		validation.Field(&p.Interval, validation.When(p.Enabled, validation.Required), validation.Min(0)),
+		validation.Field(&p.BatchSize, validation.When(p.Enabled, validation.Required), validation.Min(0), validation.Max(10000)),
+	)
+}
+
+// IntervalDuration returns the interval between two checks of the pool as a time.Duration.
+func (p TokenPoolPolicy) IntervalDuration() time.Duration {
+	return time.Duration(p.Interval) * time.Second
+}
+
+// DefaultTokenPolicy returns the token policy used when the configuration does not override it.
+func DefaultTokenPolicy() TokenPolicy {
+	return TokenPolicy{
+		Length:     defaultTokenLength,
+		Alphabet:   defaultTokenAlphabet,
+		TTL:        defaultTokenTTLMinutes,
+		TimeZone:   defaultTokenTimeZone,
+		MaxRetries: defaultTokenMaxRetries,
+		Pool: TokenPoolPolicy{
+			Size:      defaultTokenPoolSize,
+			LowWater:  defaultTokenPoolLowWater,
+			Days:      defaultTokenPoolDays,
+			Interval:  defaultTokenPoolInterval,
+			BatchSize: defaultTokenPoolBatchSize,
+		},
+	}
+}
+
+// Validate validates the token policy.
+func (p TokenPolicy) Validate() error {
+	return validation.ValidateStruct(&p,
+		// the token column allows up to 10 characters
+		validation.Field(&p.Length, validation.Required, validation.Min(4), validation.Max(10)),
+		validation.Field(&p.Alphabet, validation.Required, validation.Length(2, 0), validation.By(alphabet)),
+		validation.Field(&p.TTL, validation.Required, validation.Min(1)),
+		validation.Field(&p.TimeZone, validation.Required, validation.By(timeZone)),
+		validation.Field(&p.MaxRetries, validation.Required, validation.Min(1)),
+		validation.Field(&p.MaxActive, validation.Min(0)),
+		validation.Field(&p.MaxPerMinute, validation.Min(0)),
+		validation.Field(&p.MaxPerDay, validation.Min(0)),
+		validation.Field(&p.MaxFillRatio, validation.Min(0.0), validation.Max(1.0)),
+		validation.Field(&p.FallbackLength, validation.Min(0), validation.Max(10),
+			validation.When(p.MaxFillRatio > 0, validation.By(func(interface{}) error {
+				length, alphabet := p.Fallback()
+				if length < p.Length || length == p.Length && len(alphabet) <= len(p.Alphabet) {
+					return errors.New("must be longer than the length, unless the fallback alphabet is larger than the alphabet")
+				}
+				return nil
+			}))),
+		validation.Field(&p.FallbackAlphabet, validation.By(alphabet)),
+		validation.Field(&p.Pool),
+		validation.Field(&p.CheckDigit, validation.In("luhn", "damm"),
+			validation.When(p.CheckDigit != "", validation.By(func(interface{}) error {
+				if strings.Trim(p.Alphabet+p.FallbackAlphabet, "0123456789") != "" {
+					return errors.New("requires alphabets of decimal digits")
+				}
+				return nil
+			}))),
+	)
+}
+
+// TTLDuration returns the token time-to-live as a time.Duration.
+func (p TokenPolicy) TTLDuration() time.Duration {
+	return time.Duration(p.TTL) * time.Minute
+}
+
+// Fallback returns the length and the alphabet of the tokens generated once the fill ratio of a token day is reached.
+func (p TokenPolicy) Fallback() (int, string) {
+	length, alphabet := p.FallbackLength, p.FallbackAlphabet
+	if length == 0 {
+		length = p.Length + defaultTokenFallbackExtra
+		if length > 10 {
+			length = 10
+		}
+	}
+	if alphabet == "" {
+		alphabet = p.Alphabet
+	}
+	return length, alphabet
+}
+
+// Location returns the time zone which defines the token day. UTC is returned if the time zone is unknown.
+func (p TokenPolicy) Location() *time.Location {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
 }
 
 // Validate validates the application configuration.
 func (c Config) Validate() error {
 	return validation.ValidateStruct(&c,
 		validation.Field(&c.DSN, validation.Required),
-		validation.Field(&c.JWTSigningKey, validation.Required),
+		validation.Field(&c.PayTokenStore, validation.In("postgres", "memory"), validation.When(c.PayTokenStore == "memory", validation.By(func(interface{}) error {
+			// the token pool and the sweeper work on the tokens stored in the database
+			if c.TokenPolicy.Pool.Enabled {
+				return errors.New("must be postgres when the token pool is enabled")
+			}
+			if c.Sweeper.Enabled {
+				return errors.New("must be postgres when the sweeper is enabled")
+			}
+			return nil
+		}))),
+		validation.Field(&c.JWTSigningKey, validation.When(len(c.JWTKeys) == 0, validation.Required)),
+		validation.Field(&c.JWTKeys),
+		validation.Field(&c.JWTActiveKeyID, validation.When(len(c.JWTKeys) > 0, validation.Required, validation.By(func(interface{}) error {
+			for _, key := range c.JWTKeys {
+				if key.ID == c.JWTActiveKeyID {
+					if key.PrivateKey == "" && key.PrivateKeyFile == "" {
+						return errors.New("must refer to a key with a private key")
+					}
+					return nil
+				}
+			}
+			return errors.New("must refer to one of the jwt_keys")
+		}))),
+		validation.Field(&c.JWTExpiration, validation.Min(1)),
+		validation.Field(&c.AccessTokenExpiration, validation.Min(1)),
+		validation.Field(&c.LoginMaxAttempts, validation.Min(0)),
+		validation.Field(&c.LoginLockout, validation.Min(0)),
+		validation.Field(&c.MerchantAuth, validation.Required, validation.In("jwt", "signature", "jwt_or_signature", "jwt_and_signature")),
+		validation.Field(&c.SignatureMaxSkew, validation.Min(1)),
+		validation.Field(&c.IdempotencyTTL, validation.Min(1)),
+		validation.Field(&c.TokenPolicy),
+		validation.Field(&c.BruteForce),
+		validation.Field(&c.Sweeper),
+		validation.Field(&c.Cache),
 	)
 }
 
+// alphabet checks that a string is made of distinct printable ASCII characters.
+func alphabet(value interface{}) error {
+	s, _ := value.(string)
+	seen := map[rune]bool{}
+	for _, c := range s {
+		if c < '!' || c > '~' {
+			return errors.New("must only contain printable ASCII characters")
+		}
+		if seen[c] {
+			return errors.New("must not contain duplicate characters")
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// timeZone checks that a string is a known IANA time zone name.
+func timeZone(value interface{}) error {
+	s, _ := value.(string)
+	if _, err := time.LoadLocation(s); err != nil {
+		return errors.New("must be a valid time zone name")
+	}
+	return nil
+}
+
 // Load returns an application configuration which is populated from the given configuration file and environment variables.
 func Load(file string, logger log.Logger) (*Config, error) {
 	// default config
 	c := Config{
-		ServerPort:    defaultServerPort,
-		JWTExpiration: defaultJWTExpirationHours,
+		ServerPort:            defaultServerPort,
+		JWTExpiration:         defaultJWTExpirationHours,
+		AccessTokenExpiration: defaultAccessTokenMinutes,
+		LoginMaxAttempts:      defaultLoginMaxAttempts,
+		LoginLockout:          defaultLoginLockout,
+		MerchantAuth:          defaultMerchantAuth,
+		PayTokenStore:         defaultPayTokenStore,
+		SignatureMaxSkew:      defaultSignatureMaxSkew,
+		IdempotencyTTL:        defaultIdempotencyTTL,
+		TokenPolicy:           DefaultTokenPolicy(),
+		BruteForce:            DefaultBruteForcePolicy(),
+		Sweeper:               DefaultSweeperPolicy(),
+		Cache:                 DefaultCachePolicy(),
 	}
 
 	// load from YAML config file
@@ -0,0 +1,255 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	logger, _ := log.NewForTest()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "app.yml")
+	content := "dsn: \"postgres://127.0.0.1/test\"\nauto_migrate: true\njwt_signing_key: \"test\"\ntoken_policy:\n  length: 8\n  time_zone: \"Asia/Jakarta\"\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(file, logger)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 8, cfg.TokenPolicy.Length)
+		assert.Equal(t, "Asia/Jakarta", cfg.TokenPolicy.TimeZone)
+		// settings which are not overridden keep their defaults
+		assert.Equal(t, defaultTokenAlphabet, cfg.TokenPolicy.Alphabet)
+		assert.Equal(t, defaultTokenMaxRetries, cfg.TokenPolicy.MaxRetries)
+		// the customer limits are opt-in
+		assert.Zero(t, cfg.TokenPolicy.MaxActive)
+		assert.Zero(t, cfg.TokenPolicy.MaxPerMinute)
+		assert.Zero(t, cfg.TokenPolicy.MaxPerDay)
+		assert.Zero(t, cfg.TokenPolicy.MaxFillRatio)
+		assert.Equal(t, "postgres", cfg.PayTokenStore)
+		assert.True(t, cfg.AutoMigrate)
+	}
+
+	_, err = Load(filepath.Join(dir, "unknown.yml"), logger)
+	assert.NotNil(t, err)
+}
+
+func TestTokenPolicy_Validate(t *testing.T) {
+	policy := DefaultTokenPolicy()
+	assert.Nil(t, policy.Validate())
+	assert.Equal(t, 24*time.Hour, policy.TTLDuration())
+	assert.Equal(t, time.UTC, policy.Location())
+
+	policy = DefaultTokenPolicy()
+	policy.Length = 11
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultTokenPolicy()
+	policy.Alphabet = "1123"
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultTokenPolicy()
+	policy.Alphabet = "12 3"
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultTokenPolicy()
+	policy.TimeZone = "Mars/Olympus_Mons"
+	assert.NotNil(t, policy.Validate())
+	assert.Equal(t, time.UTC, policy.Location())
+
+	policy = DefaultTokenPolicy()
+	policy.MaxRetries = 0
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultTokenPolicy()
+	policy.CheckDigit = "damm"
+	assert.Nil(t, policy.Validate())
+	policy.CheckDigit = "verhoeff"
+	assert.NotNil(t, policy.Validate())
+	policy.CheckDigit = "luhn"
+	policy.Alphabet = "ABCDEF"
+	assert.NotNil(t, policy.Validate())
+}
+
+func TestTokenPoolPolicy_Validate(t *testing.T) {
+	policy := DefaultTokenPolicy().Pool
+	assert.Nil(t, policy.Validate())
+	assert.Equal(t, 10*time.Second, policy.IntervalDuration())
+	policy.Enabled = true
+	assert.Nil(t, policy.Validate())
+
+	policy.LowWater = policy.Size + 1
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultTokenPolicy().Pool
+	policy.Enabled, policy.Days = true, 0
+	assert.NotNil(t, policy.Validate())
+	policy.Days = 8
+	assert.NotNil(t, policy.Validate())
+
+	// a disabled pool needs no settings
+	assert.Nil(t, TokenPoolPolicy{}.Validate())
+	assert.NotNil(t, TokenPoolPolicy{Enabled: true}.Validate())
+}
+
+func TestTokenPolicy_Fallback(t *testing.T) {
+	policy := DefaultTokenPolicy()
+	policy.MaxFillRatio = 0.5
+	length, alphabet := policy.Fallback()
+	assert.Equal(t, 8, length)
+	assert.Equal(t, defaultTokenAlphabet, alphabet)
+
+	// the fallback length never exceeds the token column
+	policy.Length = 9
+	length, _ = policy.Fallback()
+	assert.Equal(t, 10, length)
+	assert.Nil(t, policy.Validate())
+
+	// the fallback keyspace must be larger
+	policy.Length = 10
+	assert.NotNil(t, policy.Validate())
+	policy.FallbackAlphabet = "0123456789"
+	assert.Nil(t, policy.Validate())
+	policy.MaxFillRatio = 0
+	policy.FallbackAlphabet = ""
+	assert.Nil(t, policy.Validate())
+
+	policy = DefaultTokenPolicy()
+	policy.MaxFillRatio = 0.5
+	policy.FallbackLength = 5
+	assert.NotNil(t, policy.Validate())
+	policy.FallbackLength = 11
+	assert.NotNil(t, policy.Validate())
+	policy.FallbackLength = 6
+	policy.FallbackAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	length, alphabet = policy.Fallback()
+	assert.Equal(t, 6, length)
+	assert.Equal(t, "23456789ABCDEFGHJKMNPQRSTUVWXYZ", alphabet)
+	assert.Nil(t, policy.Validate())
+	policy.CheckDigit = "luhn"
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultTokenPolicy()
+	policy.MaxFillRatio = 1.5
+	assert.NotNil(t, policy.Validate())
+}
+
+func TestConfig_ValidateJWTKeys(t *testing.T) {
+	c := Config{DSN: "dsn", JWTSigningKey: "test", JWTExpiration: 72, AccessTokenExpiration: 15, MerchantAuth: "jwt", TokenPolicy: DefaultTokenPolicy(), Sweeper: DefaultSweeperPolicy()}
+	assert.Nil(t, c.Validate())
+
+	// asymmetric keys replace the signing key
+	c.JWTSigningKey = ""
+	assert.NotNil(t, c.Validate())
+	c.JWTKeys = []JWTKey{
+		{ID: "2026-10", Algorithm: "ES256", PrivateKeyFile: "2026-10.pem"},
+		{ID: "2026-07", Algorithm: "RS256", PublicKeyFile: "2026-07.pub"},
+	}
+	assert.NotNil(t, c.Validate())
+	c.JWTActiveKeyID = "2026-10"
+	assert.Nil(t, c.Validate())
+
+	// only a key with a private key can sign
+	c.JWTActiveKeyID = "2026-07"
+	assert.NotNil(t, c.Validate())
+	c.JWTActiveKeyID = "unknown"
+	assert.NotNil(t, c.Validate())
+
+	c.JWTActiveKeyID = "2026-10"
+	c.JWTKeys[1].Algorithm = "HS256"
+	assert.NotNil(t, c.Validate())
+	c.JWTKeys[1] = JWTKey{ID: "2026-07", Algorithm: "RS256", PublicKey: "key", PublicKeyFile: "2026-07.pub"}
+	assert.NotNil(t, c.Validate())
+}
+
+func TestConfig_ValidatePayTokenStore(t *testing.T) {
+	c := Config{DSN: "dsn", JWTSigningKey: "test", JWTExpiration: 72, AccessTokenExpiration: 15, MerchantAuth: "jwt", TokenPolicy: DefaultTokenPolicy(), Sweeper: DefaultSweeperPolicy()}
+	c.PayTokenStore = "memory"
+	assert.Nil(t, c.Validate())
+	c.PayTokenStore = "redis"
+	assert.NotNil(t, c.Validate())
+
+	// the token pool and the sweeper need the tokens in the database
+	c.PayTokenStore = "memory"
+	c.TokenPolicy.Pool.Enabled = true
+	assert.NotNil(t, c.Validate())
+	c.PayTokenStore = "postgres"
+	assert.Nil(t, c.Validate())
+	c.TokenPolicy.Pool.Enabled = false
+	c.Sweeper.Enabled = true
+	assert.Nil(t, c.Validate())
+	c.PayTokenStore = "memory"
+	assert.NotNil(t, c.Validate())
+}
+
+func TestSweeperPolicy_Validate(t *testing.T) {
+	policy := DefaultSweeperPolicy()
+	assert.Nil(t, policy.Validate())
+	assert.Equal(t, 5*time.Minute, policy.IntervalDuration())
+
+	policy.Retention = 0
+	policy.RetentionAction = "delete"
+	assert.Nil(t, policy.Validate())
+
+	policy.RetentionAction = "truncate"
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultSweeperPolicy()
+	policy.Interval = 0
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultSweeperPolicy()
+	policy.BatchSize = 0
+	assert.NotNil(t, policy.Validate())
+}
+
+func TestCachePolicy_Validate(t *testing.T) {
+	// the cache is disabled by default
+	policy := DefaultCachePolicy()
+	assert.Nil(t, policy.Validate())
+	assert.Nil(t, CachePolicy{}.Validate())
+	assert.Equal(t, time.Minute, policy.TTLDuration())
+	assert.Equal(t, 100*time.Millisecond, policy.TimeoutDuration())
+
+	policy.Store = "memory"
+	assert.Nil(t, policy.Validate())
+	policy.Size = 0
+	assert.NotNil(t, policy.Validate())
+
+	// the Redis store needs an address
+	policy = DefaultCachePolicy()
+	policy.Store = "redis"
+	assert.NotNil(t, policy.Validate())
+	policy.Address = "127.0.0.1:6379"
+	assert.Nil(t, policy.Validate())
+	policy.TTL = 0
+	assert.NotNil(t, policy.Validate())
+
+	policy = DefaultCachePolicy()
+	policy.Store = "memcached"
+	assert.NotNil(t, policy.Validate())
+}
+
+func TestBruteForcePolicy_Validate(t *testing.T) {
+	policy := DefaultBruteForcePolicy()
+	assert.Nil(t, policy.Validate())
+
+	policy.MaxLockout = 0
+	assert.NotNil(t, policy.Validate())
+	policy.MaxLockout = policy.Lockout - 1
+	assert.NotNil(t, policy.Validate())
+
+	// the other settings are not needed once the lockout is disabled
+	assert.Nil(t, BruteForcePolicy{}.Validate())
+}
@@ -0,0 +1,45 @@
+package entity
+
+import (
+	"strings"
+	"time"
+)
+
+// Client represents a system which authenticates with the OAuth2 client credentials grant, e.g. a merchant POS backend.
+type Client struct {
+	ID         string `db:"id"`
+	Name       string `db:"name"`
+	SecretHash string `db:"secret_hash" json:"-"`
+	Role       Role   `db:"role"`
+	OwnerID    string `db:"owner_id"`
+	// Scope holds the space separated scopes the client may request.
+	Scope     string    `db:"scope"`
+	Disabled  bool      `db:"disabled"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// GetID returns the client ID.
+func (c Client) GetID() string {
+	return c.ID
+}
+
+// GetName returns the client name.
+func (c Client) GetName() string {
+	return c.Name
+}
+
+// GetRole returns the client role.
+func (c Client) GetRole() Role {
+	return c.Role
+}
+
+// GetOwnerID returns the ID of the customer or merchant the client acts for.
+func (c Client) GetOwnerID() string {
+	return c.OwnerID
+}
+
+// GetScopes returns the scopes the client may request.
+func (c Client) GetScopes() []string {
+	return strings.Fields(c.Scope)
+}
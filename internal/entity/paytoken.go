@@ -11,23 +11,87 @@ import (
 
 // PayToken struct is defined here
 type PayToken struct {
-	ID         string    `db:"id" validate:"required,uuid"`
-	Token      string    `db:"token" validate:"required,max=10"`
-	TokenDate  time.Time `db:"token_date" validate:"required"`
-	CustomerID string    `db:"customer_id" validate:"required"`
-	ValidUntil time.Time `db:"valid_until" validate:"required"`
-	CreatedAt  time.Time `db:"created_at" validate:"required"`
-	UpdatedAt  time.Time `db:"updated_at" validate:"required"`
-	Metadata   Metadata  `db:"metadata" validate:"-"`
+	ID         string      `db:"id" validate:"required,uuid"`
+	Token      string      `db:"token" validate:"required,max=10"`
+	TokenDate  time.Time   `db:"token_date" validate:"required"`
+	CustomerID string      `db:"customer_id" validate:"required"`
+	ValidUntil time.Time   `db:"valid_until" validate:"required"`
+	CreatedAt  time.Time   `db:"created_at" validate:"required"`
+	UpdatedAt  time.Time   `db:"updated_at" validate:"required"`
+	Status     TokenStatus `db:"status" validate:"required,oneof=ACTIVE VALIDATED REDEEMED EXPIRED CANCELLED"`
+	Metadata   Metadata    `db:"metadata" validate:"-"`
+}
+
+// TokenStatus represents the lifecycle state of a payment token.
+//
+//	ACTIVE ----> VALIDATED ----> REDEEMED
+//	   |             |
+//	   +-------------+---------> EXPIRED, CANCELLED
+type TokenStatus string
+
+const (
+	TokenStatusActive    TokenStatus = "ACTIVE"
+	TokenStatusValidated TokenStatus = "VALIDATED"
+	TokenStatusRedeemed  TokenStatus = "REDEEMED"
+	TokenStatusExpired   TokenStatus = "EXPIRED"
+	TokenStatusCancelled TokenStatus = "CANCELLED"
+)
+
+// tokenTransitions lists the statuses a token may move to from a given status.
+var tokenTransitions = map[TokenStatus][]TokenStatus{
+	TokenStatusActive:    {TokenStatusValidated, TokenStatusRedeemed, TokenStatusExpired, TokenStatusCancelled},
+	TokenStatusValidated: {TokenStatusRedeemed, TokenStatusExpired, TokenStatusCancelled},
+}
+
+// CanTransitionTo reports whether a token in status s may move to the next status.
+func (s TokenStatus) CanTransitionTo(next TokenStatus) bool {
+	for _, status := range tokenTransitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinal reports whether s is a terminal status, i.e. the token can not be used anymore.
+func (s TokenStatus) IsFinal() bool {
+	return len(tokenTransitions[s]) == 0
+}
+
+// EffectiveStatus returns the status of the token at the given time. A token which is past ValidUntil
+// is reported as expired even if the expiry has not been persisted yet.
+func (t PayToken) EffectiveStatus(now time.Time) TokenStatus {
+	if !t.Status.IsFinal() && now.After(t.ValidUntil) {
+		return TokenStatusExpired
+	}
+	return t.Status
 }
 
 type Metadata struct {
-	ValidatedAt time.Time `json:"validated_at"`
+	ValidatedAt  time.Time     `json:"validated_at"`
+	Redemption   *Redemption   `json:"redemption,omitempty"`
+	Cancellation *Cancellation `json:"cancellation,omitempty"`
+}
+
+// Redemption records the merchant transaction which consumed a token.
+type Redemption struct {
+	MerchantID string    `json:"merchant_id"`
+	Amount     int64     `json:"amount"`
+	Reference  string    `json:"reference"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// Cancellation records who revoked a token and why.
+type Cancellation struct {
+	CancelledBy string    `json:"cancelled_by"`
+	Reason      string    `json:"reason"`
+	CancelledAt time.Time `json:"cancelled_at"`
 }
 
 func NewToken() *PayToken {
 	return &PayToken{
-		ID: uuid.NewV4().String(),
+		ID:     uuid.NewV4().String(),
+		Status: TokenStatusActive,
 	}
 }
 
@@ -47,6 +111,8 @@ func (m *Metadata) Scan(src interface{}) error {
 // InputGenerate .
 type InputGenerate struct {
 	CustomerID string `json:"customer_id" validate:"required,numeric,startswith=62,min=10"`
+	// TimeZone optionally overrides the time zone defining the token day, e.g. "Asia/Jakarta".
+	TimeZone string `json:"time_zone" validate:"omitempty,timezone"`
 }
 
 // OutGenerate .
@@ -58,15 +124,121 @@ type OutGenerate struct {
 // InputValidate .
 type InputValidate struct {
 	Token string `json:"token" validate:"required"`
+	// TimeZone optionally overrides the time zone defining the token day, e.g. "Asia/Jakarta".
+	TimeZone string `json:"time_zone" validate:"omitempty,timezone"`
 }
 
 // OutValidate .
 type OutValidate struct {
-	Token       string    `json:"token"`
-	CustomerID  string    `json:"customer_id"`
-	ValidUntil  time.Time `json:"valid_until"`
-	IsExpired   bool      `json:"is_expired"`
-	IsValidated bool      `json:"is_validated"`
+	Token       string      `json:"token"`
+	CustomerID  string      `json:"customer_id"`
+	ValidUntil  time.Time   `json:"valid_until"`
+	Status      TokenStatus `json:"status"`
+	IsExpired   bool        `json:"is_expired"`
+	IsValidated bool        `json:"is_validated"`
+	IsUsable    bool        `json:"is_usable"`
+}
+
+// InputRedeem .
+type InputRedeem struct {
+	Token      string `json:"token" validate:"required"`
+	MerchantID string `json:"merchant_id" validate:"required,max=64"`
+	Amount     int64  `json:"amount" validate:"required,gt=0"`
+	Reference  string `json:"reference" validate:"required,max=64"`
+	// TimeZone optionally overrides the time zone defining the token day, e.g. "Asia/Jakarta".
+	TimeZone string `json:"time_zone" validate:"omitempty,timezone"`
+}
+
+// OutRedeem .
+type OutRedeem struct {
+	Token      string    `json:"token"`
+	CustomerID string    `json:"customer_id"`
+	MerchantID string    `json:"merchant_id"`
+	Amount     int64     `json:"amount"`
+	Reference  string    `json:"reference"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+// InputCancel .
+type InputCancel struct {
+	Token      string `json:"token" validate:"required"`
+	CustomerID string `json:"customer_id" validate:"required,numeric,startswith=62,min=10"`
+	Reason     string `json:"reason" validate:"max=255"`
+	// TimeZone optionally overrides the time zone defining the token day, e.g. "Asia/Jakarta".
+	TimeZone string `json:"time_zone" validate:"omitempty,timezone"`
+	// CancelledBy is the identity of the caller, it is not read from the request body.
+	CancelledBy string `json:"-"`
+}
+
+// OutCancel .
+type OutCancel struct {
+	Token       string      `json:"token"`
+	CustomerID  string      `json:"customer_id"`
+	Status      TokenStatus `json:"status"`
+	CancelledAt time.Time   `json:"cancelled_at"`
+}
+
+// OutKeyspace reports how full the keyspaces of a token day are.
+type OutKeyspace struct {
+	TokenDate string `json:"token_date"`
+	// Active is the keyspace new tokens are generated from: "primary", "fallback" or "exhausted".
+	Active       string         `json:"active"`
+	MaxFillRatio float64        `json:"max_fill_ratio"`
+	Primary      KeyspaceUsage  `json:"primary"`
+	Fallback     *KeyspaceUsage `json:"fallback,omitempty"`
+}
+
+// KeyspaceUsage reports how many of the tokens of a given length and alphabet are issued for a token day.
+type KeyspaceUsage struct {
+	Length   int    `json:"length"`
+	Alphabet string `json:"alphabet"`
+	// Size is the number of distinct tokens, excluding the check digit if any.
+	Size      float64 `json:"size"`
+	Issued    int     `json:"issued"`
+	FillRatio float64 `json:"fill_ratio"`
+}
+
+// OutPool reports the tokens left in the token pool, and the activity of the pool since the server started.
+type OutPool struct {
+	Enabled    bool        `json:"enabled"`
+	Claimed    int64       `json:"claimed"`
+	Missed     int64       `json:"missed"`
+	Reserved   int64       `json:"reserved"`
+	Collisions int64       `json:"collisions"`
+	Refills    int64       `json:"refills"`
+	Levels     []PoolLevel `json:"levels"`
+}
+
+// PoolLevel reports the number of tokens of a given length left in the token pool for a token day.
+type PoolLevel struct {
+	TokenDate string `json:"token_date"`
+	Length    int    `json:"length"`
+	Available int    `json:"available"`
+}
+
+// OutCache reports the lookups of the payment token cache since the server started.
+type OutCache struct {
+	Enabled  bool    `json:"enabled"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	Errors   int64   `json:"errors"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// TokenFilter selects and orders the payment tokens of a customer.
+type TokenFilter struct {
+	CustomerID string `validate:"required"`
+	// From and To bound the creation time of the tokens, From inclusive and To exclusive. A zero time leaves the range open.
+	From time.Time
+	To   time.Time
+	// Statuses keeps the tokens whose effective status is one of the given statuses, all the tokens when empty.
+	Statuses []TokenStatus `validate:"dive,oneof=ACTIVE VALIDATED REDEEMED EXPIRED CANCELLED"`
+	// Expired keeps the effectively expired tokens when true, the other tokens when false, all the tokens when nil.
+	Expired *bool
+	// Sort is the field ordering the tokens, prefixed with "-" for the descending order. It defaults to "-created_at".
+	Sort string `validate:"omitempty,oneof=created_at -created_at valid_until -valid_until token_date -token_date"`
+	// Now is the time at which the effective status of the tokens is taken.
+	Now time.Time
 }
 
 //PutToken
@@ -91,4 +263,7 @@ const (
 var (
 	ErrInputValidation       = fmt.Errorf("validation input error")
 	ErrDuplicateTokenPerDate = fmt.Errorf("duplicate token generated in current date")
+	ErrUniqueViolation       = fmt.Errorf("unique constraint violation")
+	ErrTokenAlreadyRedeemed  = fmt.Errorf("token already redeemed")
+	ErrTokenStatusConflict   = fmt.Errorf("token status has been changed concurrently")
 )
@@ -0,0 +1,37 @@
+package entity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenStatus_CanTransitionTo(t *testing.T) {
+	assert.True(t, TokenStatusActive.CanTransitionTo(TokenStatusValidated))
+	assert.True(t, TokenStatusActive.CanTransitionTo(TokenStatusRedeemed))
+	assert.True(t, TokenStatusValidated.CanTransitionTo(TokenStatusRedeemed))
+	assert.True(t, TokenStatusValidated.CanTransitionTo(TokenStatusCancelled))
+	assert.False(t, TokenStatusValidated.CanTransitionTo(TokenStatusActive))
+	assert.False(t, TokenStatusRedeemed.CanTransitionTo(TokenStatusCancelled))
+	assert.False(t, TokenStatusExpired.CanTransitionTo(TokenStatusRedeemed))
+	assert.False(t, TokenStatusCancelled.CanTransitionTo(TokenStatusValidated))
+}
+
+func TestTokenStatus_IsFinal(t *testing.T) {
+	assert.False(t, TokenStatusActive.IsFinal())
+	assert.False(t, TokenStatusValidated.IsFinal())
+	assert.True(t, TokenStatusRedeemed.IsFinal())
+	assert.True(t, TokenStatusExpired.IsFinal())
+	assert.True(t, TokenStatusCancelled.IsFinal())
+}
+
+func TestPayToken_EffectiveStatus(t *testing.T) {
+	now := time.Now()
+	paytoken := PayToken{ValidUntil: now.Add(time.Minute), Status: TokenStatusValidated}
+	assert.Equal(t, TokenStatusValidated, paytoken.EffectiveStatus(now))
+	assert.Equal(t, TokenStatusExpired, paytoken.EffectiveStatus(now.Add(time.Hour)))
+
+	paytoken.Status = TokenStatusRedeemed
+	assert.Equal(t, TokenStatusRedeemed, paytoken.EffectiveStatus(now.Add(time.Hour)))
+}
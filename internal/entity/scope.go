@@ -0,0 +1,40 @@
+package entity
+
+// --- list of scopes granted by access tokens
+const (
+	// ScopeTokenRead allows to list the payment tokens of a customer.
+	ScopeTokenRead = "token:read"
+	// ScopeTokenGenerate allows to generate payment tokens.
+	ScopeTokenGenerate = "token:generate"
+	// ScopeTokenValidate allows to validate payment tokens.
+	ScopeTokenValidate = "token:validate"
+	// ScopeTokenRedeem allows to redeem payment tokens.
+	ScopeTokenRedeem = "token:redeem"
+	// ScopeTokenCancel allows to cancel payment tokens.
+	ScopeTokenCancel = "token:cancel"
+	// ScopeKeyspaceRead allows to monitor how full the token keyspace is, and the token pool.
+	ScopeKeyspaceRead = "keyspace:read"
+)
+
+// RoleScopes returns the scopes a role may be granted.
+func RoleScopes(role Role) []string {
+	switch role {
+	case RoleAdmin:
+		return []string{ScopeTokenRead, ScopeTokenGenerate, ScopeTokenValidate, ScopeTokenRedeem, ScopeTokenCancel, ScopeKeyspaceRead}
+	case RoleCustomer:
+		return []string{ScopeTokenRead, ScopeTokenGenerate, ScopeTokenCancel}
+	case RoleMerchant:
+		return []string{ScopeTokenValidate, ScopeTokenRedeem}
+	}
+	return nil
+}
+
+// HasScope reports whether scope is one of scopes.
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
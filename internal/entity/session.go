@@ -0,0 +1,25 @@
+package entity
+
+import "time"
+
+// RefreshToken represents a refresh token given to a user at login. Only its hash is stored.
+// Every refresh replaces the token by a new one of the same family, which shares the expiry of the login session.
+type RefreshToken struct {
+	ID        string `db:"id"`
+	TokenHash string `db:"token_hash"`
+	FamilyID  string `db:"family_id"`
+	UserID    string `db:"user_id"`
+	// AccessTokenID is the jti of the access token issued together with the refresh token.
+	AccessTokenID string `db:"access_token_id"`
+	// AccessExpiresAt is the expiry of the access token issued together with the refresh token.
+	AccessExpiresAt time.Time  `db:"access_expires_at"`
+	ExpiresAt       time.Time  `db:"expires_at"`
+	UsedAt          *time.Time `db:"used_at"`
+	RevokedAt       *time.Time `db:"revoked_at"`
+	CreatedAt       time.Time  `db:"created_at"`
+}
+
+// IsUsable reports whether the refresh token can be exchanged for new tokens at the given time.
+func (t RefreshToken) IsUsable(now time.Time) bool {
+	return t.UsedAt == nil && t.RevokedAt == nil && now.Before(t.ExpiresAt)
+}
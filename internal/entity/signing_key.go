@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+// SigningKey represents a secret shared with a merchant, which signs its requests with HMAC-SHA256.
+type SigningKey struct {
+	ID         string `db:"id"`
+	MerchantID string `db:"merchant_id"`
+	// Secret is stored as is, since the server needs it to compute the signatures.
+	Secret    string    `db:"secret" json:"-"`
+	Disabled  bool      `db:"disabled"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
@@ -1,9 +1,19 @@
 package entity
 
+import "time"
+
 // User represents a user.
 type User struct {
-	ID   string
-	Name string
+	ID             string     `db:"id"`
+	Name           string     `db:"username"`
+	PasswordHash   string     `db:"password_hash" json:"-"`
+	Role           Role       `db:"role"`
+	OwnerID        string     `db:"owner_id"`
+	FailedAttempts int        `db:"failed_attempts"`
+	LockedUntil    *time.Time `db:"locked_until"`
+	Disabled       bool       `db:"disabled"`
+	CreatedAt      time.Time  `db:"created_at"`
+	UpdatedAt      time.Time  `db:"updated_at"`
 }
 
 // GetID returns the user ID.
@@ -15,3 +25,49 @@ func (u User) GetID() string {
 func (u User) GetName() string {
 	return u.Name
 }
+
+// GetRole returns the user role.
+func (u User) GetRole() Role {
+	return u.Role
+}
+
+// GetOwnerID returns the ID of the customer or merchant the user acts for.
+func (u User) GetOwnerID() string {
+	return u.OwnerID
+}
+
+// GetScopes returns the scopes granted to the user by its role.
+func (u User) GetScopes() []string {
+	return RoleScopes(u.Role)
+}
+
+// IsLocked reports whether the user is locked out at the given time after too many failed login attempts.
+func (u User) IsLocked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// Role represents what a user is allowed to do.
+type Role string
+
+// --- list of user roles
+const (
+	// RoleAdmin can act on behalf of any customer or merchant.
+	RoleAdmin Role = "admin"
+	// RoleCustomer can only act on the payment tokens of the customer given by the user's owner ID.
+	RoleCustomer Role = "customer"
+	// RoleMerchant can only validate and redeem payment tokens, on behalf of the merchant given by the user's owner ID.
+	RoleMerchant Role = "merchant"
+)
+
+// IsValid reports whether the role is a known one.
+func (r Role) IsValid() bool {
+	switch r {
+	case RoleAdmin, RoleCustomer, RoleMerchant:
+		return true
+	}
+	return false
+}
+
+const (
+	PGConstraintUniqueUsername = "idx_unq_users_username"
+)
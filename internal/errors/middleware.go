@@ -4,8 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
@@ -31,6 +33,10 @@ func Handler(logger log.Logger) routing.Handler {
 				if res.StatusCode() == http.StatusInternalServerError {
 					l.Errorf("encountered internal server error: %v", err)
 				}
+				if res.RetryAfter > 0 {
+					// Retry-After is given in whole seconds, rounded up so that the client does not retry too early
+					c.Response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+				}
 				c.Response.WriteHeader(res.StatusCode())
 				if err = c.Write(res); err != nil {
 					l.Errorf("failed writing error response: %v", err)
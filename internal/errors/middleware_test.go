@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
@@ -41,6 +42,15 @@ func TestHandler(t *testing.T) {
 		assert.Equal(t, http.StatusNotFound, res.Code)
 	})
 
+	t.Run("retry after processing", func(t *testing.T) {
+		logger, _ := log.NewForTest()
+		handler := Handler(logger)
+		ctx, res := buildContext(handler, handlerTooManyRequests)
+		assert.Nil(t, ctx.Next())
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.Equal(t, "3", res.Header().Get("Retry-After"))
+	})
+
 	t.Run("panic processing", func(t *testing.T) {
 		logger, entries := log.NewForTest()
 		handler := Handler(logger)
@@ -89,6 +99,10 @@ func handlerHTTPError(c *routing.Context) error {
 	return NotFound("")
 }
 
+func handlerTooManyRequests(c *routing.Context) error {
+	return TooManyRequests("", 2500*time.Millisecond)
+}
+
 func handlerPanic(c *routing.Context) error {
 	panic("xyz")
 }
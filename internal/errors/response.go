@@ -4,6 +4,7 @@ import (
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"net/http"
 	"sort"
+	"time"
 )
 
 // ErrorResponse is the response that represents an error.
@@ -11,6 +12,8 @@ type ErrorResponse struct {
 	Status  int         `json:"status"`
 	Message string      `json:"message"`
 	Details interface{} `json:"details,omitempty"`
+	// RetryAfter tells the client how long to wait before retrying, it is sent in the Retry-After header.
+	RetryAfter time.Duration `json:"-"`
 }
 
 // Error is required by the error interface.
@@ -78,6 +81,53 @@ func BadRequest(msg string) ErrorResponse {
 	}
 }
 
+// Conflict creates a new error response representing a conflict with the current state of a resource (HTTP 409)
+func Conflict(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The request conflicts with the current state of the resource."
+	}
+	return ErrorResponse{
+		Status:  http.StatusConflict,
+		Message: msg,
+	}
+}
+
+// UnprocessableEntity creates a new error response representing a request which is well-formed but can not be
+// processed (HTTP 422)
+func UnprocessableEntity(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The request can not be processed."
+	}
+	return ErrorResponse{
+		Status:  http.StatusUnprocessableEntity,
+		Message: msg,
+	}
+}
+
+// TooManyRequests creates a new error response representing a request rejected by a rate limit (HTTP 429).
+// The client is told to retry after the given duration.
+func TooManyRequests(msg string, retryAfter time.Duration) ErrorResponse {
+	if msg == "" {
+		msg = "Too many requests, please retry later."
+	}
+	return ErrorResponse{
+		Status:     http.StatusTooManyRequests,
+		Message:    msg,
+		RetryAfter: retryAfter,
+	}
+}
+
+// ServiceUnavailable creates a new error response representing a request which can not be served for now (HTTP 503)
+func ServiceUnavailable(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The service is temporarily unavailable."
+	}
+	return ErrorResponse{
+		Status:  http.StatusServiceUnavailable,
+		Message: msg,
+	}
+}
+
 type invalidField struct {
 	Field string `json:"field"`
 	Error string `json:"error"`
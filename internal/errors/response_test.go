@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestErrorResponse_Error(t *testing.T) {
@@ -62,6 +63,39 @@ func TestBadRequest(t *testing.T) {
 	assert.NotEmpty(t, res.Error())
 }
 
+func TestConflict(t *testing.T) {
+	res := Conflict("test")
+	assert.Equal(t, http.StatusConflict, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = Conflict("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestUnprocessableEntity(t *testing.T) {
+	res := UnprocessableEntity("test")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = UnprocessableEntity("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestTooManyRequests(t *testing.T) {
+	res := TooManyRequests("test", time.Minute)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	assert.Equal(t, time.Minute, res.RetryAfter)
+	res = TooManyRequests("", 0)
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	res := ServiceUnavailable("test")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = ServiceUnavailable("")
+	assert.NotEmpty(t, res.Error())
+}
+
 func TestInvalidInput(t *testing.T) {
 	err := InvalidInput(validation.Errors{
 		"xyz": fmt.Errorf("2"),
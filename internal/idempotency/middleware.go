@@ -0,0 +1,154 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/errors"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+const (
+	// Header is the request header carrying the idempotency key chosen by the client.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is the response header set when the response is replayed from an earlier request.
+	ReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	// maxKeyLength is the maximum length of an idempotency key.
+	maxKeyLength = 255
+	// maxBody is the maximum size of the body of a request sent with an idempotency key.
+	maxBody = 1 << 20
+	// lockTimeout is the time after which a request which neither completed nor failed, e.g. because the server
+	// crashed, is considered abandoned and its key can be used again.
+	lockTimeout = 2 * time.Minute
+)
+
+// Handler returns a middleware which makes the requests sent with an Idempotency-Key header safe to retry.
+// The response of the first request is stored for ttl, and replayed to the requests with the same key and body.
+// A key reused for another request is rejected with 422, a retry sent while the first request is still being
+// processed is rejected with 409, unless the first request is abandoned for lockTimeout. Failed requests are not
+// stored, so that they can be retried with the same key.
+//
+// The middleware must run after the authentication middleware, since keys are scoped to the authenticated caller.
+func Handler(store Store, ttl time.Duration, logger log.Logger) routing.Handler {
+	return func(c *routing.Context) error {
+		key := c.Request.Header.Get(Header)
+		if key == "" {
+			return nil
+		}
+		if len(key) > maxKeyLength {
+			return errors.BadRequest("The Idempotency-Key header must have at most 255 characters.")
+		}
+		body, err := readBody(c.Request)
+		if err != nil {
+			return errors.BadRequest("The request body is too large.")
+		}
+
+		ctx := c.Request.Context()
+		// keys are scoped to the caller, so that a caller can not get the response of another one
+		if identity := auth.CurrentUser(ctx); identity != nil {
+			key = identity.GetID() + ":" + key
+		}
+		fingerprint := fingerprint(c.Request.Method, c.Request.URL.RequestURI(), body)
+
+		now := time.Now()
+		record, created, err := store.Begin(ctx, key, fingerprint, now.Add(lockTimeout), now.Add(ttl))
+		if err != nil {
+			return err
+		}
+		if !created {
+			switch {
+			case record.Fingerprint != fingerprint:
+				return errors.UnprocessableEntity("The Idempotency-Key header was already used for another request.")
+			case record.Status == 0:
+				return errors.Conflict("A request with the same Idempotency-Key header is being processed.")
+			}
+			if record.ContentType != "" {
+				c.Response.Header().Set("Content-Type", record.ContentType)
+			}
+			c.Response.Header().Set(ReplayedHeader, "true")
+			c.Response.WriteHeader(record.Status)
+			c.Abort()
+			_, err := c.Response.Write(record.Body)
+			return err
+		}
+
+		rec := &responseRecorder{ResponseWriter: c.Response, status: http.StatusOK}
+		c.Response = rec
+		completed := false
+		defer func() {
+			c.Response = rec.ResponseWriter
+			if !completed {
+				if err := store.Release(ctx, key, record.Owner); stderrors.Is(err, ErrLockLost) {
+					logger.With(ctx).Warnf("idempotency key %s was taken over by another request before being released", key)
+				} else if err != nil {
+					logger.With(ctx).Errorf("failed to release idempotency key %s: %v", key, err)
+				}
+			}
+		}()
+
+		if err := c.Next(); err != nil || rec.status >= http.StatusInternalServerError {
+			return err
+		}
+		completed = true
+		if err := store.Complete(ctx, key, record.Owner, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes()); stderrors.Is(err, ErrLockLost) {
+			logger.With(ctx).Warnf("idempotency key %s was taken over by another request before its response was stored", key)
+		} else if err != nil {
+			logger.With(ctx).Errorf("failed to store the response of idempotency key %s: %v", key, err)
+		}
+		return nil
+	}
+}
+
+// fingerprint identifies a request by its method, URI and body.
+func fingerprint(method, uri string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + "\n" + uri + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// readBody reads the request body and puts it back, so that the handlers can read it again.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBody {
+		return nil, stderrors.New("request body too large")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// responseRecorder copies the status code and body of a response as they are written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status code and writes it to the wrapped writer.
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the data and writes it to the wrapped writer.
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
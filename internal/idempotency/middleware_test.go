@@ -0,0 +1,143 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/internal/errors"
+	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+
+	// the caller is identified by the X-User header
+	authenticate := func(c *routing.Context) error {
+		ctx := auth.WithUser(c.Request.Context(), c.Request.Header.Get("X-User"), "test", entity.RoleCustomer, "6281100099")
+		c.Request = c.Request.WithContext(ctx)
+		return nil
+	}
+	calls := 0
+	router.Post("/generate", authenticate, Handler(NewMemoryStore(), time.Hour, logger), func(c *routing.Context) error {
+		calls++
+		if c.Request.Header.Get("X-Fail") != "" {
+			return errors.InternalServerError("")
+		}
+		var input struct {
+			CustomerID string `json:"customer_id"`
+		}
+		if err := c.Read(&input); err != nil {
+			return errors.BadRequest("")
+		}
+		return c.WriteWithStatus(map[string]string{"token": strconv.Itoa(calls), "customer_id": input.CustomerID}, http.StatusCreated)
+	})
+
+	call := func(user, key, body string, fail bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/generate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", user)
+		if key != "" {
+			req.Header.Set(Header, key)
+		}
+		if fail {
+			req.Header.Set("X-Fail", "true")
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	// the retries replay the response of the first request
+	res := call("100", "key-1", `{"customer_id":"6281100099"}`, false)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	first := res.Body.String()
+	assert.Contains(t, first, `"token":"1"`)
+	res = call("100", "key-1", `{"customer_id":"6281100099"}`, false)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, first, res.Body.String())
+	assert.Equal(t, "true", res.Header().Get(ReplayedHeader))
+	assert.Contains(t, res.Header().Get("Content-Type"), "application/json")
+	assert.Equal(t, 1, calls)
+
+	// a key can not be reused for another request
+	res = call("100", "key-1", `{"customer_id":"6281100088"}`, false)
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+	assert.Equal(t, 1, calls)
+
+	// keys are scoped to the caller
+	res = call("101", "key-1", `{"customer_id":"6281100099"}`, false)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, 2, calls)
+
+	// requests without a key are not deduplicated
+	call("100", "", `{"customer_id":"6281100099"}`, false)
+	call("100", "", `{"customer_id":"6281100099"}`, false)
+	assert.Equal(t, 4, calls)
+
+	// failed requests can be retried with the same key
+	res = call("100", "key-2", `{}`, true)
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	res = call("100", "key-2", `{}`, false)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, 6, calls)
+
+	res = call("100", strings.Repeat("k", 256), `{}`, false)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestHandler_InProgress(t *testing.T) {
+	logger, _ := log.NewForTest()
+	store := NewMemoryStore()
+	// the key of the mock admin is reserved by a request which has not completed yet
+	_, _, _ = store.Begin(context.Background(), "100:key-1", fingerprint("POST", "/generate", []byte(`{}`)), time.Now().Add(time.Minute), time.Now().Add(time.Hour))
+
+	router := test.MockRouter(logger)
+	router.Post("/generate", auth.MockAuthHandler, Handler(store, time.Hour, logger), func(c *routing.Context) error {
+		return c.Write("ok")
+	})
+	req, _ := http.NewRequest("POST", "/generate", strings.NewReader(`{}`))
+	req.Header = auth.MockAuthHeader()
+	req.Header.Set(Header, "key-1")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusConflict, res.Code)
+}
+
+func TestHandler_Abandoned(t *testing.T) {
+	logger, _ := log.NewForTest()
+	store := NewMemoryStore()
+	// the key of the mock admin was reserved by a request which never completed, e.g. because the server crashed
+	_, _, _ = store.Begin(context.Background(), "100:key-1", fingerprint("POST", "/generate", []byte(`{}`)), time.Now().Add(-time.Second), time.Now().Add(time.Hour))
+
+	router := test.MockRouter(logger)
+	router.Post("/generate", auth.MockAuthHandler, Handler(store, time.Hour, logger), func(c *routing.Context) error {
+		return c.WriteWithStatus("ok", http.StatusCreated)
+	})
+	call := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/generate", strings.NewReader(`{}`))
+		req.Header = auth.MockAuthHeader()
+		req.Header.Set(Header, "key-1")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	// the retry takes the reservation over, and its response is replayed afterwards
+	res := call()
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Empty(t, res.Header().Get(ReplayedHeader))
+	res = call()
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Equal(t, "true", res.Header().Get(ReplayedHeader))
+}
@@ -0,0 +1,186 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// ErrLockLost is returned when a request completes or releases a key which was taken over by another request after
+// its lock passed.
+var ErrLockLost = errors.New("idempotency key reserved by another request")
+
+// Record represents a request sent with an idempotency key, and its response once the request is processed.
+type Record struct {
+	Key string `db:"key"`
+	// Fingerprint identifies the request, a key can not be reused for another request.
+	Fingerprint string `db:"fingerprint"`
+	// Status is the status code of the response, or 0 while the request is being processed.
+	Status      int    `db:"status"`
+	ContentType string `db:"content_type"`
+	Body        []byte `db:"body"`
+	// LockedUntil is the time after which a request still being processed is considered abandoned,
+	// e.g. because the server crashed, and its key can be reserved again.
+	LockedUntil time.Time `db:"locked_until"`
+	// Owner identifies the request holding the reservation, only this request can complete or release it.
+	Owner     string    `db:"owner"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// Store keeps the idempotency keys and the responses of their requests.
+type Store interface {
+	// Begin reserves the key for the request with the given fingerprint until expiresAt, and locks it until
+	// lockedUntil while the request is processed. If the key is already reserved, the existing record is returned
+	// and created is false, unless its request was not completed before its lock passed: the reservation is then
+	// taken over. The owner of the record created identifies the request to Complete and Release.
+	Begin(ctx context.Context, key, fingerprint string, lockedUntil, expiresAt time.Time) (record Record, created bool, err error)
+	// Complete stores the response of the request which reserved the key. ErrLockLost is returned if the key
+	// is no longer reserved by owner.
+	Complete(ctx context.Context, key, owner string, status int, contentType string, body []byte) error
+	// Release removes the reservation of a request which failed, so that it can be retried with the same key.
+	// ErrLockLost is returned if the key is no longer reserved by owner.
+	Release(ctx context.Context, key, owner string) error
+}
+
+// store persists idempotency keys in database, so that they are shared by all the server instances
+type store struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewStore creates a new idempotency key store backed by the database
+func NewStore(db *dbcontext.DB, logger log.Logger) Store {
+	return store{db, logger}
+}
+
+// Begin reserves the key for the request with the given fingerprint until expiresAt, and locks it until lockedUntil.
+// Expired keys are removed on the way, so that they can be reserved again.
+func (s store) Begin(ctx context.Context, key, fingerprint string, lockedUntil, expiresAt time.Time) (Record, bool, error) {
+	if _, err := s.db.With(ctx).Delete("idempotency_keys", dbx.NewExp("expires_at < now()")).Execute(); err != nil {
+		s.logger.With(ctx).Errorf("failed to remove expired idempotency keys: %v", err)
+	}
+
+	// the reservation of an abandoned request is taken over in the same statement, so that only one retry gets it
+	owner := entity.GenerateID()
+	result, err := s.db.With(ctx).
+		NewQuery("INSERT INTO idempotency_keys (key, fingerprint, locked_until, owner, expires_at) VALUES ({:key}, {:fingerprint}, {:locked_until}, {:owner}, {:expires_at}) " +
+			"ON CONFLICT (key) DO UPDATE SET fingerprint = EXCLUDED.fingerprint, locked_until = EXCLUDED.locked_until, owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at " +
+			"WHERE idempotency_keys.status = 0 AND idempotency_keys.locked_until < now()").
+		Bind(dbx.Params{"key": key, "fingerprint": fingerprint, "locked_until": lockedUntil, "owner": owner, "expires_at": expiresAt}).
+		Execute()
+	if err != nil {
+		return Record{}, false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return Record{}, false, err
+	}
+	if rows > 0 {
+		return Record{Key: key, Fingerprint: fingerprint, LockedUntil: lockedUntil, Owner: owner, ExpiresAt: expiresAt}, true, nil
+	}
+
+	var record Record
+	err = s.db.With(ctx).Select().
+		From("idempotency_keys").
+		Where(dbx.HashExp{"key": key}).
+		One(&record)
+	return record, false, err
+}
+
+// Complete stores the response of the request which reserved the key.
+func (s store) Complete(ctx context.Context, key, owner string, status int, contentType string, body []byte) error {
+	return affected(s.db.With(ctx).Update("idempotency_keys", dbx.Params{
+		"status":       status,
+		"content_type": contentType,
+		"body":         body,
+	}, dbx.HashExp{"key": key, "owner": owner, "status": 0}).Execute())
+}
+
+// Release removes the reservation of a request which failed.
+func (s store) Release(ctx context.Context, key, owner string) error {
+	return affected(s.db.With(ctx).Delete("idempotency_keys", dbx.HashExp{"key": key, "owner": owner, "status": 0}).Execute())
+}
+
+// affected returns ErrLockLost if a statement on the reservation of a request changed no row.
+func affected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// memoryStore keeps idempotency keys in memory, which only covers the retries reaching the same server instance.
+type memoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+	pruned  time.Time
+}
+
+// NewMemoryStore creates an idempotency key store which keeps the keys in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{records: map[string]Record{}}
+}
+
+// Begin reserves the key for the request with the given fingerprint until expiresAt, and locks it until lockedUntil.
+func (m *memoryStore) Begin(ctx context.Context, key, fingerprint string, lockedUntil, expiresAt time.Time) (Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	// expired keys are removed once a minute at most
+	if now.Sub(m.pruned) > time.Minute {
+		for k, record := range m.records {
+			if now.After(record.ExpiresAt) {
+				delete(m.records, k)
+			}
+		}
+		m.pruned = now
+	}
+	if record, ok := m.records[key]; ok && !now.After(record.ExpiresAt) && (record.Status != 0 || !now.After(record.LockedUntil)) {
+		return record, false, nil
+	}
+	record := Record{Key: key, Fingerprint: fingerprint, LockedUntil: lockedUntil, Owner: entity.GenerateID(), ExpiresAt: expiresAt}
+	m.records[key] = record
+	return record, true, nil
+}
+
+// Complete stores the response of the request which reserved the key.
+func (m *memoryStore) Complete(ctx context.Context, key, owner string, status int, contentType string, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.records[key]
+	if !ok || record.Owner != owner || record.Status != 0 {
+		return ErrLockLost
+	}
+	record.Status, record.ContentType, record.Body = status, contentType, body
+	m.records[key] = record
+	return nil
+}
+
+// Release removes the reservation of a request which failed.
+func (m *memoryStore) Release(ctx context.Context, key, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.records[key]
+	if !ok || record.Owner != owner || record.Status != 0 {
+		return ErrLockLost
+	}
+	delete(m.records, key)
+	return nil
+}
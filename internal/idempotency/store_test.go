@@ -0,0 +1,105 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestStore(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "idempotency_keys")
+	testStore(t, NewStore(db, logger))
+}
+
+// testStore checks the behavior shared by all the store backends.
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	lockedUntil := time.Now().Add(time.Minute)
+	expiresAt := time.Now().Add(time.Hour)
+
+	record, created, err := store.Begin(ctx, "key-1", "fp-1", lockedUntil, expiresAt)
+	assert.Nil(t, err)
+	assert.True(t, created)
+	assert.Equal(t, "fp-1", record.Fingerprint)
+	owner := record.Owner
+	assert.NotEmpty(t, owner)
+
+	// a reserved key returns the request in progress
+	record, created, err = store.Begin(ctx, "key-1", "fp-2", lockedUntil, expiresAt)
+	assert.Nil(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "fp-1", record.Fingerprint)
+	assert.Equal(t, 0, record.Status)
+
+	assert.True(t, errors.Is(store.Complete(ctx, "key-1", "other", 201, "application/json", []byte(`{}`)), ErrLockLost))
+	assert.Nil(t, store.Complete(ctx, "key-1", owner, 201, "application/json", []byte(`{"token":"123456"}`)))
+	record, created, _ = store.Begin(ctx, "key-1", "fp-1", lockedUntil, expiresAt)
+	assert.False(t, created)
+	assert.Equal(t, 201, record.Status)
+	assert.Equal(t, "application/json", record.ContentType)
+	assert.Equal(t, `{"token":"123456"}`, string(record.Body))
+	// a completed request is neither released nor completed again
+	assert.True(t, errors.Is(store.Release(ctx, "key-1", owner), ErrLockLost))
+	assert.True(t, errors.Is(store.Complete(ctx, "key-1", owner, 500, "", nil), ErrLockLost))
+	_, created, _ = store.Begin(ctx, "key-1", "fp-1", lockedUntil, expiresAt)
+	assert.False(t, created)
+
+	// a released key can be reserved again
+	record, created, _ = store.Begin(ctx, "key-2", "fp-1", lockedUntil, expiresAt)
+	assert.True(t, created)
+	assert.Nil(t, store.Release(ctx, "key-2", record.Owner))
+	_, created, _ = store.Begin(ctx, "key-2", "fp-1", lockedUntil, expiresAt)
+	assert.True(t, created)
+
+	// an expired key can be reserved again
+	_, created, _ = store.Begin(ctx, "key-3", "fp-1", time.Now().Add(-time.Second), time.Now().Add(-time.Second))
+	assert.True(t, created)
+	_, created, _ = store.Begin(ctx, "key-3", "fp-2", lockedUntil, expiresAt)
+	assert.True(t, created)
+
+	// a request abandoned before completing can be retried once its lock has passed
+	past := time.Now().Add(-time.Second)
+	_, created, _ = store.Begin(ctx, "key-4", "fp-1", past, expiresAt)
+	assert.True(t, created)
+	record, created, err = store.Begin(ctx, "key-4", "fp-2", lockedUntil, expiresAt)
+	assert.Nil(t, err)
+	assert.True(t, created)
+	assert.Equal(t, "fp-2", record.Fingerprint)
+	record, created, _ = store.Begin(ctx, "key-4", "fp-2", lockedUntil, expiresAt)
+	assert.False(t, created)
+	assert.Equal(t, 0, record.Status)
+
+	// a completed request is replayed even after its lock has passed
+	record, created, _ = store.Begin(ctx, "key-5", "fp-1", past, expiresAt)
+	assert.True(t, created)
+	assert.Nil(t, store.Complete(ctx, "key-5", record.Owner, 201, "application/json", []byte(`{}`)))
+	record, created, _ = store.Begin(ctx, "key-5", "fp-1", lockedUntil, expiresAt)
+	assert.False(t, created)
+	assert.Equal(t, 201, record.Status)
+
+	// the abandoned request can neither release nor complete the reservation taken over
+	abandoned, created, _ := store.Begin(ctx, "key-6", "fp-1", past, expiresAt)
+	assert.True(t, created)
+	retry, created, _ := store.Begin(ctx, "key-6", "fp-1", lockedUntil, expiresAt)
+	assert.True(t, created)
+	assert.NotEqual(t, abandoned.Owner, retry.Owner)
+	assert.True(t, errors.Is(store.Release(ctx, "key-6", abandoned.Owner), ErrLockLost))
+	assert.True(t, errors.Is(store.Complete(ctx, "key-6", abandoned.Owner, 500, "", nil), ErrLockLost))
+	record, created, _ = store.Begin(ctx, "key-6", "fp-1", lockedUntil, expiresAt)
+	assert.False(t, created)
+	assert.Equal(t, 0, record.Status)
+	assert.Nil(t, store.Complete(ctx, "key-6", retry.Owner, 201, "application/json", []byte(`{}`)))
+	record, _, _ = store.Begin(ctx, "key-6", "fp-1", lockedUntil, expiresAt)
+	assert.Equal(t, 201, record.Status)
+}
@@ -1,38 +1,149 @@
 package paytoken
 
 import (
+	"context"
+	stderrors "errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/bruteforce"
 	"github.com/pauluswi/tulip/internal/entity"
 	"github.com/pauluswi/tulip/internal/errors"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/pagination"
 )
 
 // RegisterHandlers sets up the routing of the HTTP handlers.
-func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
-	res := resource{service, logger}
+// The merchant endpoints (validate and redeem) are authenticated by merchantAuthHandler, which may accept
+// signed requests, the other endpoints by authHandler. Generating and redeeming tokens go through
+// idempotencyHandler, so that the retries of these requests do not mint or redeem tokens twice.
+// The endpoints looking up a token go through guardHandler, which locks out the callers guessing tokens.
+// The cursors of the token history are signed by cursors.
+func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler, merchantAuthHandler, idempotencyHandler, guardHandler routing.Handler,
+	cursors pagination.CursorSigner, logger log.Logger) {
+	res := resource{service, cursors, logger}
 
-	r.Use(authHandler)
-
-	// the following endpoints require a valid JWT
-	r.Get("/getpaytokens/<id>", res.getpaytokens)
-	r.Post("/generate", res.generate)
-	r.Post("/validate", res.validate)
+	// the following endpoints require a valid JWT or signature granting the scope of the endpoint
+	r.Get("/getpaytokens/<id>", authHandler, auth.RequireScope(entity.ScopeTokenRead), res.getpaytokens)
+	r.Post("/generate", authHandler, auth.RequireScope(entity.ScopeTokenGenerate), idempotencyHandler, res.generate)
+	r.Post("/validate", merchantAuthHandler, auth.RequireScope(entity.ScopeTokenValidate), guardHandler, res.validate)
+	r.Post("/redeem", merchantAuthHandler, auth.RequireScope(entity.ScopeTokenRedeem), guardHandler, idempotencyHandler, res.redeem)
+	r.Post("/cancel", authHandler, auth.RequireScope(entity.ScopeTokenCancel), guardHandler, res.cancel)
+	r.Get("/keyspace", authHandler, auth.RequireScope(entity.ScopeKeyspaceRead), res.keyspace)
+	r.Get("/pool", authHandler, auth.RequireScope(entity.ScopeKeyspaceRead), res.pool)
+	r.Get("/cache", authHandler, auth.RequireScope(entity.ScopeKeyspaceRead), res.cache)
 }
 
 type resource struct {
 	service Service
+	cursors pagination.CursorSigner
 	logger  log.Logger
 }
 
 func (r resource) getpaytokens(c *routing.Context) error {
-	paytoken, err := r.service.GetPayTokens(c.Request.Context(), c.Param("id"))
+	ctx := c.Request.Context()
+	if _, err := authorizeCustomer(ctx, c.Param("id")); err != nil {
+		return err
+	}
+	filter, err := parseTokenFilter(c)
 	if err != nil {
 		return err
 	}
+	if _, ok := c.Request.URL.Query()[pagination.CursorVar]; ok {
+		return r.seekpaytokens(c, filter)
+	}
+	count, err := r.service.Count(ctx, filter)
+	if err != nil {
+		return buildServiceError(err)
+	}
+	pages := pagination.NewFromRequest(c.Request, count)
+	paytokens, err := r.service.Query(ctx, filter, pages.Offset(), pages.Limit())
+	if err != nil {
+		return buildServiceError(err)
+	}
+	pages.Items = paytokens
+	if link := pages.BuildLinkHeader(linkBaseURL(c.Request.URL), pagination.DefaultPageSize); link != "" {
+		c.Response.Header().Set("Link", link)
+	}
+	return c.Write(pages)
+}
+
+// seekpaytokens writes the page of the token history following or preceding the cursor of the request,
+// which is the first page if the cursor is empty.
+func (r resource) seekpaytokens(c *routing.Context, filter entity.TokenFilter) error {
+	keyset, err := pagination.NewKeysetFromRequest(c.Request, r.cursors, filter.Sort != "created_at")
+	if err != nil {
+		return errors.BadRequest("The cursor is invalid.")
+	}
+	page, err := r.service.Seek(c.Request.Context(), filter, keyset)
+	if err != nil {
+		return buildServiceError(err)
+	}
+	if link := page.BuildLinkHeader(linkBaseURL(c.Request.URL), pagination.DefaultPageSize); link != "" {
+		c.Response.Header().Set("Link", link)
+	}
+	return c.Write(page)
+}
+
+// parseTokenFilter reads the filter of the token history from the query parameters: the creation time range
+// from and to, given as RFC 3339 times or as UTC dates (to including the whole day), the comma separated statuses,
+// expired (true or false) and sort. The tokens are compared with the current time.
+func parseTokenFilter(c *routing.Context) (entity.TokenFilter, error) {
+	filter := entity.TokenFilter{CustomerID: c.Param("id"), Sort: c.Query("sort"), Now: time.Now().UTC()}
+	var err error
+	if filter.From, err = parseTime(c.Query("from"), false); err != nil {
+		return filter, errors.BadRequest("from must be an RFC 3339 time or a date.")
+	}
+	if filter.To, err = parseTime(c.Query("to"), true); err != nil {
+		return filter, errors.BadRequest("to must be an RFC 3339 time or a date.")
+	}
+	if statuses := c.Query("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			filter.Statuses = append(filter.Statuses, entity.TokenStatus(strings.ToUpper(strings.TrimSpace(status))))
+		}
+	}
+	if expired := c.Query("expired"); expired != "" {
+		value, err := strconv.ParseBool(expired)
+		if err != nil {
+			return filter, errors.BadRequest("expired must be true or false.")
+		}
+		filter.Expired = &value
+	}
+	return filter, nil
+}
 
-	return c.Write(paytoken)
+// parseTime parses an RFC 3339 time or a UTC date. A date stands for its start, or for the start
+// of the next day if end is true, so that the date is included in a range ending before it.
+func parseTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil || !end {
+		return t, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// linkBaseURL returns the path and the query of the URL without the pagination parameters,
+// which are added by the BuildLinkHeader methods of pagination.
+func linkBaseURL(u *url.URL) string {
+	query := u.Query()
+	query.Del(pagination.PageVar)
+	query.Del(pagination.PageSizeVar)
+	query.Del(pagination.CursorVar)
+	if len(query) == 0 {
+		return u.Path
+	}
+	return u.Path + "?" + query.Encode()
 }
 
 func (r resource) generate(c *routing.Context) error {
@@ -41,10 +152,15 @@ func (r resource) generate(c *routing.Context) error {
 		r.logger.With(c.Request.Context()).Info(err)
 		return errors.BadRequest("Bad Request")
 	}
-	paytoken, err := r.service.Generate(c.Request.Context(), input)
+	customerID, err := authorizeCustomer(c.Request.Context(), input.CustomerID)
 	if err != nil {
 		return err
 	}
+	input.CustomerID = customerID
+	paytoken, err := r.service.Generate(c.Request.Context(), input)
+	if err != nil {
+		return buildServiceError(err)
+	}
 
 	return c.WriteWithStatus(paytoken, http.StatusCreated)
 }
@@ -55,9 +171,161 @@ func (r resource) validate(c *routing.Context) error {
 		r.logger.With(c.Request.Context()).Info(err)
 		return errors.BadRequest("Bad Request")
 	}
+	if _, err := authorizeMerchant(c.Request.Context(), ""); err != nil {
+		return err
+	}
 	paytoken, err := r.service.Validate(c.Request.Context(), input)
 	if err != nil {
-		return err
+		reportGuess(c.Request.Context(), err)
+		return buildServiceError(err)
 	}
 	return c.WriteWithStatus(paytoken, http.StatusCreated)
 }
+
+func (r resource) redeem(c *routing.Context) error {
+	var input entity.InputRedeem
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("Bad Request")
+	}
+	merchantID, err := authorizeMerchant(c.Request.Context(), input.MerchantID)
+	if err != nil {
+		return err
+	}
+	input.MerchantID = merchantID
+	redemption, err := r.service.Redeem(c.Request.Context(), input)
+	if err != nil {
+		reportGuess(c.Request.Context(), err)
+		return buildServiceError(err)
+	}
+	return c.Write(redemption)
+}
+
+func (r resource) cancel(c *routing.Context) error {
+	var input entity.InputCancel
+	if err := c.Read(&input); err != nil {
+		r.logger.With(c.Request.Context()).Info(err)
+		return errors.BadRequest("Bad Request")
+	}
+	customerID, err := authorizeCustomer(c.Request.Context(), input.CustomerID)
+	if err != nil {
+		return err
+	}
+	input.CustomerID = customerID
+	if identity := auth.CurrentUser(c.Request.Context()); identity != nil {
+		input.CancelledBy = identity.GetID()
+	}
+	cancellation, err := r.service.Cancel(c.Request.Context(), input)
+	if err != nil {
+		reportGuess(c.Request.Context(), err)
+		return buildServiceError(err)
+	}
+	return c.Write(cancellation)
+}
+
+func (r resource) keyspace(c *routing.Context) error {
+	keyspace, err := r.service.Keyspace(c.Request.Context(), c.Query("time_zone"))
+	if err != nil {
+		return buildServiceError(err)
+	}
+	return c.Write(keyspace)
+}
+
+func (r resource) pool(c *routing.Context) error {
+	pool, err := r.service.PoolStatus(c.Request.Context())
+	if err != nil {
+		return err
+	}
+	return c.Write(pool)
+}
+
+func (r resource) cache(c *routing.Context) error {
+	cache, err := r.service.CacheStatus(c.Request.Context())
+	if err != nil {
+		return err
+	}
+	return c.Write(cache)
+}
+
+// authorizeCustomer checks that the current user may act on the payment tokens of the given customer:
+// admins may act for any customer while customers may only act for themselves. It returns the customer ID
+// to act for, which defaults to the customer's own ID when customerID is empty.
+func authorizeCustomer(ctx context.Context, customerID string) (string, error) {
+	identity := auth.CurrentUser(ctx)
+	if identity == nil {
+		return "", errors.Forbidden("")
+	}
+	switch identity.GetRole() {
+	case entity.RoleAdmin:
+		return customerID, nil
+	case entity.RoleCustomer:
+		if customerID == "" {
+			customerID = identity.GetOwnerID()
+		}
+		if customerID == identity.GetOwnerID() {
+			return customerID, nil
+		}
+		return "", errors.Forbidden("You can only act on your own payment tokens.")
+	}
+	return "", errors.Forbidden("")
+}
+
+// authorizeMerchant checks that the current user may validate and redeem payment tokens: admins may act for
+// any merchant while merchants may only act for themselves. It returns the merchant ID to act for, which
+// defaults to the merchant's own ID when merchantID is empty.
+func authorizeMerchant(ctx context.Context, merchantID string) (string, error) {
+	identity := auth.CurrentUser(ctx)
+	if identity == nil {
+		return "", errors.Forbidden("")
+	}
+	switch identity.GetRole() {
+	case entity.RoleAdmin:
+		return merchantID, nil
+	case entity.RoleMerchant:
+		if merchantID == "" {
+			merchantID = identity.GetOwnerID()
+		}
+		if merchantID == identity.GetOwnerID() {
+			return merchantID, nil
+		}
+		return "", errors.Forbidden("You can only redeem payment tokens for your own merchant.")
+	}
+	return "", errors.Forbidden("")
+}
+
+// reportGuess reports the lookup of an unknown, malformed or foreign token as a failed attempt,
+// so that the callers enumerating tokens are locked out.
+func reportGuess(ctx context.Context, err error) {
+	if stderrors.Is(err, ErrTokenNotFound) || stderrors.Is(err, ErrMalformedToken) || stderrors.Is(err, ErrNotTokenOwner) {
+		bruteforce.Failed(ctx)
+	}
+}
+
+// buildServiceError converts the errors returned by the service into error responses,
+// so that the client gets a meaningful HTTP status instead of an internal server error.
+func buildServiceError(err error) error {
+	var limitErr LimitError
+	switch {
+	case stderrors.As(err, &limitErr):
+		return errors.TooManyRequests("Token generation limit reached: "+limitErr.Limit+".", limitErr.RetryAfter)
+	case stderrors.Is(err, ErrKeyspaceExhausted):
+		return errors.ServiceUnavailable("No more tokens can be generated for today.")
+	case stderrors.Is(err, ErrValidation):
+		return errors.BadRequest(err.Error())
+	case stderrors.Is(err, ErrMalformedToken):
+		return errors.BadRequest("Token is malformed.")
+	case stderrors.Is(err, ErrTokenNotFound):
+		return errors.NotFound("Token not found.")
+	case stderrors.Is(err, ErrTokenExpired):
+		return errors.Conflict("Token has expired.")
+	case stderrors.Is(err, entity.ErrTokenAlreadyRedeemed):
+		return errors.Conflict("Token has already been redeemed.")
+	case stderrors.Is(err, ErrTokenCancelled):
+		return errors.Conflict("Token has been cancelled.")
+	case stderrors.Is(err, ErrNotTokenOwner):
+		return errors.Forbidden("Token belongs to another customer.")
+	case stderrors.Is(err, ErrInvalidTransition):
+		return errors.Conflict("Token can not be used anymore.")
+	}
+	return err
+}
@@ -6,9 +6,14 @@ import (
 	"time"
 
 	"github.com/pauluswi/tulip/internal/auth"
+	"github.com/pauluswi/tulip/internal/bruteforce"
+	"github.com/pauluswi/tulip/internal/config"
 	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/internal/idempotency"
 	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/generator"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/pagination"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -16,13 +21,30 @@ func TestAPI(t *testing.T) {
 	logger, _ := log.NewForTest()
 	router := test.MockRouter(logger)
 	repo := &mockRepository{items: []entity.PayToken{
-		{uuid.NewV4().String(), "999999", time.Now(), "6281100099", time.Now(), time.Now(), time.Now(), entity.Metadata{time.Now().UTC()}},
+		{uuid.NewV4().String(), "999999", time.Now(), "6281100099", time.Now(), time.Now(), time.Now(), entity.TokenStatusActive, entity.Metadata{ValidatedAt: time.Now().UTC()}},
 	}}
-	RegisterHandlers(router.Group(""), NewService(repo, logger), auth.MockAuthHandler, logger)
+	RegisterHandlers(router.Group(""), NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger),
+		auth.MockAuthHandler, auth.MockAuthHandler, idempotency.Handler(idempotency.NewMemoryStore(), time.Hour, logger),
+		bruteforce.Handler(bruteforce.NewGuard("token_guessing", bruteforce.NewMemoryStore(), config.DefaultBruteForcePolicy(), logger), logger), pagination.NewCursorSigner([]byte("secret")), logger)
 	header := auth.MockAuthHeader()
+	idempotent := auth.MockAuthHeaderAs(entity.RoleCustomer, "6281100099")
+	idempotent.Set(idempotency.Header, "generate-1")
+	customer := auth.MockAuthHeaderAs(entity.RoleCustomer, "6281100099")
+	otherCustomer := auth.MockAuthHeaderAs(entity.RoleCustomer, "6281100088")
+	merchant := auth.MockAuthHeaderAs(entity.RoleMerchant, "M001")
 
 	tests := []test.APITestCase{
 		{"get all", "GET", "/getpaytokens/6281100099", "", header, http.StatusOK, `*"Token":"999999"`},
+		{"get page", "GET", "/getpaytokens/6281100099?page=2&per_page=1&status=active,validated&expired=false&from=2026-10-01&to=2026-10-18T12:00:00Z&sort=-valid_until", "", header, http.StatusOK, `*"page":1,"per_page":1,"page_count":1,"total_count":1*`},
+		{"get by cursor", "GET", "/getpaytokens/6281100099?cursor=&per_page=1&expired=false", "", header, http.StatusOK, `*"per_page":1,"items":[{*`},
+		{"get by cursor error", "GET", "/getpaytokens/6281100099?cursor=forged", "", header, http.StatusBadRequest, ""},
+		{"get by cursor sort error", "GET", "/getpaytokens/6281100099?cursor=&sort=valid_until", "", header, http.StatusBadRequest, ""},
+		{"get by cursor of another list", "GET", "/getpaytokens/6281100099?cursor=" + pagination.NewCursorSigner([]byte("secret")).Encode(pagination.Cursor{ID: "a1"}), "", header, http.StatusBadRequest, ""},
+		{"get status error", "GET", "/getpaytokens/6281100099?status=used", "", header, http.StatusBadRequest, ""},
+		{"get sort error", "GET", "/getpaytokens/6281100099?sort=token", "", header, http.StatusBadRequest, ""},
+		{"get expired error", "GET", "/getpaytokens/6281100099?expired=maybe", "", header, http.StatusBadRequest, ""},
+		{"get date error", "GET", "/getpaytokens/6281100099?from=yesterday", "", header, http.StatusBadRequest, ""},
+		{"get date range error", "GET", "/getpaytokens/6281100099?from=2026-10-18&to=2026-10-17", "", header, http.StatusBadRequest, ""},
 		{"get unknown", "GET", "/get/paytokens/62811000991", "", header, http.StatusNotFound, ""},
 		{"generate ok", "POST", "/generate", `{"customer_id":"6281100099"}`, header, http.StatusCreated, "*valid_until*"},
 		{"generate auth error", "POST", "/generate", `{"customer_id":"6281100099"}`, nil, http.StatusUnauthorized, ""},
@@ -30,6 +52,72 @@ func TestAPI(t *testing.T) {
 		{"validate ok", "POST", "/validate", `{"token":"999999"}`, header, http.StatusCreated, "*valid_until*"},
 		{"validate auth error", "POST", "/validate", `{"CustomerID":"999999"}`, nil, http.StatusUnauthorized, ""},
 		{"validate input error", "POST", "/validate", `"CustomerID":"999999"}`, header, http.StatusBadRequest, ""},
+		{"redeem ok", "POST", "/redeem", `{"token":"999999","merchant_id":"M001","amount":25000,"reference":"INV-1"}`, header, http.StatusOK, "*redeemed_at*"},
+		{"redeem twice", "POST", "/redeem", `{"token":"999999","merchant_id":"M001","amount":25000,"reference":"INV-1"}`, header, http.StatusConflict, ""},
+		{"redeem auth error", "POST", "/redeem", `{"token":"999999"}`, nil, http.StatusUnauthorized, ""},
+		{"cancel redeemed", "POST", "/cancel", `{"token":"999999","customer_id":"6281100099"}`, header, http.StatusConflict, ""},
+		{"cancel auth error", "POST", "/cancel", `{"token":"999999","customer_id":"6281100099"}`, nil, http.StatusUnauthorized, ""},
+		{"cancel input error", "POST", "/cancel", `{"token":"999999"}`, header, http.StatusBadRequest, ""},
+		{"redeem input error", "POST", "/redeem", `{"token":"999999"}`, header, http.StatusBadRequest, ""},
+		{"customer get own", "GET", "/getpaytokens/6281100099", "", customer, http.StatusOK, `*"Token":"999999"`},
+		{"customer get other", "GET", "/getpaytokens/6281100099", "", otherCustomer, http.StatusForbidden, ""},
+		{"merchant get", "GET", "/getpaytokens/6281100099", "", merchant, http.StatusForbidden, ""},
+		{"customer generate own", "POST", "/generate", `{}`, customer, http.StatusCreated, "*valid_until*"},
+		{"customer generate other", "POST", "/generate", `{"customer_id":"6281100099"}`, otherCustomer, http.StatusForbidden, ""},
+		{"merchant generate", "POST", "/generate", `{"customer_id":"6281100099"}`, merchant, http.StatusForbidden, ""},
+		{"customer validate", "POST", "/validate", `{"token":"999999"}`, customer, http.StatusForbidden, ""},
+		{"merchant validate", "POST", "/validate", `{"token":"999999"}`, merchant, http.StatusCreated, "*valid_until*"},
+		{"customer redeem", "POST", "/redeem", `{"token":"999999","merchant_id":"M001","amount":25000,"reference":"INV-1"}`, customer, http.StatusForbidden, ""},
+		{"merchant redeem for other", "POST", "/redeem", `{"token":"999999","merchant_id":"M002","amount":25000,"reference":"INV-1"}`, merchant, http.StatusForbidden, ""},
+		{"customer cancel other", "POST", "/cancel", `{"token":"999999","customer_id":"6281100099"}`, otherCustomer, http.StatusForbidden, ""},
+		{"merchant cancel", "POST", "/cancel", `{"token":"999999","customer_id":"6281100099"}`, merchant, http.StatusForbidden, ""},
+		{"generate with idempotency key", "POST", "/generate", `{}`, idempotent, http.StatusCreated, "*valid_until*"},
+		{"generate retried", "POST", "/generate", `{}`, idempotent, http.StatusCreated, "*valid_until*"},
+		{"generate idempotency key reused", "POST", "/generate", `{"time_zone":"Asia/Jakarta"}`, idempotent, http.StatusUnprocessableEntity, ""},
+		{"keyspace", "GET", "/keyspace", "", header, http.StatusOK, `*"active":"primary"*`},
+		{"keyspace time zone error", "GET", "/keyspace?time_zone=Mars/Olympus_Mons", "", header, http.StatusBadRequest, ""},
+		{"customer keyspace", "GET", "/keyspace", "", customer, http.StatusForbidden, ""},
+		{"pool", "GET", "/pool", "", header, http.StatusOK, `*"enabled":false*`},
+		{"merchant pool", "GET", "/pool", "", merchant, http.StatusForbidden, ""},
+		{"cache", "GET", "/cache", "", header, http.StatusOK, `*"enabled":false*`},
+		{"customer cache", "GET", "/cache", "", customer, http.StatusForbidden, ""},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestAPI_KeyspaceExhausted(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	policy := config.DefaultTokenPolicy()
+	policy.MaxFillRatio = 0.5
+	repo := &mockRepository{issued: map[int]int{6: 300000, 8: 30000000}}
+	RegisterHandlers(router.Group(""), NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger),
+		auth.MockAuthHandler, auth.MockAuthHandler, idempotency.Handler(idempotency.NewMemoryStore(), time.Hour, logger),
+		bruteforce.Handler(bruteforce.NewGuard("token_guessing", bruteforce.NewMemoryStore(), config.DefaultBruteForcePolicy(), logger), logger), pagination.NewCursorSigner([]byte("secret")), logger)
+
+	tests := []test.APITestCase{
+		{"generate exhausted", "POST", "/generate", `{"customer_id":"6281100099"}`, auth.MockAuthHeader(), http.StatusServiceUnavailable, ""},
+		{"keyspace exhausted", "GET", "/keyspace", "", auth.MockAuthHeader(), http.StatusOK, `*"active":"exhausted"*`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func TestAPI_GenerateLimits(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	policy := config.DefaultTokenPolicy()
+	policy.MaxActive = 1
+	repo := &mockRepository{validUntil: []time.Time{time.Now().Add(time.Hour)}}
+	RegisterHandlers(router.Group(""), NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger),
+		auth.MockAuthHandler, auth.MockAuthHandler, idempotency.Handler(idempotency.NewMemoryStore(), time.Hour, logger),
+		bruteforce.Handler(bruteforce.NewGuard("token_guessing", bruteforce.NewMemoryStore(), config.DefaultBruteForcePolicy(), logger), logger), pagination.NewCursorSigner([]byte("secret")), logger)
+
+	tests := []test.APITestCase{
+		{"generate over limit", "POST", "/generate", `{"customer_id":"6281100099"}`, auth.MockAuthHeader(), http.StatusTooManyRequests, "*1 usable tokens*"},
 	}
 	for _, tc := range tests {
 		test.Endpoint(t, router, tc)
@@ -0,0 +1,131 @@
+package paytoken
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/kvstore"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// cachedRepository caches the tokens of the day looked up by GetTodayPayToken, which every validation,
+// redemption and cancellation starts with, in a key-value store. The other methods go to the repository.
+type cachedRepository struct {
+	Repository
+	store   kvstore.Store
+	ttl     time.Duration
+	metrics *cacheMetrics
+	logger  log.Logger
+}
+
+// cacheMetrics counts the lookups of the cached repository since the server started.
+type cacheMetrics struct {
+	// hits is the number of tokens found in the cache
+	hits int64
+	// misses is the number of tokens looked up in the repository
+	misses int64
+	// errors is the number of failed reads and writes of the cache
+	errors int64
+}
+
+// NewCachedRepository creates a repository which caches the tokens of the day read from repo in store for ttl.
+// Saving, updating or transitioning a token removes it from the cache, but a lookup running concurrently with
+// the change, or the change made by a server instance not sharing the store, may leave the previous state
+// of the token cached until ttl has elapsed. The tokens not found are not cached, and the failures
+// of the store fall back to repo.
+func NewCachedRepository(repo Repository, store kvstore.Store, ttl time.Duration, logger log.Logger) Repository {
+	return cachedRepository{repo, store, ttl, &cacheMetrics{}, logger}
+}
+
+// GetTodayPayToken returns the token issued for the date of today from the cache, or from the repository
+// if it is not cached yet.
+func (r cachedRepository) GetTodayPayToken(ctx context.Context, token string, today time.Time) (*entity.PayToken, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return r.Repository.GetTodayPayToken(ctx, token, today)
+	}
+
+	key := cacheKey(token, today)
+	value, ok, err := r.store.Get(ctx, key)
+	if err != nil {
+		atomic.AddInt64(&r.metrics.errors, 1)
+		r.logger.With(ctx).Warnf("failed to read the token cache: %v", err)
+	} else if ok {
+		var paytoken entity.PayToken
+		if err := json.Unmarshal(value, &paytoken); err == nil {
+			atomic.AddInt64(&r.metrics.hits, 1)
+			return &paytoken, nil
+		}
+	}
+
+	atomic.AddInt64(&r.metrics.misses, 1)
+	paytoken, err := r.Repository.GetTodayPayToken(ctx, token, today)
+	if err != nil {
+		return paytoken, err
+	}
+	value, err = json.Marshal(paytoken)
+	if err == nil {
+		err = r.store.Set(ctx, key, value, r.ttl)
+	}
+	if err != nil {
+		atomic.AddInt64(&r.metrics.errors, 1)
+		r.logger.With(ctx).Warnf("failed to write the token cache: %v", err)
+	}
+	return paytoken, nil
+}
+
+// Save stores the token, and removes it from the cache in case a previous token of the same day was cached.
+func (r cachedRepository) Save(ctx context.Context, paytoken entity.PayToken) error {
+	err := r.Repository.Save(ctx, paytoken)
+	r.invalidate(ctx, paytoken)
+	return err
+}
+
+// Update stores the updated token and removes it from the cache.
+func (r cachedRepository) Update(ctx context.Context, paytoken entity.PayToken) error {
+	err := r.Repository.Update(ctx, paytoken)
+	r.invalidate(ctx, paytoken)
+	return err
+}
+
+// Transition stores the status and metadata of the token and removes it from the cache. The token is removed
+// even if the transition failed, so that the token is read again from the repository before a retry.
+func (r cachedRepository) Transition(ctx context.Context, paytoken entity.PayToken, from entity.TokenStatus) error {
+	err := r.Repository.Transition(ctx, paytoken, from)
+	r.invalidate(ctx, paytoken)
+	return err
+}
+
+// invalidate removes the token from the cache.
+func (r cachedRepository) invalidate(ctx context.Context, paytoken entity.PayToken) {
+	if paytoken.Token == "" {
+		return
+	}
+	if err := r.store.Delete(ctx, cacheKey(paytoken.Token, paytoken.TokenDate)); err != nil {
+		atomic.AddInt64(&r.metrics.errors, 1)
+		r.logger.With(ctx).Errorf("failed to remove token from the cache, it may be stale for %v: %v", r.ttl, err)
+	}
+}
+
+// cacheStatus returns the lookups counted since the server started.
+func (r cachedRepository) cacheStatus() entity.OutCache {
+	out := entity.OutCache{
+		Enabled: true,
+		Hits:    atomic.LoadInt64(&r.metrics.hits),
+		Misses:  atomic.LoadInt64(&r.metrics.misses),
+		Errors:  atomic.LoadInt64(&r.metrics.errors),
+	}
+	if lookups := out.Hits + out.Misses; lookups > 0 {
+		out.HitRatio = float64(out.Hits) / float64(lookups)
+	}
+	return out
+}
+
+// cacheKey returns the cache key of the token issued for the date of day.
+func cacheKey(token string, day time.Time) string {
+	return "paytoken:" + day.Format("2006-01-02") + ":" + token
+}
@@ -0,0 +1,142 @@
+package paytoken
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/generator"
+	"github.com/pauluswi/tulip/pkg/kvstore"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachedRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	ctx := context.Background()
+	today := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	token := entity.PayToken{ID: "1", Token: "123456", TokenDate: today, CustomerID: "6281100099",
+		ValidUntil: today.Add(time.Hour), Status: entity.TokenStatusActive}
+	repo := &lookupRepository{tokens: map[string]entity.PayToken{"123456": token}}
+	store := kvstore.NewLRU(10)
+	cached := NewCachedRepository(repo, store, time.Minute, logger)
+
+	// the first lookup reads the repository, the next ones the cache
+	for i := 0; i < 3; i++ {
+		paytoken, err := cached.GetTodayPayToken(ctx, " 123456 ", today)
+		assert.Nil(t, err)
+		assert.Equal(t, "1", paytoken.ID)
+		assert.Equal(t, entity.TokenStatusActive, paytoken.Status)
+		assert.True(t, paytoken.ValidUntil.Equal(token.ValidUntil))
+	}
+	assert.Equal(t, 1, repo.lookups)
+
+	// the tokens of another day are cached apart
+	_, err := cached.GetTodayPayToken(ctx, "123456", today.AddDate(0, 0, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, repo.lookups)
+
+	// a transition removes the token from the cache, even if it failed
+	token.Status = entity.TokenStatusValidated
+	assert.Nil(t, cached.Transition(ctx, token, entity.TokenStatusActive))
+	paytoken, _ := cached.GetTodayPayToken(ctx, "123456", today)
+	assert.Equal(t, entity.TokenStatusValidated, paytoken.Status)
+	assert.Equal(t, 3, repo.lookups)
+	repo.err = entity.ErrTokenStatusConflict
+	assert.Equal(t, entity.ErrTokenStatusConflict, cached.Transition(ctx, token, entity.TokenStatusActive))
+	repo.err = nil
+	_, _ = cached.GetTodayPayToken(ctx, "123456", today)
+	assert.Equal(t, 4, repo.lookups)
+
+	// saving and updating remove the token from the cache as well
+	assert.Nil(t, cached.Update(ctx, token))
+	_, _ = cached.GetTodayPayToken(ctx, "123456", today)
+	assert.Equal(t, 5, repo.lookups)
+	assert.Nil(t, cached.Save(ctx, token))
+	_, _ = cached.GetTodayPayToken(ctx, "123456", today)
+	assert.Equal(t, 6, repo.lookups)
+
+	// the tokens not found are not cached
+	for i := 0; i < 2; i++ {
+		_, err = cached.GetTodayPayToken(ctx, "654321", today)
+		assert.Equal(t, sql.ErrNoRows, err)
+	}
+	assert.Equal(t, 8, repo.lookups)
+
+	s := NewService(cached, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+	status, err := s.CacheStatus(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, entity.OutCache{Enabled: true, Hits: 2, Misses: 8, HitRatio: 0.2}, status)
+
+	s = NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+	status, err = s.CacheStatus(ctx)
+	assert.Nil(t, err)
+	assert.False(t, status.Enabled)
+}
+
+func TestCachedRepository_StoreFailure(t *testing.T) {
+	logger, entries := log.NewForTest()
+	ctx := context.Background()
+	today := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	repo := &lookupRepository{tokens: map[string]entity.PayToken{"123456": {ID: "1", Token: "123456", TokenDate: today}}}
+	cached := NewCachedRepository(repo, failingStore{}, time.Minute, logger)
+
+	// the lookups fall back to the repository
+	paytoken, err := cached.GetTodayPayToken(ctx, "123456", today)
+	assert.Nil(t, err)
+	assert.Equal(t, "1", paytoken.ID)
+	assert.Nil(t, cached.Transition(ctx, *paytoken, entity.TokenStatusActive))
+	assert.Equal(t, int64(3), cached.(cachedRepository).cacheStatus().Errors)
+	assert.Equal(t, 3, entries.Len())
+}
+
+// lookupRepository counts the lookups of the tokens it holds.
+type lookupRepository struct {
+	Repository
+	tokens  map[string]entity.PayToken
+	lookups int
+	err     error
+}
+
+func (r *lookupRepository) GetTodayPayToken(ctx context.Context, token string, today time.Time) (*entity.PayToken, error) {
+	r.lookups++
+	paytoken, ok := r.tokens[token]
+	if !ok {
+		return &entity.PayToken{}, sql.ErrNoRows
+	}
+	return &paytoken, nil
+}
+
+func (r *lookupRepository) Save(ctx context.Context, paytoken entity.PayToken) error {
+	return r.Update(ctx, paytoken)
+}
+
+func (r *lookupRepository) Update(ctx context.Context, paytoken entity.PayToken) error {
+	if r.err == nil {
+		r.tokens[paytoken.Token] = paytoken
+	}
+	return r.err
+}
+
+func (r *lookupRepository) Transition(ctx context.Context, paytoken entity.PayToken, from entity.TokenStatus) error {
+	return r.Update(ctx, paytoken)
+}
+
+// failingStore fails every operation.
+type failingStore struct{}
+
+func (failingStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	return nil, false, errors.New("store down")
+}
+
+func (failingStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return errors.New("store down")
+}
+
+func (failingStore) Delete(ctx context.Context, keys ...string) error {
+	return errors.New("store down")
+}
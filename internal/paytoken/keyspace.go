@@ -0,0 +1,110 @@
+package paytoken
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/generator"
+)
+
+// keyspaceRefresh is how long the number of tokens issued for a token day is trusted before it is counted again.
+const keyspaceRefresh = time.Minute
+
+// keyspace represents the tokens which can be generated with a length and an alphabet.
+type keyspace struct {
+	generator generator.Generator
+	length    int
+	alphabet  string
+	// size is the number of distinct tokens, the check digit does not add any
+	size float64
+}
+
+// newKeyspace creates the keyspace of the tokens of the given length made of the alphabet.
+func newKeyspace(gen generator.Generator, length int, alphabet string, checkDigit bool) keyspace {
+	digits := length
+	if checkDigit {
+		digits--
+	}
+	return keyspace{gen, length, alphabet, math.Pow(float64(len(alphabet)), float64(digits))}
+}
+
+// usage returns the usage of the keyspace when the given number of tokens have been issued.
+func (k keyspace) usage(issued int) entity.KeyspaceUsage {
+	return entity.KeyspaceUsage{
+		Length:    k.length,
+		Alphabet:  k.alphabet,
+		Size:      k.size,
+		Issued:    issued,
+		FillRatio: float64(issued) / k.size,
+	}
+}
+
+// keyspaceMonitor tracks the number of tokens issued per token day and token length. The tokens are counted
+// in the repository at most once per keyspaceRefresh, the tokens issued by this server instance in between
+// are added to the count.
+type keyspaceMonitor struct {
+	mu     sync.Mutex
+	counts map[issuedKey]issuedCount
+}
+
+// issuedKey identifies the tokens of a length issued for a token day.
+type issuedKey struct {
+	date   string
+	length int
+}
+
+// issuedCount is the number of tokens issued, as counted at a given time.
+type issuedCount struct {
+	count     int
+	countedAt time.Time
+}
+
+// newKeyspaceMonitor creates a new keyspace monitor.
+func newKeyspaceMonitor() *keyspaceMonitor {
+	return &keyspaceMonitor{counts: map[issuedKey]issuedCount{}}
+}
+
+// issued returns the number of tokens of the given length issued for the date of today, and whether the
+// number has just been counted in the repository.
+func (m *keyspaceMonitor) issued(ctx context.Context, repo Repository, today time.Time, length int) (int, bool, error) {
+	key := issuedKey{today.Format("2006-01-02"), length}
+	now := time.Now()
+
+	m.mu.Lock()
+	current, ok := m.counts[key]
+	m.mu.Unlock()
+	if ok && now.Sub(current.countedAt) < keyspaceRefresh {
+		return current.count, false, nil
+	}
+
+	count, err := repo.CountIssued(ctx, today, length)
+	if err != nil {
+		return 0, false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// the counts of past token days are not needed anymore
+	for k, c := range m.counts {
+		if now.Sub(c.countedAt) > 24*time.Hour {
+			delete(m.counts, k)
+		}
+	}
+	m.counts[key] = issuedCount{count, now}
+	return count, true, nil
+}
+
+// add records a token of the given length issued for the date of today.
+func (m *keyspaceMonitor) add(today time.Time, length int) {
+	key := issuedKey{today.Format("2006-01-02"), length}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if current, ok := m.counts[key]; ok {
+		current.count++
+		m.counts[key] = current
+	}
+}
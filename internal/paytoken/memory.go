@@ -0,0 +1,289 @@
+package paytoken
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/pagination"
+)
+
+// memoryRepository keeps payment tokens in memory, which only suits tests and local runs of a single server
+// instance. It enforces the same unique (token, token_date) index and returns the same errors as the database
+// repository.
+type memoryRepository struct {
+	mu sync.RWMutex
+	// tokens holds the tokens by ID
+	tokens map[string]entity.PayToken
+	// ids holds the token IDs by token date and token
+	ids map[string]string
+}
+
+// NewMemoryRepository creates a payment token repository which keeps the tokens in memory.
+func NewMemoryRepository() Repository {
+	return &memoryRepository{tokens: map[string]entity.PayToken{}, ids: map[string]string{}}
+}
+
+// Get returns the customer's token information with the specified token string, issued for the latest date.
+func (m *memoryRepository) Get(ctx context.Context, token string) (entity.PayToken, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found entity.PayToken
+	for _, paytoken := range m.tokens {
+		if paytoken.Token == token && (found.ID == "" || paytoken.TokenDate.After(found.TokenDate)) {
+			found = paytoken
+		}
+	}
+	if found.ID == "" {
+		return found, sql.ErrNoRows
+	}
+	return clonePayToken(found), nil
+}
+
+// GetTodayPayToken return a token that still valid and not expire with the specified today date.
+func (m *memoryRepository) GetTodayPayToken(ctx context.Context, tokenString string, today time.Time) (*entity.PayToken, error) {
+	tokenString = strings.TrimSpace(tokenString)
+	if tokenString == "" {
+		err := fmt.Errorf("%w: empty token string", entity.ErrInputValidation)
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	id, ok := m.ids[memoryKey(tokenString, today)]
+	if !ok {
+		return &entity.PayToken{}, sql.ErrNoRows
+	}
+	paytoken := clonePayToken(m.tokens[id])
+	return &paytoken, nil
+}
+
+// Save will store a token information. Like the database repository, it stores empty metadata.
+func (m *memoryRepository) Save(ctx context.Context, paytoken entity.PayToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := memoryKey(paytoken.Token, paytoken.TokenDate)
+	if _, ok := m.ids[key]; ok {
+		return fmt.Errorf("%w: duplicate key value violates unique constraint %q", entity.ErrDuplicateTokenPerDate, entity.PGConstraintUniqueTokenAndTokenDate)
+	}
+	if _, ok := m.tokens[paytoken.ID]; ok {
+		return fmt.Errorf("%w: duplicate key value violates unique constraint %q", entity.ErrUniqueViolation, "paytokens_pkey")
+	}
+	year, month, day := paytoken.TokenDate.Date()
+	paytoken.TokenDate = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	paytoken.Metadata = entity.Metadata{}
+	m.tokens[paytoken.ID] = paytoken
+	m.ids[key] = paytoken.ID
+	return nil
+}
+
+// Update will store the updated metadata of a token.
+func (m *memoryRepository) Update(ctx context.Context, paytoken entity.PayToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.tokens[paytoken.ID]; ok {
+		stored.Metadata = clonePayToken(paytoken).Metadata
+		stored.UpdatedAt = paytoken.UpdatedAt
+		m.tokens[paytoken.ID] = stored
+	}
+	return nil
+}
+
+// Transition atomically stores the status and metadata of a token, provided its stored status is still from.
+func (m *memoryRepository) Transition(ctx context.Context, paytoken entity.PayToken, from entity.TokenStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.tokens[paytoken.ID]
+	if !ok || stored.Status != from {
+		return entity.ErrTokenStatusConflict
+	}
+	stored.Status = paytoken.Status
+	stored.Metadata = clonePayToken(paytoken).Metadata
+	stored.UpdatedAt = paytoken.UpdatedAt
+	m.tokens[paytoken.ID] = stored
+	return nil
+}
+
+// Query returns at most limit payment tokens matching the filter, skipping the first offset tokens.
+func (m *memoryRepository) Query(ctx context.Context, filter entity.TokenFilter, offset, limit int) ([]entity.PayToken, error) {
+	paytokens := m.find(func(paytoken entity.PayToken) bool {
+		return matchesFilter(filter, paytoken)
+	})
+	sortKey := filter.Sort
+	if _, ok := sortColumns[sortKey]; !ok {
+		sortKey = "-created_at"
+	}
+	sort.Slice(paytokens, func(i, j int) bool {
+		return lessPayToken(paytokens[i], paytokens[j], sortKey)
+	})
+	return page(paytokens, offset, limit), nil
+}
+
+// Count returns the number of payment tokens matching the filter.
+func (m *memoryRepository) Count(ctx context.Context, filter entity.TokenFilter) (int, error) {
+	return len(m.find(func(paytoken entity.PayToken) bool {
+		return matchesFilter(filter, paytoken)
+	})), nil
+}
+
+// Seek returns the payment tokens matching the filter which follow or precede the cursor of the keyset,
+// in the order pagination.Keyset.Page expects them.
+func (m *memoryRepository) Seek(ctx context.Context, filter entity.TokenFilter, keyset *pagination.Keyset) ([]entity.PayToken, error) {
+	// the tokens are read in the reverse order of the list when going backward, like pagination.Keyset.Apply does
+	descending := keyset.Descending != (keyset.Cursor != nil && keyset.Cursor.Before)
+	sortKey := "created_at"
+	if descending {
+		sortKey = "-created_at"
+	}
+	paytokens := m.find(func(paytoken entity.PayToken) bool {
+		if !matchesFilter(filter, paytoken) {
+			return false
+		}
+		if keyset.Cursor == nil {
+			return true
+		}
+		cursor := entity.PayToken{ID: keyset.Cursor.ID, CreatedAt: keyset.Cursor.CreatedAt}
+		return lessPayToken(cursor, paytoken, sortKey)
+	})
+	sort.Slice(paytokens, func(i, j int) bool {
+		return lessPayToken(paytokens[i], paytokens[j], sortKey)
+	})
+	return page(paytokens, 0, keyset.PerPage+1), nil
+}
+
+// CountActive returns the number of tokens of a customer which are still usable at the given time,
+// and the earliest end of validity among them.
+func (m *memoryRepository) CountActive(ctx context.Context, customerID string, now time.Time) (int, time.Time, error) {
+	paytokens := m.find(func(paytoken entity.PayToken) bool {
+		return paytoken.CustomerID == customerID &&
+			(paytoken.Status == entity.TokenStatusActive || paytoken.Status == entity.TokenStatusValidated) &&
+			paytoken.ValidUntil.After(now)
+	})
+	var earliest time.Time
+	for _, paytoken := range paytokens {
+		if earliest.IsZero() || paytoken.ValidUntil.Before(earliest) {
+			earliest = paytoken.ValidUntil
+		}
+	}
+	return len(paytokens), earliest, nil
+}
+
+// CountGenerated returns the number of tokens generated for a customer since the given time,
+// and the creation time of the earliest of them.
+func (m *memoryRepository) CountGenerated(ctx context.Context, customerID string, since time.Time) (int, time.Time, error) {
+	paytokens := m.find(func(paytoken entity.PayToken) bool {
+		return paytoken.CustomerID == customerID && !paytoken.CreatedAt.Before(since)
+	})
+	var earliest time.Time
+	for _, paytoken := range paytokens {
+		if earliest.IsZero() || paytoken.CreatedAt.Before(earliest) {
+			earliest = paytoken.CreatedAt
+		}
+	}
+	return len(paytokens), earliest, nil
+}
+
+// CountIssued returns the number of tokens of the given length issued for the date of today.
+func (m *memoryRepository) CountIssued(ctx context.Context, today time.Time, length int) (int, error) {
+	date := today.Format("2006-01-02")
+	return len(m.find(func(paytoken entity.PayToken) bool {
+		return paytoken.TokenDate.Format("2006-01-02") == date && utf8.RuneCountInString(paytoken.Token) == length
+	})), nil
+}
+
+// find returns a copy of the tokens matching the condition, in no particular order.
+func (m *memoryRepository) find(match func(paytoken entity.PayToken) bool) []entity.PayToken {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var paytokens []entity.PayToken
+	for _, paytoken := range m.tokens {
+		if match(paytoken) {
+			paytokens = append(paytokens, clonePayToken(paytoken))
+		}
+	}
+	return paytokens
+}
+
+// memoryKey returns the key of the unique (token, token_date) index.
+func memoryKey(token string, day time.Time) string {
+	return day.Format("2006-01-02") + ":" + token
+}
+
+// clonePayToken returns a copy of the token which shares no metadata with it.
+func clonePayToken(paytoken entity.PayToken) entity.PayToken {
+	if paytoken.Metadata.Redemption != nil {
+		redemption := *paytoken.Metadata.Redemption
+		paytoken.Metadata.Redemption = &redemption
+	}
+	if paytoken.Metadata.Cancellation != nil {
+		cancellation := *paytoken.Metadata.Cancellation
+		paytoken.Metadata.Cancellation = &cancellation
+	}
+	return paytoken
+}
+
+// matchesFilter tells whether the token matches the filter, as filterExp does in the database.
+func matchesFilter(filter entity.TokenFilter, paytoken entity.PayToken) bool {
+	if paytoken.CustomerID != filter.CustomerID ||
+		!filter.From.IsZero() && paytoken.CreatedAt.Before(filter.From) ||
+		!filter.To.IsZero() && !paytoken.CreatedAt.Before(filter.To) {
+		return false
+	}
+	status := paytoken.EffectiveStatus(filter.Now)
+	if filter.Expired != nil && *filter.Expired != (status == entity.TokenStatusExpired) {
+		return false
+	}
+	if len(filter.Statuses) == 0 {
+		return true
+	}
+	for _, s := range filter.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// lessPayToken tells whether a comes before b in the order of the sort option, with the same tie breakers
+// as sortColumns.
+func lessPayToken(a, b entity.PayToken, sortKey string) bool {
+	descending := strings.HasPrefix(sortKey, "-")
+	var keys [][2]time.Time
+	switch strings.TrimPrefix(sortKey, "-") {
+	case "valid_until":
+		keys = [][2]time.Time{{a.ValidUntil, b.ValidUntil}}
+	case "token_date":
+		keys = [][2]time.Time{{a.TokenDate, b.TokenDate}, {a.CreatedAt, b.CreatedAt}}
+	default:
+		keys = [][2]time.Time{{a.CreatedAt, b.CreatedAt}}
+	}
+	for _, key := range keys {
+		if !key[0].Equal(key[1]) {
+			return key[0].Before(key[1]) != descending
+		}
+	}
+	return a.ID < b.ID != descending && a.ID != b.ID
+}
+
+// page returns at most limit tokens, skipping the first offset tokens.
+func page(paytokens []entity.PayToken, offset, limit int) []entity.PayToken {
+	if offset > len(paytokens) {
+		offset = len(paytokens)
+	}
+	paytokens = paytokens[offset:]
+	if limit < len(paytokens) {
+		paytokens = paytokens[:limit]
+	}
+	return paytokens
+}
@@ -0,0 +1,28 @@
+package paytoken
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/pauluswi/tulip/internal/entity"
+)
+
+// translatePGError maps known Postgres errors to typed domain errors so that callers can use errors.Is
+// instead of inspecting driver specific error codes. Errors that are not recognized are returned as is.
+func translatePGError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	switch pqErr.Code {
+	case entity.PGErrCodeUniqueViolation:
+		if pqErr.Constraint == entity.PGConstraintUniqueTokenAndTokenDate {
+			return fmt.Errorf("%w: %s", entity.ErrDuplicateTokenPerDate, pqErr.Message)
+		}
+		return fmt.Errorf("%w: %s", entity.ErrUniqueViolation, pqErr.Message)
+	}
+
+	return err
+}
@@ -0,0 +1,139 @@
+package paytoken
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/lib/pq"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// ErrPoolEmpty is returned when the pool has no token left for a token day.
+var ErrPoolEmpty = errors.New("token pool empty")
+
+// Pool keeps the tokens reserved in advance for the upcoming token days.
+type Pool interface {
+	// Claim removes a token of the given length reserved for the date of today from the pool and returns it.
+	// The date of today is taken in the location of the given time. ErrPoolEmpty is returned if no such token is left.
+	Claim(ctx context.Context, today time.Time, length int) (string, error)
+	// Reserve adds the tokens to the pool for the date of day, leaving out the tokens which are already reserved
+	// or issued for that date. It returns the number of tokens added.
+	Reserve(ctx context.Context, day time.Time, tokens []string) (int, error)
+	// Count returns the number of tokens of the given length left in the pool for the date of day.
+	Count(ctx context.Context, day time.Time, length int) (int, error)
+	// Prune removes the tokens reserved for the dates before the date of day.
+	Prune(ctx context.Context, day time.Time) error
+}
+
+// pool keeps reserved tokens in database, so that they are shared by all the server instances
+type pool struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewPool creates a new token pool backed by the database
+func NewPool(db *dbcontext.DB, logger log.Logger) Pool {
+	return pool{db, logger}
+}
+
+// Claim removes a token of the given length reserved for the date of today from the pool and returns it.
+// The tokens locked by concurrent claims are skipped, so that concurrent claims neither wait nor get the same token.
+func (p pool) Claim(ctx context.Context, today time.Time, length int) (string, error) {
+	var token string
+	err := p.db.With(ctx).
+		NewQuery(`DELETE FROM token_pool WHERE token_date = {:date} AND token = (
+				SELECT token FROM token_pool WHERE token_date = {:date} AND length(token) = {:length}
+				LIMIT 1 FOR UPDATE SKIP LOCKED
+			) RETURNING token`).
+		Bind(dbx.Params{"date": today.Format("2006-01-02"), "length": length}).
+		Row(&token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrPoolEmpty
+	}
+	return token, err
+}
+
+// Reserve adds the tokens to the pool for the date of day, leaving out the tokens already reserved or issued.
+func (p pool) Reserve(ctx context.Context, day time.Time, tokens []string) (int, error) {
+	result, err := p.db.With(ctx).
+		NewQuery(`INSERT INTO token_pool (token, token_date)
+			SELECT t.token, {:date}::DATE FROM unnest({:tokens}::VARCHAR[]) AS t(token)
+			WHERE NOT EXISTS (SELECT 1 FROM paytokens p WHERE p.token = t.token AND p.token_date = {:date})
+			ON CONFLICT DO NOTHING`).
+		Bind(dbx.Params{"date": day.Format("2006-01-02"), "tokens": pq.Array(tokens)}).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+	added, err := result.RowsAffected()
+	return int(added), err
+}
+
+// Count returns the number of tokens of the given length left in the pool for the date of day.
+func (p pool) Count(ctx context.Context, day time.Time, length int) (int, error) {
+	var count int
+	err := p.db.With(ctx).Select("COUNT(*)").
+		From("token_pool").
+		Where(dbx.And(
+			dbx.HashExp{"token_date": day.Format("2006-01-02")},
+			dbx.NewExp("length(token) = {:length}", dbx.Params{"length": length}),
+		)).
+		Row(&count)
+	return count, err
+}
+
+// Prune removes the tokens reserved for the dates before the date of day.
+func (p pool) Prune(ctx context.Context, day time.Time) error {
+	_, err := p.db.With(ctx).Delete("token_pool",
+		dbx.NewExp("token_date < {:date}", dbx.Params{"date": day.Format("2006-01-02")})).Execute()
+	return err
+}
+
+// poolMetrics counts the activity of the token pool since the server started.
+type poolMetrics struct {
+	// claimed is the number of tokens claimed from the pool
+	claimed int64
+	// missed is the number of tokens generated on the fly because the pool was empty or failing
+	missed int64
+	// reserved is the number of tokens added to the pool
+	reserved int64
+	// collisions is the number of tokens generated for the pool which were already reserved or issued
+	collisions int64
+	// refills is the number of times the pool has been checked and refilled
+	refills int64
+}
+
+// snapshot returns the current values of the metrics.
+func (m *poolMetrics) snapshot() entity.OutPool {
+	return entity.OutPool{
+		Claimed:    atomic.LoadInt64(&m.claimed),
+		Missed:     atomic.LoadInt64(&m.missed),
+		Reserved:   atomic.LoadInt64(&m.reserved),
+		Collisions: atomic.LoadInt64(&m.collisions),
+		Refills:    atomic.LoadInt64(&m.refills),
+	}
+}
+
+// RunPoolWorker refills the token pool of the service right away and then at every interval, until ctx is done.
+// Every server instance may run a worker: concurrent refills may overfill the pool a little, but never reserve
+// a token twice.
+func RunPoolWorker(ctx context.Context, service Service, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := service.RefillPool(ctx); err != nil && ctx.Err() == nil {
+			logger.With(ctx).Errorf("failed to refill the token pool: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
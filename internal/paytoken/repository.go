@@ -2,6 +2,7 @@ package paytoken
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"strings"
 	"time"
@@ -10,22 +11,45 @@ import (
 	"github.com/pauluswi/tulip/internal/entity"
 	"github.com/pauluswi/tulip/pkg/dbcontext"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/pagination"
 )
 
 // Repository encapsulates the logic to access paytoken from the data source.
 type Repository interface {
 	// Get returns the customer's token information with the specified token string.
 	Get(ctx context.Context, token string) (entity.PayToken, error)
-	// GetPayTokens return all payment token belong to a customer.
-	GetPayTokens(ctx context.Context, customer_id string) ([]entity.PayToken, error)
+	// Query returns at most limit payment tokens matching the filter, skipping the first offset tokens.
+	Query(ctx context.Context, filter entity.TokenFilter, offset, limit int) ([]entity.PayToken, error)
+	// Count returns the number of payment tokens matching the filter.
+	Count(ctx context.Context, filter entity.TokenFilter) (int, error)
+	// Seek returns the payment tokens matching the filter which follow or precede the cursor of the keyset,
+	// as read by the query prepared by pagination.Keyset.Apply.
+	Seek(ctx context.Context, filter entity.TokenFilter, keyset *pagination.Keyset) ([]entity.PayToken, error)
 	// GetTodayPayToken return a token that still valid and not expire with the specified today date.
-	GetTodayPayToken(ctx context.Context, token string) (*entity.PayToken, error)
+	// The date of today is taken in the location of the given time.
+	GetTodayPayToken(ctx context.Context, token string, today time.Time) (*entity.PayToken, error)
 	// Save will store a token information into data source.
+	// It returns entity.ErrDuplicateTokenPerDate if the token has already been issued for the same date.
 	Save(ctx context.Context, paytoken entity.PayToken) error
 	// Update will store an updated token information into data source.
 	Update(ctx context.Context, paytoken entity.PayToken) error
+	// Transition atomically stores the status and metadata of a token, provided its status in the data source is still from.
+	// It returns entity.ErrTokenStatusConflict if the token status has been changed in the meantime.
+	Transition(ctx context.Context, paytoken entity.PayToken, from entity.TokenStatus) error
+	// CountActive returns the number of tokens of a customer which are still usable at the given time,
+	// and the earliest end of validity among them.
+	CountActive(ctx context.Context, customerID string, now time.Time) (int, time.Time, error)
+	// CountGenerated returns the number of tokens generated for a customer since the given time,
+	// and the creation time of the earliest of them.
+	CountGenerated(ctx context.Context, customerID string, since time.Time) (int, time.Time, error)
+	// CountIssued returns the number of tokens of the given length issued for the date of today,
+	// whatever their status. The date of today is taken in the location of the given time.
+	CountIssued(ctx context.Context, today time.Time, length int) (int, error)
 }
 
+// columns lists the paytokens columns read into entity.PayToken.
+var columns = []string{"id", "token", "token_date", "customer_id", "valid_until", "status", "metadata", "created_at", "updated_at"}
+
 // repository persists paytoken in database
 type repository struct {
 	db     *dbcontext.DB
@@ -40,25 +64,106 @@ func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
 // Get returns the customer's token information with the specified token string.
 func (r repository) Get(ctx context.Context, token string) (entity.PayToken, error) {
 	var paytoken entity.PayToken
-	err := r.db.With(ctx).Select("id", "token", "token_date", "customer_id", "valid_until", "metadata", "created_at", "updated_at").
+	err := r.db.With(ctx).Select(columns...).
 		From("paytokens").
 		Where(dbx.HashExp{"token": token}).
 		One(&paytoken)
 	return paytoken, err
 }
 
-// GetPayTokens return all payment token belong to a customer.
-func (r repository) GetPayTokens(ctx context.Context, customer_id string) ([]entity.PayToken, error) {
+// sortColumns maps the sort options of entity.TokenFilter to the ORDER BY clauses. The id breaks the ties,
+// so that the tokens sharing the same value keep their order from one page to the next.
+var sortColumns = map[string][]string{
+	"created_at":   {"created_at ASC", "id ASC"},
+	"-created_at":  {"created_at DESC", "id DESC"},
+	"valid_until":  {"valid_until ASC", "id ASC"},
+	"-valid_until": {"valid_until DESC", "id DESC"},
+	"token_date":   {"token_date ASC", "created_at ASC", "id ASC"},
+	"-token_date":  {"token_date DESC", "created_at DESC", "id DESC"},
+}
+
+// Query returns at most limit payment tokens matching the filter, skipping the first offset tokens.
+func (r repository) Query(ctx context.Context, filter entity.TokenFilter, offset, limit int) ([]entity.PayToken, error) {
+	orderBy, ok := sortColumns[filter.Sort]
+	if !ok {
+		orderBy = sortColumns["-created_at"]
+	}
 	var paytokens []entity.PayToken
-	err := r.db.With(ctx).Select("id", "token", "token_date", "customer_id", "valid_until", "metadata", "created_at", "updated_at").
+	err := r.db.With(ctx).Select(columns...).
 		From("paytokens").
-		Where(dbx.HashExp{"customer_id": customer_id}).
+		Where(filterExp(filter)).
+		OrderBy(orderBy...).
+		Offset(int64(offset)).
+		Limit(int64(limit)).
 		All(&paytokens)
 	return paytokens, err
 }
 
+// Seek returns the payment tokens matching the filter which follow or precede the cursor of the keyset.
+func (r repository) Seek(ctx context.Context, filter entity.TokenFilter, keyset *pagination.Keyset) ([]entity.PayToken, error) {
+	var paytokens []entity.PayToken
+	q := r.db.With(ctx).Select(columns...).
+		From("paytokens").
+		Where(filterExp(filter))
+	err := keyset.Apply(q, "created_at", "id").All(&paytokens)
+	return paytokens, err
+}
+
+// Count returns the number of payment tokens matching the filter.
+func (r repository) Count(ctx context.Context, filter entity.TokenFilter) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").
+		From("paytokens").
+		Where(filterExp(filter)).
+		Row(&count)
+	return count, err
+}
+
+// filterExp returns the condition selecting the payment tokens matching the filter. The statuses are matched
+// against the effective status of the tokens at filter.Now, as reported by entity.PayToken.EffectiveStatus.
+func filterExp(filter entity.TokenFilter) dbx.Expression {
+	now := dbx.Params{"now": filter.Now}
+	expired := dbx.Or(
+		dbx.HashExp{"status": entity.TokenStatusExpired},
+		dbx.And(
+			dbx.HashExp{"status": []interface{}{entity.TokenStatusActive, entity.TokenStatusValidated}},
+			dbx.NewExp("valid_until < {:now}", now),
+		),
+	)
+
+	exps := []dbx.Expression{dbx.HashExp{"customer_id": filter.CustomerID}}
+	if !filter.From.IsZero() {
+		exps = append(exps, dbx.NewExp("created_at >= {:from}", dbx.Params{"from": filter.From}))
+	}
+	if !filter.To.IsZero() {
+		exps = append(exps, dbx.NewExp("created_at < {:to}", dbx.Params{"to": filter.To}))
+	}
+	if len(filter.Statuses) > 0 {
+		var statuses []dbx.Expression
+		for _, status := range filter.Statuses {
+			switch {
+			case status == entity.TokenStatusExpired:
+				statuses = append(statuses, expired)
+			case status.IsFinal():
+				statuses = append(statuses, dbx.HashExp{"status": status})
+			default:
+				statuses = append(statuses, dbx.And(dbx.HashExp{"status": status}, dbx.NewExp("valid_until >= {:now}", now)))
+			}
+		}
+		exps = append(exps, dbx.Or(statuses...))
+	}
+	if filter.Expired != nil {
+		if *filter.Expired {
+			exps = append(exps, expired)
+		} else {
+			exps = append(exps, dbx.Not(expired))
+		}
+	}
+	return dbx.And(exps...)
+}
+
 // GetTodayPayToken return a token that still valid and not expire with the specified today date.
-func (r repository) GetTodayPayToken(ctx context.Context, tokenString string) (*entity.PayToken, error) {
+func (r repository) GetTodayPayToken(ctx context.Context, tokenString string, today time.Time) (*entity.PayToken, error) {
 	tokenString = strings.TrimSpace(tokenString)
 	if tokenString == "" {
 		err := fmt.Errorf("%w: empty token string", entity.ErrInputValidation)
@@ -66,10 +171,9 @@ func (r repository) GetTodayPayToken(ctx context.Context, tokenString string) (*
 	}
 
 	paytoken := &entity.PayToken{}
-	today := time.Now().UTC().Format("2006-01-02")
-	err := r.db.With(ctx).Select("id", "token", "token_date", "customer_id", "valid_until", "metadata", "created_at", "updated_at").
+	err := r.db.With(ctx).Select(columns...).
 		From("paytokens").
-		Where(dbx.HashExp{"token": tokenString, "token_date": today}).
+		Where(dbx.HashExp{"token": tokenString, "token_date": today.Format("2006-01-02")}).
 		One(paytoken)
 	return paytoken, err
 
@@ -80,14 +184,15 @@ func (r repository) Save(ctx context.Context, paytoken entity.PayToken) error {
 	_, err := r.db.With(ctx).Insert("paytokens", dbx.Params{
 		"id":          paytoken.ID,
 		"token":       paytoken.Token,
-		"token_date":  paytoken.TokenDate,
+		"token_date":  paytoken.TokenDate.Format("2006-01-02"),
 		"customer_id": paytoken.CustomerID,
 		"valid_until": paytoken.ValidUntil,
+		"status":      paytoken.Status,
 		"metadata":    "{}",
 		"created_at":  paytoken.CreatedAt,
 		"updated_at":  paytoken.UpdatedAt,
 	}).Execute()
-	return err
+	return translatePGError(err)
 }
 
 // Update will store an updated token information into data source.
@@ -96,5 +201,69 @@ func (r repository) Update(ctx context.Context, paytoken entity.PayToken) error
 		"metadata":   paytoken.Metadata,
 		"updated_at": paytoken.UpdatedAt,
 	}, dbx.HashExp{"id": paytoken.ID}).Execute()
-	return err
+	return translatePGError(err)
+}
+
+// Transition atomically stores the status and metadata of a token, provided its status in the data source is still from.
+// The status works as a compare-and-set guard, so that only one of several concurrent transitions can succeed.
+func (r repository) Transition(ctx context.Context, paytoken entity.PayToken, from entity.TokenStatus) error {
+	result, err := r.db.With(ctx).Update("paytokens", dbx.Params{
+		"status":     paytoken.Status,
+		"metadata":   paytoken.Metadata,
+		"updated_at": paytoken.UpdatedAt,
+	}, dbx.HashExp{"id": paytoken.ID, "status": from}).Execute()
+	if err != nil {
+		return translatePGError(err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return entity.ErrTokenStatusConflict
+	}
+	return nil
+}
+
+// CountActive returns the number of tokens of a customer which are still usable at the given time,
+// and the earliest end of validity among them.
+func (r repository) CountActive(ctx context.Context, customerID string, now time.Time) (int, time.Time, error) {
+	return r.count(ctx, "valid_until", dbx.And(
+		dbx.HashExp{"customer_id": customerID, "status": []interface{}{entity.TokenStatusActive, entity.TokenStatusValidated}},
+		dbx.NewExp("valid_until > {:now}", dbx.Params{"now": now}),
+	))
+}
+
+// CountGenerated returns the number of tokens generated for a customer since the given time,
+// and the creation time of the earliest of them.
+func (r repository) CountGenerated(ctx context.Context, customerID string, since time.Time) (int, time.Time, error) {
+	return r.count(ctx, "created_at", dbx.And(
+		dbx.HashExp{"customer_id": customerID},
+		dbx.NewExp("created_at >= {:since}", dbx.Params{"since": since}),
+	))
+}
+
+// CountIssued returns the number of tokens of the given length issued for the date of today.
+func (r repository) CountIssued(ctx context.Context, today time.Time, length int) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").
+		From("paytokens").
+		Where(dbx.And(
+			dbx.HashExp{"token_date": today.Format("2006-01-02")},
+			dbx.NewExp("length(token) = {:length}", dbx.Params{"length": length}),
+		)).
+		Row(&count)
+	return count, err
+}
+
+// count returns the number of tokens matching the condition, and the minimum of the given time column among them.
+func (r repository) count(ctx context.Context, column string, where dbx.Expression) (int, time.Time, error) {
+	var count int
+	var earliest sql.NullTime
+	err := r.db.With(ctx).Select("COUNT(*)", "MIN("+column+")").
+		From("paytokens").
+		Where(where).
+		Row(&count, &earliest)
+	return count, earliest.Time, err
 }
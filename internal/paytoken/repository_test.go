@@ -3,12 +3,16 @@ package paytoken
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/pauluswi/tulip/internal/entity"
 	"github.com/pauluswi/tulip/internal/test"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/pagination"
 	"github.com/stretchr/testify/assert"
 
 	uuid "github.com/satori/go.uuid"
@@ -17,51 +21,339 @@ import (
 func TestRepository(t *testing.T) {
 	logger, _ := log.NewForTest()
 	db := test.DB(t)
-	test.ResetTables(t, db, "paytokens")
-	repo := NewRepository(db, logger)
+	testRepositoryConformance(t, func() Repository {
+		test.ResetTables(t, db, "paytokens")
+		return NewRepository(db, logger)
+	})
+}
 
+func TestMemoryRepository(t *testing.T) {
+	testRepositoryConformance(t, NewMemoryRepository)
+}
+
+// testRepositoryConformance runs the tests every Repository implementation must pass. newRepo must return
+// an empty repository.
+func testRepositoryConformance(t *testing.T, newRepo func() Repository) {
 	ctx := context.Background()
 
-	// create
-	err := repo.Save(ctx, entity.PayToken{
-		ID:         uuid.NewV4().String(),
-		Token:      "999999",
-		TokenDate:  time.Now(),
-		CustomerID: "081100099",
-		ValidUntil: time.Now(),
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+	t.Run("crud", func(t *testing.T) {
+		repo := newRepo()
+
+		// create
+		err := repo.Save(ctx, entity.PayToken{
+			ID:         uuid.NewV4().String(),
+			Token:      "999999",
+			TokenDate:  time.Now(),
+			CustomerID: "6281100099",
+			ValidUntil: time.Now(),
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+			Status:     entity.TokenStatusActive,
+		})
+		assert.Nil(t, err)
+
+		// get
+		paytoken, err := repo.Get(ctx, "999999")
+		assert.Nil(t, err)
+		assert.Equal(t, "6281100099", paytoken.CustomerID)
+		_, err = repo.Get(ctx, "999990")
+		assert.Equal(t, sql.ErrNoRows, err)
+
+		// get today token
+		todaytoken, err := repo.GetTodayPayToken(ctx, "999999", time.Now())
+		assert.Nil(t, err)
+		assert.Equal(t, "6281100099", todaytoken.CustomerID)
+		_, err = repo.GetTodayPayToken(ctx, "999999", time.Now().AddDate(0, 0, 1))
+		assert.Equal(t, sql.ErrNoRows, err)
+		_, err = repo.GetTodayPayToken(ctx, " ", time.Now())
+		assert.True(t, errors.Is(err, entity.ErrInputValidation))
+
+		// count today tokens by length
+		count, err := repo.CountIssued(ctx, time.Now(), 6)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, count)
+		count, err = repo.CountIssued(ctx, time.Now(), 8)
+		assert.Nil(t, err)
+		assert.Zero(t, count)
+
+		// update
+		err = repo.Update(ctx, entity.PayToken{
+			ID:        paytoken.ID,
+			Metadata:  entity.Metadata{ValidatedAt: time.Now().UTC()},
+			UpdatedAt: time.Now(),
+		})
+		assert.Nil(t, err)
+
+		// get after update
+		updatedpaytoken, err := repo.Get(ctx, "999999")
+		assert.Nil(t, err)
+		assert.Equal(t, false, updatedpaytoken.Metadata.ValidatedAt.IsZero())
+		assert.Equal(t, entity.TokenStatusActive, updatedpaytoken.Status)
 	})
-	assert.Nil(t, err)
 
-	// get
-	paytoken, err := repo.Get(ctx, "999999")
-	assert.Nil(t, err)
-	assert.Equal(t, "6281100099", paytoken.CustomerID)
-	_, err = repo.Get(ctx, "999990")
-	assert.Equal(t, sql.ErrNoRows, err)
+	t.Run("save duplicate", func(t *testing.T) {
+		repo := newRepo()
+		now := time.Now()
+		paytoken := entity.PayToken{
+			ID:         uuid.NewV4().String(),
+			Token:      "888888",
+			TokenDate:  now,
+			CustomerID: "6281100099",
+			ValidUntil: now,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			Status:     entity.TokenStatusActive,
+		}
+		err := repo.Save(ctx, paytoken)
+		assert.Nil(t, err)
 
-	// get today token
-	todaytoken, err := repo.GetTodayPayToken(ctx, "999999")
-	assert.Nil(t, err)
-	assert.Equal(t, "6281100099", todaytoken.CustomerID)
-	//assert.Equal(t, sql.ErrNoRows, err)
+		// same token on the same date must collide on idx_unq_tokens_token_token_date
+		paytoken.ID = uuid.NewV4().String()
+		err = repo.Save(ctx, paytoken)
+		assert.True(t, errors.Is(err, entity.ErrDuplicateTokenPerDate))
 
-	// get multi token
-	_, err = repo.GetPayTokens(ctx, "6281100099")
-	assert.Nil(t, err)
-	//assert.Equal(t, sql.ErrNoRows, err)
+		// same token on another date is allowed
+		paytoken.ID = uuid.NewV4().String()
+		paytoken.TokenDate = now.AddDate(0, 0, 1)
+		err = repo.Save(ctx, paytoken)
+		assert.Nil(t, err)
+
+		// another token with the same ID is not
+		paytoken.Token = "888889"
+		err = repo.Save(ctx, paytoken)
+		assert.True(t, errors.Is(err, entity.ErrUniqueViolation))
+		assert.False(t, errors.Is(err, entity.ErrDuplicateTokenPerDate))
+	})
+
+	t.Run("transition", func(t *testing.T) {
+		repo := newRepo()
+		now := time.Now()
+		paytoken := entity.PayToken{
+			ID:         uuid.NewV4().String(),
+			Token:      "777777",
+			TokenDate:  now,
+			CustomerID: "6281100099",
+			ValidUntil: now.Add(time.Hour),
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			Status:     entity.TokenStatusActive,
+		}
+		err := repo.Save(ctx, paytoken)
+		assert.Nil(t, err)
+
+		redeemed := paytoken
+		redeemed.Status = entity.TokenStatusRedeemed
+		redeemed.Metadata.Redemption = &entity.Redemption{MerchantID: "M001", Amount: 25000, Reference: "INV-1", RedeemedAt: now}
+		err = repo.Transition(ctx, redeemed, entity.TokenStatusActive)
+		assert.Nil(t, err)
+
+		// the second redemption was based on a stale status and must not overwrite the first one
+		redeemed.Metadata.Redemption.MerchantID = "M002"
+		err = repo.Transition(ctx, redeemed, entity.TokenStatusActive)
+		assert.Equal(t, entity.ErrTokenStatusConflict, err)
+
+		paytoken, err = repo.Get(ctx, "777777")
+		assert.Nil(t, err)
+		assert.Equal(t, entity.TokenStatusRedeemed, paytoken.Status)
+		if assert.NotNil(t, paytoken.Metadata.Redemption) {
+			assert.Equal(t, "M001", paytoken.Metadata.Redemption.MerchantID)
+		}
+
+		redeemed.ID = uuid.NewV4().String()
+		err = repo.Transition(ctx, redeemed, entity.TokenStatusActive)
+		assert.Equal(t, entity.ErrTokenStatusConflict, err)
+	})
+
+	t.Run("counts", func(t *testing.T) {
+		repo := newRepo()
+		now := time.Now().Truncate(time.Second)
+		for i, status := range []entity.TokenStatus{entity.TokenStatusActive, entity.TokenStatusValidated, entity.TokenStatusRedeemed, entity.TokenStatusActive} {
+			assert.Nil(t, repo.Save(ctx, entity.PayToken{
+				ID:         uuid.NewV4().String(),
+				Token:      fmt.Sprintf("66666%d", i),
+				TokenDate:  now,
+				CustomerID: "6281100099",
+				ValidUntil: now.Add(time.Duration(3-i) * time.Minute),
+				CreatedAt:  now.Add(time.Duration(i-3) * time.Minute),
+				UpdatedAt:  now,
+				Status:     status,
+			}))
+		}
 
-	// update
-	err = repo.Update(ctx, entity.PayToken{
-		ID:        paytoken.ID,
-		Metadata:  entity.Metadata{time.Now().UTC()},
-		UpdatedAt: time.Now(),
+		// the last active token is past its validity
+		count, earliest, err := repo.CountActive(ctx, "6281100099", now)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, count)
+		assert.True(t, earliest.Equal(now.Add(2*time.Minute)), earliest.String())
+		count, earliest, err = repo.CountActive(ctx, "6281100000", now)
+		assert.Nil(t, err)
+		assert.Zero(t, count)
+		assert.True(t, earliest.IsZero())
+
+		count, earliest, err = repo.CountGenerated(ctx, "6281100099", now.Add(-2*time.Minute))
+		assert.Nil(t, err)
+		assert.Equal(t, 3, count)
+		assert.True(t, earliest.Equal(now.Add(-2*time.Minute)), earliest.String())
+		count, earliest, err = repo.CountGenerated(ctx, "6281100099", now.Add(time.Minute))
+		assert.Nil(t, err)
+		assert.Zero(t, count)
+		assert.True(t, earliest.IsZero())
 	})
+
+	t.Run("query", func(t *testing.T) {
+		repo := newRepo()
+		now := time.Now().Truncate(time.Second)
+		statuses := []entity.TokenStatus{entity.TokenStatusActive, entity.TokenStatusActive, entity.TokenStatusRedeemed, entity.TokenStatusCancelled, entity.TokenStatusActive}
+		for i, status := range statuses {
+			assert.Nil(t, repo.Save(ctx, entity.PayToken{
+				ID:         fmt.Sprintf("00000000-0000-0000-0000-00000000000%d", i),
+				Token:      fmt.Sprintf("55555%d", i),
+				TokenDate:  now.AddDate(0, 0, -i%2),
+				CustomerID: "6281100099",
+				ValidUntil: now.Add(time.Duration(i-2)*time.Hour + time.Minute),
+				CreatedAt:  now.Add(time.Duration(i/2) * time.Minute),
+				UpdatedAt:  now,
+				Status:     status,
+			}))
+		}
+		assert.Nil(t, repo.Save(ctx, entity.PayToken{
+			ID:         uuid.NewV4().String(),
+			Token:      "555555",
+			TokenDate:  now,
+			CustomerID: "6281100000",
+			ValidUntil: now.Add(time.Hour),
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			Status:     entity.TokenStatusActive,
+		}))
+
+		ids := func(items []entity.PayToken) []string {
+			var ids []string
+			for _, item := range items {
+				ids = append(ids, item.ID[len(item.ID)-1:])
+			}
+			return ids
+		}
+		expired := true
+		tests := []struct {
+			name   string
+			filter entity.TokenFilter
+			offset int
+			limit  int
+			ids    []string
+		}{
+			{"default", entity.TokenFilter{}, 0, 10, []string{"4", "3", "2", "1", "0"}},
+			{"page", entity.TokenFilter{}, 1, 2, []string{"3", "2"}},
+			{"past the end", entity.TokenFilter{}, 5, 10, nil},
+			{"created_at", entity.TokenFilter{Sort: "created_at"}, 0, 10, []string{"0", "1", "2", "3", "4"}},
+			{"valid_until", entity.TokenFilter{Sort: "-valid_until"}, 0, 10, []string{"4", "3", "2", "1", "0"}},
+			{"token_date", entity.TokenFilter{Sort: "token_date"}, 0, 10, []string{"1", "3", "0", "2", "4"}},
+			{"range", entity.TokenFilter{From: now.Add(time.Minute), To: now.Add(2 * time.Minute)}, 0, 10, []string{"3", "2"}},
+			{"expired", entity.TokenFilter{Expired: &expired}, 0, 10, []string{"1", "0"}},
+			{"statuses", entity.TokenFilter{Statuses: []entity.TokenStatus{entity.TokenStatusActive, entity.TokenStatusCancelled}}, 0, 10, []string{"4", "3"}},
+		}
+		for _, test := range tests {
+			test.filter.CustomerID = "6281100099"
+			test.filter.Now = now
+			items, err := repo.Query(ctx, test.filter, test.offset, test.limit)
+			assert.Nil(t, err, test.name)
+			assert.Equal(t, test.ids, ids(items), test.name)
+			count, err := repo.Count(ctx, test.filter)
+			assert.Nil(t, err, test.name)
+			if test.offset == 0 {
+				assert.Equal(t, len(test.ids), count, test.name)
+			}
+		}
+
+		// seek the tokens page by page, then back
+		signer := pagination.NewCursorSigner([]byte("secret"))
+		filter := entity.TokenFilter{CustomerID: "6281100099", Now: now}
+		var pages [][]string
+		var prev string
+		for cursor := ""; ; {
+			keyset, err := pagination.NewKeyset(signer, cursor, 2, true)
+			assert.Nil(t, err)
+			items, err := repo.Seek(ctx, filter, keyset)
+			assert.Nil(t, err)
+			page := keyset.Page(items, func(i int) (time.Time, string) { return items[i].CreatedAt, items[i].ID })
+			pages = append(pages, ids(page.Items.([]entity.PayToken)))
+			prev = page.Prev
+			if cursor = page.Next; cursor == "" {
+				break
+			}
+		}
+		assert.Equal(t, [][]string{{"4", "3"}, {"2", "1"}, {"0"}}, pages)
+		keyset, _ := pagination.NewKeyset(signer, prev, 2, true)
+		items, err := repo.Seek(ctx, filter, keyset)
+		assert.Nil(t, err)
+		page := keyset.Page(items, func(i int) (time.Time, string) { return items[i].CreatedAt, items[i].ID })
+		assert.Equal(t, []string{"2", "1"}, ids(page.Items.([]entity.PayToken)))
+	})
+}
+
+func Test_translatePGError(t *testing.T) {
+	assert.Nil(t, translatePGError(nil))
+	assert.Equal(t, sql.ErrNoRows, translatePGError(sql.ErrNoRows))
+
+	err := translatePGError(&pq.Error{Code: entity.PGErrCodeUniqueViolation, Constraint: entity.PGConstraintUniqueTokenAndTokenDate})
+	assert.True(t, errors.Is(err, entity.ErrDuplicateTokenPerDate))
+
+	err = translatePGError(&pq.Error{Code: entity.PGErrCodeUniqueViolation, Constraint: "paytokens_pkey"})
+	assert.True(t, errors.Is(err, entity.ErrUniqueViolation))
+	assert.False(t, errors.Is(err, entity.ErrDuplicateTokenPerDate))
+
+	pqErr := &pq.Error{Code: "23503"}
+	assert.Equal(t, pqErr, translatePGError(pqErr))
+}
+
+func TestPool(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "token_pool", "paytokens")
+	repo := NewRepository(db, logger)
+	pool := NewPool(db, logger)
+
+	ctx := context.Background()
+	today := time.Now()
+	assert.Nil(t, repo.Save(ctx, entity.PayToken{
+		ID:         uuid.NewV4().String(),
+		Token:      "111111",
+		TokenDate:  today,
+		CustomerID: "6281100099",
+		ValidUntil: today,
+		CreatedAt:  today,
+		UpdatedAt:  today,
+		Status:     entity.TokenStatusActive,
+	}))
+
+	// the tokens already issued or reserved are left out
+	added, err := pool.Reserve(ctx, today, []string{"111111", "222222", "333333", "333333", "44444444"})
 	assert.Nil(t, err)
+	assert.Equal(t, 3, added)
+	added, err = pool.Reserve(ctx, today, []string{"222222"})
+	assert.Nil(t, err)
+	assert.Zero(t, added)
+	added, _ = pool.Reserve(ctx, today.AddDate(0, 0, -1), []string{"555555"})
+	assert.Equal(t, 1, added)
+
+	count, err := pool.Count(ctx, today, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
 
-	// get after update
-	updatedpaytoken, err := repo.Get(ctx, "999999")
+	// tokens are claimed once only
+	first, err := pool.Claim(ctx, today, 6)
 	assert.Nil(t, err)
-	assert.Equal(t, false, updatedpaytoken.Metadata.ValidatedAt.IsZero())
+	second, err := pool.Claim(ctx, today, 6)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"222222", "333333"}, []string{first, second})
+	_, err = pool.Claim(ctx, today, 6)
+	assert.Equal(t, ErrPoolEmpty, err)
+	token, err := pool.Claim(ctx, today, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, "44444444", token)
+
+	// the tokens of the past days are removed
+	assert.Nil(t, pool.Prune(ctx, today))
+	_, err = pool.Claim(ctx, today.AddDate(0, 0, -1), 6)
+	assert.Equal(t, ErrPoolEmpty, err)
 }
@@ -5,19 +5,32 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/pauluswi/tulip/internal/config"
 	"github.com/pauluswi/tulip/internal/entity"
-	generator "github.com/pauluswi/tulip/pkg/generator"
+	"github.com/pauluswi/tulip/pkg/generator"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/pagination"
 	"github.com/pauluswi/tulip/pkg/validator"
 )
 
 // Service encapsulates usecase logic for albums.
 type Service interface {
-	GetPayTokens(ctx context.Context, customer_id string) ([]entity.PayToken, error)
+	Query(ctx context.Context, filter entity.TokenFilter, offset, limit int) ([]entity.PayToken, error)
+	Count(ctx context.Context, filter entity.TokenFilter) (int, error)
+	Seek(ctx context.Context, filter entity.TokenFilter, keyset *pagination.Keyset) (*pagination.KeysetPage, error)
 	Generate(ctx context.Context, req entity.InputGenerate) (out entity.OutGenerate, err error)
 	Validate(ctx context.Context, req entity.InputValidate) (out entity.OutValidate, err error)
+	Redeem(ctx context.Context, req entity.InputRedeem) (out entity.OutRedeem, err error)
+	Cancel(ctx context.Context, req entity.InputCancel) (out entity.OutCancel, err error)
+	Keyspace(ctx context.Context, timeZone string) (out entity.OutKeyspace, err error)
+	PoolStatus(ctx context.Context) (out entity.OutPool, err error)
+	CacheStatus(ctx context.Context) (out entity.OutCache, err error)
+	RefillPool(ctx context.Context) error
 }
 
 // PayToken represents the data about an payment token.
@@ -26,32 +39,161 @@ type PayToken struct {
 }
 
 type service struct {
-	repo   Repository
-	logger log.Logger
+	repo     Repository
+	pool     Pool
+	metrics  *poolMetrics
+	primary  keyspace
+	fallback keyspace
+	monitor  *keyspaceMonitor
+	policy   config.TokenPolicy
+	logger   log.Logger
 }
 
-// NewService creates a new payment token service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger}
+// NewService creates a new payment token service which generates tokens according to the given policy.
+// Tokens are generated with gen until the fill ratio of the policy is reached for the token day,
+// then with fallbackGen, which must generate tokens made of the fallback alphabet of the policy.
+// If the token pool of the policy is enabled, tokens are claimed from pool rather than generated on the fly.
+func NewService(repo Repository, pool Pool, gen, fallbackGen generator.Generator, policy config.TokenPolicy, logger log.Logger) Service {
+	checkDigit := policy.CheckDigit != ""
+	fallbackLength, fallbackAlphabet := policy.Fallback()
+	return service{
+		repo:     repo,
+		pool:     pool,
+		metrics:  &poolMetrics{},
+		primary:  newKeyspace(gen, policy.Length, policy.Alphabet, checkDigit),
+		fallback: newKeyspace(fallbackGen, fallbackLength, fallbackAlphabet, checkDigit),
+		monitor:  newKeyspaceMonitor(),
+		policy:   policy,
+		logger:   logger,
+	}
 }
 
 // --- list of error and constants
 var (
-	ErrValidation    = fmt.Errorf("validation error")
-	ErrGenerateToken = fmt.Errorf("token generate error")
-	ErrDBPersist     = fmt.Errorf("persist to database error")
-	ErrTokenNotFound = fmt.Errorf("token not found in database")
+	ErrValidation     = fmt.Errorf("validation error")
+	ErrGenerateToken  = fmt.Errorf("token generate error")
+	ErrDBPersist      = fmt.Errorf("persist to database error")
+	ErrTokenNotFound  = fmt.Errorf("token not found in database")
+	ErrTokenExpired   = fmt.Errorf("token expired")
+	ErrTokenCancelled = fmt.Errorf("token cancelled")
+	ErrNotTokenOwner  = fmt.Errorf("token belongs to another customer")
+	ErrMalformedToken = fmt.Errorf("malformed token")
+
+	ErrInvalidTransition = fmt.Errorf("token status transition not allowed")
+	ErrLimitExceeded     = fmt.Errorf("token generation limit exceeded")
+	ErrKeyspaceExhausted = fmt.Errorf("token keyspace exhausted")
 )
 
-// GetPayTokens returns all payment tokens belong to a customer
-func (s service) GetPayTokens(ctx context.Context, id string) (out []entity.PayToken, err error) {
-	paytokens, err := s.repo.GetPayTokens(ctx, id)
+// LimitError reports that a customer has reached one of the generation limits of the token policy.
+type LimitError struct {
+	// Limit describes the limit which has been reached.
+	Limit string
+	// RetryAfter is the duration after which a token can be generated again.
+	RetryAfter time.Duration
+}
+
+// Error returns the error message.
+func (e LimitError) Error() string {
+	return fmt.Sprintf("%s: %s, retry after %s", ErrLimitExceeded, e.Limit, e.RetryAfter)
+}
+
+// Unwrap makes LimitError match ErrLimitExceeded.
+func (e LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// maxTransitionRetries is the number of attempts to change the status of a token which is being updated concurrently.
+const maxTransitionRetries = 3
+
+// Query returns the payment tokens of a customer matching the filter, within the given page.
+// Tokens past their validity are reported as expired even if the expiry hasn't been persisted yet.
+// A zero filter.Now stands for the current time.
+func (s service) Query(ctx context.Context, filter entity.TokenFilter, offset, limit int) ([]entity.PayToken, error) {
+	filter, err := s.checkFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	paytokens, err := s.repo.Query(ctx, filter, offset, limit)
 	if err != nil {
 		return paytokens, err
 	}
+
+	for i := range paytokens {
+		paytokens[i].Status = paytokens[i].EffectiveStatus(filter.Now)
+	}
 	return paytokens, nil
 }
 
+// Count returns the number of payment tokens of a customer matching the filter.
+// A zero filter.Now stands for the current time.
+func (s service) Count(ctx context.Context, filter entity.TokenFilter) (int, error) {
+	filter, err := s.checkFilter(filter)
+	if err != nil {
+		return 0, err
+	}
+	return s.repo.Count(ctx, filter)
+}
+
+// Seek returns the page of the payment tokens of a customer matching the filter which follows or precedes
+// the cursor of the keyset. The tokens can only be sorted by creation time, as the cursors point to a creation time.
+// A zero filter.Now stands for the current time.
+func (s service) Seek(ctx context.Context, filter entity.TokenFilter, keyset *pagination.Keyset) (*pagination.KeysetPage, error) {
+	filter, err := s.checkFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Sort != "" && filter.Sort != "created_at" && filter.Sort != "-created_at" {
+		return nil, fmt.Errorf("%w: the tokens paginated by cursor can only be sorted by created_at", ErrValidation)
+	}
+	if err := keyset.Bind(filterKey(filter)); err != nil {
+		return nil, fmt.Errorf("%w: the cursor was issued for another filter or sort order", ErrValidation)
+	}
+	paytokens, err := s.repo.Seek(ctx, filter, keyset)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range paytokens {
+		paytokens[i].Status = paytokens[i].EffectiveStatus(filter.Now)
+	}
+	return keyset.Page(paytokens, func(i int) (time.Time, string) {
+		return paytokens[i].CreatedAt, paytokens[i].ID
+	}), nil
+}
+
+// filterKey identifies the tokens kept by the filter, regardless of the time at which the filter is applied.
+func filterKey(filter entity.TokenFilter) string {
+	statuses := make([]string, len(filter.Statuses))
+	for i, status := range filter.Statuses {
+		statuses[i] = string(status)
+	}
+	expired := ""
+	if filter.Expired != nil {
+		expired = strconv.FormatBool(*filter.Expired)
+	}
+	return strings.Join([]string{
+		filter.CustomerID,
+		filter.From.UTC().Format(time.RFC3339Nano),
+		filter.To.UTC().Format(time.RFC3339Nano),
+		strings.Join(statuses, ","),
+		expired,
+	}, "\n")
+}
+
+// checkFilter validates the filter and sets its time to the current time if it is not set.
+func (s service) checkFilter(filter entity.TokenFilter) (entity.TokenFilter, error) {
+	if err := validator.ValidateWithOpts(filter, validator.Opts{Mode: validator.ModeVerbose}); err != nil {
+		return filter, fmt.Errorf("%w: %s", ErrValidation, err)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, fmt.Errorf("%w: the start of the date range must be before its end", ErrValidation)
+	}
+	if filter.Now.IsZero() {
+		filter.Now = time.Now().UTC()
+	}
+	return filter, nil
+}
+
 // Generate creates a payment token
 func (s service) Generate(ctx context.Context, req entity.InputGenerate) (out entity.OutGenerate, err error) {
 	defer func() {
@@ -60,31 +202,39 @@ func (s service) Generate(ctx context.Context, req entity.InputGenerate) (out en
 		}
 	}()
 
-	for i := 0; i < 5; i++ {
-		err = validator.ValidateWithOpts(req, validator.Opts{Mode: validator.ModeVerbose})
-		if err != nil {
-			err = fmt.Errorf("%w: %s", ErrValidation, err)
-			return entity.OutGenerate{}, err
-		}
+	err = validator.ValidateWithOpts(req, validator.Opts{Mode: validator.ModeVerbose})
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrValidation, err)
+		return entity.OutGenerate{}, err
+	}
 
-		// ** I use a very simple algorithm to generate payment token
-		// ** in real world the algorithm must be more details and secure
-		token, err := generator.EncodeToString(6)
+	loc := s.location(req.TimeZone)
+	if err = s.checkLimits(ctx, req.CustomerID, time.Now().In(loc)); err != nil {
+		return entity.OutGenerate{}, err
+	}
+	space, err := s.pickKeyspace(ctx, time.Now().In(loc))
+	if err != nil {
+		return entity.OutGenerate{}, err
+	}
+
+	for i := 0; i < s.policy.MaxRetries; i++ {
+		// the token day and its end are defined by the time zone of the request or the policy
+		now := time.Now().In(loc)
+
+		var token string
+		token, err = s.nextToken(ctx, space, now)
 		if err != nil {
-			err = fmt.Errorf("%w: %s", ErrValidation, err)
 			return entity.OutGenerate{}, err
 		}
 
-		now := time.Now().UTC()
-		nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
-
-		tokenmaxduration := 24 * time.Hour
+		nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, loc)
 
 		// If valid until is in the next day, then force valid until only to the end of the day.
-		validUntil := now.Add(tokenmaxduration)
-		if nextDay.Year() == validUntil.Year() && nextDay.Month() == validUntil.Month() && nextDay.Day() == validUntil.Day() {
+		validUntil := now.Add(s.policy.TTLDuration())
+		if !validUntil.Before(nextDay) {
 			validUntil = nextDay.Add(-1 * time.Millisecond)
 		}
+		validUntil = validUntil.UTC()
 
 		// build new token
 		paytoken := entity.NewToken()
@@ -92,8 +242,8 @@ func (s service) Generate(ctx context.Context, req entity.InputGenerate) (out en
 		paytoken.TokenDate = now
 		paytoken.CustomerID = req.CustomerID
 		paytoken.ValidUntil = validUntil
-		paytoken.CreatedAt = now
-		paytoken.UpdatedAt = now
+		paytoken.CreatedAt = now.UTC()
+		paytoken.UpdatedAt = now.UTC()
 
 		err = validator.ValidateWithOpts(paytoken, validator.Opts{Mode: validator.ModeVerbose})
 		if err != nil {
@@ -111,6 +261,7 @@ func (s service) Generate(ctx context.Context, req entity.InputGenerate) (out en
 			err = fmt.Errorf("%w: %s", ErrDBPersist, err)
 			return entity.OutGenerate{}, err
 		}
+		s.monitor.add(now, space.length)
 
 		output := entity.OutGenerate{
 			Token:      token,
@@ -119,10 +270,12 @@ func (s service) Generate(ctx context.Context, req entity.InputGenerate) (out en
 		return output, err
 	}
 
+	err = fmt.Errorf("%w: %d duplicate tokens of %d characters in a row", ErrKeyspaceExhausted, s.policy.MaxRetries, space.length)
 	return entity.OutGenerate{}, err
 }
 
 // Validate to check whether a token stil valid and not expired.
+// The first validation moves an active token to VALIDATED, a token past its validity is moved to EXPIRED.
 func (s service) Validate(ctx context.Context, req entity.InputValidate) (out entity.OutValidate, err error) {
 	defer func() {
 		if err != nil {
@@ -138,50 +291,466 @@ func (s service) Validate(ctx context.Context, req entity.InputValidate) (out en
 
 	// Find today token only,
 	// separate select and update query since select assumed faster than update with no matching records
-	inputToken, err := s.repo.GetTodayPayToken(ctx, req.Token)
-	if errors.Is(err, sql.ErrNoRows) {
-		// if return sql.Row error then don't leak sql error to response
-		err = fmt.Errorf("%w: no token found", ErrTokenNotFound)
+	inputToken, err := s.findTodayToken(ctx, req.Token, time.Now().In(s.location(req.TimeZone)))
+	if err != nil {
 		return
 	}
 
+	now := time.Now().UTC()
+
+	// update only when token hasn't validated or its expiry hasn't been recorded
+	inputToken, err = s.transition(ctx, inputToken, func(paytoken *entity.PayToken) (bool, error) {
+		switch next := paytoken.EffectiveStatus(now); {
+		case next == entity.TokenStatusExpired && paytoken.Status != next:
+			paytoken.Status = next
+		case next == entity.TokenStatusActive:
+			paytoken.Status = entity.TokenStatusValidated
+			paytoken.Metadata.ValidatedAt = now
+		default:
+			return false, nil
+		}
+		paytoken.UpdatedAt = now
+		return true, nil
+	})
+	if err != nil {
+		return entity.OutValidate{}, err
+	}
+
+	// build output
+	out = entity.OutValidate{
+		Token:       inputToken.Token,
+		CustomerID:  inputToken.CustomerID,
+		ValidUntil:  inputToken.ValidUntil.UTC(),
+		Status:      inputToken.EffectiveStatus(now),
+		IsExpired:   now.After(inputToken.ValidUntil),
+		IsValidated: now.After(inputToken.Metadata.ValidatedAt) && !inputToken.Metadata.ValidatedAt.IsZero(), // first call will return false because validatedAt is zero
+		IsUsable:    unusableError(*inputToken, now) == nil,
+	}
+
+	return out, err
+}
+
+// Redeem consumes a token for a merchant transaction. A token can only be redeemed once,
+// a second attempt returns entity.ErrTokenAlreadyRedeemed.
+func (s service) Redeem(ctx context.Context, req entity.InputRedeem) (out entity.OutRedeem, err error) {
+	defer func() {
+		if err != nil {
+			s.logger.Error(ctx, err.Error())
+		}
+	}()
+
+	err = validator.ValidateWithOpts(req, validator.Opts{Mode: validator.ModeCompact})
 	if err != nil {
-		err = fmt.Errorf("token search failed: %w", err)
+		err = fmt.Errorf("%w: %s", ErrValidation, err)
 		return
 	}
 
-	if inputToken == nil {
-		err = fmt.Errorf("%w: token empty result", ErrTokenNotFound)
+	inputToken, err := s.findTodayToken(ctx, req.Token, time.Now().In(s.location(req.TimeZone)))
+	if err != nil {
 		return
 	}
 
 	now := time.Now().UTC()
+	inputToken, err = s.transition(ctx, inputToken, func(paytoken *entity.PayToken) (bool, error) {
+		if err := unusableError(*paytoken, now); err != nil {
+			return false, err
+		}
+		paytoken.Status = entity.TokenStatusRedeemed
+		paytoken.Metadata.Redemption = &entity.Redemption{
+			MerchantID: req.MerchantID,
+			Amount:     req.Amount,
+			Reference:  req.Reference,
+			RedeemedAt: now,
+		}
+		paytoken.UpdatedAt = now
+		return true, nil
+	})
+	if err != nil {
+		return
+	}
 
-	// build output
-	out = entity.OutValidate{
+	redemption := inputToken.Metadata.Redemption
+	out = entity.OutRedeem{
+		Token:      inputToken.Token,
+		CustomerID: inputToken.CustomerID,
+		MerchantID: redemption.MerchantID,
+		Amount:     redemption.Amount,
+		Reference:  redemption.Reference,
+		RedeemedAt: redemption.RedeemedAt,
+	}
+	return out, nil
+}
+
+// Cancel revokes a token which has not been redeemed yet. Only the customer owning the token can cancel it.
+func (s service) Cancel(ctx context.Context, req entity.InputCancel) (out entity.OutCancel, err error) {
+	defer func() {
+		if err != nil {
+			s.logger.Error(ctx, err.Error())
+		}
+	}()
+
+	err = validator.ValidateWithOpts(req, validator.Opts{Mode: validator.ModeCompact})
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrValidation, err)
+		return
+	}
+
+	inputToken, err := s.findTodayToken(ctx, req.Token, time.Now().In(s.location(req.TimeZone)))
+	if err != nil {
+		return
+	}
+
+	if inputToken.CustomerID != req.CustomerID {
+		err = fmt.Errorf("%w: %s", ErrNotTokenOwner, req.CustomerID)
+		return
+	}
+
+	cancelledBy := req.CancelledBy
+	if cancelledBy == "" {
+		cancelledBy = req.CustomerID
+	}
+
+	now := time.Now().UTC()
+	inputToken, err = s.transition(ctx, inputToken, func(paytoken *entity.PayToken) (bool, error) {
+		if err := unusableError(*paytoken, now); err != nil {
+			return false, err
+		}
+		paytoken.Status = entity.TokenStatusCancelled
+		paytoken.Metadata.Cancellation = &entity.Cancellation{
+			CancelledBy: cancelledBy,
+			Reason:      req.Reason,
+			CancelledAt: now,
+		}
+		paytoken.UpdatedAt = now
+		return true, nil
+	})
+	if err != nil {
+		return
+	}
+
+	out = entity.OutCancel{
 		Token:       inputToken.Token,
 		CustomerID:  inputToken.CustomerID,
-		ValidUntil:  inputToken.ValidUntil.UTC(),
-		IsExpired:   now.After(inputToken.ValidUntil),
-		IsValidated: now.After(inputToken.Metadata.ValidatedAt) && !inputToken.Metadata.ValidatedAt.IsZero(), // first call will return false because validatedAt is zero
+		Status:      inputToken.Status,
+		CancelledAt: inputToken.Metadata.Cancellation.CancelledAt,
 	}
+	return out, nil
+}
 
-	// update only when token hasn't validated
-	shouldUpdate := false
-	if inputToken.Metadata.ValidatedAt.IsZero() {
-		inputToken.Metadata.ValidatedAt = now
-		shouldUpdate = true
+// Keyspace reports how full the keyspaces of the token day are, in the given time zone or the one of the policy.
+// The tokens are counted in the repository, regardless of the counts cached to pick the keyspace of new tokens.
+func (s service) Keyspace(ctx context.Context, timeZone string) (out entity.OutKeyspace, err error) {
+	if timeZone != "" {
+		if _, err := time.LoadLocation(timeZone); err != nil {
+			return out, fmt.Errorf("%w: unknown time zone %s", ErrValidation, timeZone)
+		}
+	}
+	today := time.Now().In(s.location(timeZone))
+	out = entity.OutKeyspace{
+		TokenDate:    today.Format("2006-01-02"),
+		Active:       "primary",
+		MaxFillRatio: s.policy.MaxFillRatio,
 	}
 
-	if shouldUpdate {
-		inputToken.UpdatedAt = now
-		err = s.repo.Update(ctx, *inputToken)
+	issued, err := s.repo.CountIssued(ctx, today, s.primary.length)
+	if err != nil {
+		return out, fmt.Errorf("keyspace count failed: %w", err)
+	}
+	out.Primary = s.primary.usage(issued)
+	if s.policy.MaxFillRatio == 0 || out.Primary.FillRatio < s.policy.MaxFillRatio {
+		return out, nil
 	}
 
+	issued, err = s.repo.CountIssued(ctx, today, s.fallback.length)
 	if err != nil {
-		err = fmt.Errorf("%w: %s", ErrDBPersist, err)
-		return entity.OutValidate{}, err
+		return out, fmt.Errorf("keyspace count failed: %w", err)
+	}
+	fallback := s.fallback.usage(issued)
+	out.Fallback = &fallback
+	out.Active = "fallback"
+	if fallback.FillRatio >= s.policy.MaxFillRatio {
+		out.Active = "exhausted"
 	}
+	return out, nil
+}
 
-	return out, err
+// PoolStatus reports the tokens left in the pool for the token days it is filled for, and the activity of the pool.
+func (s service) PoolStatus(ctx context.Context) (out entity.OutPool, err error) {
+	out = s.metrics.snapshot()
+	out.Enabled = s.policy.Pool.Enabled
+	out.Levels = []entity.PoolLevel{}
+	if !out.Enabled {
+		return out, nil
+	}
+
+	lengths := []int{s.primary.length}
+	if s.policy.MaxFillRatio > 0 && s.fallback.length != s.primary.length {
+		lengths = append(lengths, s.fallback.length)
+	}
+	today := time.Now().In(s.policy.Location())
+	for d := 0; d < s.policy.Pool.Days; d++ {
+		day := today.AddDate(0, 0, d)
+		for _, length := range lengths {
+			available, err := s.pool.Count(ctx, day, length)
+			if err != nil {
+				return out, fmt.Errorf("token pool count failed: %w", err)
+			}
+			out.Levels = append(out.Levels, entity.PoolLevel{TokenDate: day.Format("2006-01-02"), Length: length, Available: available})
+		}
+	}
+	return out, nil
+}
+
+// CacheStatus reports the lookups of the token cache, if the repository of the service caches the tokens.
+func (s service) CacheStatus(ctx context.Context) (out entity.OutCache, err error) {
+	if cached, ok := s.repo.(cachedRepository); ok {
+		return cached.cacheStatus(), nil
+	}
+	return out, nil
+}
+
+// RefillPool reserves tokens for the token days of the pool, in the time zone of the policy, whose tokens left are
+// below the low-water mark. The tokens of a day are reserved from the keyspace new tokens of that day are generated
+// from, and the tokens of the past days are removed.
+func (s service) RefillPool(ctx context.Context) error {
+	if !s.policy.Pool.Enabled {
+		return nil
+	}
+	today := time.Now().In(s.policy.Location())
+	if err := s.pool.Prune(ctx, today); err != nil {
+		return fmt.Errorf("token pool prune failed: %w", err)
+	}
+
+	for d := 0; d < s.policy.Pool.Days; d++ {
+		day := today.AddDate(0, 0, d)
+		space, err := s.pickKeyspace(ctx, day)
+		if errors.Is(err, ErrKeyspaceExhausted) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		available, err := s.pool.Count(ctx, day, space.length)
+		if err != nil {
+			return fmt.Errorf("token pool count failed: %w", err)
+		}
+		if available >= s.policy.Pool.LowWater {
+			continue
+		}
+		if err := s.reserve(ctx, day, space, s.policy.Pool.Size-available); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&s.metrics.refills, 1)
+	return nil
+}
+
+// reserve adds count tokens of the keyspace to the pool for the date of day. It gives up when a whole batch
+// of tokens collides with the tokens already reserved or issued, which only happens in a filled keyspace.
+func (s service) reserve(ctx context.Context, day time.Time, space keyspace, count int) error {
+	reserved, collisions := 0, 0
+	for reserved < count {
+		batch := count - reserved
+		if batch > s.policy.Pool.BatchSize {
+			batch = s.policy.Pool.BatchSize
+		}
+		tokens := make([]string, batch)
+		for i := range tokens {
+			token, err := space.generator.Generate(space.length)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrGenerateToken, err)
+			}
+			tokens[i] = token
+		}
+
+		added, err := s.pool.Reserve(ctx, day, tokens)
+		if err != nil {
+			return fmt.Errorf("token pool reservation failed: %w", err)
+		}
+		reserved += added
+		collisions += batch - added
+		atomic.AddInt64(&s.metrics.reserved, int64(added))
+		atomic.AddInt64(&s.metrics.collisions, int64(batch-added))
+		if added == 0 {
+			break
+		}
+	}
+	s.logger.With(ctx).Infof("reserved %d tokens of %d characters for %s, %d collisions",
+		reserved, space.length, day.Format("2006-01-02"), collisions)
+	return nil
+}
+
+// nextToken claims a token of the keyspace reserved for the date of today from the pool if it is enabled,
+// and generates a token otherwise. A token is generated as well when the pool has no token left or fails,
+// so that the pool never prevents tokens from being generated.
+func (s service) nextToken(ctx context.Context, space keyspace, today time.Time) (string, error) {
+	if s.policy.Pool.Enabled {
+		token, err := s.pool.Claim(ctx, today, space.length)
+		if err == nil {
+			atomic.AddInt64(&s.metrics.claimed, 1)
+			return token, nil
+		}
+		if !errors.Is(err, ErrPoolEmpty) {
+			s.logger.With(ctx).Errorf("failed to claim a token from the pool: %v", err)
+		}
+		atomic.AddInt64(&s.metrics.missed, 1)
+	}
+
+	token, err := space.generator.Generate(space.length)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrGenerateToken, err)
+	}
+	return token, nil
+}
+
+// pickKeyspace returns the keyspace the tokens of the token day of today are generated from: the primary one
+// until its fill ratio reaches the maximum of the policy, then the fallback one. ErrKeyspaceExhausted is returned
+// once the fallback keyspace reaches the maximum fill ratio as well, since most generated tokens would collide.
+func (s service) pickKeyspace(ctx context.Context, today time.Time) (keyspace, error) {
+	if s.policy.MaxFillRatio == 0 {
+		return s.primary, nil
+	}
+	for _, space := range []keyspace{s.primary, s.fallback} {
+		issued, counted, err := s.monitor.issued(ctx, s.repo, today, space.length)
+		if err != nil {
+			return keyspace{}, fmt.Errorf("keyspace count failed: %w", err)
+		}
+		ratio := float64(issued) / space.size
+		if ratio < s.policy.MaxFillRatio {
+			return space, nil
+		}
+		if counted {
+			s.logger.With(ctx).Warnf("%.1f%% of the tokens of %d characters are issued for %s",
+				ratio*100, space.length, today.Format("2006-01-02"))
+		}
+	}
+	return keyspace{}, fmt.Errorf("%w: fill ratio %.2f reached for %s", ErrKeyspaceExhausted, s.policy.MaxFillRatio, today.Format("2006-01-02"))
+}
+
+// transition applies the change made by next to a copy of the token and persists it, guarded by the current status
+// of the token. If the token has been changed concurrently, it is reloaded and next is evaluated again.
+// next returns false when the token should be left unchanged.
+func (s service) transition(ctx context.Context, paytoken *entity.PayToken, next func(paytoken *entity.PayToken) (bool, error)) (*entity.PayToken, error) {
+	for i := 0; i < maxTransitionRetries; i++ {
+		updated := *paytoken
+		ok, err := next(&updated)
+		if err != nil || !ok {
+			return paytoken, err
+		}
+
+		if !paytoken.Status.CanTransitionTo(updated.Status) {
+			return paytoken, fmt.Errorf("%w: from %s to %s", ErrInvalidTransition, paytoken.Status, updated.Status)
+		}
+
+		err = s.repo.Transition(ctx, updated, paytoken.Status)
+		if err == nil {
+			return &updated, nil
+		}
+		if !errors.Is(err, entity.ErrTokenStatusConflict) {
+			return paytoken, fmt.Errorf("%w: %s", ErrDBPersist, err)
+		}
+
+		if paytoken, err = s.findTodayToken(ctx, paytoken.Token, paytoken.TokenDate); err != nil {
+			return nil, err
+		}
+	}
+	return paytoken, fmt.Errorf("%w: %s", ErrDBPersist, entity.ErrTokenStatusConflict)
+}
+
+// checkLimits returns a LimitError if the customer has reached one of the generation limits of the policy.
+// The token day used by the daily limit is the one of the location of now. Concurrent requests of a customer
+// are not serialized, so that a burst of them may briefly exceed a limit.
+func (s service) checkLimits(ctx context.Context, customerID string, now time.Time) error {
+	if s.policy.MaxActive > 0 {
+		count, nextExpiry, err := s.repo.CountActive(ctx, customerID, now)
+		if err != nil {
+			return fmt.Errorf("token limit check failed: %w", err)
+		}
+		if count >= s.policy.MaxActive {
+			// a token can be generated once the first usable token expires, or is redeemed or cancelled
+			return newLimitError(fmt.Sprintf("%d usable tokens", s.policy.MaxActive), nextExpiry.Sub(now))
+		}
+	}
+
+	if s.policy.MaxPerMinute > 0 {
+		count, earliest, err := s.repo.CountGenerated(ctx, customerID, now.Add(-time.Minute))
+		if err != nil {
+			return fmt.Errorf("token limit check failed: %w", err)
+		}
+		if count >= s.policy.MaxPerMinute {
+			return newLimitError(fmt.Sprintf("%d tokens per minute", s.policy.MaxPerMinute), earliest.Add(time.Minute).Sub(now))
+		}
+	}
+
+	if s.policy.MaxPerDay > 0 {
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		count, _, err := s.repo.CountGenerated(ctx, customerID, dayStart)
+		if err != nil {
+			return fmt.Errorf("token limit check failed: %w", err)
+		}
+		if count >= s.policy.MaxPerDay {
+			return newLimitError(fmt.Sprintf("%d tokens per day", s.policy.MaxPerDay), dayStart.AddDate(0, 0, 1).Sub(now))
+		}
+	}
+	return nil
+}
+
+// newLimitError creates a LimitError, the client is never told to retry in less than a second.
+func newLimitError(limit string, retryAfter time.Duration) LimitError {
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return LimitError{limit, retryAfter}
+}
+
+// unusableError returns the reason why a token can not be used for a transaction anymore.
+// Nil is returned if the token is still usable at the given time.
+func unusableError(paytoken entity.PayToken, now time.Time) error {
+	switch paytoken.EffectiveStatus(now) {
+	case entity.TokenStatusRedeemed:
+		return entity.ErrTokenAlreadyRedeemed
+	case entity.TokenStatusExpired:
+		return fmt.Errorf("%w: valid until %s", ErrTokenExpired, paytoken.ValidUntil.UTC().Format(time.RFC3339))
+	case entity.TokenStatusCancelled:
+		return ErrTokenCancelled
+	case entity.TokenStatusActive, entity.TokenStatusValidated:
+		return nil
+	}
+	return fmt.Errorf("%w: token is %s", ErrInvalidTransition, paytoken.Status)
+}
+
+// findTodayToken looks up a token issued on the day of today and hides the sql errors from the caller.
+// A token failing the check digit of the policy is rejected without querying the repository.
+func (s service) findTodayToken(ctx context.Context, token string, today time.Time) (*entity.PayToken, error) {
+	// the repository ignores the surrounding spaces, so must the check digit
+	token = strings.TrimSpace(token)
+	if checkDigit := generator.CheckDigitByName(s.policy.CheckDigit); checkDigit != nil && !checkDigit.Verify(token) {
+		return nil, fmt.Errorf("%w: check digit mismatch", ErrMalformedToken)
+	}
+
+	paytoken, err := s.repo.GetTodayPayToken(ctx, token, today)
+	if errors.Is(err, sql.ErrNoRows) {
+		// if return sql.Row error then don't leak sql error to response
+		return nil, fmt.Errorf("%w: no token found", ErrTokenNotFound)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("token search failed: %w", err)
+	}
+
+	if paytoken == nil {
+		return nil, fmt.Errorf("%w: token empty result", ErrTokenNotFound)
+	}
+	return paytoken, nil
+}
+
+// location returns the time zone defining the token day. The time zone of the request takes precedence
+// over the one of the policy, so that customers and merchants of a region share the same token day.
+func (s service) location(timeZone string) *time.Location {
+	if timeZone != "" {
+		if loc, err := time.LoadLocation(timeZone); err == nil {
+			return loc
+		}
+	}
+	return s.policy.Location()
 }
@@ -3,11 +3,16 @@ package paytoken
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/pauluswi/tulip/internal/config"
 	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/generator"
 	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/pauluswi/tulip/pkg/pagination"
 	"github.com/stretchr/testify/assert"
 
 	uuid "github.com/satori/go.uuid"
@@ -17,7 +22,7 @@ import (
 
 func Test_service_TokenCycle(t *testing.T) {
 	logger, _ := log.NewForTest()
-	s := NewService(&mockRepository{}, logger)
+	s := NewService(&mockRepository{}, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
 
 	ctx := context.Background()
 
@@ -33,15 +38,613 @@ func Test_service_TokenCycle(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "6281100099", val.CustomerID)
 	assert.Equal(t, false, val.IsExpired)
+	assert.Equal(t, entity.TokenStatusValidated, val.Status)
+	assert.True(t, val.IsUsable)
 
 	//get all tokens
-	all, err := s.GetPayTokens(ctx, "6281100099")
+	all, err := s.Query(ctx, entity.TokenFilter{CustomerID: "6281100099"}, 0, 100)
 	assert.Nil(t, err)
 	assert.NotEqual(t, 0, len(all))
 }
 
+func Test_service_Query(t *testing.T) {
+	logger, _ := log.NewForTest()
+	now := time.Now()
+	repo := &mockRepository{items: []entity.PayToken{
+		{ID: "1", Token: "111111", CustomerID: "6281100099", ValidUntil: now.Add(-time.Minute), Status: entity.TokenStatusActive},
+		{ID: "2", Token: "222222", CustomerID: "6281100099", ValidUntil: now.Add(time.Minute), Status: entity.TokenStatusValidated},
+		{ID: "3", Token: "333333", CustomerID: "6281100099", ValidUntil: now.Add(-time.Minute), Status: entity.TokenStatusRedeemed},
+	}}
+	s := NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+	ctx := context.Background()
+	filter := entity.TokenFilter{CustomerID: "6281100099", Statuses: []entity.TokenStatus{entity.TokenStatusExpired}, Sort: "valid_until"}
+
+	count, err := s.Count(ctx, filter)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	// the tokens past their validity are reported as expired
+	items, err := s.Query(ctx, filter, 0, 2)
+	assert.Nil(t, err)
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, entity.TokenStatusExpired, items[0].Status)
+		assert.Equal(t, entity.TokenStatusValidated, items[1].Status)
+	}
+	items, err = s.Query(ctx, filter, 2, 2)
+	assert.Nil(t, err)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, entity.TokenStatusRedeemed, items[0].Status)
+	}
+
+	invalid := []entity.TokenFilter{
+		{},
+		{CustomerID: "6281100099", Statuses: []entity.TokenStatus{"USED"}},
+		{CustomerID: "6281100099", Sort: "token"},
+		{CustomerID: "6281100099", From: now, To: now.Add(-time.Hour)},
+	}
+	for _, filter := range invalid {
+		_, err = s.Count(ctx, filter)
+		assert.True(t, errors.Is(err, ErrValidation), "%+v", filter)
+		_, err = s.Query(ctx, filter, 0, 10)
+		assert.True(t, errors.Is(err, ErrValidation), "%+v", filter)
+	}
+}
+
+func Test_service_Seek(t *testing.T) {
+	logger, _ := log.NewForTest()
+	now := time.Now()
+	repo := &mockRepository{items: []entity.PayToken{
+		{ID: "1", Token: "111111", CustomerID: "6281100099", ValidUntil: now.Add(-time.Minute), Status: entity.TokenStatusActive, CreatedAt: now},
+		{ID: "2", Token: "222222", CustomerID: "6281100099", ValidUntil: now.Add(time.Minute), Status: entity.TokenStatusActive, CreatedAt: now.Add(-time.Hour)},
+		{ID: "3", Token: "333333", CustomerID: "6281100099", ValidUntil: now.Add(time.Minute), Status: entity.TokenStatusActive, CreatedAt: now.Add(-2 * time.Hour)},
+	}}
+	s := NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+	ctx := context.Background()
+	signer := pagination.NewCursorSigner([]byte("secret"))
+	keyset, err := pagination.NewKeyset(signer, "", 2, true)
+	assert.Nil(t, err)
+
+	page, err := s.Seek(ctx, entity.TokenFilter{CustomerID: "6281100099"}, keyset)
+	assert.Nil(t, err)
+	items := page.Items.([]entity.PayToken)
+	if assert.Len(t, items, 2) {
+		assert.Equal(t, entity.TokenStatusExpired, items[0].Status)
+		assert.Equal(t, entity.TokenStatusActive, items[1].Status)
+	}
+	assert.Empty(t, page.Prev)
+	next, err := signer.Decode(page.Next)
+	assert.Nil(t, err)
+	assert.True(t, next.CreatedAt.Equal(items[1].CreatedAt))
+	assert.Equal(t, "2", next.ID)
+	assert.False(t, next.Before)
+
+	_, err = s.Seek(ctx, entity.TokenFilter{CustomerID: "6281100099", Sort: "-valid_until"}, keyset)
+	assert.True(t, errors.Is(err, ErrValidation))
+
+	// the cursor only leads to the next page of the same list
+	keyset, err = pagination.NewKeyset(signer, page.Next, 2, true)
+	assert.Nil(t, err)
+	_, err = s.Seek(ctx, entity.TokenFilter{CustomerID: "6281100099"}, keyset)
+	assert.Nil(t, err)
+	keyset, _ = pagination.NewKeyset(signer, page.Next, 2, true)
+	_, err = s.Seek(ctx, entity.TokenFilter{CustomerID: "6281100099", Statuses: []entity.TokenStatus{entity.TokenStatusActive}}, keyset)
+	assert.True(t, errors.Is(err, ErrValidation))
+	keyset, _ = pagination.NewKeyset(signer, page.Next, 2, false)
+	_, err = s.Seek(ctx, entity.TokenFilter{CustomerID: "6281100099", Sort: "created_at"}, keyset)
+	assert.True(t, errors.Is(err, ErrValidation))
+}
+
+func Test_service_GenerateWithPolicy(t *testing.T) {
+	logger, _ := log.NewForTest()
+	policy := config.TokenPolicy{Length: 8, Alphabet: "AB", TTL: 48 * 60, TimeZone: "Asia/Jakarta", MaxRetries: 1}
+	s := NewService(&mockRepository{}, nil, generator.NewRandom(policy.Alphabet), generator.NewRandom(policy.Alphabet), policy, logger)
+
+	out, err := s.Generate(context.Background(), entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.Len(t, out.Token, 8)
+	assert.Empty(t, strings.Trim(out.Token, "AB"))
+
+	// the token never outlives the token day of the policy time zone
+	now := time.Now().In(policy.Location())
+	endOfDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, policy.Location())
+	assert.True(t, out.ValidUntil.Before(endOfDay))
+}
+
+func Test_service_CheckDigit(t *testing.T) {
+	logger, _ := log.NewForTest()
+	policy := config.DefaultTokenPolicy()
+	policy.CheckDigit = "luhn"
+	gen := generator.NewWithCheckDigit(generator.NewNumeric(), generator.Luhn)
+	s := NewService(&mockRepository{}, nil, gen, gen, policy, logger)
+
+	ctx := context.Background()
+	out, err := s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.True(t, generator.Luhn.Verify(out.Token))
+
+	_, err = s.Validate(ctx, entity.InputValidate{Token: out.Token})
+	assert.Nil(t, err)
+
+	// the surrounding spaces are ignored like by the repository
+	spaced := NewService(&mockRepository{}, nil, gen, gen, policy, logger)
+	_, err = spaced.Validate(ctx, entity.InputValidate{Token: " " + out.Token + "\n"})
+	assert.Nil(t, err)
+
+	// a mistyped token is rejected before the repository is queried
+	typo := []byte(out.Token)
+	typo[2] = '0' + (typo[2]-'0'+1)%10
+	_, err = s.Validate(ctx, entity.InputValidate{Token: string(typo)})
+	assert.True(t, errors.Is(err, ErrMalformedToken))
+	_, err = s.Redeem(ctx, entity.InputRedeem{Token: string(typo), MerchantID: "M001", Amount: 25000, Reference: "INV-1"})
+	assert.True(t, errors.Is(err, ErrMalformedToken))
+}
+
+func Test_service_TimeZone(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &dayRecorder{mockRepository: &mockRepository{}}
+	s := NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+
+	ctx := context.Background()
+	jakarta, _ := time.LoadLocation("Asia/Jakarta")
+
+	// the token day follows the time zone of the request
+	out, err := s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099", TimeZone: "Asia/Jakarta"})
+	assert.Nil(t, err)
+	now := time.Now().In(jakarta)
+	assert.Equal(t, now.Format("2006-01-02"), repo.saved.TokenDate.Format("2006-01-02"))
+	assert.True(t, out.ValidUntil.Before(time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, jakarta)))
+
+	_, err = s.Validate(ctx, entity.InputValidate{Token: out.Token, TimeZone: "Asia/Jakarta"})
+	assert.Nil(t, err)
+	assert.Equal(t, jakarta.String(), repo.today.Location().String())
+
+	// the policy time zone is used otherwise
+	_, err = s.Validate(ctx, entity.InputValidate{Token: out.Token})
+	assert.Nil(t, err)
+	assert.Equal(t, time.UTC, repo.today.Location())
+
+	_, err = s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099", TimeZone: "Mars/Olympus_Mons"})
+	assert.True(t, errors.Is(err, ErrValidation))
+}
+
+// dayRecorder records the token day used to save and look up tokens.
+type dayRecorder struct {
+	*mockRepository
+	saved entity.PayToken
+	today time.Time
+}
+
+func (r *dayRecorder) Save(ctx context.Context, paytoken entity.PayToken) error {
+	r.saved = paytoken
+	return r.mockRepository.Save(ctx, paytoken)
+}
+
+func (r *dayRecorder) GetTodayPayToken(ctx context.Context, token string, today time.Time) (*entity.PayToken, error) {
+	r.today = today
+	return r.mockRepository.GetTodayPayToken(ctx, token, today)
+}
+
+func Test_service_GenerateLimits(t *testing.T) {
+	logger, _ := log.NewForTest()
+	policy := config.DefaultTokenPolicy()
+	policy.MaxActive, policy.MaxPerMinute, policy.MaxPerDay = 2, 3, 4
+	repo := &mockRepository{}
+	s := NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+
+	ctx := context.Background()
+	req := entity.InputGenerate{CustomerID: "6281100099"}
+	now := time.Now().In(policy.Location())
+	var limitErr LimitError
+
+	// the customer already holds the maximum number of usable tokens
+	repo.validUntil = []time.Time{now.Add(10 * time.Minute), now.Add(5 * time.Minute)}
+	_, err := s.Generate(ctx, req)
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, "2 usable tokens", limitErr.Limit)
+		assert.InDelta(t, 5*time.Minute, limitErr.RetryAfter, float64(time.Second))
+	}
+	assert.True(t, errors.Is(err, ErrLimitExceeded))
+
+	// expired tokens are not counted
+	repo.validUntil = []time.Time{now.Add(5 * time.Minute), now.Add(-time.Minute)}
+	_, err = s.Generate(ctx, req)
+	assert.Nil(t, err)
+
+	// too many tokens generated within a minute
+	repo.validUntil = nil
+	repo.createdAt = []time.Time{now.Add(-50 * time.Second), now.Add(-20 * time.Second), now.Add(-10 * time.Second)}
+	_, err = s.Generate(ctx, req)
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, "3 tokens per minute", limitErr.Limit)
+		assert.InDelta(t, 10*time.Second, limitErr.RetryAfter, float64(time.Second))
+	}
+
+	// too many tokens generated within the token day, which ends at midnight
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	repo.createdAt = []time.Time{dayStart, dayStart, now.Add(-2 * time.Minute), now.Add(-time.Minute - time.Second)}
+	if !repo.createdAt[3].After(dayStart) {
+		t.Skip("the test needs a few minutes of the token day to have passed")
+	}
+	_, err = s.Generate(ctx, req)
+	if assert.True(t, errors.As(err, &limitErr)) {
+		assert.Equal(t, "4 tokens per day", limitErr.Limit)
+		assert.InDelta(t, dayStart.AddDate(0, 0, 1).Sub(now), limitErr.RetryAfter, float64(time.Second))
+	}
+
+	// no limit applies when they are disabled
+	policy.MaxActive, policy.MaxPerMinute, policy.MaxPerDay = 0, 0, 0
+	s = NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+	_, err = s.Generate(ctx, req)
+	assert.Nil(t, err)
+}
+
+func Test_service_Keyspace(t *testing.T) {
+	logger, entries := log.NewForTest()
+	policy := config.DefaultTokenPolicy()
+	policy.MaxFillRatio = 0.5
+	ctx := context.Background()
+
+	// 9^6 = 531441 tokens of 6 digits, 9^8 = 43046721 tokens of 8 digits
+	repo := &mockRepository{issued: map[int]int{6: 100000}}
+	s := NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+	out, err := s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.Len(t, out.Token, 6)
+	keyspace, err := s.Keyspace(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "primary", keyspace.Active)
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), keyspace.TokenDate)
+	assert.Equal(t, float64(531441), keyspace.Primary.Size)
+	assert.Equal(t, 100000, keyspace.Primary.Issued)
+	assert.InDelta(t, 0.188, keyspace.Primary.FillRatio, 0.001)
+	assert.Nil(t, keyspace.Fallback)
+
+	// longer tokens are generated once the fill ratio is reached
+	repo.issued[6] = 300000
+	s = NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+	out, err = s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.Len(t, out.Token, 8)
+	keyspace, err = s.Keyspace(ctx, "Asia/Jakarta")
+	assert.Nil(t, err)
+	assert.Equal(t, "fallback", keyspace.Active)
+	if assert.NotNil(t, keyspace.Fallback) {
+		assert.Equal(t, 8, keyspace.Fallback.Length)
+		assert.Equal(t, float64(43046721), keyspace.Fallback.Size)
+	}
+	if assert.Equal(t, 1, entries.Len()) {
+		assert.Equal(t, "WARN", entries.All()[0].Level.CapitalString())
+	}
+
+	// no token is generated once both keyspaces are filled
+	repo.issued[8] = 30000000
+	s = NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+	_, err = s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.True(t, errors.Is(err, ErrKeyspaceExhausted))
+	keyspace, err = s.Keyspace(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "exhausted", keyspace.Active)
+	_, err = s.Keyspace(ctx, "Mars/Olympus_Mons")
+	assert.True(t, errors.Is(err, ErrValidation))
+
+	// the fill ratio is not monitored when the fallback is disabled
+	policy.MaxFillRatio = 0
+	s = NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+	out, err = s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.Len(t, out.Token, 6)
+
+	// the keyspace is also reported as exhausted when every generated token collides
+	s = NewService(duplicateSaver{&mockRepository{}}, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+	_, err = s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.True(t, errors.Is(err, ErrKeyspaceExhausted))
+}
+
+// duplicateSaver fails to save any token, as if it had already been issued for the day.
+type duplicateSaver struct {
+	*mockRepository
+}
+
+func (duplicateSaver) Save(ctx context.Context, paytoken entity.PayToken) error {
+	return entity.ErrDuplicateTokenPerDate
+}
+
+func Test_keyspaceMonitor(t *testing.T) {
+	repo := &mockRepository{issued: map[int]int{6: 10}}
+	monitor := newKeyspaceMonitor()
+	ctx := context.Background()
+	today := time.Now()
+
+	issued, counted, err := monitor.issued(ctx, repo, today, 6)
+	assert.Nil(t, err)
+	assert.True(t, counted)
+	assert.Equal(t, 10, issued)
+
+	// the count is cached, and the tokens issued in between are added to it
+	repo.issued[6] = 20
+	monitor.add(today, 6)
+	issued, counted, _ = monitor.issued(ctx, repo, today, 6)
+	assert.False(t, counted)
+	assert.Equal(t, 11, issued)
+
+	// the tokens of other days and lengths are counted separately
+	issued, counted, _ = monitor.issued(ctx, repo, today.AddDate(0, 0, 1), 6)
+	assert.True(t, counted)
+	assert.Equal(t, 20, issued)
+	issued, _, _ = monitor.issued(ctx, repo, today, 8)
+	assert.Zero(t, issued)
+}
+
+func Test_service_Pool(t *testing.T) {
+	logger, _ := log.NewForTest()
+	policy := config.DefaultTokenPolicy()
+	policy.MaxFillRatio = 0.5
+	policy.Pool = config.TokenPoolPolicy{Enabled: true, Size: 10, LowWater: 5, Days: 2, Interval: 1, BatchSize: 4}
+	pool := &mockPool{}
+	s := NewService(&mockRepository{}, pool, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+	ctx := context.Background()
+	today := time.Now().UTC().Format("2006-01-02")
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+
+	// the pool is filled for today and tomorrow, the tokens of the past days are removed
+	pool.tokens = map[string][]string{"2000-01-01": {"123456"}}
+	assert.Nil(t, s.RefillPool(ctx))
+	assert.Len(t, pool.tokens[today], 10)
+	assert.Len(t, pool.tokens[tomorrow], 10)
+	assert.NotContains(t, pool.tokens, "2000-01-01")
+
+	// tokens are claimed from the pool
+	reserved := pool.tokens[today][0]
+	out, err := s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.Equal(t, reserved, out.Token)
+	assert.Len(t, pool.tokens[today], 9)
+
+	// the pool is only refilled below the low-water mark
+	pool.tokens[today] = pool.tokens[today][:5]
+	assert.Nil(t, s.RefillPool(ctx))
+	assert.Len(t, pool.tokens[today], 5)
+	pool.tokens[today] = pool.tokens[today][:4]
+	assert.Nil(t, s.RefillPool(ctx))
+	assert.Len(t, pool.tokens[today], 10)
+
+	// tokens are generated on the fly when the pool is empty or failing
+	pool.tokens[today] = nil
+	out, err = s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.Len(t, out.Token, 6)
+	pool.err = errors.New("pool down")
+	_, err = s.Generate(ctx, entity.InputGenerate{CustomerID: "6281100099"})
+	assert.Nil(t, err)
+	assert.NotNil(t, s.RefillPool(ctx))
+	pool.err = nil
+
+	status, err := s.PoolStatus(ctx)
+	assert.Nil(t, err)
+	assert.True(t, status.Enabled)
+	assert.Equal(t, int64(1), status.Claimed)
+	assert.Equal(t, int64(2), status.Missed)
+	assert.Equal(t, int64(26), status.Reserved+status.Collisions)
+	assert.Equal(t, int64(3), status.Refills)
+	assert.Equal(t, []entity.PoolLevel{
+		{TokenDate: today, Length: 6, Available: 0},
+		{TokenDate: today, Length: 8, Available: 0},
+		{TokenDate: tomorrow, Length: 6, Available: 10},
+		{TokenDate: tomorrow, Length: 8, Available: 0},
+	}, status.Levels)
+
+	// the pool is left alone when it is disabled
+	s = NewService(&mockRepository{}, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+	assert.Nil(t, s.RefillPool(ctx))
+	status, err = s.PoolStatus(ctx)
+	assert.Nil(t, err)
+	assert.False(t, status.Enabled)
+	assert.Empty(t, status.Levels)
+}
+
+func TestRunPoolWorker(t *testing.T) {
+	logger, entries := log.NewForTest()
+	policy := config.DefaultTokenPolicy()
+	policy.Pool.Enabled = true
+	pool := &mockPool{err: errors.New("pool down")}
+	s := NewService(&mockRepository{}, pool, generator.NewNumeric(), generator.NewNumeric(), policy, logger)
+
+	// the pool is refilled right away, and the worker stops with its context
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunPoolWorker(ctx, s, time.Hour, logger)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return entries.Len() > 0 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, "failed to refill the token pool: token pool prune failed: pool down", entries.All()[0].Message)
+}
+
+// mockPool keeps reserved tokens in memory, keyed by token date.
+type mockPool struct {
+	tokens map[string][]string
+	err    error
+}
+
+func (m *mockPool) Claim(ctx context.Context, today time.Time, length int) (string, error) {
+	if m.err != nil {
+		return "", m.err
+	}
+	date := today.Format("2006-01-02")
+	for i, token := range m.tokens[date] {
+		if len(token) == length {
+			m.tokens[date] = append(m.tokens[date][:i], m.tokens[date][i+1:]...)
+			return token, nil
+		}
+	}
+	return "", ErrPoolEmpty
+}
+
+func (m *mockPool) Reserve(ctx context.Context, day time.Time, tokens []string) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	date := day.Format("2006-01-02")
+	added := 0
+	for _, token := range tokens {
+		reserved := false
+		for _, t := range m.tokens[date] {
+			reserved = reserved || t == token
+		}
+		if !reserved {
+			m.tokens[date] = append(m.tokens[date], token)
+			added++
+		}
+	}
+	return added, nil
+}
+
+func (m *mockPool) Count(ctx context.Context, day time.Time, length int) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	count := 0
+	for _, token := range m.tokens[day.Format("2006-01-02")] {
+		if len(token) == length {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *mockPool) Prune(ctx context.Context, day time.Time) error {
+	if m.err != nil {
+		return m.err
+	}
+	if m.tokens == nil {
+		m.tokens = map[string][]string{}
+	}
+	for date := range m.tokens {
+		if date < day.Format("2006-01-02") {
+			delete(m.tokens, date)
+		}
+	}
+	return nil
+}
+
+func Test_service_Redeem(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(&mockRepository{}, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+
+	ctx := context.Background()
+
+	out, err := s.Redeem(ctx, entity.InputRedeem{Token: "111111", MerchantID: "M001", Amount: 25000, Reference: "INV-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "6281100099", out.CustomerID)
+	assert.Equal(t, "M001", out.MerchantID)
+	assert.Equal(t, int64(25000), out.Amount)
+	assert.False(t, out.RedeemedAt.IsZero())
+
+	// a token can only be consumed once
+	_, err = s.Redeem(ctx, entity.InputRedeem{Token: "111111", MerchantID: "M002", Amount: 25000, Reference: "INV-2"})
+	assert.True(t, errors.Is(err, entity.ErrTokenAlreadyRedeemed))
+
+	_, err = s.Redeem(ctx, entity.InputRedeem{Token: "111111", MerchantID: "M001"})
+	assert.True(t, errors.Is(err, ErrValidation))
+
+	// validation reports the redeemed token without changing it
+	val, err := s.Validate(ctx, entity.InputValidate{Token: "111111"})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.TokenStatusRedeemed, val.Status)
+}
+
+func Test_service_Cancel(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(&mockRepository{}, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger)
+
+	ctx := context.Background()
+
+	// only the owning customer can cancel the token
+	_, err := s.Cancel(ctx, entity.InputCancel{Token: "111111", CustomerID: "6281100100"})
+	assert.True(t, errors.Is(err, ErrNotTokenOwner))
+
+	out, err := s.Cancel(ctx, entity.InputCancel{Token: "111111", CustomerID: "6281100099", Reason: "purchase abandoned"})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.TokenStatusCancelled, out.Status)
+	assert.False(t, out.CancelledAt.IsZero())
+
+	// a cancelled token is reported as not usable and can not be redeemed or cancelled again
+	val, err := s.Validate(ctx, entity.InputValidate{Token: "111111"})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.TokenStatusCancelled, val.Status)
+	assert.False(t, val.IsUsable)
+
+	_, err = s.Redeem(ctx, entity.InputRedeem{Token: "111111", MerchantID: "M001", Amount: 25000, Reference: "INV-1"})
+	assert.True(t, errors.Is(err, ErrTokenCancelled))
+
+	_, err = s.Cancel(ctx, entity.InputCancel{Token: "111111", CustomerID: "6281100099"})
+	assert.True(t, errors.Is(err, ErrTokenCancelled))
+}
+
+func Test_service_transition(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{}
+	s := NewService(repo, nil, generator.NewNumeric(), generator.NewNumeric(), config.DefaultTokenPolicy(), logger).(service)
+
+	ctx := context.Background()
+	paytoken, err := s.findTodayToken(ctx, "111111", time.Now())
+	assert.Nil(t, err)
+
+	// transitions are guarded by the state machine
+	_, err = s.transition(ctx, paytoken, func(paytoken *entity.PayToken) (bool, error) {
+		paytoken.Status = entity.TokenStatusActive
+		return true, nil
+	})
+	assert.True(t, errors.Is(err, ErrInvalidTransition))
+
+	// a concurrent change is detected and the transition is evaluated against the reloaded token
+	repo.transitions = map[string]entity.PayToken{"111111": {Token: "111111", CustomerID: "6281100099", ValidUntil: paytoken.ValidUntil, Status: entity.TokenStatusValidated}}
+	updated, err := s.transition(ctx, paytoken, func(paytoken *entity.PayToken) (bool, error) {
+		paytoken.Status = entity.TokenStatusRedeemed
+		return true, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, entity.TokenStatusRedeemed, updated.Status)
+	assert.Equal(t, entity.TokenStatusRedeemed, repo.transitions["111111"].Status)
+}
+
 type mockRepository struct {
 	items []entity.PayToken
+	// transitions keeps the tokens changed by Transition, keyed by token string
+	transitions map[string]entity.PayToken
+	// validUntil and createdAt hold the end of validity of the usable tokens and the creation time of all tokens,
+	// which are counted by CountActive and CountGenerated
+	validUntil, createdAt []time.Time
+	// issued holds the number of tokens issued today by token length, which is counted by CountIssued
+	issued map[int]int
+}
+
+func (m mockRepository) CountIssued(ctx context.Context, today time.Time, length int) (int, error) {
+	return m.issued[length], nil
+}
+
+func (m mockRepository) CountActive(ctx context.Context, customerID string, now time.Time) (int, time.Time, error) {
+	return countAfter(m.validUntil, now)
+}
+
+func (m mockRepository) CountGenerated(ctx context.Context, customerID string, since time.Time) (int, time.Time, error) {
+	return countAfter(m.createdAt, since.Add(-time.Nanosecond))
+}
+
+// countAfter returns the number of times after t, and the earliest of them.
+func countAfter(times []time.Time, t time.Time) (int, time.Time, error) {
+	count, earliest := 0, time.Time{}
+	for _, item := range times {
+		if item.After(t) {
+			count++
+			if earliest.IsZero() || item.Before(earliest) {
+				earliest = item
+			}
+		}
+	}
+	return count, earliest, nil
 }
 
 func (m mockRepository) Get(ctx context.Context, id string) (entity.PayToken, error) {
@@ -53,7 +656,11 @@ func (m mockRepository) Get(ctx context.Context, id string) (entity.PayToken, er
 	return entity.PayToken{}, sql.ErrNoRows
 }
 
-func (m mockRepository) GetTodayPayToken(ctx context.Context, id string) (*entity.PayToken, error) {
+func (m mockRepository) GetTodayPayToken(ctx context.Context, id string, today time.Time) (*entity.PayToken, error) {
+	if paytoken, ok := m.transitions[id]; ok {
+		return &paytoken, nil
+	}
+
 	// build valid until
 	now := time.Now().UTC()
 	nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
@@ -71,6 +678,7 @@ func (m mockRepository) GetTodayPayToken(ctx context.Context, id string) (*entit
 		Token:      "111111",
 		CustomerID: "6281100099",
 		ValidUntil: validUntil,
+		Status:     entity.TokenStatusActive,
 	}
 	if out.Token != "" {
 		return out, nil
@@ -78,7 +686,32 @@ func (m mockRepository) GetTodayPayToken(ctx context.Context, id string) (*entit
 	return &entity.PayToken{}, sql.ErrNoRows
 }
 
-func (m mockRepository) GetPayTokens(ctx context.Context, customer_id string) ([]entity.PayToken, error) {
+func (m mockRepository) Query(ctx context.Context, filter entity.TokenFilter, offset, limit int) ([]entity.PayToken, error) {
+	items := m.list()
+	if offset > len(items) {
+		offset = len(items)
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (m mockRepository) Seek(ctx context.Context, filter entity.TokenFilter, keyset *pagination.Keyset) ([]entity.PayToken, error) {
+	return m.Query(ctx, filter, 0, keyset.PerPage+1)
+}
+
+func (m mockRepository) Count(ctx context.Context, filter entity.TokenFilter) (int, error) {
+	return len(m.list()), nil
+}
+
+// list returns the tokens of the repository, or five tokens of the customer 6281100099 if it has none.
+func (m mockRepository) list() []entity.PayToken {
+	if len(m.items) > 0 {
+		return append([]entity.PayToken(nil), m.items...)
+	}
+	var items []entity.PayToken
 	var tok entity.PayToken
 	for i := 0; i < 5; i++ {
 		tok.ID = uuid.NewV4().String()
@@ -89,9 +722,9 @@ func (m mockRepository) GetPayTokens(ctx context.Context, customer_id string) ([
 		tok.CreatedAt = time.Now()
 		tok.UpdatedAt = time.Now()
 
-		m.items = append(m.items, tok)
+		items = append(items, tok)
 	}
-	return m.items, nil
+	return items
 }
 
 func (m mockRepository) Save(ctx context.Context, paytoken entity.PayToken) error {
@@ -114,3 +747,14 @@ func (m mockRepository) Update(ctx context.Context, paytoken entity.PayToken) er
 	// }
 	return nil
 }
+
+func (m *mockRepository) Transition(ctx context.Context, paytoken entity.PayToken, from entity.TokenStatus) error {
+	if m.transitions == nil {
+		m.transitions = map[string]entity.PayToken{}
+	}
+	if current, ok := m.transitions[paytoken.Token]; ok && current.Status != from {
+		return entity.ErrTokenStatusConflict
+	}
+	m.transitions[paytoken.Token] = paytoken
+	return nil
+}
@@ -0,0 +1,79 @@
+package sweeper
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/pkg/dbcontext"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// Repository changes the payment tokens in batches.
+type Repository interface {
+	// Expire marks at most limit usable tokens past their validity at the given time as expired.
+	// It returns the number of tokens expired.
+	Expire(ctx context.Context, now time.Time, limit int) (int, error)
+	// Archive moves at most limit tokens issued for the dates before the date of day to the archive table.
+	// It returns the number of tokens archived.
+	Archive(ctx context.Context, day time.Time, limit int) (int, error)
+	// Delete deletes at most limit tokens issued for the dates before the date of day.
+	// It returns the number of tokens deleted.
+	Delete(ctx context.Context, day time.Time, limit int) (int, error)
+}
+
+// repository changes the payment tokens in database
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new sweeper repository
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// Expire marks at most limit usable tokens past their validity as expired. The tokens being changed by
+// a concurrent request are skipped, they will be expired by the next run if they are still usable.
+func (r repository) Expire(ctx context.Context, now time.Time, limit int) (int, error) {
+	return r.execute(ctx, `UPDATE paytokens SET status = {:expired}, updated_at = {:now} WHERE id IN (
+			SELECT id FROM paytokens WHERE status IN ({:active}, {:validated}) AND valid_until < {:now}
+			LIMIT {:limit} FOR UPDATE SKIP LOCKED
+		)`, dbx.Params{
+		"expired":   entity.TokenStatusExpired,
+		"active":    entity.TokenStatusActive,
+		"validated": entity.TokenStatusValidated,
+		"now":       now,
+		"limit":     limit,
+	})
+}
+
+// Archive moves at most limit tokens issued for the dates before the date of day to the archive table.
+// The tokens are deleted and archived by the same statement, so that a token is never lost nor kept twice.
+func (r repository) Archive(ctx context.Context, day time.Time, limit int) (int, error) {
+	return r.execute(ctx, `WITH moved AS (
+			DELETE FROM paytokens WHERE id IN (
+				SELECT id FROM paytokens WHERE token_date < {:day} LIMIT {:limit} FOR UPDATE SKIP LOCKED
+			) RETURNING id, token, token_date, customer_id, valid_until, status, metadata, created_at, updated_at
+		)
+		INSERT INTO paytokens_archive (id, token, token_date, customer_id, valid_until, status, metadata, created_at, updated_at)
+		SELECT * FROM moved`, dbx.Params{"day": day.Format("2006-01-02"), "limit": limit})
+}
+
+// Delete deletes at most limit tokens issued for the dates before the date of day.
+func (r repository) Delete(ctx context.Context, day time.Time, limit int) (int, error) {
+	return r.execute(ctx, `DELETE FROM paytokens WHERE id IN (
+			SELECT id FROM paytokens WHERE token_date < {:day} LIMIT {:limit} FOR UPDATE SKIP LOCKED
+		)`, dbx.Params{"day": day.Format("2006-01-02"), "limit": limit})
+}
+
+// execute runs the statement and returns the number of rows it affected.
+func (r repository) execute(ctx context.Context, sql string, params dbx.Params) (int, error) {
+	result, err := r.db.With(ctx).NewQuery(sql).Bind(params).Execute()
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
@@ -0,0 +1,68 @@
+package sweeper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/pauluswi/tulip/internal/entity"
+	"github.com/pauluswi/tulip/internal/test"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestRepository(t *testing.T) {
+	logger, _ := log.NewForTest()
+	db := test.DB(t)
+	test.ResetTables(t, db, "paytokens", "paytokens_archive")
+	repo := NewRepository(db, logger)
+
+	ctx := context.Background()
+	now := time.Now()
+	insert := func(token string, day time.Time, validUntil time.Time, status entity.TokenStatus) {
+		_, err := db.DB().Insert("paytokens", dbx.Params{
+			"id":          uuid.NewV4().String(),
+			"token":       token,
+			"token_date":  day.Format("2006-01-02"),
+			"customer_id": "6281100099",
+			"valid_until": validUntil,
+			"status":      status,
+			"metadata":    "{}",
+		}).Execute()
+		assert.Nil(t, err)
+	}
+	insert("111111", now, now.Add(time.Hour), entity.TokenStatusActive)
+	insert("222222", now, now.Add(-time.Hour), entity.TokenStatusActive)
+	insert("333333", now, now.Add(-time.Hour), entity.TokenStatusValidated)
+	insert("444444", now, now.Add(-time.Hour), entity.TokenStatusRedeemed)
+	insert("555555", now.AddDate(0, 0, -100), now.AddDate(0, 0, -100), entity.TokenStatusExpired)
+	insert("666666", now.AddDate(0, 0, -100), now.AddDate(0, 0, -100), entity.TokenStatusExpired)
+
+	// only the usable tokens past their validity are expired
+	count, err := repo.Expire(ctx, now, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	count, err = repo.Expire(ctx, now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	count, _ = repo.Expire(ctx, now, 10)
+	assert.Zero(t, count)
+
+	// old tokens are moved to the archive table
+	count, err = repo.Archive(ctx, now.AddDate(0, 0, -90), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	var archived int
+	assert.Nil(t, db.DB().Select("COUNT(*)").From("paytokens_archive").Row(&archived))
+	assert.Equal(t, 1, archived)
+
+	count, err = repo.Delete(ctx, now.AddDate(0, 0, -90), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	var left int
+	assert.Nil(t, db.DB().Select("COUNT(*)").From("paytokens").Row(&left))
+	assert.Equal(t, 4, left)
+}
@@ -0,0 +1,100 @@
+// Package sweeper marks the payment tokens past their validity as expired, and archives or deletes the payment
+// tokens older than the retention period, so that the paytokens table only holds the recent tokens.
+package sweeper
+
+import (
+	"context"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+// Result counts the payment tokens changed by a sweep.
+type Result struct {
+	Expired  int
+	Archived int
+	Deleted  int
+}
+
+// Sweeper runs the sweeps described by a sweeper policy.
+type Sweeper struct {
+	repo   Repository
+	policy config.SweeperPolicy
+	// location is the time zone of the token dates
+	location *time.Location
+	logger   log.Logger
+}
+
+// NewSweeper creates a new sweeper. The retention period is counted in days of location, the time zone which
+// defines the token day.
+func NewSweeper(repo Repository, policy config.SweeperPolicy, location *time.Location, logger log.Logger) *Sweeper {
+	return &Sweeper{repo, policy, location, logger}
+}
+
+// Run sweeps right away and then at every interval of the policy, until ctx is done.
+// A sweep in progress stops once ctx is done. Every batch is a single statement, so that the batch being run
+// is either completed or rolled back.
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.policy.IntervalDuration())
+	defer ticker.Stop()
+	for {
+		if _, err := s.Sweep(ctx); err != nil && ctx.Err() == nil {
+			s.logger.With(ctx).Errorf("failed to sweep payment tokens: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep marks the usable tokens past their validity as expired, then archives or deletes the tokens whose token day
+// is older than the retention period, batch by batch until no token is left to change or ctx is done.
+func (s *Sweeper) Sweep(ctx context.Context) (Result, error) {
+	var result Result
+	now := time.Now()
+
+	expired, err := s.batches(ctx, func(limit int) (int, error) {
+		return s.repo.Expire(ctx, now, limit)
+	})
+	result.Expired = expired
+	if err != nil {
+		return result, err
+	}
+
+	if s.policy.Retention > 0 {
+		today := now.In(s.location)
+		day := time.Date(today.Year(), today.Month(), today.Day()-s.policy.Retention, 0, 0, 0, 0, s.location)
+		if s.policy.RetentionAction == "delete" {
+			result.Deleted, err = s.batches(ctx, func(limit int) (int, error) {
+				return s.repo.Delete(ctx, day, limit)
+			})
+		} else {
+			result.Archived, err = s.batches(ctx, func(limit int) (int, error) {
+				return s.repo.Archive(ctx, day, limit)
+			})
+		}
+	}
+
+	if result != (Result{}) {
+		s.logger.With(ctx).Infof("swept payment tokens: %d expired, %d archived, %d deleted",
+			result.Expired, result.Archived, result.Deleted)
+	}
+	return result, err
+}
+
+// batches runs batch with the batch size of the policy until it changes fewer tokens than the batch size,
+// and returns the number of tokens changed. It stops early once ctx is done.
+func (s *Sweeper) batches(ctx context.Context, batch func(limit int) (int, error)) (int, error) {
+	total := 0
+	for ctx.Err() == nil {
+		count, err := batch(s.policy.BatchSize)
+		total += count
+		if err != nil || count < s.policy.BatchSize {
+			return total, err
+		}
+	}
+	return total, ctx.Err()
+}
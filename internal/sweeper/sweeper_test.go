@@ -0,0 +1,141 @@
+package sweeper
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/internal/config"
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweeper_Sweep(t *testing.T) {
+	logger, entries := log.NewForTest()
+	policy := config.SweeperPolicy{Interval: 1, BatchSize: 10, Retention: 30, RetentionAction: "archive"}
+	repo := &mockRepository{expirable: 25, old: 12}
+	s := NewSweeper(repo, policy, time.UTC, logger)
+
+	result, err := s.Sweep(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Expired: 25, Archived: 12}, result)
+	// the batches go on until one changes fewer tokens than the batch size
+	assert.Equal(t, []int{10, 10, 5}, repo.expired)
+	assert.Equal(t, []int{10, 2}, repo.archived)
+	assert.Equal(t, time.Now().UTC().AddDate(0, 0, -30).Format("2006-01-02"), repo.day.Format("2006-01-02"))
+	assert.Equal(t, 1, entries.Len())
+
+	// nothing is logged when no token is changed
+	result, err = s.Sweep(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, Result{}, result)
+	assert.Equal(t, 1, entries.Len())
+
+	policy.RetentionAction = "delete"
+	repo = &mockRepository{old: 3}
+	result, err = NewSweeper(repo, policy, time.UTC, logger).Sweep(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Deleted: 3}, result)
+	assert.Empty(t, repo.archived)
+
+	// the tokens are kept forever without retention period
+	policy.Retention = 0
+	repo = &mockRepository{old: 3}
+	result, err = NewSweeper(repo, policy, time.UTC, logger).Sweep(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, Result{}, result)
+	assert.Equal(t, 3, repo.old)
+}
+
+func TestSweeper_SweepTimeZone(t *testing.T) {
+	logger, _ := log.NewForTest()
+	policy := config.SweeperPolicy{Interval: 1, BatchSize: 10, Retention: 30, RetentionAction: "delete"}
+	// the token day of this time zone is ahead of the local and UTC ones for most of the day
+	location := time.FixedZone("UTC+14", 14*60*60)
+	repo := &mockRepository{old: 3}
+
+	_, err := NewSweeper(repo, policy, location, logger).Sweep(context.Background())
+	assert.Nil(t, err)
+	today := time.Now().In(location)
+	assert.Equal(t, time.Date(today.Year(), today.Month(), today.Day()-30, 0, 0, 0, 0, location), repo.day)
+}
+
+func TestSweeper_SweepError(t *testing.T) {
+	logger, _ := log.NewForTest()
+	policy := config.DefaultSweeperPolicy()
+	repo := &mockRepository{old: 3, err: errors.New("db down")}
+	_, err := NewSweeper(repo, policy, time.UTC, logger).Sweep(context.Background())
+	assert.EqualError(t, err, "db down")
+	// the tokens are not archived when they could not be expired
+	assert.Equal(t, 3, repo.old)
+}
+
+func TestSweeper_Run(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{expirable: 1000000}
+	policy := config.SweeperPolicy{Interval: 60, BatchSize: 10, RetentionAction: "archive"}
+	s := NewSweeper(repo, policy, time.UTC, logger)
+
+	// the sweep in progress stops with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	repo.onBatch = func() {
+		if len(repo.expired) == 3 {
+			cancel()
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the sweeper did not stop")
+	}
+	assert.Len(t, repo.expired, 3)
+}
+
+// mockRepository holds a number of tokens to expire and to archive or delete, and records the batches.
+type mockRepository struct {
+	expirable, old    int
+	expired, archived []int
+	day               time.Time
+	err               error
+	onBatch           func()
+}
+
+func (m *mockRepository) Expire(ctx context.Context, now time.Time, limit int) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	count := take(&m.expirable, limit)
+	m.expired = append(m.expired, count)
+	if m.onBatch != nil {
+		m.onBatch()
+	}
+	return count, nil
+}
+
+func (m *mockRepository) Archive(ctx context.Context, day time.Time, limit int) (int, error) {
+	m.day = day
+	count := take(&m.old, limit)
+	m.archived = append(m.archived, count)
+	return count, nil
+}
+
+func (m *mockRepository) Delete(ctx context.Context, day time.Time, limit int) (int, error) {
+	m.day = day
+	return take(&m.old, limit), nil
+}
+
+// take removes at most limit tokens from the given number and returns the number removed.
+func take(count *int, limit int) int {
+	n := *count
+	if n > limit {
+		n = limit
+	}
+	*count -= n
+	return n
+}
@@ -0,0 +1,2 @@
+ALTER TABLE paytokens DROP CONSTRAINT IF EXISTS chk_paytokens_status;
+ALTER TABLE paytokens DROP COLUMN IF EXISTS status;
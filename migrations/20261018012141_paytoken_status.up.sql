@@ -0,0 +1,12 @@
+-- Add explicit lifecycle status to paytokens, see entity.TokenStatus for the allowed transitions
+
+ALTER TABLE paytokens ADD COLUMN IF NOT EXISTS "status" VARCHAR NOT NULL DEFAULT 'ACTIVE';
+
+-- Backfill the status of existing tokens from their metadata and validity
+UPDATE paytokens SET status = 'REDEEMED' WHERE metadata->'redemption' IS NOT NULL;
+UPDATE paytokens SET status = 'VALIDATED'
+    WHERE status = 'ACTIVE' AND COALESCE(metadata->>'validated_at', '0001-01-01T00:00:00Z') <> '0001-01-01T00:00:00Z';
+UPDATE paytokens SET status = 'EXPIRED' WHERE status IN ('ACTIVE', 'VALIDATED') AND valid_until < now();
+
+ALTER TABLE paytokens ADD CONSTRAINT chk_paytokens_status
+    CHECK (status IN ('ACTIVE', 'VALIDATED', 'REDEEMED', 'EXPIRED', 'CANCELLED'));
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS users (
+    "id" UUID NOT NULL PRIMARY KEY,
+    "username" VARCHAR NOT NULL,
+    "password_hash" VARCHAR NOT NULL,
+    "failed_attempts" INTEGER NOT NULL DEFAULT 0,
+    "locked_until" TIMESTAMP WITH TIME ZONE NULL,
+    "disabled" BOOLEAN NOT NULL DEFAULT false,
+    "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+-- Add unique index to ensure a username can only be taken once
+CREATE UNIQUE INDEX IF NOT EXISTS idx_unq_users_username ON users (username);
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS chk_users_role;
+ALTER TABLE users DROP COLUMN IF EXISTS "owner_id";
+ALTER TABLE users DROP COLUMN IF EXISTS "role";
@@ -0,0 +1,4 @@
+-- The role decides what a user is allowed to do, the owner ID is the customer or merchant the user acts for.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS "role" VARCHAR NOT NULL DEFAULT 'customer';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS "owner_id" VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE users ADD CONSTRAINT chk_users_role CHECK ("role" IN ('admin', 'customer', 'merchant'));
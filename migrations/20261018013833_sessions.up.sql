@@ -0,0 +1,25 @@
+-- Refresh tokens are rotated on every use, tokens issued from the same login share a family
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    "id" UUID NOT NULL PRIMARY KEY,
+    "token_hash" VARCHAR NOT NULL,
+    "family_id" UUID NOT NULL,
+    "user_id" UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    "access_token_id" VARCHAR NOT NULL,
+    "access_expires_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "expires_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "used_at" TIMESTAMP WITH TIME ZONE NULL,
+    "revoked_at" TIMESTAMP WITH TIME ZONE NULL,
+    "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_unq_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens (user_id);
+
+-- Access tokens revoked before their expiry, identified by their jti claim
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    "jti" VARCHAR NOT NULL PRIMARY KEY,
+    "expires_at" TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens (expires_at);
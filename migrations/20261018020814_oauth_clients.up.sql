@@ -0,0 +1,13 @@
+-- Clients authenticate with the OAuth2 client credentials grant, the secret is stored as a SHA-256 hash
+CREATE TABLE IF NOT EXISTS clients (
+    "id" VARCHAR NOT NULL PRIMARY KEY,
+    "name" VARCHAR NOT NULL,
+    "secret_hash" VARCHAR NOT NULL,
+    "role" VARCHAR NOT NULL,
+    "owner_id" VARCHAR NOT NULL DEFAULT '',
+    "scope" VARCHAR NOT NULL DEFAULT '',
+    "disabled" BOOLEAN NOT NULL DEFAULT false,
+    "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    CONSTRAINT chk_clients_role CHECK ("role" IN ('admin', 'customer', 'merchant'))
+);
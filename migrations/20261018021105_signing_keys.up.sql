@@ -0,0 +1,19 @@
+-- Secrets shared with merchants to sign their requests, a merchant may have several keys during a rotation
+CREATE TABLE IF NOT EXISTS signing_keys (
+    "id" VARCHAR NOT NULL PRIMARY KEY,
+    "merchant_id" VARCHAR NOT NULL,
+    "secret" VARCHAR NOT NULL,
+    "disabled" BOOLEAN NOT NULL DEFAULT false,
+    "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    "updated_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_signing_keys_merchant_id ON signing_keys (merchant_id);
+
+-- Nonces of the signed requests, kept until their timestamp falls out of the accepted window
+CREATE TABLE IF NOT EXISTS request_nonces (
+    "nonce" VARCHAR NOT NULL PRIMARY KEY,
+    "expires_at" TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_request_nonces_expires_at ON request_nonces (expires_at);
@@ -0,0 +1,13 @@
+-- Responses of the requests sent with an Idempotency-Key header, replayed to the retries of these requests.
+-- A status of 0 marks a request which is still being processed.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    "key" VARCHAR NOT NULL PRIMARY KEY,
+    "fingerprint" VARCHAR NOT NULL,
+    "status" INTEGER NOT NULL DEFAULT 0,
+    "content_type" VARCHAR NOT NULL DEFAULT '',
+    "body" BYTEA NULL,
+    "expires_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys (expires_at);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_paytokens_customer_id_created_at;
@@ -0,0 +1,2 @@
+-- Speed up the per-customer generation limits, which count the tokens of a customer by creation time and validity
+CREATE INDEX IF NOT EXISTS idx_paytokens_customer_id_created_at ON paytokens (customer_id, created_at);
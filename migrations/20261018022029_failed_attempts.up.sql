@@ -0,0 +1,9 @@
+-- Failed attempts of the callers and IP addresses, counted within a window starting with the first failure
+CREATE TABLE IF NOT EXISTS failed_attempts (
+    "key" VARCHAR NOT NULL PRIMARY KEY,
+    "failures" INTEGER NOT NULL DEFAULT 0,
+    "window_start" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "locked_until" TIMESTAMP WITH TIME ZONE NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_failed_attempts_window_start ON failed_attempts (window_start);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_paytokens_token_date_length;
@@ -0,0 +1,2 @@
+-- Speed up the keyspace monitoring, which counts the tokens of a token day by length
+CREATE INDEX IF NOT EXISTS idx_paytokens_token_date_length ON paytokens (token_date, length(token));
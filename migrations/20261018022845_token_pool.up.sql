@@ -0,0 +1,8 @@
+-- Tokens reserved in advance for the upcoming token days, claimed by the token generation.
+-- A token is only reserved when it has not been issued for its token day yet, and is removed from the pool once claimed.
+CREATE TABLE IF NOT EXISTS token_pool (
+    "token" VARCHAR NOT NULL,
+    "token_date" DATE NOT NULL,
+    "created_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY ("token_date", "token")
+);
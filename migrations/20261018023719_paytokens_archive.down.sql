@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_paytokens_usable_valid_until;
+DROP TABLE IF EXISTS paytokens_archive;
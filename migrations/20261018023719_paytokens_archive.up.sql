@@ -0,0 +1,19 @@
+-- Payment tokens moved out of paytokens by the sweeper once they are older than the retention period
+CREATE TABLE IF NOT EXISTS paytokens_archive (
+    "id" UUID NOT NULL PRIMARY KEY,
+    "token" VARCHAR NOT NULL,
+    "token_date" DATE NOT NULL,
+    "customer_id" VARCHAR NOT NULL,
+    "valid_until" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "status" VARCHAR NOT NULL,
+    "metadata" JSONB NOT NULL DEFAULT '{}',
+    "created_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "updated_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "archived_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_paytokens_archive_customer_id ON paytokens_archive (customer_id);
+
+-- Speed up the sweeper, which looks for the usable tokens past their validity
+CREATE INDEX IF NOT EXISTS idx_paytokens_usable_valid_until ON paytokens (valid_until)
+    WHERE status IN ('ACTIVE', 'VALIDATED');
@@ -0,0 +1,3 @@
+-- A request which is still being processed once locked_until has passed is considered abandoned, and its key can be
+-- reserved again. The requests in progress when the column is added are considered abandoned.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS "locked_until" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
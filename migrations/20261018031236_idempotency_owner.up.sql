@@ -0,0 +1,3 @@
+-- The owner identifies the request holding the reservation of a key, so that a request which took longer than its
+-- lock can neither complete nor release the reservation taken over by a retry.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS "owner" VARCHAR NOT NULL DEFAULT '';
@@ -0,0 +1,12 @@
+// Package migrations embeds the SQL migrations of the database schema, so that the server binary can apply them
+// without the migrations directory.
+//
+// The files are named <version>_<name>.up.sql and <version>_<name>.down.sql, as created by make migrate-new.
+package migrations
+
+import "embed"
+
+// FS holds the SQL migration files.
+//
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pauluswi/tulip/pkg/migration"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFS(t *testing.T) {
+	migrations, err := migration.Load(FS)
+	assert.Nil(t, err)
+	if assert.NotEmpty(t, migrations) {
+		assert.Equal(t, "20211230_init", migrations[0].String())
+	}
+	// every migration can be reverted by make migrate-down
+	for _, m := range migrations {
+		assert.NotEmpty(t, m.Down, m.String())
+	}
+	// the migrations following the initial schema are versioned by their creation time, as by make migrate-new
+	for i := 1; i < len(migrations); i++ {
+		m := migrations[i]
+		_, err := time.Parse("20060102150405", strconv.FormatUint(m.Version, 10))
+		assert.Nil(t, err, m.String())
+	}
+}
@@ -0,0 +1,155 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CheckDigit computes and verifies the check digit appended to numeric tokens, which allows to detect
+// mistyped tokens without looking them up.
+type CheckDigit interface {
+	// Compute returns the check digit of the given decimal digits.
+	Compute(digits string) (byte, error)
+	// Verify reports whether the last character of token is the check digit of the preceding digits.
+	Verify(token string) bool
+}
+
+var (
+	// Luhn is the check digit algorithm used by payment cards. It detects all single digit errors
+	// and most transpositions of adjacent digits.
+	Luhn CheckDigit = luhn{}
+	// Damm detects all single digit errors and all transpositions of adjacent digits.
+	Damm CheckDigit = damm{}
+
+	// ErrNotDigits is returned when a check digit is computed for a string which has non decimal characters.
+	ErrNotDigits = errors.New("check digit requires decimal digits")
+)
+
+// CheckDigitByName returns the check digit algorithm with the given name, either "luhn" or "damm".
+// Nil is returned if the name is empty or unknown.
+func CheckDigitByName(name string) CheckDigit {
+	switch name {
+	case "luhn":
+		return Luhn
+	case "damm":
+		return Damm
+	}
+	return nil
+}
+
+// checkDigitGenerator appends a check digit to the tokens of another generator.
+type checkDigitGenerator struct {
+	generator Generator
+	algorithm CheckDigit
+}
+
+// NewWithCheckDigit creates a generator which appends a check digit to the numeric tokens generated by g.
+// The check digit is included in the requested length.
+func NewWithCheckDigit(g Generator, algorithm CheckDigit) Generator {
+	return checkDigitGenerator{g, algorithm}
+}
+
+// Generate returns a new token of the given length whose last character is the check digit.
+func (c checkDigitGenerator) Generate(length int) (string, error) {
+	if length < 2 {
+		return "", ErrInvalidLength
+	}
+	body, err := c.generator.Generate(length - 1)
+	if err != nil {
+		return "", err
+	}
+	digit, err := c.algorithm.Compute(body)
+	if err != nil {
+		return "", err
+	}
+	return body + string(digit), nil
+}
+
+type luhn struct{}
+
+// Compute returns the Luhn check digit of the given decimal digits.
+func (luhn) Compute(digits string) (byte, error) {
+	sum, err := luhnSum(digits, true)
+	if err != nil {
+		return 0, err
+	}
+	return byte('0' + (10-sum%10)%10), nil
+}
+
+// Verify reports whether token ends with the Luhn check digit of the preceding digits.
+func (luhn) Verify(token string) bool {
+	if len(token) < 2 {
+		return false
+	}
+	sum, err := luhnSum(token, false)
+	return err == nil && sum%10 == 0
+}
+
+// luhnSum sums the digits from right to left, doubling every second digit.
+// The rightmost digit is doubled when it is not the check digit yet.
+func luhnSum(digits string, doubleFirst bool) (int, error) {
+	sum := 0
+	double := doubleFirst
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if d > 9 {
+			return 0, fmt.Errorf("%w: %q", ErrNotDigits, digits)
+		}
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum, nil
+}
+
+// dammTable is the totally anti-symmetric quasigroup of order 10 used by the Damm algorithm.
+var dammTable = [10][10]byte{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+type damm struct{}
+
+// Compute returns the Damm check digit of the given decimal digits.
+func (damm) Compute(digits string) (byte, error) {
+	interim, err := dammInterim(digits)
+	if err != nil {
+		return 0, err
+	}
+	return '0' + interim, nil
+}
+
+// Verify reports whether token ends with the Damm check digit of the preceding digits.
+func (damm) Verify(token string) bool {
+	if len(token) < 2 {
+		return false
+	}
+	interim, err := dammInterim(token)
+	return err == nil && interim == 0
+}
+
+// dammInterim runs the digits through the Damm table and returns the final interim digit.
+func dammInterim(digits string) (byte, error) {
+	var interim byte
+	for i := 0; i < len(digits); i++ {
+		d := digits[i] - '0'
+		if d > 9 {
+			return 0, fmt.Errorf("%w: %q", ErrNotDigits, digits)
+		}
+		interim = dammTable[interim][d]
+	}
+	return interim, nil
+}
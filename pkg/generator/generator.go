@@ -0,0 +1,38 @@
+// Package generator provides strategies to generate payment token strings.
+package generator
+
+import "errors"
+
+// Generator generates token strings.
+type Generator interface {
+	// Generate returns a new token of the given length.
+	Generate(length int) (string, error)
+}
+
+const (
+	// Numeric contains the digits used by the default tokens. Zero is left out so that a token never starts with it.
+	Numeric = "123456789"
+	// Digits contains all decimal digits.
+	Digits = "0123456789"
+	// Alphanumeric contains upper case letters and digits, leaving out the characters which are easily
+	// confused when read aloud or typed: 0/O, 1/I/L.
+	Alphanumeric = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+)
+
+var (
+	// ErrInvalidLength is returned when a token of zero or negative length is requested.
+	ErrInvalidLength = errors.New("invalid token length")
+	// ErrInvalidAlphabet is returned when the alphabet is empty or has more than 256 characters.
+	ErrInvalidAlphabet = errors.New("invalid token alphabet")
+)
+
+// validate checks the length of the token and the alphabet it is made of.
+func validate(length int, alphabet string) error {
+	if length <= 0 {
+		return ErrInvalidLength
+	}
+	if len(alphabet) == 0 || len(alphabet) > 256 {
+		return ErrInvalidAlphabet
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package generator
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandom_Generate(t *testing.T) {
+	g := NewNumeric()
+	token, err := g.Generate(6)
+	assert.Nil(t, err)
+	assert.Len(t, token, 6)
+	assert.Empty(t, strings.Trim(token, Numeric))
+
+	token, err = NewAlphanumeric().Generate(10)
+	assert.Nil(t, err)
+	assert.Empty(t, strings.Trim(token, Alphanumeric))
+
+	_, err = g.Generate(0)
+	assert.Equal(t, ErrInvalidLength, err)
+	_, err = NewRandom("").Generate(6)
+	assert.Equal(t, ErrInvalidAlphabet, err)
+}
+
+func TestRandom_GenerateRejectsBiasedBytes(t *testing.T) {
+	// 252 is the largest multiple of 9 below 256, bytes from 252 up would favour the first characters
+	g := random{Numeric, bytes.NewReader([]byte{252, 0, 255, 8, 9, 1})}
+	token, err := g.Generate(3)
+	assert.Nil(t, err)
+	assert.Equal(t, "191", token)
+
+	// a short read is reported instead of panicking
+	g = random{Numeric, bytes.NewReader([]byte{1})}
+	_, err = g.Generate(3)
+	assert.NotNil(t, err)
+}
+
+func TestSeeded_Generate(t *testing.T) {
+	a, b := NewSeeded(42, Digits), NewSeeded(42, Digits)
+	for i := 0; i < 5; i++ {
+		ta, err := a.Generate(6)
+		assert.Nil(t, err)
+		tb, _ := b.Generate(6)
+		assert.Equal(t, ta, tb)
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	d, err := Luhn.Compute("7992739871")
+	assert.Nil(t, err)
+	assert.Equal(t, byte('3'), d)
+	assert.True(t, Luhn.Verify("79927398713"))
+	assert.False(t, Luhn.Verify("79927398714"))
+	// transposition of adjacent digits
+	assert.False(t, Luhn.Verify("97927398713"))
+	assert.False(t, Luhn.Verify("7"))
+
+	_, err = Luhn.Compute("12a4")
+	assert.True(t, errors.Is(err, ErrNotDigits))
+	assert.False(t, Luhn.Verify("12a4"))
+}
+
+func TestDamm(t *testing.T) {
+	d, err := Damm.Compute("572")
+	assert.Nil(t, err)
+	assert.Equal(t, byte('4'), d)
+	assert.True(t, Damm.Verify("5724"))
+	assert.False(t, Damm.Verify("5723"))
+	assert.False(t, Damm.Verify("7524"))
+
+	_, err = Damm.Compute("5A2")
+	assert.True(t, errors.Is(err, ErrNotDigits))
+}
+
+func TestNewWithCheckDigit(t *testing.T) {
+	for _, algorithm := range []CheckDigit{Luhn, Damm} {
+		g := NewWithCheckDigit(NewNumeric(), algorithm)
+		token, err := g.Generate(6)
+		assert.Nil(t, err)
+		assert.Len(t, token, 6)
+		assert.True(t, algorithm.Verify(token))
+	}
+
+	_, err := NewWithCheckDigit(NewNumeric(), Luhn).Generate(1)
+	assert.Equal(t, ErrInvalidLength, err)
+	_, err = NewWithCheckDigit(NewAlphanumeric(), Luhn).Generate(6)
+	assert.NotNil(t, err)
+}
+
+func TestCheckDigitByName(t *testing.T) {
+	assert.Equal(t, Luhn, CheckDigitByName("luhn"))
+	assert.Equal(t, Damm, CheckDigitByName("damm"))
+	assert.Nil(t, CheckDigitByName(""))
+	assert.Nil(t, CheckDigitByName("verhoeff"))
+}
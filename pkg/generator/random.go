@@ -0,0 +1,57 @@
+package generator
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// random generates tokens from a cryptographically secure source of random bytes.
+type random struct {
+	alphabet string
+	reader   io.Reader
+}
+
+// NewRandom creates a generator which picks every character uniformly at random from the given alphabet.
+func NewRandom(alphabet string) Generator {
+	return random{alphabet, rand.Reader}
+}
+
+// NewNumeric creates a random generator of numeric tokens.
+func NewNumeric() Generator {
+	return NewRandom(Numeric)
+}
+
+// NewAlphanumeric creates a random generator of alphanumeric tokens without ambiguous characters.
+func NewAlphanumeric() Generator {
+	return NewRandom(Alphanumeric)
+}
+
+// Generate returns a new token of the given length.
+//
+// Random bytes are mapped to the alphabet using rejection sampling: bytes beyond the largest multiple
+// of the alphabet size are discarded, so that every character is equally likely.
+func (r random) Generate(length int) (string, error) {
+	if err := validate(length, r.alphabet); err != nil {
+		return "", err
+	}
+
+	size := len(r.alphabet)
+	limit := 256 - 256%size
+	token := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(token) < length {
+		if _, err := io.ReadFull(r.reader, buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if int(b) >= limit {
+				continue
+			}
+			token = append(token, r.alphabet[int(b)%size])
+			if len(token) == length {
+				break
+			}
+		}
+	}
+	return string(token), nil
+}
@@ -0,0 +1,34 @@
+package generator
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// seeded generates a reproducible sequence of tokens. It must not be used in production.
+type seeded struct {
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	alphabet string
+}
+
+// NewSeeded creates a deterministic generator for tests. Generators created with the same seed and alphabet
+// return the same sequence of tokens.
+func NewSeeded(seed int64, alphabet string) Generator {
+	return &seeded{rnd: rand.New(rand.NewSource(seed)), alphabet: alphabet}
+}
+
+// Generate returns the next token of the given length.
+func (s *seeded) Generate(length int) (string, error) {
+	if err := validate(length, s.alphabet); err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := make([]byte, length)
+	for i := range token {
+		token[i] = s.alphabet[s.rnd.Intn(len(s.alphabet))]
+	}
+	return string(token), nil
+}
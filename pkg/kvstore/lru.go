@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// lru keeps the most recently used entries in memory, up to a number of entries.
+type lru struct {
+	size    int
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+// lruEntry is the value of the elements of the usage order list.
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewLRU creates a new in-memory store keeping at most size entries. Once the store is full,
+// adding an entry evicts the least recently used one.
+func NewLRU(size int) Store {
+	return &lru{size: size, order: list.New(), entries: map[string]*list.Element{}, now: time.Now}
+}
+
+// Get returns the value of the key, and false if the key is not found or has expired.
+func (s *lru) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*lruEntry)
+	if !s.now().Before(entry.expiresAt) {
+		s.remove(element)
+		return nil, false, nil
+	}
+	s.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+// Set stores the value of the key, which expires after ttl.
+func (s *lru) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &lruEntry{key: key, value: value, expiresAt: s.now().Add(ttl)}
+	if element, ok := s.entries[key]; ok {
+		element.Value = entry
+		s.order.MoveToFront(element)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(entry)
+	for s.order.Len() > s.size {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+// Delete removes the keys.
+func (s *lru) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if element, ok := s.entries[key]; ok {
+			s.remove(element)
+		}
+	}
+	return nil
+}
+
+// remove removes the entry of the element. The caller must hold the lock.
+func (s *lru) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*lruEntry).key)
+}
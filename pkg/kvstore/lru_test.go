@@ -0,0 +1,61 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	s := NewLRU(2)
+
+	_, ok, err := s.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, s.Set(ctx, "a", []byte("1"), time.Minute))
+	assert.Nil(t, s.Set(ctx, "b", []byte("2"), time.Minute))
+	value, ok, err := s.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+
+	// b is the least recently used entry, so it is evicted by c
+	assert.Nil(t, s.Set(ctx, "c", []byte("3"), time.Minute))
+	_, ok, _ = s.Get(ctx, "b")
+	assert.False(t, ok)
+	_, ok, _ = s.Get(ctx, "a")
+	assert.True(t, ok)
+
+	// replacing an entry keeps the store size
+	assert.Nil(t, s.Set(ctx, "c", []byte("4"), time.Minute))
+	value, _, _ = s.Get(ctx, "c")
+	assert.Equal(t, []byte("4"), value)
+	_, ok, _ = s.Get(ctx, "a")
+	assert.True(t, ok)
+
+	assert.Nil(t, s.Delete(ctx, "a", "unknown"))
+	_, ok, _ = s.Get(ctx, "a")
+	assert.False(t, ok)
+	_, ok, _ = s.Get(ctx, "c")
+	assert.True(t, ok)
+}
+
+func TestLRU_Expiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := NewLRU(2).(*lru)
+	s.now = func() time.Time { return now }
+
+	assert.Nil(t, s.Set(ctx, "a", []byte("1"), time.Minute))
+	now = now.Add(59 * time.Second)
+	_, ok, _ := s.Get(ctx, "a")
+	assert.True(t, ok)
+	now = now.Add(time.Second)
+	_, ok, _ = s.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, s.order.Len())
+}
@@ -0,0 +1,222 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxIdleConns is the number of connections kept open between two commands.
+const maxIdleConns = 10
+
+// ErrProtocol is returned when a server reply does not follow the RESP protocol.
+var ErrProtocol = errors.New("RESP protocol error")
+
+// RESPError is an error replied by the server, e.g. "WRONGPASS invalid username-password pair".
+type RESPError string
+
+// Error returns the error message.
+func (e RESPError) Error() string {
+	return string(e)
+}
+
+// respClient stores the entries in a Redis compatible server, which it talks to with the RESP protocol.
+type respClient struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *respConn
+}
+
+// NewRESPClient creates a new store backed by the Redis compatible server listening at address (host:port).
+// The connections authenticate with password unless it is empty, and select the database db.
+// Every command, including the connection to the server if needed, times out after timeout.
+func NewRESPClient(address, password string, db int, timeout time.Duration) Store {
+	return &respClient{address, password, db, timeout, make(chan *respConn, maxIdleConns)}
+}
+
+// Get returns the value of the key, and false if the key is not found or has expired.
+func (c *respClient) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := c.do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("%w: unexpected reply to GET: %v", ErrProtocol, reply)
+	}
+	return value, true, nil
+}
+
+// Set stores the value of the key, which expires after ttl.
+func (c *respClient) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	_, err := c.do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+// Delete removes the keys.
+func (c *respClient) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := c.do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// do sends the command to the server and returns its reply: nil, a string, an int64, a []byte or an []interface{}.
+// An error replied by the server is returned as a RESPError.
+func (c *respClient) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn, err := c.get(ctx, deadline)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(deadline, args...)
+	if err != nil {
+		// the state of the connection is unknown after a network or protocol error
+		_ = conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	if e, ok := reply.(RESPError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+// get returns an idle connection, or a new connection if none is idle.
+func (c *respClient) get(ctx context.Context, deadline time.Time) (*respConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &respConn{netConn, bufio.NewReader(netConn)}
+	if c.password != "" {
+		if err := conn.setup(deadline, "AUTH", c.password); err != nil {
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if err := conn.setup(deadline, "SELECT", strconv.Itoa(c.db)); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// put keeps the connection for the next commands, or closes it if enough connections are idle.
+func (c *respClient) put(conn *respConn) {
+	select {
+	case c.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// respConn is a connection to a RESP server.
+type respConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// setup sends a command preparing the connection, and closes the connection if the command fails.
+func (c *respConn) setup(deadline time.Time, args ...string) error {
+	reply, err := c.do(deadline, args...)
+	if err == nil {
+		if e, ok := reply.(RESPError); ok {
+			err = e
+		}
+	}
+	if err != nil {
+		_ = c.Close()
+	}
+	return err
+}
+
+// do sends the command and reads its reply.
+func (c *respConn) do(deadline time.Time, args ...string) (interface{}, error) {
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+// readReply reads a RESP value: nil for a null bulk string or array, a string for a simple string,
+// a RESPError for an error, an int64 for an integer, a []byte for a bulk string and an []interface{} for an array.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%w: malformed line %q", ErrProtocol, line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return RESPError(line), nil
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed integer %q", ErrProtocol, line)
+		}
+		return n, nil
+	case '$', '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed length %q", ErrProtocol, line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if kind == '$' {
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			if buf[n] != '\r' || buf[n+1] != '\n' {
+				return nil, fmt.Errorf("%w: unterminated bulk string", ErrProtocol)
+			}
+			return buf[:n], nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("%w: unknown reply type %q", ErrProtocol, kind)
+}
@@ -0,0 +1,245 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRESPClient(t *testing.T) {
+	server := newFakeRESPServer(t, "secret")
+	defer server.close()
+	ctx := context.Background()
+	s := NewRESPClient(server.address(), "secret", 2, time.Second)
+
+	_, ok, err := s.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, s.Set(ctx, "a", []byte("1\r\n2"), time.Minute))
+	value, ok, err := s.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1\r\n2"), value)
+	assert.Equal(t, int64(60000), server.ttl("a"))
+
+	assert.Nil(t, s.Set(ctx, "b", []byte("2"), time.Minute))
+	assert.Nil(t, s.Delete(ctx, "a", "b", "unknown"))
+	assert.Nil(t, s.Delete(ctx))
+	_, ok, _ = s.Get(ctx, "a")
+	assert.False(t, ok)
+
+	// the connection is authenticated and set up once, then reused
+	assert.Equal(t, []string{"AUTH secret", "SELECT 2", "GET a", "SET a 1\r\n2 PX 60000", "GET a", "SET b 2 PX 60000", "DEL a b unknown", "GET a"}, server.commands())
+	assert.Equal(t, 1, server.connections())
+}
+
+func TestRESPClient_Errors(t *testing.T) {
+	server := newFakeRESPServer(t, "secret")
+	defer server.close()
+	ctx := context.Background()
+
+	_, _, err := NewRESPClient(server.address(), "wrong", 0, time.Second).Get(ctx, "a")
+	assert.Equal(t, RESPError("WRONGPASS invalid password"), err)
+
+	s := NewRESPClient(server.address(), "secret", 0, time.Second)
+	assert.Nil(t, s.Set(ctx, "a", []byte("1"), time.Minute))
+
+	// a dropped connection fails the command, and the next command reconnects
+	server.drop()
+	_, _, err = s.Get(ctx, "a")
+	assert.NotNil(t, err)
+	_, ok, err := s.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// a server which does not reply times out
+	server.stall()
+	s = NewRESPClient(server.address(), "", 0, 50*time.Millisecond)
+	_, _, err = s.Get(ctx, "a")
+	if assert.NotNil(t, err) {
+		netErr, ok := err.(net.Error)
+		assert.True(t, ok && netErr.Timeout(), err.Error())
+	}
+
+	_, _, err = NewRESPClient("127.0.0.1:1", "", 0, time.Second).Get(ctx, "a")
+	assert.NotNil(t, err)
+}
+
+func Test_readReply(t *testing.T) {
+	tests := []struct {
+		input string
+		reply interface{}
+		err   bool
+	}{
+		{"+OK\r\n", "OK", false},
+		{"-ERR unknown\r\n", RESPError("ERR unknown"), false},
+		{":42\r\n", int64(42), false},
+		{"$3\r\nabc\r\n", []byte("abc"), false},
+		{"$-1\r\n", nil, false},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []interface{}{[]byte("a"), int64(1)}, false},
+		{"*-1\r\n", nil, false},
+		{"OK\r\n", nil, true},
+		{"+OK\n", nil, true},
+		{":x\r\n", nil, true},
+		{"$3\r\nabcd\r\n", nil, true},
+		{"$3\r\nab", nil, true},
+	}
+	for _, test := range tests {
+		reply, err := readReply(bufio.NewReader(strings.NewReader(test.input)))
+		assert.Equal(t, test.err, err != nil, test.input)
+		assert.Equal(t, test.reply, reply, test.input)
+	}
+}
+
+// fakeRESPServer is a Redis server handling AUTH, SELECT, GET, SET with PX and DEL.
+type fakeRESPServer struct {
+	listener net.Listener
+	password string
+	mu       sync.Mutex
+	values   map[string][]byte
+	ttls     map[string]int64
+	log      []string
+	conns    []net.Conn
+	dialed   int
+	stalled  bool
+}
+
+// newFakeRESPServer starts a fake server on a random local port.
+func newFakeRESPServer(t *testing.T, password string) *fakeRESPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRESPServer{listener: listener, password: password, values: map[string][]byte{}, ttls: map[string]int64{}}
+	go s.serve()
+	return s
+}
+
+// close stops the server.
+func (s *fakeRESPServer) close() {
+	_ = s.listener.Close()
+	s.drop()
+}
+
+func (s *fakeRESPServer) address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRESPServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+func (s *fakeRESPServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialed
+}
+
+func (s *fakeRESPServer) ttl(key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttls[key]
+}
+
+// drop closes the open connections.
+func (s *fakeRESPServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+// stall makes the server stop replying.
+func (s *fakeRESPServer) stall() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stalled = true
+}
+
+func (s *fakeRESPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.dialed++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRESPServer) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		request, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		var args []string
+		for _, item := range items {
+			arg, _ := item.([]byte)
+			args = append(args, string(arg))
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		s.mu.Lock()
+		s.log = append(s.log, strings.Join(args, " "))
+		stalled := s.stalled
+		reply := "+OK\r\n"
+		switch {
+		case args[0] == "AUTH":
+			if authenticated = args[1] == s.password; !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "GET":
+			if value, ok := s.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case args[0] == "SET" && len(args) == 5 && args[3] == "PX":
+			s.values[args[1]] = []byte(args[2])
+			s.ttls[args[1]], _ = strconv.ParseInt(args[4], 10, 64)
+		case args[0] == "DEL":
+			deleted := 0
+			for _, key := range args[1:] {
+				if _, ok := s.values[key]; ok {
+					delete(s.values, key)
+					deleted++
+				}
+			}
+			reply = fmt.Sprintf(":%d\r\n", deleted)
+		case args[0] != "SELECT":
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+
+		if stalled {
+			continue
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
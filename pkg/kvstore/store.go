@@ -0,0 +1,17 @@
+// Package kvstore provides key-value stores whose entries expire, to be used as caches.
+package kvstore
+
+import (
+	"context"
+	"time"
+)
+
+// Store is a key-value store whose entries expire.
+type Store interface {
+	// Get returns the value of the key, and false if the key is not found or has expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores the value of the key, which expires after ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes the keys. The keys which are not found are ignored.
+	Delete(ctx context.Context, keys ...string) error
+}
@@ -19,6 +19,8 @@ type Logger interface {
 	Debug(args ...interface{})
 	// Info uses fmt.Sprint to construct and log a message at INFO level
 	Info(args ...interface{})
+	// Warn uses fmt.Sprint to construct and log a message at WARN level
+	Warn(args ...interface{})
 	// Error uses fmt.Sprint to construct and log a message at ERROR level
 	Error(args ...interface{})
 
@@ -26,10 +28,18 @@ type Logger interface {
 	Debugf(format string, args ...interface{})
 	// Infof uses fmt.Sprintf to construct and log a message at INFO level
 	Infof(format string, args ...interface{})
+	// Warnf uses fmt.Sprintf to construct and log a message at WARN level
+	Warnf(format string, args ...interface{})
 	// Errorf uses fmt.Sprintf to construct and log a message at ERROR level
 	Errorf(format string, args ...interface{})
 }
 
+// SecurityEventKey is the field naming the security event a log message reports, e.g. an account lockout.
+// Security events are logged at WARN level, so that they can be told apart and routed to alerting:
+//
+//	logger.With(ctx, log.SecurityEventKey, "validation_lockout").Warnf("...")
+const SecurityEventKey = "security_event"
+
 type logger struct {
 	*zap.SugaredLogger
 }
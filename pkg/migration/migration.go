@@ -0,0 +1,84 @@
+// Package migration applies and reverts the SQL migrations of a PostgreSQL database schema.
+//
+// The version of the schema is kept in the schema_migrations table used by golang-migrate, so that a database
+// migrated with the migrate command can be migrated further with this package, and the other way round.
+package migration
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Migration represents a change of the database schema.
+type Migration struct {
+	// the version of the migration, which orders the migrations
+	Version uint64
+	// the name of the migration
+	Name string
+	// the SQL statements applying the change
+	Up string
+	// the SQL statements reverting the change, empty if it can not be reverted
+	Down string
+}
+
+// fileName matches the names of the migration files, e.g. 20261018023719_paytokens_archive.up.sql.
+var fileName = regexp.MustCompile(`^([0-9]+)_(.+)\.(up|down)\.sql$`)
+
+// Load reads the migrations from the files of the root directory of fsys, which are named
+// <version>_<name>.up.sql and <version>_<name>.down.sql, and returns them sorted by version.
+// The other files are ignored.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[uint64]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %v: %w", entry.Name(), err)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations %v_%v and %v_%v have the same version", version, m.Name, version, match[2])
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %v has no up file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// String returns the file name of the migration without suffix, e.g. 20261018023719_paytokens_archive.
+func (m Migration) String() string {
+	return fmt.Sprintf("%v_%v", m.Version, m.Name)
+}
@@ -0,0 +1,43 @@
+package migration
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"20261018013316_users.up.sql":           {Data: []byte("CREATE TABLE users ();")},
+		"20261018013316_users.down.sql":         {Data: []byte("DROP TABLE users;")},
+		"20211230_init.up.sql":                  {Data: []byte("CREATE TABLE paytokens ();")},
+		"20211230_init.down.sql":                {Data: []byte("DROP TABLE paytokens;")},
+		"20261018013503_irreversible.up.sql":    {Data: []byte("DELETE FROM users;")},
+		"migrations.go":                         {Data: []byte("package migrations")},
+		"archive/20261018013833_old.up.sql":     {Data: []byte("SELECT 1;")},
+		"20261018020814_no_suffix.sql":          {Data: []byte("SELECT 1;")},
+		"not_a_version_init.up.sql":             {Data: []byte("SELECT 1;")},
+		"20261018021105_not_a_direction.up.txt": {Data: []byte("SELECT 1;")},
+	}
+	migrations, err := Load(fsys)
+	assert.Nil(t, err)
+	assert.Equal(t, []Migration{
+		{20211230, "init", "CREATE TABLE paytokens ();", "DROP TABLE paytokens;"},
+		{20261018013316, "users", "CREATE TABLE users ();", "DROP TABLE users;"},
+		{20261018013503, "irreversible", "DELETE FROM users;", ""},
+	}, migrations)
+	assert.Equal(t, "20261018013316_users", migrations[1].String())
+
+	// every migration needs an up file and a version of its own
+	_, err = Load(fstest.MapFS{"20261018013316_users.down.sql": {Data: []byte("DROP TABLE users;")}})
+	assert.NotNil(t, err)
+	_, err = Load(fstest.MapFS{
+		"20261018013316_users.up.sql":     {Data: []byte("CREATE TABLE users ();")},
+		"20261018013316_clients.up.sql":   {Data: []byte("CREATE TABLE clients ();")},
+		"20261018013316_clients.down.sql": {Data: []byte("DROP TABLE clients;")},
+	})
+	assert.NotNil(t, err)
+	_, err = Load(fstest.MapFS{"99999999999999999999_huge.up.sql": {Data: []byte("SELECT 1;")}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,263 @@
+package migration
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/pauluswi/tulip/pkg/log"
+)
+
+const (
+	// defaultTable is the table holding the version of the schema, as created by golang-migrate
+	defaultTable = "schema_migrations"
+	// lockKey identifies the advisory lock which serializes the migrations of the server instances
+	lockKey = 5283014391
+)
+
+var (
+	// ErrDirty is returned when a migration failed half way without transaction, e.g. when applied with
+	// the migrate command. The schema must be fixed by hand, then the dirty flag of the version table reset.
+	ErrDirty = errors.New("database schema is dirty")
+	// ErrUnknownVersion is returned when migrating to or from a version which is not one of the migrations.
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// Status represents the state of the database schema.
+type Status struct {
+	// the version of the last migration applied, 0 if none
+	Version uint64
+	// whether the last migration failed half way
+	Dirty bool
+	// the migrations applied, in the order they were applied
+	Applied []Migration
+	// the migrations not applied yet, in the order they will be applied
+	Pending []Migration
+}
+
+// Migrator applies and reverts the migrations of a database schema. Every migration runs in a transaction
+// which also updates the version of the schema, and the migrations are serialized by a PostgreSQL advisory
+// lock, so that several server instances starting together apply each migration once.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+	table      string
+	logger     log.Logger
+}
+
+// step represents a migration applied or reverted, and the version of the schema after it.
+type step struct {
+	migration Migration
+	up        bool
+	version   uint64
+}
+
+// New creates a migrator of the schema of db. The migrations must be sorted by version, as returned by Load.
+func New(db *sql.DB, migrations []Migration, logger log.Logger) *Migrator {
+	return &Migrator{db, migrations, defaultTable, logger}
+}
+
+// Up applies all the migrations not applied yet.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.migrate(ctx, func(current uint64) (uint64, error) {
+		if len(m.migrations) == 0 || current > m.migrations[len(m.migrations)-1].Version {
+			return current, nil
+		}
+		return m.migrations[len(m.migrations)-1].Version, nil
+	})
+}
+
+// Down reverts the last migration applied.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.migrate(ctx, func(current uint64) (uint64, error) {
+		var previous uint64
+		for _, migration := range m.migrations {
+			if migration.Version >= current {
+				break
+			}
+			previous = migration.Version
+		}
+		return previous, nil
+	})
+}
+
+// To applies or reverts the migrations until the schema is at the given version. Version 0 reverts all
+// the migrations.
+func (m *Migrator) To(ctx context.Context, version uint64) error {
+	return m.migrate(ctx, func(current uint64) (uint64, error) {
+		if !m.known(version) {
+			return 0, fmt.Errorf("%w: %v", ErrUnknownVersion, version)
+		}
+		return version, nil
+	})
+}
+
+// Status returns the version of the schema and the migrations applied and pending.
+func (m *Migrator) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := m.run(ctx, func(conn *sql.Conn) error {
+		var err error
+		status.Version, status.Dirty, err = m.version(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return status, err
+	}
+	for _, migration := range m.migrations {
+		if migration.Version <= status.Version {
+			status.Applied = append(status.Applied, migration)
+		} else {
+			status.Pending = append(status.Pending, migration)
+		}
+	}
+	return status, nil
+}
+
+// migrate moves the schema from its current version to the version returned by target.
+func (m *Migrator) migrate(ctx context.Context, target func(current uint64) (uint64, error)) error {
+	return m.run(ctx, func(conn *sql.Conn) error {
+		current, dirty, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("%w at version %v", ErrDirty, current)
+		}
+		version, err := target(current)
+		if err != nil {
+			return err
+		}
+		steps, err := m.plan(current, version)
+		if err != nil {
+			return err
+		}
+		if len(steps) == 0 {
+			m.logger.Infof("database schema is at version %v, no migration to run", current)
+			return nil
+		}
+		for _, s := range steps {
+			if err := m.apply(ctx, conn, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// plan returns the steps moving the schema from version current to version target.
+func (m *Migrator) plan(current, target uint64) ([]step, error) {
+	var steps []step
+	if target >= current {
+		for _, migration := range m.migrations {
+			if migration.Version > current && migration.Version <= target {
+				steps = append(steps, step{migration, true, migration.Version})
+			}
+		}
+		return steps, nil
+	}
+
+	// the schema can only be reverted from a version this migrator knows about
+	if !m.known(current) {
+		return nil, fmt.Errorf("%w: the database schema is at version %v", ErrUnknownVersion, current)
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= target || migration.Version > current {
+			continue
+		}
+		if migration.Down == "" {
+			return nil, fmt.Errorf("migration %v can not be reverted", migration)
+		}
+		var previous uint64
+		if i > 0 {
+			previous = m.migrations[i-1].Version
+		}
+		steps = append(steps, step{migration, false, previous})
+	}
+	return steps, nil
+}
+
+// apply runs a step and stores the version of the schema after it in the same transaction.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, s step) error {
+	query, action := s.migration.Up, "applied"
+	if !s.up {
+		query, action = s.migration.Down, "reverted"
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("migration %v failed: %w", s.migration, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+m.table); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	// like golang-migrate, the version table is left empty once all the migrations are reverted
+	if s.version > 0 {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+m.table+" (version, dirty) VALUES ($1, false)", s.version); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.logger.Infof("%v migration %v", action, s.migration)
+	return nil
+}
+
+// run calls f with a connection holding the advisory lock, once the version table exists.
+func (m *Migrator) run(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return fmt.Errorf("failed to lock the database schema: %w", err)
+	}
+	defer func() {
+		// ctx may be done already, and the lock must not be left to the connection pool
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey); err != nil {
+			m.logger.Errorf("failed to unlock the database schema, closing the connection: %v", err)
+			_ = conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.table+" (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)"); err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+// version returns the version of the schema, which is 0 if no migration is applied.
+func (m *Migrator) version(ctx context.Context, conn *sql.Conn) (uint64, bool, error) {
+	var version int64
+	var dirty bool
+	err := conn.QueryRowContext(ctx, "SELECT version, dirty FROM "+m.table+" LIMIT 1").Scan(&version, &dirty)
+	if err == sql.ErrNoRows || err == nil && version < 0 {
+		// golang-migrate stores -1 when a migration from no version failed
+		return 0, dirty, nil
+	}
+	return uint64(version), dirty, err
+}
+
+// known tells whether version is 0 or the version of one of the migrations.
+func (m *Migrator) known(version uint64) bool {
+	if version == 0 {
+		return true
+	}
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package migration
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	_ "github.com/lib/pq" // initialize posgresql for test
+	"github.com/pauluswi/tulip/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const DSN = "postgres://127.0.0.1/go_restful?sslmode=disable&user=postgres&password=postgres"
+
+// testMigrations creates and drops tables which do not exist in the application schema.
+var testMigrations = []Migration{
+	{1, "first", "CREATE TABLE migrationtest_first (id int); CREATE TABLE migrationtest_other (id int);", "DROP TABLE migrationtest_first; DROP TABLE migrationtest_other;"},
+	{5, "second", "CREATE TABLE migrationtest_second (id int);", "DROP TABLE migrationtest_second;"},
+	{7, "third", "ALTER TABLE migrationtest_second ADD COLUMN name varchar;", "ALTER TABLE migrationtest_second DROP COLUMN name;"},
+}
+
+func TestMigrator(t *testing.T) {
+	runDBTest(t, func(db *dbx.DB) {
+		logger, entries := log.NewForTest()
+		ctx := context.Background()
+		m := newTestMigrator(db, testMigrations, logger)
+
+		status, err := m.Status(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, Status{Pending: testMigrations}, status)
+
+		assert.Nil(t, m.Up(ctx))
+		assert.Equal(t, []string{"migrationtest_first", "migrationtest_other", "migrationtest_second"}, tables(t, db))
+		status, err = m.Status(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, Status{Version: 7, Applied: testMigrations}, status)
+		assert.Equal(t, 3, entries.Len())
+
+		// nothing left to apply
+		assert.Nil(t, m.Up(ctx))
+		assert.Equal(t, 4, entries.Len())
+
+		assert.Nil(t, m.Down(ctx))
+		status, _ = m.Status(ctx)
+		assert.Equal(t, uint64(5), status.Version)
+		assert.Equal(t, testMigrations[2:], status.Pending)
+
+		assert.Nil(t, m.To(ctx, 1))
+		assert.Equal(t, []string{"migrationtest_first", "migrationtest_other"}, tables(t, db))
+		assert.Nil(t, m.To(ctx, 7))
+		status, _ = m.Status(ctx)
+		assert.Equal(t, uint64(7), status.Version)
+		assert.True(t, errors.Is(m.To(ctx, 6), ErrUnknownVersion))
+
+		// reverting all the migrations leaves the version table empty
+		assert.Nil(t, m.To(ctx, 0))
+		assert.Empty(t, tables(t, db))
+		var count int
+		assert.Nil(t, db.NewQuery("SELECT COUNT(*) FROM migrationtest_schema").Row(&count))
+		assert.Zero(t, count)
+		assert.Nil(t, m.Down(ctx))
+	})
+}
+
+func TestMigrator_Errors(t *testing.T) {
+	runDBTest(t, func(db *dbx.DB) {
+		logger, _ := log.NewForTest()
+		ctx := context.Background()
+
+		// a failed migration is rolled back together with the version
+		failing := append(append([]Migration{}, testMigrations[:2]...), Migration{6, "failing", "CREATE TABLE migrationtest_third (id int); SELECT 1/0;", ""})
+		m := newTestMigrator(db, failing, logger)
+		assert.NotNil(t, m.Up(ctx))
+		status, err := m.Status(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(5), status.Version)
+		assert.Equal(t, []string{"migrationtest_first", "migrationtest_other", "migrationtest_second"}, tables(t, db))
+
+		// a migration without down file can not be reverted
+		m = newTestMigrator(db, append(testMigrations[:1:1], Migration{5, "second", "", ""}), logger)
+		assert.NotNil(t, m.Down(ctx))
+
+		// a migrator which does not know the version can not revert it
+		m = newTestMigrator(db, testMigrations[:1], logger)
+		assert.True(t, errors.Is(m.Down(ctx), ErrUnknownVersion))
+		assert.Nil(t, m.Up(ctx))
+
+		// a dirty schema must be fixed by hand
+		_, err = db.NewQuery("UPDATE migrationtest_schema SET dirty = true").Execute()
+		assert.Nil(t, err)
+		m = newTestMigrator(db, testMigrations, logger)
+		assert.True(t, errors.Is(m.Up(ctx), ErrDirty))
+		status, err = m.Status(ctx)
+		assert.Nil(t, err)
+		assert.True(t, status.Dirty)
+	})
+}
+
+func TestMigrator_Concurrent(t *testing.T) {
+	runDBTest(t, func(db *dbx.DB) {
+		logger, _ := log.NewForTest()
+		ctx := context.Background()
+
+		// the migrations would fail if they were applied twice
+		var wg sync.WaitGroup
+		errs := make([]error, 5)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = newTestMigrator(db, testMigrations, logger).Up(ctx)
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, make([]error, 5), errs)
+		assert.Equal(t, []string{"migrationtest_first", "migrationtest_other", "migrationtest_second"}, tables(t, db))
+	})
+}
+
+// newTestMigrator creates a migrator which keeps the version apart from the application schema.
+func newTestMigrator(db *dbx.DB, migrations []Migration, logger log.Logger) *Migrator {
+	m := New(db.DB(), migrations, logger)
+	m.table = "migrationtest_schema"
+	return m
+}
+
+// tables returns the test tables which exist, sorted by name.
+func tables(t *testing.T, db *dbx.DB) []string {
+	var names []string
+	err := db.NewQuery("SELECT tablename FROM pg_tables WHERE tablename LIKE 'migrationtest\\_%' AND tablename <> 'migrationtest_schema' ORDER BY tablename").Column(&names)
+	assert.Nil(t, err)
+	return names
+}
+
+func runDBTest(t *testing.T, f func(db *dbx.DB)) {
+	dsn, ok := os.LookupEnv("APP_DSN")
+	if !ok {
+		dsn = DSN
+	}
+	db, err := dbx.MustOpen("postgres", dsn)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	sqls := []string{
+		"DROP TABLE IF EXISTS migrationtest_first, migrationtest_other, migrationtest_second, migrationtest_third, migrationtest_schema",
+	}
+	for _, s := range sqls {
+		_, err = db.NewQuery(s).Execute()
+		if err != nil {
+			t.Error(err, " with SQL: ", s)
+			t.FailNow()
+		}
+	}
+
+	f(db)
+}
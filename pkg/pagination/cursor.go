@@ -0,0 +1,242 @@
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+// CursorVar specifies the query parameter name for the cursor of keyset pagination
+var CursorVar = "cursor"
+
+// ErrInvalidCursor is returned when a cursor is malformed or its signature does not match.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrCursorMismatch is returned when a cursor was issued for a list with another order or filter.
+var ErrCursorMismatch = errors.New("cursor of another list")
+
+// Cursor points to an item of a list ordered by creation time and ID. The page it leads to starts
+// right after the item, or ends right before it if Before is true.
+type Cursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+	Before    bool      `json:"b,omitempty"`
+	// Descending and Filter identify the list the cursor was issued for, Filter being a hash of its filter.
+	Descending bool   `json:"d,omitempty"`
+	Filter     string `json:"f,omitempty"`
+}
+
+// CursorSigner encodes cursors into opaque strings signed with a secret key, so that clients can neither
+// forge cursors nor rely on their content.
+type CursorSigner struct {
+	key []byte
+}
+
+// NewCursorSigner creates a new cursor signer using the given secret key.
+func NewCursorSigner(key []byte) CursorSigner {
+	return CursorSigner{key}
+}
+
+// Encode returns the opaque string representing the cursor.
+func (s CursorSigner) Encode(c Cursor) string {
+	payload, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+}
+
+// Decode returns the cursor represented by the opaque string. It returns ErrInvalidCursor if the string
+// was not returned by Encode with the same key.
+func (s CursorSigner) Decode(value string) (Cursor, error) {
+	var c Cursor
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return c, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, s.sign(payload)) {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// sign returns the HMAC-SHA256 of the payload.
+func (s CursorSigner) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Keyset represents a page request of a list paginated by keyset, i.e. by seeking the items after or before
+// a cursor. Unlike OFFSET/LIMIT, seeking does not slow down on the last pages, and neither skips nor repeats
+// items when items are inserted while paging.
+type Keyset struct {
+	PerPage int
+	// Descending tells whether the list is ordered from the newest item to the oldest one.
+	Descending bool
+	// Cursor is the cursor the page is requested with, nil for the first page.
+	Cursor *Cursor
+	signer CursorSigner
+	// filter is the hash of the filter of the list, as set by Bind
+	filter string
+}
+
+// KeysetPage represents a page of a list paginated by keyset.
+type KeysetPage struct {
+	PerPage int    `json:"per_page"`
+	Next    string `json:"next_cursor,omitempty"`
+	Prev    string `json:"prev_cursor,omitempty"`
+	// Items holds the items of the page, in the order of the list.
+	Items interface{} `json:"items"`
+}
+
+// NewKeyset creates a Keyset instance requesting perPage items after or before the cursor encoded by signer.
+// An empty cursor requests the first page.
+func NewKeyset(signer CursorSigner, cursor string, perPage int, descending bool) (*Keyset, error) {
+	if perPage <= 0 {
+		perPage = DefaultPageSize
+	}
+	if perPage > MaxPageSize {
+		perPage = MaxPageSize
+	}
+	k := &Keyset{PerPage: perPage, Descending: descending, signer: signer}
+	if cursor != "" {
+		c, err := signer.Decode(cursor)
+		if err != nil {
+			return nil, err
+		}
+		k.Cursor = &c
+	}
+	return k, nil
+}
+
+// NewKeysetFromRequest creates a Keyset object using the query parameters found in the given HTTP request.
+func NewKeysetFromRequest(req *http.Request, signer CursorSigner, descending bool) (*Keyset, error) {
+	perPage := parseInt(req.URL.Query().Get(PageSizeVar), DefaultPageSize)
+	return NewKeyset(signer, req.URL.Query().Get(CursorVar), perPage, descending)
+}
+
+// Bind ties the keyset to the list filtered by filter, a string which identifies the filter, e.g. its fields
+// joined together. The cursors of the pages then carry the order and a hash of the filter of the list, and
+// ErrCursorMismatch is returned if the cursor of the keyset was issued for a list with another order or filter,
+// since its position would be meaningless there.
+func (k *Keyset) Bind(filter string) error {
+	hash := sha256.Sum256([]byte(filter))
+	k.filter = base64.RawURLEncoding.EncodeToString(hash[:16])
+	if k.Cursor != nil && (k.Cursor.Descending != k.Descending || k.Cursor.Filter != k.filter) {
+		return ErrCursorMismatch
+	}
+	return nil
+}
+
+// backward tells whether the page is read from the cursor towards the start of the list.
+func (k *Keyset) backward() bool {
+	return k.Cursor != nil && k.Cursor.Before
+}
+
+// Apply adds to the query the seek predicate on the given creation time and ID columns, the order in which
+// the items must be read and the limit, which is one more than the page size so that Page can tell whether
+// more items follow. The query must not be ordered nor limited otherwise.
+func (k *Keyset) Apply(q *dbx.SelectQuery, createdAtColumn, idColumn string) *dbx.SelectQuery {
+	// the items are read in the reverse order of the list when going backward, then put back in order by Page
+	descending := k.Descending != k.backward()
+	operator, direction := ">", "ASC"
+	if descending {
+		operator, direction = "<", "DESC"
+	}
+	if k.Cursor != nil {
+		q.AndWhere(dbx.NewExp(
+			fmt.Sprintf("(%s, %s) %s ({:cursor_created_at}, {:cursor_id})", createdAtColumn, idColumn, operator),
+			dbx.Params{"cursor_created_at": k.Cursor.CreatedAt, "cursor_id": k.Cursor.ID},
+		))
+	}
+	return q.OrderBy(createdAtColumn+" "+direction, idColumn+" "+direction).Limit(int64(k.PerPage + 1))
+}
+
+// Page builds the page out of the items read by a query prepared by Apply. items must be a slice,
+// which is trimmed to the page size and reordered in place. key returns the creation time and the ID
+// of the i-th item of the slice.
+func (k *Keyset) Page(items interface{}, key func(i int) (time.Time, string)) *KeysetPage {
+	value := reflect.ValueOf(items)
+	more := value.Len() > k.PerPage
+	if more {
+		value = value.Slice(0, k.PerPage)
+	}
+	n := value.Len()
+	if k.backward() {
+		swap := reflect.Swapper(value.Interface())
+		for i := 0; i < n/2; i++ {
+			swap(i, n-1-i)
+		}
+	}
+
+	page := &KeysetPage{PerPage: k.PerPage, Items: value.Interface()}
+	hasNext, hasPrev := more, k.Cursor != nil
+	if k.backward() {
+		hasNext, hasPrev = true, more
+	}
+	if n == 0 {
+		// the cursors only lead to pages with items, unless the items have been deleted in the meantime
+		return page
+	}
+	if hasNext {
+		createdAt, id := key(n - 1)
+		page.Next = k.signer.Encode(Cursor{CreatedAt: createdAt, ID: id, Descending: k.Descending, Filter: k.filter})
+	}
+	if hasPrev {
+		createdAt, id := key(0)
+		page.Prev = k.signer.Encode(Cursor{CreatedAt: createdAt, ID: id, Before: true, Descending: k.Descending, Filter: k.filter})
+	}
+	return page
+}
+
+// BuildLinkHeader returns an HTTP header containing the links to the next and previous pages.
+func (p *KeysetPage) BuildLinkHeader(baseURL string, defaultPerPage int) string {
+	links := p.BuildLinks(baseURL, defaultPerPage)
+	header := ""
+	if links[0] != "" {
+		header += fmt.Sprintf("<%v>; rel=\"prev\"", links[0])
+	}
+	if links[1] != "" {
+		if header != "" {
+			header += ", "
+		}
+		header += fmt.Sprintf("<%v>; rel=\"next\"", links[1])
+	}
+	return header
+}
+
+// BuildLinks returns the prev and next links corresponding to the pagination.
+// A link is an empty string if there is no such page.
+func (p *KeysetPage) BuildLinks(baseURL string, defaultPerPage int) [2]string {
+	var links [2]string
+	if strings.Contains(baseURL, "?") {
+		baseURL += "&"
+	} else {
+		baseURL += "?"
+	}
+	for i, cursor := range []string{p.Prev, p.Next} {
+		if cursor == "" {
+			continue
+		}
+		links[i] = fmt.Sprintf("%v%v=%v", baseURL, CursorVar, cursor)
+		if p.PerPage != defaultPerPage {
+			links[i] += fmt.Sprintf("&%v=%v", PageSizeVar, p.PerPage)
+		}
+	}
+	return links
+}
@@ -0,0 +1,177 @@
+package pagination
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorSigner(t *testing.T) {
+	signer := NewCursorSigner([]byte("secret"))
+	cursor := Cursor{CreatedAt: time.Date(2026, 10, 18, 12, 0, 0, 123456000, time.UTC), ID: "a1", Before: true}
+
+	value := signer.Encode(cursor)
+	decoded, err := signer.Decode(value)
+	assert.Nil(t, err)
+	assert.Equal(t, cursor, decoded)
+
+	// the cursors signed with another key or tampered with are rejected
+	_, err = NewCursorSigner([]byte("other")).Decode(value)
+	assert.Equal(t, ErrInvalidCursor, err)
+	forged := signer.Encode(Cursor{ID: "a2"})
+	_, err = signer.Decode(forged[:len(forged)/2] + value[len(value)/2:])
+	assert.Equal(t, ErrInvalidCursor, err)
+	for _, value := range []string{"", "abc", "a.b.c", "!.!"} {
+		_, err = signer.Decode(value)
+		assert.Equal(t, ErrInvalidCursor, err, value)
+	}
+}
+
+func TestNewKeysetFromRequest(t *testing.T) {
+	signer := NewCursorSigner([]byte("secret"))
+	cursor := Cursor{CreatedAt: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), ID: "a1"}
+
+	req, _ := http.NewRequest("GET", "http://example.com?per_page=20&cursor="+signer.Encode(cursor), bytes.NewBufferString(""))
+	k, err := NewKeysetFromRequest(req, signer, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, k.PerPage)
+	assert.True(t, k.Descending)
+	assert.Equal(t, &cursor, k.Cursor)
+
+	req, _ = http.NewRequest("GET", "http://example.com?per_page=2000", bytes.NewBufferString(""))
+	k, err = NewKeysetFromRequest(req, signer, false)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxPageSize, k.PerPage)
+	assert.Nil(t, k.Cursor)
+
+	req, _ = http.NewRequest("GET", "http://example.com?cursor=abc", bytes.NewBufferString(""))
+	_, err = NewKeysetFromRequest(req, signer, false)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestKeyset_Apply(t *testing.T) {
+	db := dbx.NewFromDB(nil, "postgres")
+	signer := NewCursorSigner([]byte("secret"))
+	createdAt := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		tag        string
+		cursor     *Cursor
+		descending bool
+		sql        string
+	}{
+		{"first", nil, true, `SELECT * FROM "items" WHERE "owner"={:p0} ORDER BY "created_at" DESC, "id" DESC LIMIT 11`},
+		{"next descending", &Cursor{CreatedAt: createdAt, ID: "a1"}, true,
+			`SELECT * FROM "items" WHERE ("owner"={:p0}) AND ((created_at, id) < ({:cursor_created_at}, {:cursor_id})) ORDER BY "created_at" DESC, "id" DESC LIMIT 11`},
+		{"prev descending", &Cursor{CreatedAt: createdAt, ID: "a1", Before: true}, true,
+			`SELECT * FROM "items" WHERE ("owner"={:p0}) AND ((created_at, id) > ({:cursor_created_at}, {:cursor_id})) ORDER BY "created_at" ASC, "id" ASC LIMIT 11`},
+		{"next ascending", &Cursor{CreatedAt: createdAt, ID: "a1"}, false,
+			`SELECT * FROM "items" WHERE ("owner"={:p0}) AND ((created_at, id) > ({:cursor_created_at}, {:cursor_id})) ORDER BY "created_at" ASC, "id" ASC LIMIT 11`},
+	}
+	for _, test := range tests {
+		k := &Keyset{PerPage: 10, Descending: test.descending, Cursor: test.cursor, signer: signer}
+		q := db.Select("*").From("items").Where(dbx.HashExp{"owner": "o1"})
+		query := k.Apply(q, "created_at", "id").Build()
+		assert.Equal(t, test.sql, query.SQL(), test.tag)
+		if test.cursor != nil {
+			assert.Equal(t, createdAt, query.Params()["cursor_created_at"], test.tag)
+			assert.Equal(t, "a1", query.Params()["cursor_id"], test.tag)
+		}
+	}
+}
+
+func TestKeyset_Page(t *testing.T) {
+	type item struct {
+		createdAt time.Time
+		id        string
+	}
+	signer := NewCursorSigner([]byte("secret"))
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	key := func(items []item) func(i int) (time.Time, string) {
+		return func(i int) (time.Time, string) {
+			return items[i].createdAt, items[i].id
+		}
+	}
+	decode := func(value string) Cursor {
+		c, err := signer.Decode(value)
+		assert.Nil(t, err)
+		return c
+	}
+
+	// the first page, read newest first, has more items
+	items := []item{{now, "c"}, {now.Add(-time.Hour), "b"}, {now.Add(-2 * time.Hour), "a"}}
+	k := &Keyset{PerPage: 2, Descending: true, signer: signer}
+	page := k.Page(items, key(items))
+	assert.Equal(t, []item{{now, "c"}, {now.Add(-time.Hour), "b"}}, page.Items)
+	assert.Empty(t, page.Prev)
+	assert.Equal(t, Cursor{CreatedAt: now.Add(-time.Hour), ID: "b", Descending: true}, decode(page.Next))
+
+	// the last page
+	items = []item{{now.Add(-2 * time.Hour), "a"}}
+	k.Cursor = &Cursor{CreatedAt: now.Add(-time.Hour), ID: "b"}
+	page = k.Page(items, key(items))
+	assert.Equal(t, []item{{now.Add(-2 * time.Hour), "a"}}, page.Items)
+	assert.Equal(t, Cursor{CreatedAt: now.Add(-2 * time.Hour), ID: "a", Before: true, Descending: true}, decode(page.Prev))
+	assert.Empty(t, page.Next)
+
+	// going backward, the items are read oldest first and put back in order
+	items = []item{{now.Add(-time.Hour), "b"}, {now, "c"}}
+	k.Cursor = &Cursor{CreatedAt: now.Add(-2 * time.Hour), ID: "a", Before: true}
+	page = k.Page(items, key(items))
+	assert.Equal(t, []item{{now, "c"}, {now.Add(-time.Hour), "b"}}, page.Items)
+	assert.Empty(t, page.Prev)
+	assert.Equal(t, Cursor{CreatedAt: now.Add(-time.Hour), ID: "b", Descending: true}, decode(page.Next))
+
+	// no links lead out of an empty page
+	page = k.Page([]item{}, key(nil))
+	assert.Equal(t, []item{}, page.Items)
+	assert.Empty(t, page.Prev)
+	assert.Empty(t, page.Next)
+}
+
+func TestKeyset_Bind(t *testing.T) {
+	type item struct {
+		createdAt time.Time
+		id        string
+	}
+	signer := NewCursorSigner([]byte("secret"))
+	items := []item{{time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), "b"}, {time.Date(2026, 10, 18, 11, 0, 0, 0, time.UTC), "a"}}
+	k, _ := NewKeyset(signer, "", 1, true)
+	assert.Nil(t, k.Bind("customer=1"))
+	page := k.Page(items, func(i int) (time.Time, string) {
+		return items[i].createdAt, items[i].id
+	})
+
+	// the cursors only lead to the pages of the same list
+	k, err := NewKeyset(signer, page.Next, 1, true)
+	assert.Nil(t, err)
+	assert.Nil(t, k.Bind("customer=1"))
+	k, _ = NewKeyset(signer, page.Next, 1, true)
+	assert.Equal(t, ErrCursorMismatch, k.Bind("customer=2"))
+	k, _ = NewKeyset(signer, page.Next, 1, false)
+	assert.Equal(t, ErrCursorMismatch, k.Bind("customer=1"))
+}
+
+func TestKeysetPage_BuildLinkHeader(t *testing.T) {
+	tests := []struct {
+		tag        string
+		prev, next string
+		perPage    int
+		header     string
+	}{
+		{"t1", "", "n1", 20, "</tokens?cursor=n1&per_page=20>; rel=\"next\""},
+		{"t2", "p1", "n1", 20, "</tokens?cursor=p1&per_page=20>; rel=\"prev\", </tokens?cursor=n1&per_page=20>; rel=\"next\""},
+		{"t3", "p1", "", 10, "</tokens?cursor=p1>; rel=\"prev\""},
+		{"t4", "", "", 10, ""},
+	}
+	for _, test := range tests {
+		p := &KeysetPage{PerPage: test.perPage, Prev: test.prev, Next: test.next}
+		assert.Equal(t, test.header, p.BuildLinkHeader("/tokens", 10), test.tag)
+	}
+
+	p := &KeysetPage{PerPage: 10, Next: "n1"}
+	assert.Equal(t, "</tokens?from=10&cursor=n1>; rel=\"next\"", p.BuildLinkHeader("/tokens?from=10", 10))
+}
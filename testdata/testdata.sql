@@ -2,4 +2,7 @@ INSERT INTO paytokens (id, token, token_date, customer_id, valid_until, metadata
 VALUES ('967d5bb5-3a7a-4d5e-8a6c-febc8c5b3f13', 'token1', '2019-10-01 15:36:38'::timestamp, '08110000', '2019-10-01 15:36:38'::timestamp, '{}', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp),
        ('c809bf15-bc2c-4621-bb96-70af96fd5d67', 'token2', '2019-10-02 11:16:12'::timestamp, '08110000', '2019-10-01 15:36:38'::timestamp, '{}', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp),
        ('2367710a-d4fb-49f5-8860-557b337386dd', 'token3', '2019-10-05 05:21:11'::timestamp, '08110000', '2019-10-01 15:36:38'::timestamp, '{}', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp);
-     
\ No newline at end of file
+     
+-- the demo admin logs in with the password "pass"
+INSERT INTO users (id, username, password_hash, role, created_at, updated_at)
+VALUES ('3c1b1f4e-6a0b-4c43-9d1c-2f0e8a7b5d21', 'demo', '$2a$10$erd0KgRJlZngdyLI0.V.2eFJJqVuhw4S3Ysfwhq7z.EJbbFrUw7Sa', 'admin', '2019-10-01 15:36:38'::timestamp, '2019-10-01 15:36:38'::timestamp);